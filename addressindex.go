@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	DefaultAddressIndexName = "address_index"
+	AddressIndexSize        = 32 + 4 + 32 + 1 + 4 + 32 + 4 + 8 + 8 + 8 + 4
+	// the previous record position of the first record of a scripthash
+	NoAddressIndexPos            = 0xffffffffffffffff
+	DefaultScriptHashHistorySize = 1000
+	MaxScriptHashHistorySize     = 10000
+)
+
+// AddressIndex records an output funding the scripthash or an input spending it,
+// the records of the same scripthash key are linked from the latest to the earliest
+type AddressIndex struct {
+	ScriptHash  bigint.Uint256
+	BlockHeight uint32
+	TxId        bigint.Uint256
+	Spending    bool
+	// the output index of the funding record, the input index of the spending record
+	N uint32
+	// the spent output of the spending record
+	PrevTxId bigint.Uint256
+	PrevN    uint32
+	Value    int64
+	// the position of the funding record spent by the spending record
+	FundingPos uint64
+	PrevPos    uint64
+}
+
+func (a AddressIndex) packBody(writer io.Writer) error {
+	var err error
+	err = a.ScriptHash.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, a.BlockHeight)
+	if err != nil {
+		return err
+	}
+	err = a.TxId.Pack(writer)
+	if err != nil {
+		return err
+	}
+	var spending byte = 0
+	if a.Spending {
+		spending = 1
+	}
+	err = serialize.PackByte(writer, spending)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, a.N)
+	if err != nil {
+		return err
+	}
+	err = a.PrevTxId.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, a.PrevN)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackInt64(writer, a.Value)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint64(writer, a.FundingPos)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint64(writer, a.PrevPos)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *AddressIndex) unpackBody(reader io.Reader) error {
+	var err error
+	err = a.ScriptHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	a.BlockHeight, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	err = a.TxId.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	spending, err := serialize.UnPackByte(reader)
+	if err != nil {
+		return err
+	}
+	a.Spending = spending != 0
+	a.N, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	err = a.PrevTxId.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	a.PrevN, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	a.Value, err = serialize.UnPackInt64(reader)
+	if err != nil {
+		return err
+	}
+	a.FundingPos, err = serialize.UnPackUint64(reader)
+	if err != nil {
+		return err
+	}
+	a.PrevPos, err = serialize.UnPackUint64(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a AddressIndex) Pack(writer io.Writer) error {
+	checksum := crc32.New(crc32cTable)
+	err := a.packBody(io.MultiWriter(writer, checksum))
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, checksum.Sum32())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *AddressIndex) UnPack(reader io.Reader) error {
+	checksum := crc32.New(crc32cTable)
+	err := a.unpackBody(io.TeeReader(reader, checksum))
+	if err != nil {
+		return err
+	}
+	checksumRead, err := serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	if checksumRead != checksum.Sum32() {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// calcScriptHash returns the electrum scripthash, the sha256 of the scriptPubKey shown in reversed hex
+func calcScriptHash(scriptBytes []byte) bigint.Uint256 {
+	var scriptHash bigint.Uint256
+	hash := sha256.Sum256(scriptBytes)
+	_ = scriptHash.SetData(hash[:])
+	return scriptHash
+}
+
+func getScriptHashKey(scriptHash *bigint.Uint256) uint64 {
+	return binary.LittleEndian.Uint64(scriptHash.GetData()[0:8])
+}
+
+func getOutPointKey(txId *bigint.Uint256, n uint32) uint64 {
+	return binary.LittleEndian.Uint64(txId.GetData()[0:8]) ^ uint64(n)
+}
+
+func getOutPointString(txId *bigint.Uint256, n uint32) string {
+	return txId.GetHex() + ":" + strconv.FormatUint(uint64(n), 10)
+}
+
+// AddressIndexManager appends the funding and the spending records of every stored block in block order,
+// the latest record of every scripthash key and the funding records not spent yet are kept in memory
+type AddressIndexManager struct {
+	AddressIndexFileName string
+	AddressIndexFileObj  *os.File
+	RecordCount          uint64
+	// the number of the blocks which are indexed
+	BlockCount         uint32
+	scriptHashToPosMap map[uint64]uint64
+	unspentKeyToPosMap map[uint64]uint64
+	// the unspent funding records whose outpoint key collides with a different outpoint
+	unspentToPosMap   map[string]uint64
+	addressIndexMutex *sync.RWMutex
+}
+
+var addressIndexMgr *AddressIndexManager
+
+func (a *AddressIndexManager) Init(dataDir string, addressIndexName string) error {
+	if a.addressIndexMutex == nil {
+		a.addressIndexMutex = new(sync.RWMutex)
+	}
+	a.addressIndexMutex.Lock()
+	defer a.addressIndexMutex.Unlock()
+
+	var err error
+	addressIndexFileName := dataDir + "/" + addressIndexName
+	a.AddressIndexFileObj, err = os.OpenFile(addressIndexFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend)
+	if err != nil {
+		return err
+	}
+	addressIndexInfo, err := a.AddressIndexFileObj.Stat()
+	if err != nil {
+		return err
+	}
+	a.AddressIndexFileName = addressIndexFileName
+	a.RecordCount = 0
+	a.BlockCount = 0
+	a.scriptHashToPosMap = make(map[uint64]uint64)
+	a.unspentKeyToPosMap = make(map[uint64]uint64)
+	a.unspentToPosMap = make(map[string]uint64)
+
+	// drop the partial record left by a crash
+	recordCount := uint64(addressIndexInfo.Size() / AddressIndexSize)
+	if uint64(addressIndexInfo.Size()) != recordCount*AddressIndexSize {
+		err = a.AddressIndexFileObj.Truncate(int64(recordCount) * AddressIndexSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	// load the latest records of the scripthashes and the unspent funding records
+	_, err = a.AddressIndexFileObj.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	addressIndexReader := bufio.NewReader(a.AddressIndexFileObj)
+	addressIndexData := make([]byte, AddressIndexSize)
+	for pos := uint64(0); pos < recordCount; pos++ {
+		_, err = io.ReadFull(addressIndexReader, addressIndexData)
+		if err != nil {
+			return err
+		}
+		addressIndex := new(AddressIndex)
+		err = addressIndex.UnPack(bytes.NewReader(addressIndexData))
+		if err == ErrChecksumMismatch {
+			return errors.New("corrupt address index record " + strconv.FormatUint(pos, 10) + ", need to rebuild address index")
+		}
+		if err != nil {
+			return err
+		}
+		err = a.applyAddressIndex(addressIndex, pos, nil)
+		if err != nil {
+			return err
+		}
+		a.RecordCount = pos + 1
+		a.BlockCount = addressIndex.BlockHeight + 1
+	}
+	return nil
+}
+
+// readAddressIndex reads the record at the position, the records not written yet are in pending from the position RecordCount
+func (a *AddressIndexManager) readAddressIndex(pos uint64, pending []AddressIndex) (*AddressIndex, error) {
+	if pos >= a.RecordCount {
+		if pos-a.RecordCount >= uint64(len(pending)) {
+			return nil, errors.New("address index record not found")
+		}
+		return &pending[pos-a.RecordCount], nil
+	}
+	addressIndexData := make([]byte, AddressIndexSize)
+	_, err := a.AddressIndexFileObj.ReadAt(addressIndexData, int64(pos)*AddressIndexSize)
+	if err != nil {
+		return nil, err
+	}
+	addressIndex := new(AddressIndex)
+	err = addressIndex.UnPack(bytes.NewReader(addressIndexData))
+	if err != nil {
+		return nil, err
+	}
+	return addressIndex, nil
+}
+
+// findUnspent returns the position of the unspent funding record of the outpoint
+func (a *AddressIndexManager) findUnspent(txId *bigint.Uint256, n uint32, pending []AddressIndex) (uint64, bool, error) {
+	pos, ok := a.unspentToPosMap[getOutPointString(txId, n)]
+	if ok {
+		return pos, true, nil
+	}
+	pos, ok = a.unspentKeyToPosMap[getOutPointKey(txId, n)]
+	if !ok {
+		return 0, false, nil
+	}
+	fundingIndex, err := a.readAddressIndex(pos, pending)
+	if err != nil {
+		return 0, false, err
+	}
+	if fundingIndex.N != n || !bigint.IsUint256Equal(&fundingIndex.TxId, txId) {
+		return 0, false, nil
+	}
+	return pos, true, nil
+}
+
+func (a *AddressIndexManager) addUnspent(fundingIndex *AddressIndex, pos uint64, pending []AddressIndex) error {
+	outPointKey := getOutPointKey(&fundingIndex.TxId, fundingIndex.N)
+	keyPos, ok := a.unspentKeyToPosMap[outPointKey]
+	if ok {
+		keyIndex, err := a.readAddressIndex(keyPos, pending)
+		if err != nil {
+			return err
+		}
+		if keyIndex.N != fundingIndex.N || !bigint.IsUint256Equal(&keyIndex.TxId, &fundingIndex.TxId) {
+			a.unspentToPosMap[getOutPointString(&fundingIndex.TxId, fundingIndex.N)] = pos
+			return nil
+		}
+	}
+	a.unspentKeyToPosMap[outPointKey] = pos
+	return nil
+}
+
+func (a *AddressIndexManager) removeUnspent(txId *bigint.Uint256, n uint32, pos uint64) {
+	outPoint := getOutPointString(txId, n)
+	collidedPos, ok := a.unspentToPosMap[outPoint]
+	if ok && collidedPos == pos {
+		delete(a.unspentToPosMap, outPoint)
+		return
+	}
+	outPointKey := getOutPointKey(txId, n)
+	keyPos, ok := a.unspentKeyToPosMap[outPointKey]
+	if ok && keyPos == pos {
+		delete(a.unspentKeyToPosMap, outPointKey)
+	}
+}
+
+// applyAddressIndex links the record at the position into the memory maps
+func (a *AddressIndexManager) applyAddressIndex(addressIndex *AddressIndex, pos uint64, pending []AddressIndex) error {
+	a.scriptHashToPosMap[getScriptHashKey(&addressIndex.ScriptHash)] = pos
+	if addressIndex.Spending {
+		a.removeUnspent(&addressIndex.PrevTxId, addressIndex.PrevN, addressIndex.FundingPos)
+		return nil
+	}
+	return a.addUnspent(addressIndex, pos, pending)
+}
+
+// AddBlockAddressIndex appends the funding and the spending records of the block at the next height
+func (a *AddressIndexManager) AddBlockAddressIndex(blockHeight uint32, rawBlockData []byte) error {
+	a.addressIndexMutex.Lock()
+	defer a.addressIndexMutex.Unlock()
+	if blockHeight != a.BlockCount {
+		return errors.New("unexpected block height " + strconv.Itoa(int(blockHeight)) + " for address index, expect " + strconv.Itoa(int(a.BlockCount)))
+	}
+	chainBlock, err := unpackChainBlock(rawBlockData)
+	if err != nil {
+		return err
+	}
+
+	pending := make([]AddressIndex, 0)
+	addPending := func(addressIndex AddressIndex) error {
+		pos := a.RecordCount + uint64(len(pending))
+		addressIndex.BlockHeight = blockHeight
+		addressIndex.PrevPos = NoAddressIndexPos
+		prevPos, ok := a.scriptHashToPosMap[getScriptHashKey(&addressIndex.ScriptHash)]
+		if ok {
+			addressIndex.PrevPos = prevPos
+		}
+		pending = append(pending, addressIndex)
+		return a.applyAddressIndex(&pending[len(pending)-1], pos, pending)
+	}
+	for i := range chainBlock.Vtx {
+		tx := &chainBlock.Vtx[i]
+		txId, err := tx.CalcTrxId()
+		if err != nil {
+			return err
+		}
+		if !isCoinBase(tx) {
+			for n, txIn := range tx.Vin {
+				// the outputs not indexed, like the unspendable ones, are never spent
+				fundingPos, found, err := a.findUnspent(&txIn.PrevOut.Hash, txIn.PrevOut.N, pending)
+				if err != nil {
+					return err
+				}
+				if !found {
+					continue
+				}
+				fundingIndex, err := a.readAddressIndex(fundingPos, pending)
+				if err != nil {
+					return err
+				}
+				spendingIndex := AddressIndex{ScriptHash: fundingIndex.ScriptHash, TxId: txId, Spending: true, N: uint32(n)}
+				spendingIndex.PrevTxId = txIn.PrevOut.Hash
+				spendingIndex.PrevN = txIn.PrevOut.N
+				spendingIndex.Value = fundingIndex.Value
+				spendingIndex.FundingPos = fundingPos
+				err = addPending(spendingIndex)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for n, txOut := range tx.Vout {
+			scriptBytes := txOut.ScriptPubKey.GetScriptBytes()
+			if isUnspendableScript(scriptBytes) {
+				continue
+			}
+			fundingIndex := AddressIndex{ScriptHash: calcScriptHash(scriptBytes), TxId: txId, N: uint32(n), Value: txOut.Value}
+			_ = fundingIndex.PrevTxId.SetData(make([]byte, 32))
+			err = addPending(fundingIndex)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	addressIndexBuf := bytes.NewBuffer(make([]byte, 0, len(pending)*AddressIndexSize))
+	for i := range pending {
+		err = pending[i].Pack(addressIndexBuf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = a.AddressIndexFileObj.Write(addressIndexBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	a.RecordCount = a.RecordCount + uint64(len(pending))
+	a.BlockCount = blockHeight + 1
+	return nil
+}
+
+// TruncateAddressIndex keeps the records of the first blockCount blocks,
+// the funding records spent by the removed records become unspent again
+func (a *AddressIndexManager) TruncateAddressIndex(blockCount uint32) error {
+	a.addressIndexMutex.Lock()
+	defer a.addressIndexMutex.Unlock()
+	pos := a.RecordCount
+	for pos > 0 {
+		addressIndex, err := a.readAddressIndex(pos-1, nil)
+		if err != nil {
+			return err
+		}
+		if addressIndex.BlockHeight < blockCount {
+			break
+		}
+		scriptHashKey := getScriptHashKey(&addressIndex.ScriptHash)
+		if a.scriptHashToPosMap[scriptHashKey] == pos-1 {
+			if addressIndex.PrevPos == NoAddressIndexPos {
+				delete(a.scriptHashToPosMap, scriptHashKey)
+			} else {
+				a.scriptHashToPosMap[scriptHashKey] = addressIndex.PrevPos
+			}
+		}
+		if addressIndex.Spending {
+			fundingIndex, err := a.readAddressIndex(addressIndex.FundingPos, nil)
+			if err != nil {
+				return err
+			}
+			err = a.addUnspent(fundingIndex, addressIndex.FundingPos, nil)
+			if err != nil {
+				return err
+			}
+		} else {
+			a.removeUnspent(&addressIndex.TxId, addressIndex.N, pos-1)
+		}
+		pos--
+	}
+	err := a.AddressIndexFileObj.Truncate(int64(pos) * AddressIndexSize)
+	if err != nil {
+		return err
+	}
+	a.RecordCount = pos
+	if a.BlockCount > blockCount {
+		a.BlockCount = blockCount
+	}
+	return nil
+}
+
+// Catchup indexes the stored blocks below blockCount which are not indexed yet, the last indexed block
+// is indexed again since its records may be partial, and it must still be the stored block of its height
+func (a *AddressIndexManager) Catchup(blockCount uint32) error {
+	if a.BlockCount > blockCount {
+		err := a.TruncateAddressIndex(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	indexedCount := a.BlockCount
+	if a.BlockCount > 0 {
+		lastHeight := a.BlockCount - 1
+		lastAddressIndex, err := a.readAddressIndex(a.RecordCount-1, nil)
+		if err != nil {
+			return err
+		}
+		ptrRawBlock, err := loadStoredRawBlock(lastHeight)
+		if err != nil {
+			return err
+		}
+		txIndexes, err := getBlockTxIndexes(lastHeight, ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		found := false
+		for i := range txIndexes {
+			if bigint.IsUint256Equal(&lastAddressIndex.TxId, &txIndexes[i].TxId) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("address index not match with the stored block at height " + strconv.Itoa(int(lastHeight)) + ", need to rebuild address index")
+		}
+		err = a.TruncateAddressIndex(lastHeight)
+		if err != nil {
+			return err
+		}
+	}
+	for height := a.BlockCount; height < blockCount; height++ {
+		ptrRawBlock, err := loadStoredRawBlock(height)
+		if err != nil {
+			return err
+		}
+		err = a.AddBlockAddressIndex(height, ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		if height >= indexedCount && (height%10000 == 0 || height == blockCount-1) {
+			var completeRate float64 = float64(height-indexedCount+1) * float64(100) / float64(blockCount-indexedCount)
+			fmt.Println("index addresses of block height", height, "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+		}
+	}
+	return a.Sync()
+}
+
+// GetScriptHashHistory returns the records of the scripthash in the block heights from startHeight to endHeight
+// in ascending order, at most limit records but the records of a block are never split,
+// nextHeight is the start height of the next page, 0 if there is no more record
+func (a *AddressIndexManager) GetScriptHashHistory(scriptHash *bigint.Uint256, startHeight uint32, endHeight uint32, limit int) ([]*AddressIndex, uint32, error) {
+	a.addressIndexMutex.RLock()
+	defer a.addressIndexMutex.RUnlock()
+	records := make([]*AddressIndex, 0)
+	pos, ok := a.scriptHashToPosMap[getScriptHashKey(scriptHash)]
+	for ok && pos != NoAddressIndexPos {
+		addressIndex, err := a.readAddressIndex(pos, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if addressIndex.BlockHeight < startHeight {
+			break
+		}
+		if addressIndex.BlockHeight <= endHeight && bigint.IsUint256Equal(&addressIndex.ScriptHash, scriptHash) {
+			records = append(records, addressIndex)
+		}
+		pos = addressIndex.PrevPos
+	}
+
+	// the records are read from the latest
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	var nextHeight uint32 = 0
+	if len(records) > limit {
+		end := limit
+		for end > 0 && records[end].BlockHeight == records[end-1].BlockHeight {
+			end--
+		}
+		if end == 0 {
+			// the records of the first block exceed the limit
+			end = limit
+			for end < len(records) && records[end].BlockHeight == records[0].BlockHeight {
+				end++
+			}
+		}
+		if end < len(records) {
+			nextHeight = records[end].BlockHeight
+			records = records[0:end]
+		}
+	}
+	return records, nextHeight, nil
+}
+
+// GetScriptHashUnspent returns the funding records of the scripthash not spent yet in ascending order
+func (a *AddressIndexManager) GetScriptHashUnspent(scriptHash *bigint.Uint256) ([]*AddressIndex, error) {
+	a.addressIndexMutex.RLock()
+	defer a.addressIndexMutex.RUnlock()
+	records := make([]*AddressIndex, 0)
+	pos, ok := a.scriptHashToPosMap[getScriptHashKey(scriptHash)]
+	for ok && pos != NoAddressIndexPos {
+		addressIndex, err := a.readAddressIndex(pos, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !addressIndex.Spending && bigint.IsUint256Equal(&addressIndex.ScriptHash, scriptHash) {
+			unspentPos, found, err := a.findUnspent(&addressIndex.TxId, addressIndex.N, nil)
+			if err != nil {
+				return nil, err
+			}
+			if found && unspentPos == pos {
+				records = append(records, addressIndex)
+			}
+		}
+		pos = addressIndex.PrevPos
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+func (a *AddressIndexManager) Sync() error {
+	a.addressIndexMutex.Lock()
+	err := a.AddressIndexFileObj.Sync()
+	a.addressIndexMutex.Unlock()
+	return err
+}
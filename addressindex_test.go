@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"testing"
+)
+
+// testAddressRecord describes an address index record by the height, the transaction and the output or input index
+type testAddressRecord struct {
+	height   uint32
+	tx       []byte
+	spending bool
+	n        uint32
+}
+
+// checkTestAddressRecords checks the records are the expected ones in order
+func checkTestAddressRecords(t *testing.T, name string, records []*AddressIndex, expected []testAddressRecord) {
+	if len(records) != len(expected) {
+		t.Fatalf("%s: got %d records, expected %d", name, len(records), len(expected))
+	}
+	for i, record := range records {
+		if record.BlockHeight != expected[i].height || record.TxId.GetHex() != getTestTxIdHex(expected[i].tx) ||
+			record.Spending != expected[i].spending || record.N != expected[i].n {
+			t.Fatalf("%s: unexpected record %d %+v", name, i, record)
+		}
+	}
+}
+
+func TestAddressIndexRollback(t *testing.T) {
+	rawBlocks, txs := buildTestSpendingChain(t)
+	coinbase1, tx2 := txs[0], txs[2]
+	savedAddressIndexMgr := addressIndexMgr
+	addressIndexMgr = new(AddressIndexManager)
+	t.Cleanup(func() {
+		_ = addressIndexMgr.AddressIndexFileObj.Close()
+		addressIndexMgr = savedAddressIndexMgr
+	})
+	err := addressIndexMgr.Init(config.DataConfig.DataDir, DefaultAddressIndexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height, rawBlock := range rawBlocks {
+		err = addressIndexMgr.AddBlockAddressIndex(uint32(height), rawBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the output of coinbase1 is spent by tx2 in the block 2, which funds the second script
+	spentScriptHash := calcScriptHash([]byte{0x51})
+	fundedScriptHash := calcScriptHash([]byte{0x53})
+	tests := []struct {
+		name          string
+		blockCount    uint32
+		reopen        bool
+		spentHistory  []testAddressRecord
+		spentUnspent  []testAddressRecord
+		fundedHistory []testAddressRecord
+		fundedUnspent []testAddressRecord
+	}{
+		{"stored", 3, false,
+			[]testAddressRecord{{1, coinbase1, false, 0}, {2, tx2, true, 0}}, nil,
+			[]testAddressRecord{{2, tx2, false, 0}}, []testAddressRecord{{2, tx2, false, 0}}},
+		{"rolled back", 2, false,
+			[]testAddressRecord{{1, coinbase1, false, 0}}, []testAddressRecord{{1, coinbase1, false, 0}},
+			nil, nil},
+		{"reopened", 2, true,
+			[]testAddressRecord{{1, coinbase1, false, 0}}, []testAddressRecord{{1, coinbase1, false, 0}},
+			nil, nil},
+		{"stored again", 3, false,
+			[]testAddressRecord{{1, coinbase1, false, 0}, {2, tx2, true, 0}}, nil,
+			[]testAddressRecord{{2, tx2, false, 0}}, []testAddressRecord{{2, tx2, false, 0}}},
+	}
+	for _, test := range tests {
+		if test.reopen {
+			_ = addressIndexMgr.AddressIndexFileObj.Close()
+			addressIndexMgr = new(AddressIndexManager)
+			err = addressIndexMgr.Init(config.DataConfig.DataDir, DefaultAddressIndexName)
+		} else if test.blockCount < addressIndexMgr.BlockCount {
+			err = addressIndexMgr.TruncateAddressIndex(test.blockCount)
+		} else {
+			for height := addressIndexMgr.BlockCount; height < test.blockCount; height++ {
+				err = addressIndexMgr.AddBlockAddressIndex(height, rawBlocks[height])
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addressIndexMgr.BlockCount != test.blockCount {
+			t.Fatalf("%s: unexpected block count %d", test.name, addressIndexMgr.BlockCount)
+		}
+		for _, scriptHash := range []struct {
+			name    string
+			hash    *bigint.Uint256
+			history []testAddressRecord
+			unspent []testAddressRecord
+		}{
+			{"spent script", &spentScriptHash, test.spentHistory, test.spentUnspent},
+			{"funded script", &fundedScriptHash, test.fundedHistory, test.fundedUnspent},
+		} {
+			history, nextHeight, err := addressIndexMgr.GetScriptHashHistory(scriptHash.hash, 0, test.blockCount, DefaultScriptHashHistorySize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nextHeight != 0 {
+				t.Fatalf("%s %s: unexpected next height %d", test.name, scriptHash.name, nextHeight)
+			}
+			checkTestAddressRecords(t, test.name+" "+scriptHash.name+" history", history, scriptHash.history)
+			unspent, err := addressIndexMgr.GetScriptHashUnspent(scriptHash.hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestAddressRecords(t, test.name+" "+scriptHash.name+" unspent", unspent, scriptHash.unspent)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/blob"
+	"github.com/mutalisk999/bitcoin-lib/src/block"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"github.com/mutalisk999/bitcoin-lib/src/transaction"
+	"io"
+)
+
+const (
+	AuxPowVersionFlag       = 1 << 8
+	AuxPowMaxChainBranchLen = 30
+	AuxPowMaxBranchLen      = 64
+)
+
+var mergedMiningHeader = []byte{0xfa, 0xbe, 'm', 'm'}
+
+// AuxPow is the proof that a merge mined block is committed in the coinbase of a parent block
+type AuxPow struct {
+	CoinbaseTx        transaction.Transaction
+	ParentBlockHash   bigint.Uint256
+	CoinbaseBranch    [][]byte
+	CoinbaseIndex     int32
+	ChainBranch       [][]byte
+	ChainIndex        int32
+	ParentHeader      block.BlockHeader
+	ParentHeaderBytes []byte
+}
+
+func unpackMerkleBranch(reader io.Reader) ([][]byte, error) {
+	branchLen, err := serialize.UnPackCompactSize(reader)
+	if err != nil {
+		return nil, err
+	}
+	if branchLen > AuxPowMaxBranchLen {
+		return nil, errors.New("auxpow merkle branch too long")
+	}
+	branch := make([][]byte, 0, branchLen)
+	for i := uint64(0); i < branchLen; i++ {
+		var hash bigint.Uint256
+		err = hash.UnPack(reader)
+		if err != nil {
+			return nil, err
+		}
+		branch = append(branch, hash.GetData())
+	}
+	return branch, nil
+}
+
+func (a *AuxPow) UnPack(reader io.Reader) error {
+	var err error
+	err = a.CoinbaseTx.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = a.ParentBlockHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	a.CoinbaseBranch, err = unpackMerkleBranch(reader)
+	if err != nil {
+		return err
+	}
+	a.CoinbaseIndex, err = serialize.UnPackInt32(reader)
+	if err != nil {
+		return err
+	}
+	a.ChainBranch, err = unpackMerkleBranch(reader)
+	if err != nil {
+		return err
+	}
+	a.ChainIndex, err = serialize.UnPackInt32(reader)
+	if err != nil {
+		return err
+	}
+	a.ParentHeaderBytes = make([]byte, BlockHeaderSize)
+	_, err = io.ReadFull(reader, a.ParentHeaderBytes)
+	if err != nil {
+		return err
+	}
+	err = a.ParentHeader.UnPack(bytes.NewReader(a.ParentHeaderBytes))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func calcMerkleBranchRoot(hash []byte, branch [][]byte, index int32) []byte {
+	for _, otherHash := range branch {
+		if index&1 != 0 {
+			hash = calcDoubleSha256(append(append([]byte{}, otherHash...), hash...))
+		} else {
+			hash = calcDoubleSha256(append(append([]byte{}, hash...), otherHash...))
+		}
+		index >>= 1
+	}
+	return hash
+}
+
+// getExpectedChainIndex is the slot of the chain in the merged mining tree, derived from the nonce and the chain id
+func getExpectedChainIndex(nonce uint32, chainId int32, merkleHeight int) int32 {
+	rand := nonce
+	rand = rand*1103515245 + 12345
+	rand += uint32(chainId)
+	rand = rand*1103515245 + 12345
+	return int32(rand % (uint32(1) << uint(merkleHeight)))
+}
+
+// Check checks the auxpow commits to the block hash, as CAuxPow::check of namecoin and dogecoin
+func (a *AuxPow) Check(blockHash []byte, chainId int32, strictChainId bool) error {
+	if a.CoinbaseIndex != 0 {
+		return errors.New("auxpow is not a generate")
+	}
+	if strictChainId && int32(a.ParentHeader.Version>>16) == chainId {
+		return errors.New("auxpow parent has our chain id")
+	}
+	if len(a.ChainBranch) > AuxPowMaxChainBranchLen {
+		return errors.New("auxpow chain merkle branch too long")
+	}
+
+	coinbaseTxId, err := a.CoinbaseTx.CalcTrxId()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(calcMerkleBranchRoot(coinbaseTxId.GetData(), a.CoinbaseBranch, a.CoinbaseIndex), a.ParentHeader.HashMerkleRoot.GetData()) {
+		return errors.New("auxpow merkle root incorrect")
+	}
+	if len(a.CoinbaseTx.Vin) == 0 {
+		return errors.New("auxpow coinbase without input")
+	}
+
+	// the chain merkle root is committed big endian in the coinbase script
+	chainRoot := blob.DataReverse(calcMerkleBranchRoot(blockHash, a.ChainBranch, a.ChainIndex))
+	script := a.CoinbaseTx.Vin[0].ScriptSig.GetScriptBytes()
+	headerPos := bytes.Index(script, mergedMiningHeader)
+	rootPos := bytes.Index(script, chainRoot)
+	if rootPos < 0 {
+		return errors.New("auxpow missing chain merkle root in parent coinbase")
+	}
+	if headerPos >= 0 {
+		if bytes.Index(script[headerPos+1:], mergedMiningHeader) >= 0 {
+			return errors.New("multiple merged mining headers in coinbase")
+		}
+		if headerPos+len(mergedMiningHeader) != rootPos {
+			return errors.New("merged mining header is not just before chain merkle root")
+		}
+	} else if rootPos > 20 {
+		return errors.New("auxpow chain merkle root must start in the first 20 bytes of the parent coinbase")
+	}
+	pos := rootPos + len(chainRoot)
+	if len(script)-pos < 8 {
+		return errors.New("auxpow missing chain merkle tree size and nonce in parent coinbase")
+	}
+	merkleSize := binary.LittleEndian.Uint32(script[pos : pos+4])
+	if merkleSize != uint32(1)<<uint(len(a.ChainBranch)) {
+		return errors.New("auxpow merkle branch size does not match parent coinbase")
+	}
+	nonce := binary.LittleEndian.Uint32(script[pos+4 : pos+8])
+	if a.ChainIndex != getExpectedChainIndex(nonce, chainId, len(a.ChainBranch)) {
+		return errors.New("auxpow wrong index")
+	}
+	return nil
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/block"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the error codes of the bitcoin core json rpc
+const (
+	BitcoinRpcMiscError           = -1
+	BitcoinRpcTypeError           = -3
+	BitcoinRpcInvalidAddressOrKey = -5
+	BitcoinRpcInvalidParameter    = -8
+	BitcoinRpcInWarmup            = -28
+	BitcoinRpcInvalidRequest      = -32600
+	BitcoinRpcMethodNotFound      = -32601
+	BitcoinRpcParseError          = -32700
+)
+
+type BitcoinRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newBitcoinRpcError(code int, message string) *BitcoinRpcError {
+	return &BitcoinRpcError{Code: code, Message: message}
+}
+
+type BitcoinRpcRequest struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type BitcoinRpcResponse struct {
+	Result interface{}      `json:"result"`
+	Error  *BitcoinRpcError `json:"error"`
+	Id     json.RawMessage  `json:"id"`
+}
+
+// BitcoinRpcMethod describes the parameters of a method, the named parameters are mapped to the positions by ParamNames
+type BitcoinRpcMethod struct {
+	Usage          string
+	ParamNames     []string
+	RequiredParams int
+	Handler        func(params []interface{}) (interface{}, *BitcoinRpcError)
+}
+
+var bitcoinRpcMethods = map[string]*BitcoinRpcMethod{
+	"getbestblockhash":  {"getbestblockhash", nil, 0, bitcoinRpcGetBestBlockHash},
+	"getblock":          {"getblock \"blockhash\" ( verbosity )", []string{"blockhash", "verbosity"}, 1, bitcoinRpcGetBlock},
+	"getblockchaininfo": {"getblockchaininfo", nil, 0, bitcoinRpcGetBlockChainInfo},
+	"getblockcount":     {"getblockcount", nil, 0, bitcoinRpcGetBlockCount},
+	"getblockfilter":    {"getblockfilter \"blockhash\" ( \"filtertype\" )", []string{"blockhash", "filtertype"}, 1, bitcoinRpcGetBlockFilter},
+	"getblockhash":      {"getblockhash height", []string{"height"}, 1, bitcoinRpcGetBlockHash},
+	"getblockheader":    {"getblockheader \"blockhash\" ( verbose )", []string{"blockhash", "verbose"}, 1, bitcoinRpcGetBlockHeader},
+	"getrawtransaction": {"getrawtransaction \"txid\" ( verbose \"blockhash\" )", []string{"txid", "verbose", "blockhash"}, 1, bitcoinRpcGetRawTransaction},
+	"gettxout":          {"gettxout \"txid\" n ( include_mempool )", []string{"txid", "n", "include_mempool"}, 2, bitcoinRpcGetTxOut},
+	"gettxoutsetinfo":   {"gettxoutsetinfo ( \"hash_type\" hash_or_height use_index )", []string{"hash_type", "hash_or_height", "use_index"}, 0, bitcoinRpcGetTxOutSetInfo},
+}
+
+// BitcoinRpcHandler answers the json rpc of bitcoin core on the same endpoint as the gorilla rpc service,
+// the requests of the methods named as "Service.Method" are passed to the next handler
+type BitcoinRpcHandler struct {
+	Next http.Handler
+}
+
+func (h *BitcoinRpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		writeBitcoinRpcReply(w, http.StatusInternalServerError, &BitcoinRpcResponse{Error: newBitcoinRpcError(BitcoinRpcParseError, "Parse error")})
+		return
+	}
+
+	// batch
+	if len(body) != 0 && body[0] == '[' {
+		var rawRequests []json.RawMessage
+		_ = json.Unmarshal(body, &rawRequests)
+		responses := make([]*BitcoinRpcResponse, 0, len(rawRequests))
+		for _, rawRequest := range rawRequests {
+			request := new(BitcoinRpcRequest)
+			err = json.Unmarshal(rawRequest, request)
+			if err != nil {
+				responses = append(responses, &BitcoinRpcResponse{Error: newBitcoinRpcError(BitcoinRpcInvalidRequest, "Invalid Request object")})
+				continue
+			}
+			responses = append(responses, callBitcoinRpc(request))
+		}
+		writeBitcoinRpcReply(w, http.StatusOK, responses)
+		return
+	}
+
+	request := new(BitcoinRpcRequest)
+	err = json.Unmarshal(body, request)
+	if err != nil {
+		writeBitcoinRpcReply(w, http.StatusBadRequest, &BitcoinRpcResponse{Error: newBitcoinRpcError(BitcoinRpcInvalidRequest, "Invalid Request object")})
+		return
+	}
+	if strings.Contains(request.Method, ".") {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	response := callBitcoinRpc(request)
+	status := http.StatusOK
+	if response.Error != nil {
+		// the http status of bitcoin core for the errors of a single request
+		switch response.Error.Code {
+		case BitcoinRpcInvalidRequest:
+			status = http.StatusBadRequest
+		case BitcoinRpcMethodNotFound:
+			status = http.StatusNotFound
+		default:
+			status = http.StatusInternalServerError
+		}
+	}
+	writeBitcoinRpcReply(w, status, response)
+}
+
+func writeBitcoinRpcReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(reply)
+}
+
+func callBitcoinRpc(request *BitcoinRpcRequest) *BitcoinRpcResponse {
+	response := &BitcoinRpcResponse{Id: request.Id}
+	if request.Method == "" {
+		response.Error = newBitcoinRpcError(BitcoinRpcInvalidRequest, "Missing method")
+		return response
+	}
+	method, ok := bitcoinRpcMethods[request.Method]
+	if !ok {
+		response.Error = newBitcoinRpcError(BitcoinRpcMethodNotFound, "Method not found")
+		return response
+	}
+	params, rpcErr := parseBitcoinRpcParams(method, request.Params)
+	if rpcErr != nil {
+		response.Error = rpcErr
+		return response
+	}
+	result, rpcErr := method.Handler(params)
+	if rpcErr != nil {
+		response.Error = rpcErr
+		return response
+	}
+	response.Result = result
+	return response
+}
+
+// parseBitcoinRpcParams returns the positional parameters, the missing optional ones are nil
+func parseBitcoinRpcParams(method *BitcoinRpcMethod, rawParams json.RawMessage) ([]interface{}, *BitcoinRpcError) {
+	var params []interface{}
+	var paramsValue interface{}
+	if len(rawParams) != 0 {
+		decoder := json.NewDecoder(bytes.NewReader(rawParams))
+		decoder.UseNumber()
+		err := decoder.Decode(&paramsValue)
+		if err != nil {
+			return nil, newBitcoinRpcError(BitcoinRpcParseError, "Parse error")
+		}
+	}
+	switch value := paramsValue.(type) {
+	case nil:
+		params = make([]interface{}, 0)
+	case []interface{}:
+		params = value
+	case map[string]interface{}:
+		params = make([]interface{}, len(method.ParamNames))
+		for name, param := range value {
+			position := -1
+			for i, paramName := range method.ParamNames {
+				if paramName == name {
+					position = i
+				}
+			}
+			if position < 0 {
+				return nil, newBitcoinRpcError(BitcoinRpcInvalidParameter, "Unknown named parameter "+name)
+			}
+			params[position] = param
+		}
+		for len(params) != 0 && params[len(params)-1] == nil {
+			params = params[0 : len(params)-1]
+		}
+	default:
+		return nil, newBitcoinRpcError(BitcoinRpcInvalidRequest, "Params must be an array or object")
+	}
+	if len(params) < method.RequiredParams || len(params) > len(method.ParamNames) {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, method.Usage)
+	}
+	for len(params) < len(method.ParamNames) {
+		params = append(params, nil)
+	}
+	return params, nil
+}
+
+func getJsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func newBitcoinRpcTypeError(value interface{}, expectedType string) *BitcoinRpcError {
+	return newBitcoinRpcError(BitcoinRpcTypeError, "JSON value of type "+getJsonTypeName(value)+" is not of expected type "+expectedType)
+}
+
+func getBitcoinRpcIntParam(param interface{}) (int64, *BitcoinRpcError) {
+	number, ok := param.(json.Number)
+	if !ok {
+		return 0, newBitcoinRpcTypeError(param, "number")
+	}
+	value, err := number.Int64()
+	if err != nil {
+		return 0, newBitcoinRpcError(BitcoinRpcTypeError, "JSON integer out of range")
+	}
+	return value, nil
+}
+
+func getBitcoinRpcHashParam(param interface{}, name string) (string, *BitcoinRpcError) {
+	hashHex, ok := param.(string)
+	if !ok {
+		return "", newBitcoinRpcTypeError(param, "string")
+	}
+	if len(hashHex) != 64 {
+		return "", newBitcoinRpcError(BitcoinRpcInvalidParameter, name+" must be of length 64 (not "+strconv.Itoa(len(hashHex))+", for '"+hashHex+"')")
+	}
+	_, err := hex.DecodeString(hashHex)
+	if err != nil {
+		return "", newBitcoinRpcError(BitcoinRpcInvalidParameter, name+" must be hexadecimal string (not '"+hashHex+"')")
+	}
+	return strings.ToLower(hashHex), nil
+}
+
+func getBitcoinRpcTipHeight() (uint32, *BitcoinRpcError) {
+	tipHeight, blockCount := getStoredTip()
+	if blockCount == 0 {
+		return 0, newBitcoinRpcError(BitcoinRpcInWarmup, "Collecting the genesis block...")
+	}
+	return tipHeight, nil
+}
+
+// loadBitcoinRpcBlock returns the decompressed raw block of the block hash, and whether it is a stale block
+func loadBitcoinRpcBlock(blockHash string) (*RawBlock, bool, *BitcoinRpcError) {
+	ptrRawBlock, stale, err := loadRawBlockByHash(blockHash)
+	if err == ErrBlockNotFound {
+		return nil, false, newBitcoinRpcError(BitcoinRpcInvalidAddressOrKey, "Block not found")
+	}
+	if err != nil {
+		return nil, false, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	return ptrRawBlock, stale, nil
+}
+
+func bitcoinRpcGetBlockCount(params []interface{}) (interface{}, *BitcoinRpcError) {
+	return getBitcoinRpcTipHeight()
+}
+
+func bitcoinRpcGetBestBlockHash(params []interface{}) (interface{}, *BitcoinRpcError) {
+	tipHeight, rpcErr := getBitcoinRpcTipHeight()
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	blockHash, _ := getStoredBlockHash(tipHeight)
+	return blockHash, nil
+}
+
+func bitcoinRpcGetBlockHash(params []interface{}) (interface{}, *BitcoinRpcError) {
+	blockHeight, rpcErr := getBitcoinRpcIntParam(params[0])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	if blockHeight < 0 || blockHeight > math.MaxUint32 {
+		return nil, newBitcoinRpcError(BitcoinRpcInvalidParameter, "Block height out of range")
+	}
+	blockHash, ok := getStoredBlockHash(uint32(blockHeight))
+	if !ok {
+		return nil, newBitcoinRpcError(BitcoinRpcInvalidParameter, "Block height out of range")
+	}
+	return blockHash, nil
+}
+
+func bitcoinRpcGetBlock(params []interface{}) (interface{}, *BitcoinRpcError) {
+	blockHash, rpcErr := getBitcoinRpcHashParam(params[0], "blockhash")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbosity := 1
+	switch value := params[1].(type) {
+	case nil:
+	case bool:
+		if !value {
+			verbosity = 0
+		}
+	default:
+		verbosityValue, rpcErr := getBitcoinRpcIntParam(value)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		verbosity = int(verbosityValue)
+	}
+
+	ptrRawBlock, stale, rpcErr := loadBitcoinRpcBlock(blockHash)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	if verbosity <= 0 {
+		return ptrRawBlock.RawBlockData.GetHex(), nil
+	}
+	chainBlock, err := unpackChainBlock(ptrRawBlock.RawBlockData.GetData())
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	blockInfo, err := getBlockInfo(ptrRawBlock, chainBlock, stale, verbosity)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	return blockInfo, nil
+}
+
+func bitcoinRpcGetBlockHeader(params []interface{}) (interface{}, *BitcoinRpcError) {
+	blockHash, rpcErr := getBitcoinRpcHashParam(params[0], "blockhash")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbose := true
+	if params[1] != nil {
+		value, ok := params[1].(bool)
+		if !ok {
+			return nil, newBitcoinRpcTypeError(params[1], "bool")
+		}
+		verbose = value
+	}
+
+	blockHeight, ok := getStoredBlockHeight(blockHash)
+	if !ok {
+		// the stale blocks are not in the block header file
+		return getBitcoinRpcStaleBlockHeader(blockHash, verbose)
+	}
+	headerData, err := blockHeaderMgr.GetBlockHeader(blockHeight)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	if !verbose {
+		return hex.EncodeToString(headerData), nil
+	}
+	blockHeader := new(block.BlockHeader)
+	err = blockHeader.UnPack(bytes.NewReader(headerData))
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	txCount, err := loadBlockTxCount(blockHeight)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	headerInfo, err := getBlockHeaderInfo(blockHash, blockHeight, blockHeader, txCount, false)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	return headerInfo, nil
+}
+
+// getBitcoinRpcStaleBlockHeader answers getblockheader of the stale block from the stale block store
+func getBitcoinRpcStaleBlockHeader(blockHash string, verbose bool) (interface{}, *BitcoinRpcError) {
+	ptrRawBlock, stale, rpcErr := loadBitcoinRpcBlock(blockHash)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	if !verbose {
+		return hex.EncodeToString(ptrRawBlock.RawBlockData.GetData()[0:BlockHeaderSize]), nil
+	}
+	chainBlock, err := unpackChainBlock(ptrRawBlock.RawBlockData.GetData())
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	headerInfo, err := getBlockHeaderInfo(blockHash, ptrRawBlock.BlockHeight, &chainBlock.Header, len(chainBlock.Vtx), stale)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	return headerInfo, nil
+}
+
+func bitcoinRpcGetRawTransaction(params []interface{}) (interface{}, *BitcoinRpcError) {
+	txId, rpcErr := getBitcoinRpcHashParam(params[0], "parameter 1")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbose := false
+	switch value := params[1].(type) {
+	case nil:
+	case bool:
+		verbose = value
+	default:
+		verbosity, rpcErr := getBitcoinRpcIntParam(value)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		verbose = verbosity != 0
+	}
+	if _, rpcErr = getBitcoinRpcTipHeight(); rpcErr != nil {
+		return nil, rpcErr
+	}
+	genesisHeader, err := loadBlockHeader(GenesisBlockHeight)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	if txId == genesisHeader.HashMerkleRoot.GetHex() {
+		return nil, newBitcoinRpcError(BitcoinRpcInvalidAddressOrKey, "The genesis block coinbase is not considered an ordinary transaction and cannot be retrieved")
+	}
+
+	var txResult *RawTransactionInfo
+	if params[2] != nil {
+		// look up in the given block, which may be a stale block
+		blockHash, rpcErr := getBitcoinRpcHashParam(params[2], "parameter 3")
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		ptrRawBlock, stale, err := loadRawBlockByHash(blockHash)
+		if err == ErrBlockNotFound {
+			return nil, newBitcoinRpcError(BitcoinRpcInvalidAddressOrKey, "Block hash not found")
+		}
+		if err != nil {
+			return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+		}
+		rawBlockData := ptrRawBlock.RawBlockData.GetData()
+		chainBlock, err := unpackChainBlock(rawBlockData)
+		if err != nil {
+			return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+		}
+		txIndexes, err := getBlockTxIndexes(ptrRawBlock.BlockHeight, rawBlockData)
+		if err != nil {
+			return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+		}
+		for _, txIndex := range txIndexes {
+			if txIndex.TxId.GetHex() != txId {
+				continue
+			}
+			txData := rawBlockData[txIndex.TxOffset : txIndex.TxOffset+txIndex.TxSize]
+			txResult, err = getRawTransactionInfo(txData, blockHash, txIndex.BlockHeight, chainBlock.Header.Time, stale, verbose)
+			if err != nil {
+				return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+			}
+			inActiveChain := !stale
+			txResult.InActiveChain = &inActiveChain
+			break
+		}
+		if txResult == nil {
+			return nil, newBitcoinRpcError(BitcoinRpcInvalidAddressOrKey, "No such transaction found in the provided block. Use gettransaction for wallet transactions.")
+		}
+	} else {
+		if txIndexMgr == nil {
+			return nil, newBitcoinRpcError(BitcoinRpcInvalidAddressOrKey, "No such mempool transaction. Use -txindex or provide a block hash to enable blockchain transaction queries. Use gettransaction for wallet transactions.")
+		}
+		txIndex, txData, err := loadIndexedTransaction(txId)
+		if err == ErrTxNotFound {
+			return nil, newBitcoinRpcError(BitcoinRpcInvalidAddressOrKey, "No such mempool or blockchain transaction. Use gettransaction for wallet transactions.")
+		}
+		if err != nil {
+			return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+		}
+		blockHeader, err := loadBlockHeader(txIndex.BlockHeight)
+		if err != nil {
+			return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+		}
+		blockHash, _ := getStoredBlockHash(txIndex.BlockHeight)
+		txResult, err = getRawTransactionInfo(txData, blockHash, txIndex.BlockHeight, blockHeader.Time, false, verbose)
+		if err != nil {
+			return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+		}
+	}
+	if !verbose {
+		return txResult.Hex, nil
+	}
+	return txResult, nil
+}
+
+// BitcoinRpcBlockChainInfo is the getblockchaininfo json of bitcoin core
+type BitcoinRpcBlockChainInfo struct {
+	Chain                string  `json:"chain"`
+	Blocks               uint32  `json:"blocks"`
+	Headers              uint32  `json:"headers"`
+	BestBlockHash        string  `json:"bestblockhash"`
+	Difficulty           float64 `json:"difficulty"`
+	Time                 uint32  `json:"time"`
+	MedianTime           uint32  `json:"mediantime"`
+	VerificationProgress float64 `json:"verificationprogress"`
+	InitialBlockDownload bool    `json:"initialblockdownload"`
+	ChainWork            string  `json:"chainwork"`
+	SizeOnDisk           uint64  `json:"size_on_disk"`
+	Pruned               bool    `json:"pruned"`
+	Warnings             string  `json:"warnings"`
+}
+
+func bitcoinRpcGetBlockChainInfo(params []interface{}) (interface{}, *BitcoinRpcError) {
+	tipHeight, rpcErr := getBitcoinRpcTipHeight()
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	blockHeader, err := loadBlockHeader(tipHeight)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	medianTime, err := chainStateMgr.GetMedianTimePast(tipHeight, blockHeader.Time)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	chainWork, err := chainStateMgr.GetChainWork(tipHeight, blockHeader.Bits)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+
+	// the size of the raw block files
+	var sizeOnDisk uint64 = 0
+	latestTag, err := getLatestRawBlockTag()
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	for tag := uint32(0); tag <= latestTag; tag++ {
+		rawBlockFileSize, err := getRawBlockFileSize(tag)
+		if err != nil {
+			return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+		}
+		sizeOnDisk += rawBlockFileSize
+	}
+
+	// the headers are the blocks known by the upstream
+	headers := getGatherStatus().NodeBlockCount
+	if headers < tipHeight {
+		headers = tipHeight
+	}
+
+	chainInfo := new(BitcoinRpcBlockChainInfo)
+	chainInfo.Chain = networkParams.ChainName
+	chainInfo.Blocks = tipHeight
+	chainInfo.Headers = headers
+	chainInfo.BestBlockHash, _ = getStoredBlockHash(tipHeight)
+	chainInfo.Difficulty = getDifficulty(blockHeader.Bits)
+	chainInfo.Time = blockHeader.Time
+	chainInfo.MedianTime = medianTime
+	chainInfo.VerificationProgress = float64(tipHeight+1) / float64(headers+1)
+	chainInfo.InitialBlockDownload = tipHeight < headers
+	chainInfo.ChainWork = fmt.Sprintf("%064x", chainWork)
+	chainInfo.SizeOnDisk = sizeOnDisk
+	chainInfo.Pruned = false
+	chainInfo.Warnings = ""
+	return chainInfo, nil
+}
+
+// bitcoinRpcGetTxOut returns null for the output spent or not found, there is no mempool to include
+func bitcoinRpcGetTxOut(params []interface{}) (interface{}, *BitcoinRpcError) {
+	txId, rpcErr := getBitcoinRpcHashParam(params[0], "txid")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	n, rpcErr := getBitcoinRpcIntParam(params[1])
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	if utxoSetMgr == nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, "utxo set is not enabled")
+	}
+	if n < 0 || n > 0xffffffff {
+		return nil, nil
+	}
+	var txIdValue bigint.Uint256
+	_ = txIdValue.SetHex(txId)
+	utxoRecord, err := utxoSetMgr.GetUtxo(&txIdValue, uint32(n))
+	if err == ErrUtxoNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	return getUtxoInfo(utxoRecord), nil
+}
+
+// bitcoinRpcGetTxOutSetInfo summarizes the utxo set of the latest block, the set hash is muhash by default
+// since the hash_serialized_3 of bitcoin core needs the outputs in the order of the outpoints
+func bitcoinRpcGetTxOutSetInfo(params []interface{}) (interface{}, *BitcoinRpcError) {
+	hashType := "muhash"
+	if params[0] != nil {
+		value, ok := params[0].(string)
+		if !ok {
+			return nil, newBitcoinRpcTypeError(params[0], "string")
+		}
+		hashType = value
+	}
+	if hashType != "muhash" && hashType != "none" {
+		return nil, newBitcoinRpcError(BitcoinRpcInvalidParameter, "'"+hashType+"' is not a valid hash_type")
+	}
+	if params[1] != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcInvalidParameter, "Querying specific block heights requires coinstatsindex")
+	}
+	if utxoSetMgr == nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, "utxo set is not enabled")
+	}
+	if _, rpcErr := getBitcoinRpcTipHeight(); rpcErr != nil {
+		return nil, rpcErr
+	}
+	utxoSetInfo, err := utxoSetMgr.GetUtxoSetInfo(hashType == "muhash")
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	return utxoSetInfo, nil
+}
+
+// BitcoinRpcBlockFilter is the getblockfilter json of bitcoin core
+type BitcoinRpcBlockFilter struct {
+	Filter string `json:"filter"`
+	Header string `json:"header"`
+}
+
+func bitcoinRpcGetBlockFilter(params []interface{}) (interface{}, *BitcoinRpcError) {
+	blockHash, rpcErr := getBitcoinRpcHashParam(params[0], "blockhash")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	filterType := "basic"
+	if params[1] != nil {
+		value, ok := params[1].(string)
+		if !ok {
+			return nil, newBitcoinRpcTypeError(params[1], "string")
+		}
+		filterType = value
+	}
+	if filterType != "basic" {
+		return nil, newBitcoinRpcError(BitcoinRpcInvalidAddressOrKey, "Unknown filtertype")
+	}
+	if blockFilterMgr == nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, "Index is not enabled for filtertype basic")
+	}
+	blockHeight, ok := getStoredBlockHeight(blockHash)
+	if !ok {
+		return nil, newBitcoinRpcError(BitcoinRpcInvalidAddressOrKey, "Block not found")
+	}
+	blockFilter, err := blockFilterMgr.GetBlockFilter(blockHeight)
+	if err != nil {
+		return nil, newBitcoinRpcError(BitcoinRpcMiscError, err.Error())
+	}
+	return &BitcoinRpcBlockFilter{Filter: hex.EncodeToString(blockFilter.Filter), Header: blockFilter.FilterHeader.GetHex()}, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useTestStoredChain stores a regtest chain with the transactions of each block in the data directory,
+// with the managers the json rpc reads
+func useTestStoredChain(t *testing.T, blockCount int, compressedType byte) ([]string, [][]byte) {
+	useTestDataDir(t)
+	useTestNetwork(t, "bitcoin", "regtest")
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	blockHashes := []string{calcBlockHash(genesisBlock)}
+	rawBlocks := [][]byte{genesisBlock}
+	for height := 1; height < blockCount; height++ {
+		txs := [][]byte{buildTestCoinbase(uint32(height), "rpc", []byte{0x51})}
+		for i := 0; i < height; i++ {
+			txs = append(txs, buildTestTx(calcTestTxId(txs[0]), uint32(i), []byte{0x51}, testTxOut{1, []byte{0x51}}))
+		}
+		blockHash, rawBlock := mineTestBlock(t, blockHashes[height-1], txs...)
+		blockHashes = append(blockHashes, blockHash)
+		rawBlocks = append(rawBlocks, rawBlock)
+	}
+	writeTestRawBlocks(t, rawBlocks, compressedType)
+	useTestChain(t, blockHashes)
+
+	savedLatestRawBlockMgr := latestRawBlockMgr
+	savedBlockHeaderMgr := blockHeaderMgr
+	savedChainStateMgr := chainStateMgr
+	latestRawBlockMgr = new(RawBlockManager)
+	latestRawBlockMgr.BlockHeight = uint32(blockCount - 1)
+	latestRawBlockMgr.BlockCount = uint32(blockCount)
+	blockHeaderMgr = new(BlockHeaderManager)
+	err := blockHeaderMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockHeaderName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rawBlock := range rawBlocks {
+		err = blockHeaderMgr.AddBlockHeader(rawBlock[0:BlockHeaderSize])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	chainStateMgr = new(ChainStateManager)
+	chainStateMgr.Init()
+	t.Cleanup(func() {
+		_ = blockHeaderMgr.BlockHeaderFileObj.Close()
+		latestRawBlockMgr = savedLatestRawBlockMgr
+		blockHeaderMgr = savedBlockHeaderMgr
+		chainStateMgr = savedChainStateMgr
+	})
+	return blockHashes, rawBlocks
+}
+
+func TestBitcoinRpcGetBlockHeader(t *testing.T) {
+	for _, compressedType := range []byte{CompressedTypeNone, CompressedTypeZstd} {
+		blockHashes, rawBlocks := useTestStoredChain(t, 4, compressedType)
+		for height, blockHash := range blockHashes {
+			// the header json matches with the header of the block json
+			headerInfo, rpcErr := bitcoinRpcGetBlockHeader([]interface{}{blockHash, nil})
+			if rpcErr != nil {
+				t.Fatal(rpcErr)
+			}
+			blockInfo, rpcErr := bitcoinRpcGetBlock([]interface{}{blockHash, nil})
+			if rpcErr != nil {
+				t.Fatal(rpcErr)
+			}
+			if !reflect.DeepEqual(*headerInfo.(*BlockHeaderInfo), blockInfo.(*BlockInfo).BlockHeaderInfo) {
+				t.Fatalf("unexpected header json of height %d: %+v", height, headerInfo)
+			}
+			if headerInfo.(*BlockHeaderInfo).NTx != height+1 {
+				t.Fatalf("unexpected tx count of height %d: %d", height, headerInfo.(*BlockHeaderInfo).NTx)
+			}
+		}
+
+		// the header is served from the block header file without the raw blocks
+		err := os.Remove(getRawBlockFileName(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for height, blockHash := range blockHashes {
+			headerHex, rpcErr := bitcoinRpcGetBlockHeader([]interface{}{blockHash, false})
+			if rpcErr != nil {
+				t.Fatal(rpcErr)
+			}
+			if headerHex != hex.EncodeToString(rawBlocks[height][0:BlockHeaderSize]) {
+				t.Fatalf("unexpected header of height %d", height)
+			}
+		}
+	}
+}
+
+func TestBitcoinRpcBatchPartialErrors(t *testing.T) {
+	blockHashes, _ := useTestStoredChain(t, 3, CompressedTypeNone)
+	handler := &BitcoinRpcHandler{Next: http.NotFoundHandler()}
+	body := `[
+		{"jsonrpc": "1.0", "id": 1, "method": "getblockcount"},
+		{"jsonrpc": "1.0", "id": 2, "method": "getblockhash", "params": [9]},
+		{"jsonrpc": "1.0", "id": 3, "method": "getblockhash", "params": [1]},
+		{"jsonrpc": "1.0", "id": 4, "method": "getmempoolinfo"},
+		"not a request",
+		{"jsonrpc": "1.0", "id": 6, "method": "getblockhash", "params": ["1"]}
+	]`
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	// the batch is answered even if some of its requests fail
+	if recorder.Code != http.StatusOK {
+		t.Fatal("unexpected http status of the batch", recorder.Code)
+	}
+	var responses []struct {
+		Result interface{}      `json:"result"`
+		Error  *BitcoinRpcError `json:"error"`
+		Id     json.RawMessage  `json:"id"`
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id     string
+		result interface{}
+		code   int
+	}{
+		{"1", float64(2), 0},
+		{"2", nil, BitcoinRpcInvalidParameter},
+		{"3", blockHashes[1], 0},
+		{"4", nil, BitcoinRpcMethodNotFound},
+		{"", nil, BitcoinRpcInvalidRequest},
+		{"6", nil, BitcoinRpcTypeError},
+	}
+	if len(responses) != len(tests) {
+		t.Fatal("unexpected response count", len(responses))
+	}
+	for i, test := range tests {
+		response := responses[i]
+		id := string(response.Id)
+		if id == "null" {
+			id = ""
+		}
+		if id != test.id {
+			t.Errorf("response %d: unexpected id %s", i, response.Id)
+		}
+		if test.code == 0 {
+			if response.Error != nil || response.Result != test.result {
+				t.Errorf("response %d: got %v %v, expected %v", i, response.Result, response.Error, test.result)
+			}
+			continue
+		}
+		if response.Error == nil || response.Error.Code != test.code || response.Result != nil {
+			t.Errorf("response %d: got %v %v, expected error %d", i, response.Result, response.Error, test.code)
+		}
+	}
+}
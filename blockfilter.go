@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/script"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	DefaultBlockFilterName = "block_filter"
+	// the basic filter of bip158 is the only filter type
+	BasicFilterType = 0
+	BasicFilterP    = 19
+	BasicFilterM    = 784931
+	// the fixed part of a block filter record before the filter
+	BlockFilterHeaderSize = 4 + 32 + 32 + 32 + 4
+	MaxBlockFilterSize    = 32 * 1024 * 1024
+	// the limits of the getcfilters, getcfheaders and getcfcheckpt of bip157
+	MaxCFiltersCount  = 1000
+	MaxCFHeadersCount = 2000
+	CFCheckptInterval = 1000
+)
+
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13)
+	v1 ^= v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17)
+	v1 ^= v2
+	v2 = bits.RotateLeft64(v2, 32)
+	return v0, v1, v2, v3
+}
+
+// calcSipHash returns the SipHash-2-4 of the data
+func calcSipHash(k0 uint64, k1 uint64, data []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	length := len(data)
+	for len(data) >= 8 {
+		m := binary.LittleEndian.Uint64(data[0:8])
+		v3 ^= m
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0 ^= m
+		data = data[8:]
+	}
+	var lastBlock [8]byte
+	copy(lastBlock[:], data)
+	lastBlock[7] = byte(length)
+	m := binary.LittleEndian.Uint64(lastBlock[:])
+	v3 ^= m
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= m
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// BitWriter writes the bits from the most significant bit of each byte
+type BitWriter struct {
+	data     []byte
+	bitCount uint
+}
+
+func (b *BitWriter) WriteBits(value uint64, count uint) {
+	for count > 0 {
+		if b.bitCount%8 == 0 {
+			b.data = append(b.data, 0)
+		}
+		count--
+		if value>>count&1 == 1 {
+			b.data[len(b.data)-1] |= 0x80 >> (b.bitCount % 8)
+		}
+		b.bitCount++
+	}
+}
+
+// buildBasicFilter encodes the elements as the golomb-coded set of bip158, keyed by the block hash
+func buildBasicFilter(blockHash []byte, elements [][]byte) ([]byte, error) {
+	k0 := binary.LittleEndian.Uint64(blockHash[0:8])
+	k1 := binary.LittleEndian.Uint64(blockHash[8:16])
+	filterRange := uint64(len(elements)) * BasicFilterM
+	values := make([]uint64, 0, len(elements))
+	for _, element := range elements {
+		value, _ := bits.Mul64(calcSipHash(k0, k1, element), filterRange)
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	filterBuf := new(bytes.Buffer)
+	err := serialize.PackCompactSize(filterBuf, uint64(len(elements)))
+	if err != nil {
+		return nil, err
+	}
+	bitWriter := new(BitWriter)
+	var lastValue uint64 = 0
+	for _, value := range values {
+		delta := value - lastValue
+		for quotient := delta >> BasicFilterP; quotient > 0; quotient-- {
+			bitWriter.WriteBits(1, 1)
+		}
+		bitWriter.WriteBits(0, 1)
+		bitWriter.WriteBits(delta, BasicFilterP)
+		lastValue = value
+	}
+	filterBuf.Write(bitWriter.data)
+	return filterBuf.Bytes(), nil
+}
+
+// getBasicFilterElements returns the distinct scriptPubKeys of the outputs of the block except the OP_RETURN ones,
+// and of the outputs spent by the block
+func getBasicFilterElements(chainBlock *ChainBlock, spentScripts [][]byte) [][]byte {
+	elements := make([][]byte, 0)
+	elementSet := make(map[string]bool)
+	addElement := func(scriptBytes []byte) {
+		if len(scriptBytes) == 0 || elementSet[string(scriptBytes)] {
+			return
+		}
+		elementSet[string(scriptBytes)] = true
+		elements = append(elements, scriptBytes)
+	}
+	for i := range chainBlock.Vtx {
+		for _, txOut := range chainBlock.Vtx[i].Vout {
+			scriptBytes := txOut.ScriptPubKey.GetScriptBytes()
+			if len(scriptBytes) != 0 && scriptBytes[0] == script.OP_RETURN {
+				continue
+			}
+			addElement(scriptBytes)
+		}
+	}
+	for _, scriptBytes := range spentScripts {
+		addElement(scriptBytes)
+	}
+	return elements
+}
+
+// BlockFilter is the basic filter of a block, the filter header commits to the filter and the previous filter header
+type BlockFilter struct {
+	BlockHeight  uint32
+	BlockHash    bigint.Uint256
+	FilterHash   bigint.Uint256
+	FilterHeader bigint.Uint256
+	Filter       []byte
+}
+
+func (b BlockFilter) packBody(writer io.Writer) error {
+	var err error
+	err = serialize.PackUint32(writer, b.BlockHeight)
+	if err != nil {
+		return err
+	}
+	err = b.BlockHash.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = b.FilterHash.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = b.FilterHeader.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, uint32(len(b.Filter)))
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(b.Filter)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *BlockFilter) unpackBody(reader io.Reader) error {
+	var err error
+	b.BlockHeight, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	err = b.BlockHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = b.FilterHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	err = b.FilterHeader.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	filterSize, err := serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	b.Filter = make([]byte, filterSize)
+	_, err = io.ReadFull(reader, b.Filter)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b BlockFilter) Pack(writer io.Writer) error {
+	checksum := crc32.New(crc32cTable)
+	err := b.packBody(io.MultiWriter(writer, checksum))
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, checksum.Sum32())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *BlockFilter) UnPack(reader io.Reader) error {
+	checksum := crc32.New(crc32cTable)
+	err := b.unpackBody(io.TeeReader(reader, checksum))
+	if err != nil {
+		return err
+	}
+	checksumRead, err := serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	if checksumRead != checksum.Sum32() {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// readBlockFilterData reads a whole record, the size of the record is known from its fixed part
+func readBlockFilterData(reader io.Reader) ([]byte, error) {
+	headerData := make([]byte, BlockFilterHeaderSize)
+	_, err := io.ReadFull(reader, headerData)
+	if err != nil {
+		return nil, err
+	}
+	filterSize := binary.LittleEndian.Uint32(headerData[BlockFilterHeaderSize-4:])
+	if filterSize > MaxBlockFilterSize {
+		return nil, ErrChecksumMismatch
+	}
+	recordData := make([]byte, BlockFilterHeaderSize+int(filterSize)+4)
+	copy(recordData, headerData)
+	_, err = io.ReadFull(reader, recordData[BlockFilterHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	return recordData, nil
+}
+
+// BlockFilterManager appends the basic filter of every stored block in block order, the filter of the block height N
+// is the record N located by its position kept in memory, the outputs spent by a block are read from the utxo set
+type BlockFilterManager struct {
+	BlockFilterFileName string
+	BlockFilterFileObj  *os.File
+	FileSize            uint64
+	BlockCount          uint32
+	filterPos           []uint64
+	// the filter header of the latest block
+	lastFilterHeader bigint.Uint256
+	blockFilterMutex *sync.RWMutex
+}
+
+var blockFilterMgr *BlockFilterManager
+
+func (b *BlockFilterManager) Init(dataDir string, blockFilterName string) error {
+	if b.blockFilterMutex == nil {
+		b.blockFilterMutex = new(sync.RWMutex)
+	}
+	b.blockFilterMutex.Lock()
+	defer b.blockFilterMutex.Unlock()
+
+	var err error
+	blockFilterFileName := dataDir + "/" + blockFilterName
+	b.BlockFilterFileObj, err = os.OpenFile(blockFilterFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend)
+	if err != nil {
+		return err
+	}
+	blockFilterInfo, err := b.BlockFilterFileObj.Stat()
+	if err != nil {
+		return err
+	}
+	b.BlockFilterFileName = blockFilterFileName
+	b.FileSize = 0
+	b.BlockCount = 0
+	b.filterPos = make([]uint64, 0)
+	_ = b.lastFilterHeader.SetData(make([]byte, 32))
+
+	// locate the records
+	_, err = b.BlockFilterFileObj.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	blockFilterReader := bufio.NewReader(b.BlockFilterFileObj)
+	for b.FileSize < uint64(blockFilterInfo.Size()) {
+		recordData, err := readBlockFilterData(blockFilterReader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// drop the partial record left by a crash
+			err = b.BlockFilterFileObj.Truncate(int64(b.FileSize))
+			if err != nil {
+				return err
+			}
+			break
+		}
+		blockFilter := new(BlockFilter)
+		if err == nil {
+			err = blockFilter.UnPack(bytes.NewReader(recordData))
+		}
+		if err == nil && blockFilter.BlockHeight != b.BlockCount {
+			err = ErrChecksumMismatch
+		}
+		if err == ErrChecksumMismatch {
+			return errors.New("corrupt block filter record " + strconv.Itoa(int(b.BlockCount)) + ", need to rebuild block filter")
+		}
+		if err != nil {
+			return err
+		}
+		b.filterPos = append(b.filterPos, b.FileSize)
+		b.FileSize = b.FileSize + uint64(len(recordData))
+		b.BlockCount = b.BlockCount + 1
+		b.lastFilterHeader = blockFilter.FilterHeader
+	}
+	return nil
+}
+
+func (b *BlockFilterManager) readBlockFilter(blockHeight uint32) (*BlockFilter, error) {
+	pos := b.filterPos[blockHeight]
+	recordData, err := readBlockFilterData(io.NewSectionReader(b.BlockFilterFileObj, int64(pos), int64(b.FileSize-pos)))
+	if err != nil {
+		return nil, err
+	}
+	blockFilter := new(BlockFilter)
+	err = blockFilter.UnPack(bytes.NewReader(recordData))
+	if err != nil {
+		return nil, err
+	}
+	return blockFilter, nil
+}
+
+// AddBlockFilter appends the filter of the block at the next height, the block must be applied to the utxo set
+func (b *BlockFilterManager) AddBlockFilter(blockHeight uint32, rawBlockData []byte) error {
+	b.blockFilterMutex.Lock()
+	defer b.blockFilterMutex.Unlock()
+	if blockHeight != b.BlockCount {
+		return errors.New("unexpected block height " + strconv.Itoa(int(blockHeight)) + " for block filter, expect " + strconv.Itoa(int(b.BlockCount)))
+	}
+	chainBlock, err := unpackChainBlock(rawBlockData)
+	if err != nil {
+		return err
+	}
+	spentScripts, err := utxoSetMgr.GetBlockSpentScripts(blockHeight)
+	if err != nil {
+		return err
+	}
+	blockHash := calcDoubleSha256(rawBlockData[0:BlockHeaderSize])
+	filter, err := buildBasicFilter(blockHash, getBasicFilterElements(chainBlock, spentScripts))
+	if err != nil {
+		return err
+	}
+
+	blockFilter := BlockFilter{BlockHeight: blockHeight, Filter: filter}
+	_ = blockFilter.BlockHash.SetData(blockHash)
+	filterHash := calcDoubleSha256(filter)
+	_ = blockFilter.FilterHash.SetData(filterHash)
+	headerData := make([]byte, 0, 64)
+	headerData = append(headerData, filterHash...)
+	headerData = append(headerData, b.lastFilterHeader.GetData()...)
+	_ = blockFilter.FilterHeader.SetData(calcDoubleSha256(headerData))
+	blockFilterBuf := new(bytes.Buffer)
+	err = blockFilter.Pack(blockFilterBuf)
+	if err != nil {
+		return err
+	}
+	_, err = b.BlockFilterFileObj.Write(blockFilterBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	b.filterPos = append(b.filterPos, b.FileSize)
+	b.FileSize = b.FileSize + uint64(blockFilterBuf.Len())
+	b.BlockCount = blockHeight + 1
+	b.lastFilterHeader = blockFilter.FilterHeader
+	return nil
+}
+
+// TruncateBlockFilter keeps the filters of the first blockCount blocks
+func (b *BlockFilterManager) TruncateBlockFilter(blockCount uint32) error {
+	b.blockFilterMutex.Lock()
+	defer b.blockFilterMutex.Unlock()
+	if blockCount >= b.BlockCount {
+		return nil
+	}
+	_ = b.lastFilterHeader.SetData(make([]byte, 32))
+	if blockCount > 0 {
+		blockFilter, err := b.readBlockFilter(blockCount - 1)
+		if err != nil {
+			return err
+		}
+		b.lastFilterHeader = blockFilter.FilterHeader
+	}
+	err := b.BlockFilterFileObj.Truncate(int64(b.filterPos[blockCount]))
+	if err != nil {
+		return err
+	}
+	b.FileSize = b.filterPos[blockCount]
+	b.filterPos = b.filterPos[0:blockCount]
+	b.BlockCount = blockCount
+	return nil
+}
+
+// Catchup builds the filters of the stored blocks below blockCount which are not built yet,
+// the latest filter must still be the filter of the stored block of its height
+func (b *BlockFilterManager) Catchup(blockCount uint32) error {
+	if b.BlockCount > blockCount {
+		err := b.TruncateBlockFilter(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	builtCount := b.BlockCount
+	if b.BlockCount > 0 {
+		lastHeight := b.BlockCount - 1
+		blockFilter, err := b.readBlockFilter(lastHeight)
+		if err != nil {
+			return err
+		}
+		ptrBlockIndex, err := loadBlockIndex(lastHeight)
+		if err != nil {
+			return err
+		}
+		if !bigint.IsUint256Equal(&blockFilter.BlockHash, &ptrBlockIndex.BlockHash) {
+			return errors.New("block filter not match with the stored block at height " + strconv.Itoa(int(lastHeight)) + ", need to rebuild block filter")
+		}
+	}
+	for height := b.BlockCount; height < blockCount; height++ {
+		ptrRawBlock, err := loadStoredRawBlock(height)
+		if err != nil {
+			return err
+		}
+		err = b.AddBlockFilter(height, ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		if height%10000 == 0 || height == blockCount-1 {
+			var completeRate float64 = float64(height-builtCount+1) * float64(100) / float64(blockCount-builtCount)
+			fmt.Println("build block filter of block height", height, "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+		}
+	}
+	return b.Sync()
+}
+
+// GetBlockFilters returns the filters of the blocks from the start height to the stop height
+func (b *BlockFilterManager) GetBlockFilters(startHeight uint32, stopHeight uint32) ([]*BlockFilter, error) {
+	b.blockFilterMutex.RLock()
+	defer b.blockFilterMutex.RUnlock()
+	if startHeight > stopHeight || stopHeight >= b.BlockCount {
+		return nil, errors.New("block filter not found")
+	}
+	pos := b.filterPos[startHeight]
+	blockFilterReader := bufio.NewReader(io.NewSectionReader(b.BlockFilterFileObj, int64(pos), int64(b.FileSize-pos)))
+	blockFilters := make([]*BlockFilter, 0, stopHeight-startHeight+1)
+	for height := startHeight; height <= stopHeight; height++ {
+		recordData, err := readBlockFilterData(blockFilterReader)
+		if err != nil {
+			return nil, err
+		}
+		blockFilter := new(BlockFilter)
+		err = blockFilter.UnPack(bytes.NewReader(recordData))
+		if err != nil {
+			return nil, err
+		}
+		blockFilters = append(blockFilters, blockFilter)
+	}
+	return blockFilters, nil
+}
+
+func (b *BlockFilterManager) GetBlockFilter(blockHeight uint32) (*BlockFilter, error) {
+	b.blockFilterMutex.RLock()
+	defer b.blockFilterMutex.RUnlock()
+	if blockHeight >= b.BlockCount {
+		return nil, errors.New("block filter not found")
+	}
+	return b.readBlockFilter(blockHeight)
+}
+
+func (b *BlockFilterManager) Sync() error {
+	b.blockFilterMutex.Lock()
+	err := b.BlockFilterFileObj.Sync()
+	b.blockFilterMutex.Unlock()
+	return err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSipHash(t *testing.T) {
+	// the vectors of the siphash reference implementation, the key 00..0f and the message 00..len-1
+	k0 := uint64(0x0706050403020100)
+	k1 := uint64(0x0f0e0d0c0b0a0908)
+	tests := []struct {
+		length int
+		hash   uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{8, 0x93f5f5799a932462},
+		{15, 0xa129ca6149be45e5},
+	}
+	for _, test := range tests {
+		data := make([]byte, test.length)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		if hash := calcSipHash(k0, k1, data); hash != test.hash {
+			t.Errorf("siphash of %d bytes: %016x, expected %016x", test.length, hash, test.hash)
+		}
+	}
+}
+
+// the genesis block of testnet3 differs from the one of regtest in the header
+func buildTestnetGenesisBlock(t *testing.T) []byte {
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	copy(genesisBlock[72:80], mustDecodeHex(t, "ffff001d1aa4ae18"))
+	return genesisBlock
+}
+
+func TestBasicFilter(t *testing.T) {
+	// the filter of no element is the element count only
+	filter, err := buildBasicFilter(make([]byte, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(filter) != "00" {
+		t.Fatal("unexpected empty filter", hex.EncodeToString(filter))
+	}
+
+	// the genesis block vector of bip158 testnet-19.json
+	useTestDataDir(t)
+	useTestNetwork(t, "bitcoin", "testnet3")
+	genesisBlock := buildTestnetGenesisBlock(t)
+	if calcBlockHash(genesisBlock) != "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943" {
+		t.Fatal("unexpected testnet genesis hash", calcBlockHash(genesisBlock))
+	}
+	chainBlock, err := unpackChainBlock(genesisBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err = buildBasicFilter(calcDoubleSha256(genesisBlock[0:BlockHeaderSize]), getBasicFilterElements(chainBlock, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(filter) != "019dfca8" {
+		t.Fatal("unexpected genesis filter", hex.EncodeToString(filter))
+	}
+
+	// the filter header chains from the zero header
+	savedUtxoSetMgr := utxoSetMgr
+	savedBlockFilterMgr := blockFilterMgr
+	utxoSetMgr = new(UtxoSetManager)
+	blockFilterMgr = new(BlockFilterManager)
+	t.Cleanup(func() {
+		_ = utxoSetMgr.UtxoSetFileObj.Close()
+		_ = blockFilterMgr.BlockFilterFileObj.Close()
+		utxoSetMgr = savedUtxoSetMgr
+		blockFilterMgr = savedBlockFilterMgr
+	})
+	err = utxoSetMgr.Init(config.DataConfig.DataDir, "utxo_set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockFilterMgr.Init(config.DataConfig.DataDir, "block_filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = utxoSetMgr.AddBlockUtxoSet(0, genesisBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockFilterMgr.AddBlockFilter(0, genesisBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockFilter, err := blockFilterMgr.GetBlockFilter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(blockFilter.Filter) != "019dfca8" ||
+		blockFilter.FilterHeader.GetHex() != "21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750" {
+		t.Fatalf("unexpected genesis block filter %x %s", blockFilter.Filter, blockFilter.FilterHeader.GetHex())
+	}
+}
+
+// useTestIndexes enables the utxo set and the block filter, and closes the indexes opened by initIndexes
+func useTestIndexes(t *testing.T, utxoSet bool, blockFilterIndex bool) {
+	config.DataConfig.UtxoSet = utxoSet
+	config.DataConfig.UtxoSetName = DefaultUtxoSetName
+	config.DataConfig.BlockFilterIndex = blockFilterIndex
+	config.DataConfig.BlockFilterName = DefaultBlockFilterName
+	savedUtxoSetMgr := utxoSetMgr
+	savedBlockFilterMgr := blockFilterMgr
+	utxoSetMgr = nil
+	blockFilterMgr = nil
+	t.Cleanup(func() {
+		closeIndexes()
+		utxoSetMgr = savedUtxoSetMgr
+		blockFilterMgr = savedBlockFilterMgr
+	})
+}
+
+func TestInitIndexesBlockFilter(t *testing.T) {
+	// the block filter needs the utxo set
+	useTestStoredChain(t, 4, CompressedTypeNone)
+	useTestIndexes(t, false, true)
+	err := initIndexes(4)
+	if err == nil || !strings.Contains(err.Error(), "needs utxoSet") {
+		t.Fatal("block filter without utxo set not refused", err)
+	}
+
+	blockHashes, _ := useTestStoredChain(t, 4, CompressedTypeNone)
+	useTestIndexes(t, true, true)
+	err = initIndexes(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockFilters, err := blockFilterMgr.GetBlockFilters(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeIndexes()
+
+	// the utxo set removed to be rebuilt is caught up before the filters are checked
+	err = os.Remove(config.DataConfig.DataDir + "/" + DefaultUtxoSetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = initIndexes(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utxoSetMgr.BlockCount != 4 || blockFilterMgr.BlockCount != 4 {
+		t.Fatalf("unexpected index block counts %d %d", utxoSetMgr.BlockCount, blockFilterMgr.BlockCount)
+	}
+	for height, blockHash := range blockHashes {
+		blockFilter, err := blockFilterMgr.GetBlockFilter(uint32(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(blockFilter, blockFilters[height]) || blockFilter.BlockHash.GetHex() != blockHash {
+			t.Fatalf("unexpected block filter of height %d", height)
+		}
+	}
+	closeIndexes()
+
+	// the filters of another chain are refused once the utxo set is rebuilt for the stored chain
+	err = os.Remove(config.DataConfig.DataDir + "/" + DefaultUtxoSetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(getRawBlockFileName(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(config.DataConfig.DataDir + "/" + config.DataConfig.BlockIndexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	otherHashes, otherBlocks := mineTestChain(t, blockHashes[0], 1, 3, "other")
+	writeTestRawBlocks(t, append([][]byte{genesisBlock}, otherBlocks...), CompressedTypeNone)
+	useTestChain(t, append([]string{blockHashes[0]}, otherHashes...))
+	err = initIndexes(4)
+	if err == nil || !strings.Contains(err.Error(), "block filter not match with the stored block at height 3") {
+		t.Fatal("block filter of another chain not refused", err)
+	}
+	if utxoSetMgr.BlockCount != 4 {
+		t.Fatal("utxo set not rebuilt before the block filter check", utxoSetMgr.BlockCount)
+	}
+}
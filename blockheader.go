@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	DefaultBlockHeaderName = "block_header"
+	MaxBlockHeadersCount   = 2000
+)
+
+// BlockHeaderManager keeps the 80 bytes header of every stored block in an append only file,
+// the header of the block height N is at the offset N*80
+type BlockHeaderManager struct {
+	BlockHeaderFileName string
+	BlockHeaderFileObj  *os.File
+	HeaderCount         uint32
+	blockHeaderMutex    *sync.RWMutex
+}
+
+var blockHeaderMgr *BlockHeaderManager
+
+func getBlockHeaderData(rawBlockData []byte) ([]byte, error) {
+	if len(rawBlockData) < BlockHeaderSize {
+		return nil, errors.New("invalid raw block size")
+	}
+	headerData := make([]byte, BlockHeaderSize)
+	copy(headerData, rawBlockData[0:BlockHeaderSize])
+	return headerData, nil
+}
+
+func (b *BlockHeaderManager) Init(dataDir string, blockHeaderName string) error {
+	if b.blockHeaderMutex == nil {
+		b.blockHeaderMutex = new(sync.RWMutex)
+	}
+	b.blockHeaderMutex.Lock()
+	defer b.blockHeaderMutex.Unlock()
+
+	var err error
+	blockHeaderFileName := dataDir + "/" + blockHeaderName
+	b.BlockHeaderFileObj, err = os.OpenFile(blockHeaderFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend)
+	if err != nil {
+		return err
+	}
+	blockHeaderInfo, err := b.BlockHeaderFileObj.Stat()
+	if err != nil {
+		return err
+	}
+	b.BlockHeaderFileName = blockHeaderFileName
+	// drop the partial header left by a crash
+	headerCount := blockHeaderInfo.Size() / BlockHeaderSize
+	if blockHeaderInfo.Size() != headerCount*BlockHeaderSize {
+		err = b.BlockHeaderFileObj.Truncate(headerCount * BlockHeaderSize)
+		if err != nil {
+			return err
+		}
+	}
+	b.HeaderCount = uint32(headerCount)
+	return nil
+}
+
+// Catchup makes the header file hold the headers of the first blockCount stored blocks,
+// the missing headers are read from the raw blocks, which also fills the header file of an existing data directory
+func (b *BlockHeaderManager) Catchup(blockCount uint32) error {
+	if b.HeaderCount > blockCount {
+		return b.TruncateBlockHeader(blockCount)
+	}
+	startCount := b.HeaderCount
+	for height := startCount; height < blockCount; height++ {
+		ptrRawBlock, err := loadStoredRawBlock(height)
+		if err != nil {
+			return err
+		}
+		headerData, err := getBlockHeaderData(ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		err = b.AddBlockHeader(headerData)
+		if err != nil {
+			return err
+		}
+		if height%10000 == 0 || height == blockCount-1 {
+			var completeRate float64 = float64(height-startCount+1) * float64(100) / float64(blockCount-startCount)
+			fmt.Println("load block header height", height, "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+		}
+	}
+	return b.Sync()
+}
+
+func (b *BlockHeaderManager) AddBlockHeader(headerData []byte) error {
+	b.blockHeaderMutex.Lock()
+	defer b.blockHeaderMutex.Unlock()
+	if len(headerData) != BlockHeaderSize {
+		return errors.New("invalid block header size")
+	}
+	_, err := b.BlockHeaderFileObj.Write(headerData)
+	if err != nil {
+		return err
+	}
+	b.HeaderCount = b.HeaderCount + 1
+	return nil
+}
+
+// TruncateBlockHeader keeps the headers of the first blockCount blocks
+func (b *BlockHeaderManager) TruncateBlockHeader(blockCount uint32) error {
+	b.blockHeaderMutex.Lock()
+	defer b.blockHeaderMutex.Unlock()
+	if blockCount >= b.HeaderCount {
+		return nil
+	}
+	err := b.BlockHeaderFileObj.Truncate(int64(blockCount) * BlockHeaderSize)
+	if err != nil {
+		return err
+	}
+	b.HeaderCount = blockCount
+	return nil
+}
+
+// GetBlockHeaders returns the headers of count blocks from the start height, fewer if the chain ends
+func (b *BlockHeaderManager) GetBlockHeaders(startHeight uint32, count uint32) ([]byte, error) {
+	b.blockHeaderMutex.RLock()
+	defer b.blockHeaderMutex.RUnlock()
+	if startHeight >= b.HeaderCount {
+		return nil, errors.New("block height not found")
+	}
+	if count > b.HeaderCount-startHeight {
+		count = b.HeaderCount - startHeight
+	}
+	headersData := make([]byte, int(count)*BlockHeaderSize)
+	_, err := b.BlockHeaderFileObj.ReadAt(headersData, int64(startHeight)*BlockHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	return headersData, nil
+}
+
+func (b *BlockHeaderManager) GetBlockHeader(blockHeight uint32) ([]byte, error) {
+	return b.GetBlockHeaders(blockHeight, 1)
+}
+
+// WriteBlockHeaders streams the headers from the start height to the header count when called
+func (b *BlockHeaderManager) WriteBlockHeaders(writer io.Writer, startHeight uint32) error {
+	b.blockHeaderMutex.RLock()
+	headerCount := b.HeaderCount
+	b.blockHeaderMutex.RUnlock()
+	if startHeight > headerCount {
+		return errors.New("block height not found")
+	}
+	sectionReader := io.NewSectionReader(b.BlockHeaderFileObj, int64(startHeight)*BlockHeaderSize, int64(headerCount-startHeight)*BlockHeaderSize)
+	_, err := io.Copy(writer, sectionReader)
+	return err
+}
+
+func (b *BlockHeaderManager) Sync() error {
+	b.blockHeaderMutex.Lock()
+	err := b.BlockHeaderFileObj.Sync()
+	b.blockHeaderMutex.Unlock()
+	return err
+}
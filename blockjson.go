@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/block"
+	"github.com/mutalisk999/bitcoin-lib/src/transaction"
+	"math"
+	"strconv"
+)
+
+const (
+	WitnessScaleFactor = 4
+)
+
+// BitcoinAmount is an amount in satoshis, marshaled in coins with 8 decimals as bitcoin core does
+type BitcoinAmount int64
+
+func (a BitcoinAmount) MarshalJSON() ([]byte, error) {
+	sign := ""
+	value := int64(a)
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	return []byte(sign + strconv.FormatInt(value/1e8, 10) + "." + fmt.Sprintf("%08d", value%1e8)), nil
+}
+
+// BlockHeaderInfo is the getblockheader json of bitcoin core
+type BlockHeaderInfo struct {
+	Hash              string  `json:"hash"`
+	Confirmations     int64   `json:"confirmations"`
+	Height            uint32  `json:"height"`
+	Version           int32   `json:"version"`
+	VersionHex        string  `json:"versionHex"`
+	MerkleRoot        string  `json:"merkleroot"`
+	Time              uint32  `json:"time"`
+	MedianTime        uint32  `json:"mediantime"`
+	Nonce             uint32  `json:"nonce"`
+	Bits              string  `json:"bits"`
+	Difficulty        float64 `json:"difficulty"`
+	ChainWork         string  `json:"chainwork"`
+	NTx               int     `json:"nTx"`
+	PreviousBlockHash string  `json:"previousblockhash,omitempty"`
+	NextBlockHash     string  `json:"nextblockhash,omitempty"`
+}
+
+// BlockInfo is the getblock json of bitcoin core, Tx lists the txids in verbosity 1 and the transactions in verbosity 2
+type BlockInfo struct {
+	BlockHeaderInfo
+	StrippedSize int         `json:"strippedsize"`
+	Size         int         `json:"size"`
+	Weight       int         `json:"weight"`
+	Tx           interface{} `json:"tx"`
+}
+
+type ScriptSigInfo struct {
+	Asm string `json:"asm"`
+	Hex string `json:"hex"`
+}
+
+type ScriptPubKeyInfo struct {
+	Asm  string `json:"asm"`
+	Desc string `json:"desc"`
+	Hex  string `json:"hex"`
+	// empty for the script types without an address
+	Address string `json:"address,omitempty"`
+	Type    string `json:"type"`
+}
+
+type TxInInfo struct {
+	Coinbase string `json:"coinbase,omitempty"`
+	TxId     string `json:"txid,omitempty"`
+	// nil for the coinbase input
+	Vout        *uint32        `json:"vout,omitempty"`
+	ScriptSig   *ScriptSigInfo `json:"scriptSig,omitempty"`
+	TxInWitness []string       `json:"txinwitness,omitempty"`
+	Sequence    uint32         `json:"sequence"`
+}
+
+type TxOutInfo struct {
+	Value        BitcoinAmount    `json:"value"`
+	N            uint32           `json:"n"`
+	ScriptPubKey ScriptPubKeyInfo `json:"scriptPubKey"`
+}
+
+// TxInfo is the decoded transaction json of bitcoin core
+type TxInfo struct {
+	TxId     string      `json:"txid"`
+	Hash     string      `json:"hash"`
+	Version  int32       `json:"version"`
+	Size     int         `json:"size"`
+	VSize    int         `json:"vsize"`
+	Weight   int         `json:"weight"`
+	LockTime uint32      `json:"locktime"`
+	Vin      []TxInInfo  `json:"vin"`
+	Vout     []TxOutInfo `json:"vout"`
+	Hex      string      `json:"hex"`
+}
+
+// RawTransactionInfo is the getrawtransaction json of bitcoin core, TxInfo is nil if not verbose,
+// the stale block has no confirmation and no time
+type RawTransactionInfo struct {
+	InActiveChain *bool `json:"in_active_chain,omitempty"`
+	*TxInfo
+	Hex           string `json:"hex"`
+	BlockHash     string `json:"blockhash"`
+	Confirmations int64  `json:"confirmations"`
+	Time          uint32 `json:"time,omitempty"`
+	BlockTime     uint32 `json:"blocktime,omitempty"`
+}
+
+// UtxoInfo is the gettxout json of bitcoin core
+type UtxoInfo struct {
+	BestBlock     string           `json:"bestblock"`
+	Confirmations uint32           `json:"confirmations"`
+	Value         BitcoinAmount    `json:"value"`
+	ScriptPubKey  ScriptPubKeyInfo `json:"scriptPubKey"`
+	CoinBase      bool             `json:"coinbase"`
+}
+
+func getUtxoInfo(utxoRecord *UtxoRecord) *UtxoInfo {
+	utxoInfo := new(UtxoInfo)
+	tipHeight, _ := getStoredTip()
+	utxoInfo.BestBlock, _ = getStoredBlockHash(tipHeight)
+	utxoInfo.Confirmations = tipHeight - utxoRecord.BlockHeight + 1
+	utxoInfo.Value = BitcoinAmount(utxoRecord.Value)
+	utxoInfo.ScriptPubKey = getScriptPubKeyInfo(utxoRecord.ScriptPubKey)
+	utxoInfo.CoinBase = utxoRecord.CoinBase
+	return utxoInfo
+}
+
+// getDifficulty returns the difficulty of the nBits relative to the minimum difficulty 0x1d00ffff
+func getDifficulty(bits uint32) float64 {
+	if bits&0x00ffffff == 0 {
+		return 0
+	}
+	shift := (bits >> 24) & 0xff
+	difficulty := float64(0x0000ffff) / float64(bits&0x00ffffff)
+	for shift < 29 {
+		difficulty *= 256.0
+		shift++
+	}
+	for shift > 29 {
+		difficulty /= 256.0
+		shift--
+	}
+	if math.IsInf(difficulty, 0) {
+		return 0
+	}
+	return difficulty
+}
+
+func calcHashHex(data []byte) string {
+	var hash bigint.Uint256
+	_ = hash.SetData(calcDoubleSha256(data))
+	return hash.GetHex()
+}
+
+func isCoinBase(tx *transaction.Transaction) bool {
+	if len(tx.Vin) != 1 || tx.Vin[0].PrevOut.N != 0xffffffff {
+		return false
+	}
+	for _, b := range tx.Vin[0].PrevOut.Hash.GetData() {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// packTransaction returns the serialization of the transaction with and without the witness
+func packTransaction(tx *transaction.Transaction) ([]byte, []byte, error) {
+	txBuf := bytes.NewBuffer([]byte{})
+	err := tx.Pack(txBuf)
+	if err != nil {
+		return nil, nil, err
+	}
+	strippedTxBuf := bytes.NewBuffer([]byte{})
+	err = tx.PackNoWitness(strippedTxBuf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return txBuf.Bytes(), strippedTxBuf.Bytes(), nil
+}
+
+func getScriptPubKeyInfo(scriptBytes []byte) ScriptPubKeyInfo {
+	scriptType, solutions := solveScript(scriptBytes)
+	address := getScriptAddress(scriptType, solutions)
+	scriptPubKeyInfo := ScriptPubKeyInfo{}
+	scriptPubKeyInfo.Asm = scriptToAsm(scriptBytes, false)
+	scriptPubKeyInfo.Desc = inferDescriptor(scriptBytes, scriptType, solutions, address)
+	scriptPubKeyInfo.Hex = hex.EncodeToString(scriptBytes)
+	scriptPubKeyInfo.Address = address
+	scriptPubKeyInfo.Type = scriptType
+	return scriptPubKeyInfo
+}
+
+func getTxInfo(tx *transaction.Transaction) (*TxInfo, error) {
+	txBytes, strippedTxBytes, err := packTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+	txInfo := new(TxInfo)
+	txInfo.TxId = calcHashHex(strippedTxBytes)
+	txInfo.Hash = calcHashHex(txBytes)
+	txInfo.Version = tx.Version
+	txInfo.Size = len(txBytes)
+	txInfo.Weight = len(strippedTxBytes)*(WitnessScaleFactor-1) + len(txBytes)
+	txInfo.VSize = (txInfo.Weight + WitnessScaleFactor - 1) / WitnessScaleFactor
+	txInfo.LockTime = tx.LockTime
+
+	coinBase := isCoinBase(tx)
+	txInfo.Vin = make([]TxInInfo, 0, len(tx.Vin))
+	for _, txIn := range tx.Vin {
+		txInInfo := TxInInfo{Sequence: txIn.Sequence}
+		if coinBase {
+			txInInfo.Coinbase = hex.EncodeToString(txIn.ScriptSig.GetScriptBytes())
+		} else {
+			prevOutN := txIn.PrevOut.N
+			txInInfo.TxId = txIn.PrevOut.Hash.GetHex()
+			txInInfo.Vout = &prevOutN
+			scriptSigBytes := txIn.ScriptSig.GetScriptBytes()
+			txInInfo.ScriptSig = &ScriptSigInfo{Asm: scriptToAsm(scriptSigBytes, true), Hex: hex.EncodeToString(scriptSigBytes)}
+		}
+		for _, witnessItem := range txIn.ScriptWitness.GetScriptWitnessBytes() {
+			txInInfo.TxInWitness = append(txInInfo.TxInWitness, hex.EncodeToString(witnessItem))
+		}
+		txInfo.Vin = append(txInfo.Vin, txInInfo)
+	}
+	txInfo.Vout = make([]TxOutInfo, 0, len(tx.Vout))
+	for n, txOut := range tx.Vout {
+		txOutInfo := TxOutInfo{Value: BitcoinAmount(txOut.Value), N: uint32(n)}
+		txOutInfo.ScriptPubKey = getScriptPubKeyInfo(txOut.ScriptPubKey.GetScriptBytes())
+		txInfo.Vout = append(txInfo.Vout, txOutInfo)
+	}
+	txInfo.Hex = hex.EncodeToString(txBytes)
+	return txInfo, nil
+}
+
+// getRawTransactionInfo fills the transaction json of the raw transaction data in the block
+func getRawTransactionInfo(txData []byte, blockHash string, blockHeight uint32, blockTime uint32, stale bool, verbose bool) (*RawTransactionInfo, error) {
+	txResult := new(RawTransactionInfo)
+	if verbose {
+		tx, err := unpackChainTransaction(bytes.NewReader(txData))
+		if err != nil {
+			return nil, err
+		}
+		txResult.TxInfo, err = getTxInfo(&tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	txResult.Hex = hex.EncodeToString(txData)
+	txResult.BlockHash = blockHash
+	if !stale {
+		tipHeight, _ := getStoredTip()
+		txResult.Confirmations = int64(tipHeight) - int64(blockHeight) + 1
+		txResult.Time = blockTime
+		txResult.BlockTime = blockTime
+	}
+	return txResult, nil
+}
+
+// getBlockHeaderInfo fills the header json of the block header, the stale block has no confirmation
+func getBlockHeaderInfo(blockHash string, blockHeight uint32, blockHeader *block.BlockHeader, txCount int, stale bool) (*BlockHeaderInfo, error) {
+	medianTime, err := chainStateMgr.GetMedianTimePast(blockHeight, blockHeader.Time)
+	if err != nil {
+		return nil, err
+	}
+	chainWork, err := chainStateMgr.GetChainWork(blockHeight, blockHeader.Bits)
+	if err != nil {
+		return nil, err
+	}
+
+	headerInfo := new(BlockHeaderInfo)
+	headerInfo.Hash = blockHash
+	headerInfo.Confirmations = -1
+	if !stale {
+		tipHeight, _ := getStoredTip()
+		headerInfo.Confirmations = int64(tipHeight) - int64(blockHeight) + 1
+	}
+	headerInfo.Height = blockHeight
+	headerInfo.Version = blockHeader.Version
+	headerInfo.VersionHex = fmt.Sprintf("%08x", uint32(blockHeader.Version))
+	headerInfo.MerkleRoot = blockHeader.HashMerkleRoot.GetHex()
+	headerInfo.Time = blockHeader.Time
+	headerInfo.MedianTime = medianTime
+	headerInfo.Nonce = blockHeader.Nonce
+	headerInfo.Bits = fmt.Sprintf("%08x", blockHeader.Bits)
+	headerInfo.Difficulty = getDifficulty(blockHeader.Bits)
+	headerInfo.ChainWork = fmt.Sprintf("%064x", chainWork)
+	headerInfo.NTx = txCount
+	if blockHeight != GenesisBlockHeight {
+		headerInfo.PreviousBlockHash = blockHeader.HashPrevBlock.GetHex()
+	}
+	if !stale {
+		headerInfo.NextBlockHash, _ = getStoredBlockHash(blockHeight + 1)
+	}
+	return headerInfo, nil
+}
+
+// getBlockInfo fills the block json of the decompressed raw block, verbosity 1 lists the txids, 2 decodes the transactions
+func getBlockInfo(ptrRawBlock *RawBlock, chainBlock *ChainBlock, stale bool, verbosity int) (*BlockInfo, error) {
+	headerInfo, err := getBlockHeaderInfo(ptrRawBlock.BlockHash.GetHex(), ptrRawBlock.BlockHeight, &chainBlock.Header, len(chainBlock.Vtx), stale)
+	if err != nil {
+		return nil, err
+	}
+	blockInfo := new(BlockInfo)
+	blockInfo.BlockHeaderInfo = *headerInfo
+	blockInfo.Size = len(ptrRawBlock.RawBlockData.GetData())
+	blockInfo.StrippedSize = blockInfo.Size
+
+	txIds := make([]string, 0, len(chainBlock.Vtx))
+	txInfos := make([]*TxInfo, 0, len(chainBlock.Vtx))
+	for i := range chainBlock.Vtx {
+		txInfo, err := getTxInfo(&chainBlock.Vtx[i])
+		if err != nil {
+			return nil, err
+		}
+		// the stripped size leaves out the witness of every transaction
+		blockInfo.StrippedSize -= txInfo.Size - (txInfo.Weight-txInfo.Size)/(WitnessScaleFactor-1)
+		txIds = append(txIds, txInfo.TxId)
+		txInfos = append(txInfos, txInfo)
+	}
+	blockInfo.Weight = blockInfo.StrippedSize*(WitnessScaleFactor-1) + blockInfo.Size
+	if verbosity >= 2 {
+		blockInfo.Tx = txInfos
+	} else {
+		blockInfo.Tx = txIds
+	}
+	return blockInfo, nil
+}
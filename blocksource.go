@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/ybbus/jsonrpc"
+)
+
+const (
+	BlockSourceRpc = "rpc"
+	BlockSourceP2P = "p2p"
+)
+
+// BlockSource is the upstream the blocks are gathered from, the errors of the calls are *RpcCallError
+type BlockSource interface {
+	GetBlockCount() (uint32, error)
+	GetBlockHash(blockHeight uint32) (string, error)
+	// GetBlockHashes returns the hashes and the error of each height, or an error if the whole call failed
+	GetBlockHashes(blockHeights []uint32) ([]string, []error, error)
+	GetRawBlock(blockHash string) ([]byte, error)
+	// GetRawBlocks returns the raw blocks and the error of each hash, or an error if the whole call failed
+	GetRawBlocks(blockHashes []string) ([][]byte, []error, error)
+}
+
+var blockSource BlockSource = nil
+
+func initBlockSource() error {
+	switch config.RpcClientConfig.BlockSource {
+	case "", BlockSourceRpc:
+		upstreamBlockSource, err := newUpstreamBlockSource()
+		if err != nil {
+			return err
+		}
+		blockSource = upstreamBlockSource
+	case BlockSourceP2P:
+		p2pBlockSource, err := newP2PBlockSource(config.RpcClientConfig.P2PPeer, networkParams)
+		if err != nil {
+			return err
+		}
+		blockSource = p2pBlockSource
+	default:
+		return errors.New("unknown block source: " + config.RpcClientConfig.BlockSource)
+	}
+	return nil
+}
+
+// RpcBlockSource gathers the blocks through the json rpc of bitcoind
+type RpcBlockSource struct {
+	RpcClient jsonrpc.RPCClient
+}
+
+func newRpcBlockSource(rpcReqUrl string) *RpcBlockSource {
+	s := new(RpcBlockSource)
+	s.RpcClient = newJsonRpcClient(rpcReqUrl)
+	return s
+}
+
+func (s *RpcBlockSource) GetBlockCount() (uint32, error) {
+	return getBlockCountRpc(s.RpcClient)
+}
+
+func (s *RpcBlockSource) GetBlockHash(blockHeight uint32) (string, error) {
+	return getBlockHashRpc(s.RpcClient, blockHeight)
+}
+
+func (s *RpcBlockSource) GetBlockHashes(blockHeights []uint32) ([]string, []error, error) {
+	return getBlockHashesRpc(s.RpcClient, blockHeights)
+}
+
+func (s *RpcBlockSource) GetRawBlock(blockHash string) ([]byte, error) {
+	rawBlockHex, err := getRawBlock(s.RpcClient, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	rawBlockData, err := hex.DecodeString(rawBlockHex)
+	if err != nil {
+		return nil, newMalformedRpcError("getblock", err)
+	}
+	return rawBlockData, nil
+}
+
+func (s *RpcBlockSource) GetRawBlocks(blockHashes []string) ([][]byte, []error, error) {
+	rawBlockHexes, errs, err := getRawBlocksRpc(s.RpcClient, blockHashes)
+	if err != nil {
+		return nil, nil, err
+	}
+	rawBlocks := make([][]byte, len(blockHashes))
+	for i, rawBlockHex := range rawBlockHexes {
+		if errs[i] != nil {
+			continue
+		}
+		rawBlocks[i], err = hex.DecodeString(rawBlockHex)
+		if err != nil {
+			errs[i] = newMalformedRpcError("getblock", err)
+		}
+	}
+	return rawBlocks, errs, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mutalisk999/bitcoin-lib/src/block"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"github.com/mutalisk999/bitcoin-lib/src/transaction"
+	"golang.org/x/crypto/scrypt"
+	"io"
+)
+
+const (
+	TxFlagWitness = 1
+	// litecoin marks the hogex and the mweb transactions
+	TxFlagMweb = 8
+)
+
+// ChainBlock is a block parsed by the parameters of the chain
+type ChainBlock struct {
+	Header      block.BlockHeader
+	HeaderBytes []byte
+	// the auxpow of a merge mined block, nil for the others
+	AuxPow *AuxPow
+	Vtx    []transaction.Transaction
+	// the litecoin mweb extension block after the transactions
+	ExtensionData []byte
+}
+
+func isAuxPowVersion(version int32) bool {
+	return networkParams.AuxPowChainId != 0 && version&AuxPowVersionFlag != 0
+}
+
+// unpackChainHeader reads the 80 bytes header, and the auxpow following it on the merge mined chains
+func unpackChainHeader(reader io.Reader) (block.BlockHeader, []byte, *AuxPow, error) {
+	var blockHeader block.BlockHeader
+	headerBytes := make([]byte, BlockHeaderSize)
+	_, err := io.ReadFull(reader, headerBytes)
+	if err != nil {
+		return blockHeader, nil, nil, err
+	}
+	err = blockHeader.UnPack(bytes.NewReader(headerBytes))
+	if err != nil {
+		return blockHeader, nil, nil, err
+	}
+	if !isAuxPowVersion(blockHeader.Version) {
+		return blockHeader, headerBytes, nil, nil
+	}
+	auxPow := new(AuxPow)
+	err = auxPow.UnPack(reader)
+	if err != nil {
+		return blockHeader, nil, nil, err
+	}
+	return blockHeader, headerBytes, auxPow, nil
+}
+
+// unpackChainTransaction reads a transaction, the litecoin transactions may carry the mweb flag
+func unpackChainTransaction(reader io.Reader) (transaction.Transaction, error) {
+	var tx transaction.Transaction
+	if !networkParams.ExtensionBlock {
+		err := tx.UnPack(reader)
+		return tx, err
+	}
+
+	var err error
+	var flags uint8 = 0
+	tx.Version, err = serialize.UnPackInt32(reader)
+	if err != nil {
+		return tx, err
+	}
+	tx.Vin, err = unpackTxIns(reader)
+	if err != nil {
+		return tx, err
+	}
+	if len(tx.Vin) == 0 {
+		flags, err = serialize.UnPackUint8(reader)
+		if err != nil {
+			return tx, err
+		}
+		if flags != 0 {
+			tx.Vin, err = unpackTxIns(reader)
+			if err != nil {
+				return tx, err
+			}
+		}
+	}
+	tx.Vout, err = unpackTxOuts(reader)
+	if err != nil {
+		return tx, err
+	}
+	if flags&TxFlagWitness != 0 {
+		flags ^= TxFlagWitness
+		for i := 0; i < len(tx.Vin); i++ {
+			err = tx.Vin[i].ScriptWitness.UnPack(reader)
+			if err != nil {
+				return tx, err
+			}
+		}
+	}
+	if flags&TxFlagMweb != 0 {
+		flags ^= TxFlagMweb
+		// the mweb transaction body is only carried outside of the blocks, the hogex has none
+		hasMwebTx, err := serialize.UnPackUint8(reader)
+		if err != nil {
+			return tx, err
+		}
+		if hasMwebTx != 0 {
+			return tx, errors.New("mweb transaction body in block is not supported")
+		}
+	}
+	if flags != 0 {
+		return tx, errors.New("unknown transaction option data")
+	}
+	tx.LockTime, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return tx, err
+	}
+	return tx, nil
+}
+
+func unpackTxIns(reader io.Reader) ([]transaction.TxIn, error) {
+	count, err := serialize.UnPackCompactSize(reader)
+	if err != nil {
+		return nil, err
+	}
+	txIns := make([]transaction.TxIn, count)
+	for i := range txIns {
+		err = txIns[i].UnPack(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return txIns, nil
+}
+
+func unpackTxOuts(reader io.Reader) ([]transaction.TxOut, error) {
+	count, err := serialize.UnPackCompactSize(reader)
+	if err != nil {
+		return nil, err
+	}
+	txOuts := make([]transaction.TxOut, count)
+	for i := range txOuts {
+		err = txOuts[i].UnPack(reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return txOuts, nil
+}
+
+func unpackChainBlock(rawBlockData []byte) (*ChainBlock, error) {
+	var err error
+	chainBlock := new(ChainBlock)
+	blockReader := bytes.NewReader(rawBlockData)
+	chainBlock.Header, chainBlock.HeaderBytes, chainBlock.AuxPow, err = unpackChainHeader(blockReader)
+	if err != nil {
+		return nil, err
+	}
+	txCount, err := serialize.UnPackCompactSize(blockReader)
+	if err != nil {
+		return nil, err
+	}
+	if txCount > uint64(blockReader.Len()) {
+		return nil, errors.New("invalid transaction count")
+	}
+	chainBlock.Vtx = make([]transaction.Transaction, txCount)
+	for i := range chainBlock.Vtx {
+		chainBlock.Vtx[i], err = unpackChainTransaction(blockReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if blockReader.Len() != 0 {
+		if !networkParams.ExtensionBlock {
+			return nil, errors.New("unexpected data after the last transaction")
+		}
+		chainBlock.ExtensionData = rawBlockData[len(rawBlockData)-blockReader.Len():]
+	}
+	return chainBlock, nil
+}
+
+func calcPowHash(headerBytes []byte) ([]byte, error) {
+	if networkParams.PowAlgo == PowAlgoScrypt {
+		return scrypt.Key(headerBytes[0:BlockHeaderSize], headerBytes[0:BlockHeaderSize], 1024, 1, 1, 32)
+	}
+	return calcDoubleSha256(headerBytes[0:BlockHeaderSize]), nil
+}
+
+// checkChainProofOfWork checks the proof of work of the header, or of the parent block of the auxpow
+func checkChainProofOfWork(headerBytes []byte, blockHeader *block.BlockHeader, auxPow *AuxPow) error {
+	if networkParams.AuxPowChainId != 0 && networkParams.StrictChainId {
+		chainId := blockHeader.Version >> 16
+		legacy := blockHeader.Version == 1 || (blockHeader.Version == 2 && chainId == 0)
+		if !legacy && chainId != networkParams.AuxPowChainId {
+			return errors.New("block does not have our chain id")
+		}
+	}
+	if auxPow == nil {
+		if isAuxPowVersion(blockHeader.Version) {
+			return errors.New("auxpow flag without auxpow")
+		}
+		powHash, err := calcPowHash(headerBytes)
+		if err != nil {
+			return err
+		}
+		return checkProofOfWork(powHash, blockHeader.Bits)
+	}
+	err := auxPow.Check(calcDoubleSha256(headerBytes[0:BlockHeaderSize]), networkParams.AuxPowChainId, networkParams.StrictChainId)
+	if err != nil {
+		return err
+	}
+	powHash, err := calcPowHash(auxPow.ParentHeaderBytes)
+	if err != nil {
+		return err
+	}
+	return checkProofOfWork(powHash, blockHeader.Bits)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/mutalisk999/bitcoin-lib/src/blob"
+	"github.com/mutalisk999/bitcoin-lib/src/block"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"strings"
+	"testing"
+)
+
+func TestScryptProofOfWork(t *testing.T) {
+	// the genesis headers of the scrypt chains, with the scrypt hashes known from the chains
+	tests := []struct {
+		chain   string
+		network string
+		header  string
+		powHash string
+	}{
+		{"litecoin", "mainnet",
+			"010000000000000000000000000000000000000000000000000000000000000000000000d9ced4ed1130f7b7faad9be25323ffafa33232a17c3edf6cfd97bee6bafbdd97b9aa8e4ef0ff0f1ecd513f7c",
+			"0000050c34a64b415b6b15b37f2216634b5b1669cb9a2e38d76f7213b0671e00"},
+		{"litecoin", "testnet4",
+			"010000000000000000000000000000000000000000000000000000000000000000000000d9ced4ed1130f7b7faad9be25323ffafa33232a17c3edf6cfd97bee6bafbdd97f60ba158f0ff0f1ee1790400",
+			"000006cc0225c4b4c387604dd670b1ff4b95af0f46f86bef805c0d085b60de64"},
+		{"dogecoin", "mainnet",
+			"010000000000000000000000000000000000000000000000000000000000000000000000696ad20e2dd4365c7459b4a4a5af743d5e92c6da3229e6532cd605f6533f2a5b24a6a152f0ff0f1e67860100",
+			"0000026f3f7874ca0c251314eaed2d2fcf83d7da3acfaacf59417d485310b448"},
+		{"dogecoin", "testnet3",
+			"010000000000000000000000000000000000000000000000000000000000000000000000696ad20e2dd4365c7459b4a4a5af743d5e92c6da3229e6532cd605f6533f2a5bb9a7f052f0ff0f1ef7390f00",
+			"000006f85d58f35abaf699e775011c29304e122079153181b78534fbfd574ea7"},
+	}
+	for _, test := range tests {
+		useTestNetwork(t, test.chain, test.network)
+		headerBytes := mustDecodeHex(t, test.header)
+		if calcBlockHash(headerBytes) != networkParams.GenesisHash {
+			t.Fatalf("%s %s: unexpected genesis hash %s", test.chain, test.network, calcBlockHash(headerBytes))
+		}
+		powHash, err := calcPowHash(headerBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(blob.DataReverse(powHash)) != test.powHash {
+			t.Errorf("%s %s: scrypt hash %x", test.chain, test.network, blob.DataReverse(powHash))
+		}
+		blockHeader, _, auxPow, err := unpackChainHeader(bytes.NewReader(headerBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkChainProofOfWork(headerBytes, &blockHeader, auxPow)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.chain, test.network, err)
+		}
+		// the sha256d hash of the header does not meet the target
+		err = checkProofOfWork(calcDoubleSha256(headerBytes), blockHeader.Bits)
+		if err == nil {
+			t.Errorf("%s %s: sha256d hash accepted as the proof of work", test.chain, test.network)
+		}
+	}
+}
+
+// buildTestMergedMiningScript commits the chain merkle root in the coinbase script of the parent block
+func buildTestMergedMiningScript(prefix []byte, withHeader bool, childHash []byte, merkleSize uint32, nonce uint32) []byte {
+	script := bytes.NewBuffer(append([]byte{}, prefix...))
+	if withHeader {
+		script.Write(mergedMiningHeader)
+	}
+	script.Write(blob.DataReverse(childHash))
+	_ = serialize.PackUint32(script, merkleSize)
+	_ = serialize.PackUint32(script, nonce)
+	return script.Bytes()
+}
+
+// buildTestAuxPow builds the auxpow of a parent block with the coinbase script, the scrypt hash of the parent
+// header meets the regtest target or not
+func buildTestAuxPow(t *testing.T, scriptSig []byte, parentVersion uint32, parentPow bool) []byte {
+	coinbase := buildTestTx(make([]byte, 32), 0xffffffff, scriptSig, testTxOut{1, []byte{0x51}})
+	var parentHeader []byte
+	for nonce := uint32(0); ; nonce++ {
+		parentHeader = buildTestHeader(strings.Repeat("11", 32), calcTestTxId(coinbase), 1296688602, regtestBits, nonce)
+		binary.LittleEndian.PutUint32(parentHeader[0:4], parentVersion)
+		powHash, err := calcPowHash(parentHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (checkProofOfWork(powHash, regtestBits) == nil) == parentPow {
+			break
+		}
+		if nonce == 1000 {
+			t.Fatal("mine parent header failed")
+		}
+	}
+	auxPow := bytes.NewBuffer(append([]byte{}, coinbase...))
+	auxPow.Write(make([]byte, 32))
+	_ = serialize.PackCompactSize(auxPow, 0)
+	_ = serialize.PackInt32(auxPow, 0)
+	_ = serialize.PackCompactSize(auxPow, 0)
+	_ = serialize.PackInt32(auxPow, 0)
+	auxPow.Write(parentHeader)
+	return auxPow.Bytes()
+}
+
+// the auxpow vectors are built here, as the merge mined blocks of dogecoin are not at hand offline
+func TestAuxPowProofOfWork(t *testing.T) {
+	useTestNetwork(t, "dogecoin", "regtest")
+	height := []byte{4, 1, 0, 0, 0}
+	auxPowVersion := uint32(0x00620104)
+	tests := []struct {
+		name          string
+		version       uint32
+		withAuxPow    bool
+		scriptSig     func(childHash []byte) []byte
+		parentVersion uint32
+		parentPow     bool
+		mutate        func(auxPow *AuxPow)
+		err           string
+	}{
+		{"auxpow", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, true, childHash, 1, 0)
+		}, 0x20000000, true, nil, ""},
+		{"root without header", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, false, childHash, 1, 0)
+		}, 0x20000000, true, nil, ""},
+		{"parent proof of work", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, true, childHash, 1, 0)
+		}, 0x20000000, false, nil, "proof of work failed"},
+		{"other block", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, true, make([]byte, 32), 1, 0)
+		}, 0x20000000, true, nil, "missing chain merkle root"},
+		{"root after 20 bytes", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(make([]byte, 21), false, childHash, 1, 0)
+		}, 0x20000000, true, nil, "first 20 bytes"},
+		{"multiple headers", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(append(append([]byte{}, height...), mergedMiningHeader...), true, childHash, 1, 0)
+		}, 0x20000000, true, nil, "multiple merged mining headers"},
+		{"merkle size", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, true, childHash, 2, 0)
+		}, 0x20000000, true, nil, "size does not match"},
+		{"parent chain id", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, true, childHash, 1, 0)
+		}, 0x00620000, true, nil, "parent has our chain id"},
+		{"not generate", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, true, childHash, 1, 0)
+		}, 0x20000000, true, func(auxPow *AuxPow) {
+			auxPow.CoinbaseIndex = 1
+		}, "not a generate"},
+		{"coinbase branch", auxPowVersion, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, true, childHash, 1, 0)
+		}, 0x20000000, true, func(auxPow *AuxPow) {
+			auxPow.CoinbaseBranch = [][]byte{make([]byte, 32)}
+		}, "merkle root incorrect"},
+		{"other chain id", 0x00630104, true, func(childHash []byte) []byte {
+			return buildTestMergedMiningScript(height, true, childHash, 1, 0)
+		}, 0x20000000, true, nil, "does not have our chain id"},
+		{"flag without auxpow", auxPowVersion, false, nil, 0, false, nil, "auxpow flag without auxpow"},
+	}
+	for _, test := range tests {
+		header := buildTestHeader(strings.Repeat("22", 32), make([]byte, 32), 1296688602, regtestBits, 0)
+		binary.LittleEndian.PutUint32(header[0:4], test.version)
+		var auxPow *AuxPow
+		var headerBytes []byte
+		if test.withAuxPow {
+			rawHeader := append(append([]byte{}, header...), buildTestAuxPow(t, test.scriptSig(calcDoubleSha256(header)), test.parentVersion, test.parentPow)...)
+			blockHeader, unpackedHeader, unpackedAuxPow, err := unpackChainHeader(bytes.NewReader(rawHeader))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unpackedAuxPow == nil || uint32(blockHeader.Version) != test.version {
+				t.Fatalf("%s: auxpow not unpacked", test.name)
+			}
+			auxPow = unpackedAuxPow
+			headerBytes = unpackedHeader
+		} else {
+			headerBytes = header
+		}
+		if test.mutate != nil {
+			test.mutate(auxPow)
+		}
+		var blockHeader block.BlockHeader
+		err := blockHeader.UnPack(bytes.NewReader(headerBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkChainProofOfWork(headerBytes, &blockHeader, auxPow)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
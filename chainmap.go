@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+)
+
+// chainMapMutex guards the height and hash maps of the stored chain and its tip, the rpc goroutines and the fetch
+// workers read them while the gatherer extends or rolls back the chain
+var chainMapMutex = new(sync.RWMutex)
+
+// getStoredBlockHash returns the hash of the stored block at the height
+func getStoredBlockHash(blockHeight uint32) (string, bool) {
+	chainMapMutex.RLock()
+	defer chainMapMutex.RUnlock()
+	blockHash, ok := heightToHashMap[blockHeight]
+	return blockHash, ok
+}
+
+// getStoredBlockHeight returns the height of the stored block of the hash
+func getStoredBlockHeight(blockHash string) (uint32, bool) {
+	chainMapMutex.RLock()
+	defer chainMapMutex.RUnlock()
+	blockHeight, ok := hashToHeightMap[blockHash]
+	return blockHeight, ok
+}
+
+// getStoredTip returns the height of the latest stored block and the stored block count
+func getStoredTip() (uint32, uint32) {
+	chainMapMutex.RLock()
+	defer chainMapMutex.RUnlock()
+	return latestRawBlockMgr.BlockHeight, latestRawBlockMgr.BlockCount
+}
+
+// addStoredBlock adds the block stored at the next height to the maps, and makes it the tip
+func addStoredBlock(blockHeight uint32, blockHash string) {
+	chainMapMutex.Lock()
+	defer chainMapMutex.Unlock()
+	heightToHashMap[blockHeight] = blockHash
+	hashToHeightMap[blockHash] = blockHeight
+	latestRawBlockMgr.BlockHeight = blockHeight
+	latestRawBlockMgr.BlockCount = blockHeight + 1
+}
+
+// removeStoredBlocks removes the blocks above the fork height from the maps, and makes the fork block the tip
+func removeStoredBlocks(forkHeight uint32) {
+	chainMapMutex.Lock()
+	defer chainMapMutex.Unlock()
+	for height := forkHeight + 1; height <= latestRawBlockMgr.BlockHeight; height++ {
+		blockHash := heightToHashMap[height]
+		delete(heightToHashMap, height)
+		delete(hashToHeightMap, blockHash)
+	}
+	latestRawBlockMgr.BlockHeight = forkHeight
+	latestRawBlockMgr.BlockCount = forkHeight + 1
+}
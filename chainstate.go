@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mutalisk999/bitcoin-lib/src/block"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+const (
+	ChainWorkInterval = 2016
+	MedianTimeSpan    = 11
+)
+
+// ChainStateManager keeps the time and the nBits of the stored blocks in memory for the median time past
+// and the chain work, the headers are loaded on demand from the block header file
+type ChainStateManager struct {
+	blockTimes []uint32
+	blockBits  []uint32
+	// chainWorks[i] is the total work of the blocks below the height i*ChainWorkInterval
+	chainWorks      []*big.Int
+	chainStateMutex *sync.Mutex
+}
+
+var chainStateMgr *ChainStateManager
+
+func loadBlockHeader(blockHeight uint32) (*block.BlockHeader, error) {
+	headerData, err := blockHeaderMgr.GetBlockHeader(blockHeight)
+	if err != nil {
+		return nil, err
+	}
+	blockHeader := new(block.BlockHeader)
+	err = blockHeader.UnPack(bytes.NewReader(headerData))
+	if err != nil {
+		return nil, err
+	}
+	return blockHeader, nil
+}
+
+// getBlockWork returns 2**256 / (target+1), the expected number of hashes to find a block of the nBits
+func getBlockWork(bits uint32) *big.Int {
+	target := compactToTarget(bits)
+	if target == nil {
+		return big.NewInt(0)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+func (c *ChainStateManager) Init() {
+	c.chainStateMutex = new(sync.Mutex)
+	c.blockTimes = make([]uint32, 0)
+	c.blockBits = make([]uint32, 0)
+	c.chainWorks = []*big.Int{big.NewInt(0)}
+}
+
+// load reads the headers of the stored blocks below blockCount which are not loaded yet
+func (c *ChainStateManager) load(blockCount uint32) error {
+	if _, storedCount := getStoredTip(); blockCount > storedCount {
+		return errors.New("block height not found")
+	}
+	for height := uint32(len(c.blockTimes)); height < blockCount; height++ {
+		blockHeader, err := loadBlockHeader(height)
+		if err != nil {
+			return err
+		}
+		c.blockTimes = append(c.blockTimes, blockHeader.Time)
+		c.blockBits = append(c.blockBits, blockHeader.Bits)
+		if (height+1)%ChainWorkInterval == 0 {
+			chainWork := new(big.Int).Set(c.chainWorks[len(c.chainWorks)-1])
+			for _, bits := range c.blockBits[height+1-ChainWorkInterval:] {
+				chainWork.Add(chainWork, getBlockWork(bits))
+			}
+			c.chainWorks = append(c.chainWorks, chainWork)
+		}
+	}
+	return nil
+}
+
+// Truncate drops the loaded headers from the height blockCount, called when the blocks are rolled back
+func (c *ChainStateManager) Truncate(blockCount uint32) {
+	c.chainStateMutex.Lock()
+	defer c.chainStateMutex.Unlock()
+	if uint32(len(c.blockTimes)) <= blockCount {
+		return
+	}
+	c.blockTimes = c.blockTimes[0:blockCount]
+	c.blockBits = c.blockBits[0:blockCount]
+	c.chainWorks = c.chainWorks[0 : blockCount/ChainWorkInterval+1]
+}
+
+// GetMedianTimePast returns the median time of the block and the 10 stored blocks below its height,
+// the block itself is given by its time, so that a stale block is measured on top of the stored chain
+func (c *ChainStateManager) GetMedianTimePast(blockHeight uint32, blockTime uint32) (uint32, error) {
+	c.chainStateMutex.Lock()
+	defer c.chainStateMutex.Unlock()
+	err := c.load(blockHeight)
+	if err != nil {
+		return 0, err
+	}
+	var startHeight uint32 = 0
+	if blockHeight >= MedianTimeSpan {
+		startHeight = blockHeight + 1 - MedianTimeSpan
+	}
+	blockTimes := make([]uint32, 0, MedianTimeSpan)
+	blockTimes = append(blockTimes, c.blockTimes[startHeight:blockHeight]...)
+	blockTimes = append(blockTimes, blockTime)
+	sort.Slice(blockTimes, func(i, j int) bool { return blockTimes[i] < blockTimes[j] })
+	return blockTimes[len(blockTimes)/2], nil
+}
+
+// GetChainWork returns the total work of the stored blocks below the block height and the block of the nBits
+func (c *ChainStateManager) GetChainWork(blockHeight uint32, bits uint32) (*big.Int, error) {
+	c.chainStateMutex.Lock()
+	defer c.chainStateMutex.Unlock()
+	err := c.load(blockHeight)
+	if err != nil {
+		return nil, err
+	}
+	intervalHeight := blockHeight / ChainWorkInterval * ChainWorkInterval
+	chainWork := new(big.Int).Set(c.chainWorks[blockHeight/ChainWorkInterval])
+	for _, blockBits := range c.blockBits[intervalHeight:blockHeight] {
+		chainWork.Add(chainWork, getBlockWork(blockBits))
+	}
+	return chainWork.Add(chainWork, getBlockWork(bits)), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressedTypeNone   = 0
+	CompressedTypeZstd   = 1
+	CompressedTypeSnappy = 2
+)
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+func getCompressedType(compressedTypeName string) (byte, error) {
+	if compressedTypeName == "" || compressedTypeName == "none" {
+		return CompressedTypeNone, nil
+	} else if compressedTypeName == "zstd" {
+		return CompressedTypeZstd, nil
+	} else if compressedTypeName == "snappy" {
+		return CompressedTypeSnappy, nil
+	}
+	return CompressedTypeNone, errors.New("not support compressed type: " + compressedTypeName)
+}
+
+func compressData(compressedType byte, data []byte) ([]byte, error) {
+	if compressedType == CompressedTypeNone {
+		return data, nil
+	} else if compressedType == CompressedTypeZstd {
+		return zstdEncoder.EncodeAll(data, nil), nil
+	} else if compressedType == CompressedTypeSnappy {
+		return snappy.Encode(nil, data), nil
+	}
+	return nil, errors.New("unknown compressed type")
+}
+
+func decompressData(compressedType byte, data []byte) ([]byte, error) {
+	if compressedType == CompressedTypeNone {
+		return data, nil
+	} else if compressedType == CompressedTypeZstd {
+		return zstdDecoder.DecodeAll(data, nil)
+	} else if compressedType == CompressedTypeSnappy {
+		return snappy.Decode(nil, data)
+	}
+	return nil, errors.New("unknown compressed type")
+}
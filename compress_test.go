@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestGetCompressedType(t *testing.T) {
+	tests := []struct {
+		name           string
+		compressedType byte
+		ok             bool
+	}{
+		{"", CompressedTypeNone, true},
+		{"none", CompressedTypeNone, true},
+		{"zstd", CompressedTypeZstd, true},
+		{"snappy", CompressedTypeSnappy, true},
+		{"gzip", CompressedTypeNone, false},
+	}
+	for _, test := range tests {
+		compressedType, err := getCompressedType(test.name)
+		if (err == nil) != test.ok || compressedType != test.compressedType {
+			t.Errorf("getCompressedType(%q) = %d, %v", test.name, compressedType, err)
+		}
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomData := make([]byte, 100000)
+	random.Read(randomData)
+	datas := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("raw block"),
+		"repetitive": bytes.Repeat([]byte{0x00, 0x01, 0x02, 0x03}, 50000),
+		"random":     randomData,
+	}
+	for _, compressedType := range []byte{CompressedTypeNone, CompressedTypeZstd, CompressedTypeSnappy} {
+		for name, data := range datas {
+			compressedData, err := compressData(compressedType, data)
+			if err != nil {
+				t.Fatalf("compress %s with type %d: %v", name, compressedType, err)
+			}
+			decompressedData, err := decompressData(compressedType, compressedData)
+			if err != nil {
+				t.Fatalf("decompress %s with type %d: %v", name, compressedType, err)
+			}
+			if !bytes.Equal(decompressedData, data) {
+				t.Errorf("round trip of %s with type %d not match", name, compressedType)
+			}
+			if name == "repetitive" && compressedType != CompressedTypeNone && len(compressedData) >= len(data)/10 {
+				t.Errorf("repetitive data not compressed with type %d: %d bytes", compressedType, len(compressedData))
+			}
+		}
+	}
+}
+
+func TestDecompressInvalidData(t *testing.T) {
+	for _, compressedType := range []byte{CompressedTypeZstd, CompressedTypeSnappy} {
+		_, err := decompressData(compressedType, []byte("not compressed data"))
+		if err == nil {
+			t.Errorf("invalid data decompressed with type %d", compressedType)
+		}
+	}
+	_, err := compressData(0x7f, []byte{})
+	if err == nil {
+		t.Error("unknown compressed type accepted")
+	}
+}
+
+func TestRawBlockCompress(t *testing.T) {
+	rawBlockData := bytes.Repeat([]byte("block"), 1000)
+	for _, compressedType := range []byte{CompressedTypeZstd, CompressedTypeSnappy} {
+		rawBlock := new(RawBlock)
+		rawBlock.RawBlockData.SetData(rawBlockData)
+		err := rawBlock.Compress(compressedType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rawBlock.CompressedType != compressedType || bytes.Equal(rawBlock.RawBlockData.GetData(), rawBlockData) {
+			t.Fatalf("raw block not compressed with type %d", compressedType)
+		}
+		err = rawBlock.Decompress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rawBlock.CompressedType != CompressedTypeNone || !bytes.Equal(rawBlock.RawBlockData.GetData(), rawBlockData) {
+			t.Fatalf("raw block not restored from type %d", compressedType)
+		}
+	}
+}
@@ -6,13 +6,53 @@ import (
 )
 
 type DataConfig struct {
+	Chain              string `json:"chain"`
+	Network            string `json:"network"`
 	DataDir            string `json:"dataDir"`
 	BlockIndexName     string `json:"blockIndexName"`
 	RawBlockFilePrefix string `json:"rawBlockFilePrefix"`
+	StaleBlockName     string `json:"staleBlockName"`
+	BlockHeaderName    string `json:"blockHeaderName"`
+	TxIndex            bool   `json:"txIndex"`
+	TxIndexName        string `json:"txIndexName"`
+	AddressIndex       bool   `json:"addressIndex"`
+	AddressIndexName   string `json:"addressIndexName"`
+	UtxoSet            bool   `json:"utxoSet"`
+	UtxoSetName        string `json:"utxoSetName"`
+	SpentIndex         bool   `json:"spentIndex"`
+	SpentIndexName     string `json:"spentIndexName"`
+	BlockFilterIndex   bool   `json:"blockFilterIndex"`
+	BlockFilterName    string `json:"blockFilterName"`
+	CompressedType     string `json:"compressedType"`
+	MaxFileSize        uint64 `json:"maxFileSize"`
+	MaxFileBlocks      uint32 `json:"maxFileBlocks"`
+	FileHeightAlign    uint32 `json:"fileHeightAlign"`
 }
 
-type RpcClientConfig struct {
+// UpstreamConfig is one bitcoind to gather from, the smaller priority value is preferred
+type UpstreamConfig struct {
 	RpcReqUrl string `json:"rpcReqUrl"`
+	Priority  int    `json:"priority"`
+}
+
+type RpcClientConfig struct {
+	BlockSource       string           `json:"blockSource"`
+	RpcReqUrl         string           `json:"rpcReqUrl"`
+	Upstreams         []UpstreamConfig `json:"upstreams"`
+	Quorum            int              `json:"quorum"`
+	MaxLag            uint32           `json:"maxLag"`
+	RpcTimeout        int              `json:"rpcTimeout"`
+	FetchWorkers      int              `json:"fetchWorkers"`
+	FetchAhead        int              `json:"fetchAhead"`
+	BatchSize         int              `json:"batchSize"`
+	RetryInitialDelay int              `json:"retryInitialDelay"`
+	RetryMaxDelay     int              `json:"retryMaxDelay"`
+	RetryMaxAttempts  int              `json:"retryMaxAttempts"`
+	RetryMaxDuration  int              `json:"retryMaxDuration"`
+	ZmqEndPoint       string           `json:"zmqEndPoint"`
+	ZmqTopic          string           `json:"zmqTopic"`
+	ZmqPollInterval   int              `json:"zmqPollInterval"`
+	P2PPeer           string           `json:"p2pPeer"`
 }
 
 type RpcServerConfig struct {
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"github.com/mutalisk999/go-lib/src/sched/goroutine_mgr"
+	"sync"
+)
+
+type FetchResult struct {
+	BlockHeight  uint32
+	BlockHash    string
+	RawBlockData []byte
+	Err          error
+}
+
+// BlockFetcher fetches blocks ahead of the tip with several workers, and hands them out strictly in height order
+type BlockFetcher struct {
+	nextHeight   uint32
+	commitHeight uint32
+	endHeight    uint32
+	results      map[uint32]*FetchResult
+	// bounds the number of blocks being fetched or waiting to be committed
+	slotChan   chan struct{}
+	quitChan   chan struct{}
+	stopped    bool
+	fetchMutex *sync.Mutex
+	fetchCond  *sync.Cond
+}
+
+func getFetchWorkers() int {
+	if config.RpcClientConfig.FetchWorkers <= 0 {
+		return 1
+	}
+	return config.RpcClientConfig.FetchWorkers
+}
+
+func getFetchAhead() int {
+	fetchWorkers := getFetchWorkers()
+	if config.RpcClientConfig.FetchAhead < fetchWorkers {
+		return fetchWorkers
+	}
+	return config.RpcClientConfig.FetchAhead
+}
+
+func startBlockFetcher(startHeight uint32, endHeight uint32) *BlockFetcher {
+	f := new(BlockFetcher)
+	f.nextHeight = startHeight
+	f.commitHeight = startHeight
+	f.endHeight = endHeight
+	f.results = make(map[uint32]*FetchResult)
+	f.slotChan = make(chan struct{}, getFetchAhead())
+	f.quitChan = make(chan struct{})
+	f.stopped = false
+	f.fetchMutex = new(sync.Mutex)
+	f.fetchCond = sync.NewCond(f.fetchMutex)
+	for i := 0; i < getFetchWorkers(); i++ {
+		goroutineMgr.GoroutineCreatePn("fetchblock", doFetchBlock, f)
+	}
+	return f
+}
+
+func doFetchBlock(goroutine goroutine_mgr.Goroutine, args ...interface{}) {
+	defer goroutine.OnQuit()
+	f := args[0].(*BlockFetcher)
+	for {
+		// wait for a free slot
+		select {
+		case <-f.quitChan:
+			return
+		case f.slotChan <- struct{}{}:
+		}
+
+		f.fetchMutex.Lock()
+		if f.stopped || f.nextHeight > f.endHeight {
+			f.fetchMutex.Unlock()
+			<-f.slotChan
+			return
+		}
+		blockHeights := []uint32{f.nextHeight}
+		f.nextHeight++
+		// claim more heights for one batch while slots are free
+		for len(blockHeights) < getBatchSize() && f.nextHeight <= f.endHeight {
+			claimed := false
+			select {
+			case f.slotChan <- struct{}{}:
+				claimed = true
+			default:
+			}
+			if !claimed {
+				break
+			}
+			blockHeights = append(blockHeights, f.nextHeight)
+			f.nextHeight++
+		}
+		f.fetchMutex.Unlock()
+
+		var fetchResults []*FetchResult
+		if len(blockHeights) == 1 {
+			fetchResults = []*FetchResult{fetchBlock(blockHeights[0])}
+		} else {
+			fetchResults = fetchBlockBatch(blockHeights)
+		}
+
+		f.fetchMutex.Lock()
+		for _, fetchResult := range fetchResults {
+			f.results[fetchResult.BlockHeight] = fetchResult
+		}
+		f.fetchCond.Broadcast()
+		f.fetchMutex.Unlock()
+	}
+}
+
+func fetchBlock(blockHeight uint32) *FetchResult {
+	fetchResult := new(FetchResult)
+	fetchResult.BlockHeight = blockHeight
+	fetchResult.BlockHash, fetchResult.Err = blockSource.GetBlockHash(blockHeight)
+	if fetchResult.Err == nil {
+		fetchResult.RawBlockData, fetchResult.Err = blockSource.GetRawBlock(fetchResult.BlockHash)
+	}
+	return fetchResult
+}
+
+// fetchBlockBatch fetches the hashes of the blocks in one call and then the blocks in one call, the error of each block is kept in its result
+func fetchBlockBatch(blockHeights []uint32) []*FetchResult {
+	fetchResults := make([]*FetchResult, 0, len(blockHeights))
+	for _, blockHeight := range blockHeights {
+		fetchResult := new(FetchResult)
+		fetchResult.BlockHeight = blockHeight
+		fetchResults = append(fetchResults, fetchResult)
+	}
+
+	blockHashes, errs, err := blockSource.GetBlockHashes(blockHeights)
+	if err != nil {
+		for _, fetchResult := range fetchResults {
+			fetchResult.Err = err
+		}
+		return fetchResults
+	}
+	hashResults := make([]*FetchResult, 0, len(fetchResults))
+	hashes := make([]string, 0, len(fetchResults))
+	for i, fetchResult := range fetchResults {
+		if errs[i] != nil {
+			fetchResult.Err = errs[i]
+			continue
+		}
+		fetchResult.BlockHash = blockHashes[i]
+		hashResults = append(hashResults, fetchResult)
+		hashes = append(hashes, blockHashes[i])
+	}
+	if len(hashes) == 0 {
+		return fetchResults
+	}
+
+	rawBlocks, errs, err := blockSource.GetRawBlocks(hashes)
+	if err != nil {
+		for _, fetchResult := range hashResults {
+			fetchResult.Err = err
+		}
+		return fetchResults
+	}
+	for i, fetchResult := range hashResults {
+		fetchResult.RawBlockData, fetchResult.Err = rawBlocks[i], errs[i]
+	}
+	return fetchResults
+}
+
+// Next waits for the block at the next height, returns nil if the fetcher is stopped or all blocks are handed out
+func (f *BlockFetcher) Next() *FetchResult {
+	f.fetchMutex.Lock()
+	if f.commitHeight > f.endHeight {
+		f.fetchMutex.Unlock()
+		return nil
+	}
+	fetchResult, ok := f.results[f.commitHeight]
+	for !ok && !f.stopped {
+		f.fetchCond.Wait()
+		fetchResult, ok = f.results[f.commitHeight]
+	}
+	if !ok {
+		f.fetchMutex.Unlock()
+		return nil
+	}
+	delete(f.results, f.commitHeight)
+	f.commitHeight++
+	f.fetchMutex.Unlock()
+
+	// release the slot of the block
+	<-f.slotChan
+	return fetchResult
+}
+
+func (f *BlockFetcher) Stop() {
+	f.fetchMutex.Lock()
+	if !f.stopped {
+		f.stopped = true
+		close(f.quitChan)
+		f.fetchCond.Broadcast()
+	}
+	f.fetchMutex.Unlock()
+}
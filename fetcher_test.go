@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/go-lib/src/sched/goroutine_mgr"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBlockSource serves the blocks of a fake chain, the blocks of the lower heights are served slower,
+// so the workers finish them out of height order
+type testBlockSource struct {
+	blockCount uint32
+	errHeight  uint32
+	// the blocks are held back until the gate is closed
+	gate         chan struct{}
+	mutex        sync.Mutex
+	fetchHeights map[uint32]bool
+}
+
+func newTestBlockSource(blockCount uint32) *testBlockSource {
+	s := new(testBlockSource)
+	s.blockCount = blockCount
+	s.errHeight = blockCount
+	s.gate = make(chan struct{})
+	close(s.gate)
+	s.fetchHeights = make(map[uint32]bool)
+	return s
+}
+
+func getTestBlockHash(blockHeight uint32) string {
+	return fmt.Sprintf("%064x", blockHeight)
+}
+
+func (s *testBlockSource) fetchCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.fetchHeights)
+}
+
+func (s *testBlockSource) GetBlockCount() (uint32, error) {
+	return s.blockCount, nil
+}
+
+func (s *testBlockSource) GetBlockHash(blockHeight uint32) (string, error) {
+	s.mutex.Lock()
+	s.fetchHeights[blockHeight] = true
+	s.mutex.Unlock()
+	<-s.gate
+	time.Sleep(time.Duration(10-blockHeight%10) * time.Millisecond)
+	return getTestBlockHash(blockHeight), nil
+}
+
+func (s *testBlockSource) GetBlockHashes(blockHeights []uint32) ([]string, []error, error) {
+	blockHashes := make([]string, 0, len(blockHeights))
+	errs := make([]error, 0, len(blockHeights))
+	for _, blockHeight := range blockHeights {
+		blockHash, err := s.GetBlockHash(blockHeight)
+		blockHashes = append(blockHashes, blockHash)
+		errs = append(errs, err)
+	}
+	return blockHashes, errs, nil
+}
+
+func (s *testBlockSource) GetRawBlock(blockHash string) ([]byte, error) {
+	if blockHash == getTestBlockHash(s.errHeight) {
+		return nil, errors.New("block not found")
+	}
+	return []byte(blockHash), nil
+}
+
+func (s *testBlockSource) GetRawBlocks(blockHashes []string) ([][]byte, []error, error) {
+	rawBlocks := make([][]byte, 0, len(blockHashes))
+	errs := make([]error, 0, len(blockHashes))
+	for _, blockHash := range blockHashes {
+		rawBlock, err := s.GetRawBlock(blockHash)
+		rawBlocks = append(rawBlocks, rawBlock)
+		errs = append(errs, err)
+	}
+	return rawBlocks, errs, nil
+}
+
+// useTestBlockSource sets the block source and the fetch config for the test,
+// and waits for the workers of the stopped fetchers before restoring them
+func useTestBlockSource(t *testing.T, source BlockSource, fetchWorkers int, fetchAhead int, batchSize int) {
+	savedBlockSource := blockSource
+	savedRpcClientConfig := config.RpcClientConfig
+	savedGoroutineMgr := goroutineMgr
+	blockSource = source
+	config.RpcClientConfig.FetchWorkers = fetchWorkers
+	config.RpcClientConfig.FetchAhead = fetchAhead
+	config.RpcClientConfig.BatchSize = batchSize
+	goroutineMgr = new(goroutine_mgr.GoroutineManager)
+	goroutineMgr.Initialise("TestGoroutineManager")
+	t.Cleanup(func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for goroutineMgr.GoroutineCount() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("fetch workers not quit")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		blockSource = savedBlockSource
+		config.RpcClientConfig = savedRpcClientConfig
+		goroutineMgr = savedGoroutineMgr
+	})
+}
+
+func TestGetFetchAhead(t *testing.T) {
+	tests := []struct {
+		fetchWorkers int
+		fetchAhead   int
+		expected     int
+	}{
+		{0, 0, 1},
+		{4, 0, 4},
+		{4, 2, 4},
+		{4, 16, 16},
+	}
+	for _, test := range tests {
+		useTestBlockSource(t, nil, test.fetchWorkers, test.fetchAhead, 1)
+		if getFetchAhead() != test.expected {
+			t.Errorf("getFetchAhead() with %d workers and %d ahead = %d", test.fetchWorkers, test.fetchAhead, getFetchAhead())
+		}
+	}
+}
+
+func TestBlockFetcherOrder(t *testing.T) {
+	tests := []struct {
+		name         string
+		fetchWorkers int
+		fetchAhead   int
+		batchSize    int
+	}{
+		{"one worker", 1, 1, 1},
+		{"workers", 4, 8, 1},
+		{"batch", 3, 12, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := newTestBlockSource(40)
+			source.errHeight = 25
+			useTestBlockSource(t, source, test.fetchWorkers, test.fetchAhead, test.batchSize)
+			f := startBlockFetcher(5, 39)
+			defer f.Stop()
+			for blockHeight := uint32(5); blockHeight <= 39; blockHeight++ {
+				fetchResult := f.Next()
+				if fetchResult == nil {
+					t.Fatal("fetcher stopped at block height", blockHeight)
+				}
+				if fetchResult.BlockHeight != blockHeight || fetchResult.BlockHash != getTestBlockHash(blockHeight) {
+					t.Fatalf("got block height %d, expected %d", fetchResult.BlockHeight, blockHeight)
+				}
+				// the error of a block is handed out at its height
+				if (fetchResult.Err != nil) != (blockHeight == source.errHeight) {
+					t.Fatalf("unexpected error %v of block height %d", fetchResult.Err, blockHeight)
+				}
+				if fetchResult.Err == nil && string(fetchResult.RawBlockData) != getTestBlockHash(blockHeight) {
+					t.Fatal("unexpected raw block of block height", blockHeight)
+				}
+			}
+			if f.Next() != nil {
+				t.Fatal("block handed out after the end height")
+			}
+		})
+	}
+}
+
+func TestBlockFetcherMemoryBound(t *testing.T) {
+	fetchAhead := 6
+	source := newTestBlockSource(100)
+	useTestBlockSource(t, source, 3, fetchAhead, 2)
+	f := startBlockFetcher(0, 99)
+	defer f.Stop()
+
+	// nothing is committed, the fetcher stops at the fetch ahead blocks
+	time.Sleep(300 * time.Millisecond)
+	if source.fetchCount() != fetchAhead {
+		t.Fatalf("%d blocks fetched ahead, expected %d", source.fetchCount(), fetchAhead)
+	}
+	for i := 0; i < 3; i++ {
+		if f.Next() == nil {
+			t.Fatal("fetcher stopped")
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	if source.fetchCount() != fetchAhead+3 {
+		t.Fatalf("%d blocks fetched after 3 commits, expected %d", source.fetchCount(), fetchAhead+3)
+	}
+}
+
+func TestBlockFetcherStop(t *testing.T) {
+	source := newTestBlockSource(100)
+	source.gate = make(chan struct{})
+	useTestBlockSource(t, source, 2, 4, 1)
+	f := startBlockFetcher(0, 99)
+
+	nextResult := make(chan *FetchResult, 1)
+	go func() {
+		nextResult <- f.Next()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	f.Stop()
+	select {
+	case fetchResult := <-nextResult:
+		if fetchResult != nil {
+			t.Fatal("block handed out by the stopped fetcher")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next is not woken by Stop")
+	}
+	// let the blocked workers quit
+	close(source.gate)
+}
@@ -1,150 +1,523 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/block"
 	"github.com/mutalisk999/go-lib/src/sched/goroutine_mgr"
 	"github.com/ybbus/jsonrpc"
+	"net/http"
 	"os"
-	"strconv"
+	"sync"
 	"time"
 )
 
-func doHttpJsonRpcCall(method string, args ...interface{}) (*jsonrpc.RPCResponse, error) {
-	rpcClient := jsonrpc.NewClient(config.RpcClientConfig.RpcReqUrl)
+type GatherStatus struct {
+	BlockHeight     uint32           `json:"blockHeight"`
+	NodeBlockCount  uint32           `json:"nodeBlockCount"`
+	LastError       string           `json:"lastError"`
+	LastErrorHeight uint32           `json:"lastErrorHeight"`
+	LastErrorTime   int64            `json:"lastErrorTime"`
+	RetryAttempts   int              `json:"retryAttempts"`
+	ZmqHealthy      bool             `json:"zmqHealthy"`
+	Upstreams       []UpstreamStatus `json:"upstreams,omitempty"`
+}
+
+var gatherStatus GatherStatus
+var gatherStatusMutex = new(sync.RWMutex)
+
+func setGatherError(blockHeight uint32, err error) {
+	gatherStatusMutex.Lock()
+	gatherStatus.LastError = redactError(err)
+	gatherStatus.LastErrorHeight = blockHeight
+	gatherStatus.LastErrorTime = time.Now().Unix()
+	gatherStatusMutex.Unlock()
+}
+
+func setGatherRetryAttempts(retryAttempts int) {
+	gatherStatusMutex.Lock()
+	gatherStatus.RetryAttempts = retryAttempts
+	gatherStatusMutex.Unlock()
+}
+
+func getGatherStatus() GatherStatus {
+	gatherStatusMutex.RLock()
+	status := gatherStatus
+	gatherStatusMutex.RUnlock()
+	status.BlockHeight, _ = getStoredTip()
+	status.ZmqHealthy = zmqNotifier != nil && zmqNotifier.IsHealthy()
+	if upstreamBlockSource, ok := blockSource.(*UpstreamBlockSource); ok {
+		status.Upstreams = upstreamBlockSource.GetUpstreamStatus()
+	}
+	return status
+}
+
+func newJsonRpcClient(rpcReqUrl string) jsonrpc.RPCClient {
+	rpcTimeout := config.RpcClientConfig.RpcTimeout
+	if rpcTimeout <= 0 {
+		rpcTimeout = DefaultRpcTimeout
+	}
+	rpcClientOpts := new(jsonrpc.RPCClientOpts)
+	rpcClientOpts.HTTPClient = &http.Client{Timeout: time.Duration(rpcTimeout) * time.Second}
+	return jsonrpc.NewClientWithOpts(rpcReqUrl, rpcClientOpts)
+}
+
+func doHttpJsonRpcCall(rpcClient jsonrpc.RPCClient, method string, args ...interface{}) (*jsonrpc.RPCResponse, error) {
 	rpcResponse, err := rpcClient.Call(method, args)
 	if err != nil {
-		return nil, err
+		return nil, newRpcCallError(method, err)
+	}
+	if rpcResponse.Error != nil {
+		return nil, newRpcCallError(method, rpcResponse.Error)
 	}
 	return rpcResponse, nil
 }
 
-func getBlockCountRpc() (uint32, error) {
-	rpcResponse, err := doHttpJsonRpcCall("getblockcount")
+// doHttpJsonRpcBatchCall returns the responses in the order of the requests, the response missing in the batch is nil
+func doHttpJsonRpcBatchCall(rpcClient jsonrpc.RPCClient, method string, rpcRequests jsonrpc.RPCRequests) (jsonrpc.RPCResponses, error) {
+	rpcResponses, err := rpcClient.CallBatch(rpcRequests)
 	if err != nil {
-		fmt.Println("doHttpJsonRpcCall Failed: ", err)
+		return nil, newRpcCallError(method, err)
+	}
+	rpcResponseMap := rpcResponses.AsMap()
+	orderedResponses := make(jsonrpc.RPCResponses, len(rpcRequests))
+	for i := range rpcRequests {
+		orderedResponses[i] = rpcResponseMap[i]
+	}
+	return orderedResponses, nil
+}
+
+// getBatchResponseString returns the string result of one response in a batch, with the error classified
+func getBatchResponseString(method string, rpcResponse *jsonrpc.RPCResponse) (string, error) {
+	if rpcResponse == nil {
+		return "", newMalformedRpcError(method, errors.New("rpc response missing in batch"))
+	}
+	if rpcResponse.Error != nil {
+		return "", newRpcCallError(method, rpcResponse.Error)
+	}
+	result, err := rpcResponse.GetString()
+	if err != nil {
+		return "", newMalformedRpcError(method, err)
+	}
+	return result, nil
+}
+
+func getBatchSize() int {
+	if config.RpcClientConfig.BatchSize <= 0 {
+		return 1
+	}
+	return config.RpcClientConfig.BatchSize
+}
+
+func getBlockCountRpc(rpcClient jsonrpc.RPCClient) (uint32, error) {
+	rpcResponse, err := doHttpJsonRpcCall(rpcClient, "getblockcount")
+	if err != nil {
+		fmt.Println("doHttpJsonRpcCall Failed: ", redactError(err))
 		return 0, err
 	}
 	blockCount, err := rpcResponse.GetInt()
 	if err != nil {
 		fmt.Println("Get blockCount from rpcResponse Failed: ", err)
-		return 0, err
+		return 0, newMalformedRpcError("getblockcount", err)
 	}
 	return uint32(blockCount), nil
 }
 
-func getBlockHashRpc(blockHeight uint32) (string, error) {
-	rpcResponse, err := doHttpJsonRpcCall("getblockhash", blockHeight)
+type BlockChainInfo struct {
+	Chain string `json:"chain"`
+}
+
+func getBlockChainNameRpc(rpcClient jsonrpc.RPCClient) (string, error) {
+	rpcResponse, err := doHttpJsonRpcCall(rpcClient, "getblockchaininfo")
 	if err != nil {
 		fmt.Println("doHttpJsonRpcCall Failed: ", err)
 		return "", err
 	}
+	var blockChainInfo BlockChainInfo
+	err = rpcResponse.GetObject(&blockChainInfo)
+	if err != nil {
+		fmt.Println("Get blockChainInfo from rpcResponse Failed: ", err)
+		return "", newMalformedRpcError("getblockchaininfo", err)
+	}
+	return blockChainInfo.Chain, nil
+}
+
+func getBlockHashRpc(rpcClient jsonrpc.RPCClient, blockHeight uint32) (string, error) {
+	rpcResponse, err := doHttpJsonRpcCall(rpcClient, "getblockhash", blockHeight)
+	if err != nil {
+		fmt.Println("doHttpJsonRpcCall Failed: ", redactError(err))
+		return "", err
+	}
 	blockHash, err := rpcResponse.GetString()
 	if err != nil {
 		fmt.Println("Get blockHash from rpcResponse Failed: ", err)
-		return "", err
+		return "", newMalformedRpcError("getblockhash", err)
 	}
 	return blockHash, nil
 }
 
-func getRawBlock(blockHash string) (string, error) {
-	rpcResponse, err := doHttpJsonRpcCall("getblock", blockHash, 0)
+func getRawBlock(rpcClient jsonrpc.RPCClient, blockHash string) (string, error) {
+	rpcResponse, err := doHttpJsonRpcCall(rpcClient, "getblock", blockHash, 0)
 	if err != nil {
-		fmt.Println("doHttpJsonRpcCall Failed: ", err)
+		fmt.Println("doHttpJsonRpcCall Failed: ", redactError(err))
 		return "", err
 	}
 	rawBlockHex, err := rpcResponse.GetString()
 	if err != nil {
 		fmt.Println("Get rawBlockHex from rpcResponse Failed: ", err)
-		return "", err
+		return "", newMalformedRpcError("getblock", err)
 	}
 	return rawBlockHex, nil
 }
 
+func getBlockHashesRpc(rpcClient jsonrpc.RPCClient, blockHeights []uint32) ([]string, []error, error) {
+	rpcRequests := make(jsonrpc.RPCRequests, 0, len(blockHeights))
+	for _, blockHeight := range blockHeights {
+		rpcRequests = append(rpcRequests, jsonrpc.NewRequest("getblockhash", blockHeight))
+	}
+	rpcResponses, err := doHttpJsonRpcBatchCall(rpcClient, "getblockhash", rpcRequests)
+	if err != nil {
+		fmt.Println("doHttpJsonRpcBatchCall Failed: ", redactError(err))
+		return nil, nil, err
+	}
+	blockHashes := make([]string, len(blockHeights))
+	errs := make([]error, len(blockHeights))
+	for i, rpcResponse := range rpcResponses {
+		blockHashes[i], errs[i] = getBatchResponseString("getblockhash", rpcResponse)
+	}
+	return blockHashes, errs, nil
+}
+
+func getRawBlocksRpc(rpcClient jsonrpc.RPCClient, blockHashes []string) ([]string, []error, error) {
+	rpcRequests := make(jsonrpc.RPCRequests, 0, len(blockHashes))
+	for _, blockHash := range blockHashes {
+		rpcRequests = append(rpcRequests, jsonrpc.NewRequest("getblock", blockHash, 0))
+	}
+	rpcResponses, err := doHttpJsonRpcBatchCall(rpcClient, "getblock", rpcRequests)
+	if err != nil {
+		fmt.Println("doHttpJsonRpcBatchCall Failed: ", redactError(err))
+		return nil, nil, err
+	}
+	rawBlockHexes := make([]string, len(blockHashes))
+	errs := make([]error, len(blockHashes))
+	for i, rpcResponse := range rpcResponses {
+		rawBlockHexes[i], errs[i] = getBatchResponseString("getblock", rpcResponse)
+	}
+	return rawBlockHexes, errs, nil
+}
+
+func getPrevBlockHash(rawBlockData []byte) (string, error) {
+	if len(rawBlockData) < BlockHeaderSize {
+		return "", errors.New("invalid raw block data")
+	}
+	var blockHeader block.BlockHeader
+	err := blockHeader.UnPack(bytes.NewReader(rawBlockData[0:BlockHeaderSize]))
+	if err != nil {
+		return "", err
+	}
+	return blockHeader.HashPrevBlock.GetHex(), nil
+}
+
+func findForkHeight() (uint32, error) {
+	forkHeight := latestRawBlockMgr.BlockHeight
+	for forkHeight > 0 {
+		blockHash, err := blockSource.GetBlockHash(forkHeight)
+		if err != nil {
+			return 0, err
+		}
+		storedHash, _ := getStoredBlockHash(forkHeight)
+		if blockHash == storedHash {
+			break
+		}
+		forkHeight--
+	}
+	return forkHeight, nil
+}
+
+func rollbackToForkHeight(forkHeight uint32) error {
+	var err error
+	tipHeight := latestRawBlockMgr.BlockHeight
+
+	// keep the orphaned blocks in the stale block store
+	for height := forkHeight + 1; height <= tipHeight; height++ {
+		ptrBlockIndex, err := loadBlockIndex(height)
+		if err != nil {
+			return err
+		}
+		ptrRawBlock, err := loadRawBlock(ptrBlockIndex)
+		if err != nil {
+			return err
+		}
+		err = staleBlockMgr.AddStaleBlock(ptrRawBlock)
+		if err != nil {
+			return err
+		}
+	}
+	// the rpc goroutines stop finding the orphaned blocks in the chain before their records are truncated
+	removeStoredBlocks(forkHeight)
+
+	// locate the end of the fork block, the genesis block is never rolled back
+	ptrBlockIndex, err := loadBlockIndex(forkHeight)
+	if err != nil {
+		return err
+	}
+	forkFileTag := ptrBlockIndex.RawBlockFileTag
+	forkFileEndPos := ptrBlockIndex.BlockFileEndPos
+
+	// roll back the raw block index first, so that it never points past the raw block data
+	err = blockIndexMgr.TruncateBlockIndex(forkHeight + 1)
+	if err != nil {
+		return err
+	}
+	err = blockIndexMgr.Sync()
+	if err != nil {
+		return err
+	}
+	err = blockHeaderMgr.TruncateBlockHeader(forkHeight + 1)
+	if err != nil {
+		return err
+	}
+	err = truncateIndexes(forkHeight + 1)
+	if err != nil {
+		return err
+	}
+
+	// roll back the raw block files
+	latestFileTag := latestRawBlockMgr.RawBlockFileTag
+	err = latestRawBlockMgr.SwitchFile(forkFileTag)
+	if err != nil {
+		return err
+	}
+	for tag := latestFileTag; tag > forkFileTag; tag-- {
+		err = os.Remove(getRawBlockFileName(tag))
+		if err != nil {
+			return err
+		}
+	}
+	err = latestRawBlockMgr.TruncateBlock(forkFileEndPos)
+	if err != nil {
+		return err
+	}
+	latestRawBlockMgr.FileBlockCount, err = getFileBlockCount(forkFileTag, forkHeight)
+	if err != nil {
+		return err
+	}
+	chainStateMgr.Truncate(forkHeight + 1)
+	return nil
+}
+
+// storeNewBlock appends the validated block at the next height to the raw block files and the index,
+// syncData false leaves the raw block data unsynced before indexing, for bulk writers which sync by themselves
+func storeNewBlock(rawBlockNew *RawBlock, blockHash string, rawBlockSize uint32, syncData bool) error {
+	blockIndexNew, err := storeNewBlockData(rawBlockNew, blockHash, rawBlockSize)
+	if err != nil {
+		return err
+	}
+	// the raw block data must be durable before the index points to it
+	if syncData {
+		err = latestRawBlockMgr.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return blockIndexMgr.AddNewBlockIndex(blockIndexNew)
+}
+
+// storeNewBlockData appends the block to the raw block files, the header file and the indexes,
+// and returns the raw block index record of the block which is left to the caller to write
+func storeNewBlockData(rawBlockNew *RawBlock, blockHash string, rawBlockSize uint32) (*RawBlockIndex, error) {
+	NewBlockHeight := rawBlockNew.BlockHeight
+	// the raw block data is compressed when added
+	rawBlockData := rawBlockNew.RawBlockData.GetData()
+	headerData, err := getBlockHeaderData(rawBlockData)
+	if err != nil {
+		return nil, err
+	}
+	// compress before the roll over check to know the size of the packed block
+	err = rawBlockNew.Compress(latestRawBlockMgr.CompressedType)
+	if err != nil {
+		return nil, err
+	}
+	if latestRawBlockMgr.NeedRollOver(NewBlockHeight, rawBlockNew.PackSize()) {
+		err = latestRawBlockMgr.RollOver()
+		if err != nil {
+			return nil, err
+		}
+	}
+	startPos := latestRawBlockMgr.BlockFileEndPos
+	err = latestRawBlockMgr.AddNewBlock(rawBlockNew)
+	if err != nil {
+		return nil, err
+	}
+
+	// new block index
+	blockIndexNew := new(RawBlockIndex)
+	blockIndexNew.BlockHeight = NewBlockHeight
+	_ = blockIndexNew.BlockHash.SetHex(blockHash)
+	blockIndexNew.RawBlockSize = rawBlockSize
+	blockIndexNew.RawBlockFileTag = latestRawBlockMgr.RawBlockFileTag
+	blockIndexNew.BlockFileStartPos = startPos
+	blockIndexNew.BlockFileEndPos = latestRawBlockMgr.BlockFileEndPos
+
+	// the header file and the indexes are truncated to the raw block index on startup if the index record is lost
+	err = blockHeaderMgr.AddBlockHeader(headerData)
+	if err != nil {
+		return nil, err
+	}
+	err = addBlockToIndexes(NewBlockHeight, rawBlockData)
+	if err != nil {
+		return nil, err
+	}
+
+	addStoredBlock(NewBlockHeight, blockHash)
+	return blockIndexNew, nil
+}
+
+// waitForRpcRetry waits before retrying the failed rpc call, returns false if the error is fatal or the give up policy is reached
+func waitForRpcRetry(backoff *RetryBackoff, blockHeight uint32, err error) bool {
+	setGatherError(blockHeight, err)
+	if !isTransientRpcError(err) {
+		fmt.Println("fatal rpc error, stop gathering: ", err)
+		return false
+	}
+	delay, giveUpErr := backoff.NextDelay()
+	setGatherRetryAttempts(backoff.Attempts)
+	if giveUpErr != nil {
+		fmt.Println("rpc error, stop gathering:", giveUpErr, ":", err)
+		return false
+	}
+	fmt.Println("rpc error, retry", backoff.Attempts, "in", delay, ":", err)
+	sleepUnlessQuit(delay)
+	return true
+}
+
+func resetRpcRetry(backoff *RetryBackoff) {
+	if backoff.Attempts != 0 {
+		fmt.Println("rpc recovered after", backoff.Attempts, "retries")
+		backoff.Reset()
+		setGatherRetryAttempts(0)
+	}
+}
+
 func doGatherBlock(goroutine goroutine_mgr.Goroutine, args ...interface{}) {
 	defer goroutine.OnQuit()
+	backoff := newRetryBackoff()
+	zmqTimedOut := false
 	for {
 		if quitFlag {
 			break
 		}
-		blockCount, err := getBlockCountRpc()
+		blockCount, err := blockSource.GetBlockCount()
 		if err != nil {
-			break
+			if !waitForRpcRetry(backoff, latestRawBlockMgr.BlockCount, err) {
+				quitFlag = true
+				break
+			}
+			continue
 		}
+		gatherStatusMutex.Lock()
+		gatherStatus.NodeBlockCount = blockCount
+		gatherStatusMutex.Unlock()
 
-		if latestRawBlockMgr.BlockHeight >= blockCount {
-			time.Sleep(5 * 1000 * 1000 * 1000)
+		if zmqTimedOut && latestRawBlockMgr.BlockCount <= blockCount {
+			zmqNotifier.MarkSilent()
+		}
+		zmqTimedOut = false
+
+		// the node reports the height of its tip as the block count
+		if latestRawBlockMgr.BlockCount > blockCount {
+			resetRpcRetry(backoff)
+			zmqTimedOut = waitForNewBlock()
 		} else {
+			var fetcher *BlockFetcher = nil
 			for {
 				if quitFlag {
 					break
 				}
 
-				if latestRawBlockMgr.BlockHeight >= blockCount {
+				if latestRawBlockMgr.BlockCount > blockCount {
 					break
 				}
-				NewBlockHeight := latestRawBlockMgr.BlockHeight + 1
+				NewBlockHeight := latestRawBlockMgr.BlockCount
 
-				blockHash, err := getBlockHashRpc(NewBlockHeight)
-				if err != nil {
-					quitFlag = true
+				// prefetch the blocks ahead of the tip
+				if fetcher == nil {
+					fetcher = startBlockFetcher(NewBlockHeight, blockCount)
+				}
+				fetchResult := fetcher.Next()
+				if fetchResult == nil {
 					break
 				}
-				rawBlockData, err := getRawBlock(blockHash)
-				if err != nil {
-					quitFlag = true
+				if fetchResult.Err != nil {
+					// resume from the tip once the node is reachable again
+					fetcher.Stop()
+					fetcher = nil
+					if !waitForRpcRetry(backoff, fetchResult.BlockHeight, fetchResult.Err) {
+						quitFlag = true
+					}
 					break
 				}
+				blockHash := fetchResult.BlockHash
+				rawBlockData := fetchResult.RawBlockData
 
-				// add new block data
-				rawBlockNew := new(RawBlock)
-				rawBlockNew.BlockHeight = NewBlockHeight
-				_ = rawBlockNew.BlockHash.SetHex(blockHash)
-				rawBlockNew.CompressedType = 0
-				_ = rawBlockNew.RawBlockData.SetHex(rawBlockData)
-				blockFileInfo, err := os.Stat(config.DataConfig.DataDir + "/" + config.DataConfig.RawBlockFilePrefix + "." + strconv.Itoa(int(latestRawBlockMgr.RawBlockFileTag)))
+				// check if the new block links to the tip, otherwise roll back to the fork point
+				prevBlockHash, err := getPrevBlockHash(rawBlockData)
 				if err != nil {
 					quitFlag = true
 					break
 				}
-				if blockFileInfo.Size() > 1*1024*1024*1024 {
-					newRawBlockMgr := new(RawBlockManager)
-					_ = newRawBlockMgr.Init(config.DataConfig.DataDir, config.DataConfig.RawBlockFilePrefix, latestRawBlockMgr.RawBlockFileTag+1)
-					newRawBlockMgr.BlockHeight = latestRawBlockMgr.BlockHeight
-					newRawBlockMgr.BlockFileEndPos = 0
-					_ = latestRawBlockMgr.RawBlockFileObj.Close()
-					latestRawBlockMgr = newRawBlockMgr
-					blockFileInfo, err = os.Stat(config.DataConfig.DataDir + "/" + config.DataConfig.RawBlockFilePrefix + "." + strconv.Itoa(int(latestRawBlockMgr.RawBlockFileTag)))
+				tipHeight, _ := getStoredTip()
+				tipBlockHash, ok := getStoredBlockHash(tipHeight)
+				if ok && prevBlockHash != tipBlockHash {
+					fmt.Println("chain reorganization detected at block height", NewBlockHeight)
+					forkHeight, err := findForkHeight()
 					if err != nil {
+						fetcher.Stop()
+						fetcher = nil
+						if !waitForRpcRetry(backoff, NewBlockHeight, err) {
+							quitFlag = true
+						}
+						break
+					}
+					err = rollbackToForkHeight(forkHeight)
+					if err != nil {
+						fmt.Println("rollbackToForkHeight Failed: ", err)
 						quitFlag = true
 						break
 					}
+					fmt.Println("roll back to fork block height", forkHeight)
+					fetcher.Stop()
+					fetcher = nil
+					continue
 				}
-				startPos := latestRawBlockMgr.BlockFileEndPos
-				err = latestRawBlockMgr.AddNewBlock(rawBlockNew)
+
+				// add new block data
+				rawBlockNew := new(RawBlock)
+				rawBlockNew.BlockHeight = NewBlockHeight
+				_ = rawBlockNew.BlockHash.SetHex(blockHash)
+				rawBlockNew.CompressedType = CompressedTypeNone
+				rawBlockNew.RawBlockData.SetData(rawBlockData)
+
+				// refuse to persist the block if it is inconsistent, and retry later
+				err = validateRawBlock(NewBlockHeight, blockHash, rawBlockNew.RawBlockData.GetData())
 				if err != nil {
-					quitFlag = true
-					break
+					fmt.Println("validateRawBlock Failed: block height", NewBlockHeight, "block hash", blockHash, err)
+					setGatherError(NewBlockHeight, err)
+					fetcher.Stop()
+					fetcher = nil
+					sleepUnlessQuit(5 * time.Second)
+					continue
 				}
-
-				// add new block index
-				blockIndexNew := new(RawBlockIndex)
-				blockIndexNew.BlockHeight = NewBlockHeight
-				_ = blockIndexNew.BlockHash.SetHex(blockHash)
-				blockIndexNew.RawBlockSize = uint32(len(rawBlockData) / 2)
-				blockIndexNew.RawBlockFileTag = latestRawBlockMgr.RawBlockFileTag
-				blockIndexNew.BlockFileStartPos = startPos
-				blockIndexNew.BlockFileEndPos = latestRawBlockMgr.BlockFileEndPos
-				err = blockIndexMgr.AddNewBlockIndex(blockIndexNew)
+				err = storeNewBlock(rawBlockNew, blockHash, uint32(len(rawBlockData)), true)
 				if err != nil {
 					quitFlag = true
 					break
 				}
-
-				// add to map
-				heightToHashMap[NewBlockHeight] = blockHash
-				hashToHeightMap[blockHash] = NewBlockHeight
-
-				latestRawBlockMgr.BlockHeight += 1
+				resetRpcRetry(backoff)
+			}
+			if fetcher != nil {
+				fetcher.Stop()
 			}
 			// if break from the inside loop for, break from the outside loop for
 			if quitFlag == true {
@@ -152,6 +525,9 @@ func doGatherBlock(goroutine goroutine_mgr.Goroutine, args ...interface{}) {
 			}
 		}
 	}
+	if zmqNotifier != nil {
+		zmqNotifier.Stop()
+	}
 	quitChan <- 0x0
 }
 
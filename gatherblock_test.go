@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useTestGatherer opens the managers the gatherer writes to on an empty data directory, with maxFileBlocks
+// blocks in each raw block file
+func useTestGatherer(t *testing.T, maxFileBlocks uint32) {
+	useTestDataDir(t)
+	useTestNetwork(t, "bitcoin", "regtest")
+	useTestChain(t, nil)
+
+	savedLatestRawBlockMgr := latestRawBlockMgr
+	savedBlockIndexMgr := blockIndexMgr
+	savedBlockHeaderMgr := blockHeaderMgr
+	savedStaleBlockMgr := staleBlockMgr
+	savedChainStateMgr := chainStateMgr
+	latestRawBlockMgr = new(RawBlockManager)
+	blockIndexMgr = new(RawBlockIndexManager)
+	blockHeaderMgr = new(BlockHeaderManager)
+	staleBlockMgr = new(StaleBlockManager)
+	chainStateMgr = new(ChainStateManager)
+	t.Cleanup(func() {
+		_ = latestRawBlockMgr.RawBlockFileObj.Close()
+		_ = blockIndexMgr.BlockIndexFileObj.Close()
+		_ = blockHeaderMgr.BlockHeaderFileObj.Close()
+		_ = staleBlockMgr.StaleBlockFileObj.Close()
+		latestRawBlockMgr = savedLatestRawBlockMgr
+		blockIndexMgr = savedBlockIndexMgr
+		blockHeaderMgr = savedBlockHeaderMgr
+		staleBlockMgr = savedStaleBlockMgr
+		chainStateMgr = savedChainStateMgr
+	})
+	err := latestRawBlockMgr.Init(config.DataConfig.DataDir, config.DataConfig.RawBlockFilePrefix, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latestRawBlockMgr.MaxFileBlocks = maxFileBlocks
+	err = blockIndexMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockIndexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blockHeaderMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockHeaderName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = staleBlockMgr.Init(config.DataConfig.DataDir, config.DataConfig.StaleBlockName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainStateMgr.Init()
+}
+
+// storeTestBlocks stores the blocks from the next height on as the gatherer does
+func storeTestBlocks(t *testing.T, rawBlocks ...[]byte) {
+	for _, rawBlockData := range rawBlocks {
+		_, blockCount := getStoredTip()
+		blockHash := calcBlockHash(rawBlockData)
+		rawBlockNew := new(RawBlock)
+		rawBlockNew.BlockHeight = blockCount
+		_ = rawBlockNew.BlockHash.SetHex(blockHash)
+		rawBlockNew.CompressedType = CompressedTypeNone
+		rawBlockNew.RawBlockData.SetData(rawBlockData)
+		err := storeNewBlock(rawBlockNew, blockHash, uint32(len(rawBlockData)), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// mineTestChain mines count blocks on the previous block hash, tagging the coinbases to tell the forks apart
+func mineTestChain(t *testing.T, prevBlockHash string, startHeight uint32, count int, tag string) ([]string, [][]byte) {
+	blockHashes := make([]string, 0, count)
+	rawBlocks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		blockHash, rawBlock := mineTestBlock(t, prevBlockHash, buildTestCoinbase(startHeight+uint32(i), tag, []byte{0x51}))
+		blockHashes = append(blockHashes, blockHash)
+		rawBlocks = append(rawBlocks, rawBlock)
+		prevBlockHash = blockHash
+	}
+	return blockHashes, rawBlocks
+}
+
+func TestRollbackToForkHeight(t *testing.T) {
+	useTestGatherer(t, 2)
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	genesisHash := calcBlockHash(genesisBlock)
+	mainHashes, mainBlocks := mineTestChain(t, genesisHash, 1, 5, "main")
+	storeTestBlocks(t, genesisBlock)
+	storeTestBlocks(t, mainBlocks...)
+	if tipHeight, blockCount := getStoredTip(); tipHeight != 5 || blockCount != 6 {
+		t.Fatalf("unexpected stored tip %d %d", tipHeight, blockCount)
+	}
+	// the blocks 0 and 1 are in raw_block.0, 2 and 3 in raw_block.1, 4 and 5 in raw_block.2
+	if latestRawBlockMgr.RawBlockFileTag != 2 {
+		t.Fatal("unexpected raw block file tag", latestRawBlockMgr.RawBlockFileTag)
+	}
+
+	// the rpc handlers read the chain while it is rolled back
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tipHeight, _ := getStoredTip()
+			_, _ = getStoredBlockHash(tipHeight)
+			_, _ = getStoredBlockHeight(mainHashes[4])
+			_, _ = bitcoinRpcGetBestBlockHash(nil)
+		}
+	}()
+	err := rollbackToForkHeight(2)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tipHeight, blockCount := getStoredTip(); tipHeight != 2 || blockCount != 3 {
+		t.Fatalf("unexpected rolled back tip %d %d", tipHeight, blockCount)
+	}
+	if latestRawBlockMgr.RawBlockFileTag != 1 || latestRawBlockMgr.FileBlockCount != 1 {
+		t.Fatalf("unexpected raw block file %d with %d blocks", latestRawBlockMgr.RawBlockFileTag, latestRawBlockMgr.FileBlockCount)
+	}
+	if _, err = os.Stat(getRawBlockFileName(2)); !os.IsNotExist(err) {
+		t.Fatal("raw block file of the orphaned blocks not removed", err)
+	}
+	blockIndexes := readTestBlockIndexes(t)
+	if len(blockIndexes) != 3 {
+		t.Fatal("unexpected block index count", len(blockIndexes))
+	}
+	for height, blockHash := range []string{genesisHash, mainHashes[0], mainHashes[1]} {
+		storedHash, ok := getStoredBlockHash(uint32(height))
+		if !ok || storedHash != blockHash || blockIndexes[height].BlockHash.GetHex() != blockHash {
+			t.Fatalf("unexpected block of height %d after the rollback", height)
+		}
+	}
+	// the orphaned blocks leave the chain and are served as stale blocks
+	for i, blockHash := range mainHashes[2:] {
+		height := uint32(i + 3)
+		if _, ok := getStoredBlockHash(height); ok {
+			t.Fatalf("orphaned height %d still in the chain", height)
+		}
+		if _, ok := getStoredBlockHeight(blockHash); ok {
+			t.Fatalf("orphaned block %s still in the chain", blockHash)
+		}
+		ptrRawBlock, stale, err := loadRawBlockByHash(blockHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stale || ptrRawBlock.BlockHeight != height {
+			t.Fatalf("unexpected stale block of height %d", height)
+		}
+	}
+
+	// the fork is stored on top of the fork block
+	forkHashes, forkBlocks := mineTestChain(t, mainHashes[1], 3, 4, "fork")
+	storeTestBlocks(t, forkBlocks...)
+	if tipHeight, _ := getStoredTip(); tipHeight != 6 {
+		t.Fatal("unexpected tip height of the fork", tipHeight)
+	}
+	blockIndexes = readTestBlockIndexes(t)
+	if len(blockIndexes) != 7 {
+		t.Fatal("unexpected block index count", len(blockIndexes))
+	}
+	for i, blockHash := range forkHashes {
+		height := uint32(i + 3)
+		storedHeight, ok := getStoredBlockHeight(blockHash)
+		if !ok || storedHeight != height || blockIndexes[height].BlockHash.GetHex() != blockHash {
+			t.Fatalf("unexpected fork block of height %d", height)
+		}
+		ptrRawBlock, stale, err := loadRawBlockByHash(blockHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stale || calcBlockHash(ptrRawBlock.RawBlockData.GetData()) != blockHash {
+			t.Fatalf("unexpected stored fork block of height %d", height)
+		}
+	}
+}
+
+// startTestBatchNode answers each request of a batch with the reply of its first param, nil leaves the request unanswered
+func startTestBatchNode(t *testing.T, replies map[string]map[string]interface{}) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requests []struct {
+			Id     int           `json:"id"`
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&requests)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		responses := make([]map[string]interface{}, 0, len(requests))
+		// the node may answer a batch in any order
+		for i := len(requests) - 1; i >= 0; i-- {
+			reply := replies[requests[i].Method+" "+jsonParamString(requests[i].Params[0])]
+			if reply == nil {
+				continue
+			}
+			response := map[string]interface{}{"jsonrpc": "2.0", "id": requests[i].Id}
+			for k, v := range reply {
+				response[k] = v
+			}
+			responses = append(responses, response)
+		}
+		_ = json.NewEncoder(w).Encode(responses)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func jsonParamString(param interface{}) string {
+	data, _ := json.Marshal(param)
+	return strings.Trim(string(data), "\"")
+}
+
+func TestJsonRpcBatchPartialErrors(t *testing.T) {
+	rpcReqUrl := startTestBatchNode(t, map[string]map[string]interface{}{
+		"getblockhash 0": {"result": "hash0"},
+		"getblockhash 1": {"error": map[string]interface{}{"code": -8, "message": "Block height out of range"}},
+		"getblockhash 3": {"result": 3},
+		"getblock hash0": {"result": "00"},
+		"getblock hash1": {"error": map[string]interface{}{"code": -1, "message": "Block not available (pruned data)"}},
+	})
+	rpcClient := newJsonRpcClient(rpcReqUrl)
+
+	type batchItem struct {
+		result    string
+		err       string
+		class     RpcErrorClass
+		transient bool
+	}
+	tests := []struct {
+		name  string
+		call  func() ([]string, []error, error)
+		items []batchItem
+	}{
+		{"getblockhash", func() ([]string, []error, error) {
+			return getBlockHashesRpc(rpcClient, []uint32{0, 1, 2, 3})
+		}, []batchItem{
+			{"hash0", "", 0, false},
+			{"", "Block height out of range", RpcErrorCode, true},
+			{"", "rpc response missing in batch", RpcErrorMalformed, true},
+			{"", "", RpcErrorMalformed, true},
+		}},
+		{"getblock", func() ([]string, []error, error) {
+			return getRawBlocksRpc(rpcClient, []string{"hash0", "hash1"})
+		}, []batchItem{
+			{"00", "", 0, false},
+			{"", "pruned data", RpcErrorCode, false},
+		}},
+	}
+	for _, test := range tests {
+		results, errs, err := test.call()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(results) != len(test.items) || len(errs) != len(test.items) {
+			t.Fatalf("%s: unexpected result count %d %d", test.name, len(results), len(errs))
+		}
+		for i, item := range test.items {
+			if item.result != "" {
+				if errs[i] != nil || results[i] != item.result {
+					t.Errorf("%s item %d: got %q %v, expected %q", test.name, i, results[i], errs[i], item.result)
+				}
+				continue
+			}
+			rpcCallError, ok := errs[i].(*RpcCallError)
+			if !ok {
+				t.Errorf("%s item %d: unexpected error %v", test.name, i, errs[i])
+				continue
+			}
+			if rpcCallError.Class != item.class || rpcCallError.Transient() != item.transient || !strings.Contains(rpcCallError.Error(), item.err) {
+				t.Errorf("%s item %d: unexpected error %v", test.name, i, rpcCallError)
+			}
+		}
+	}
+
+	// the failure of the whole batch is not split into the items
+	_, errs, err := getBlockHashesRpc(newJsonRpcClient("http://127.0.0.1:1"), []uint32{0, 1})
+	if errs != nil || !isTransientRpcError(err) {
+		t.Fatal("unexpected batch failure", errs, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// loadFirstRawBlock returns the first record of the raw block files, nil if there is none
+func loadFirstRawBlock() (*RawBlock, error) {
+	rawBlockFileObj, err := os.Open(getRawBlockFileName(0))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rawBlockFileObj.Close()
+	rawBlockInfo, err := rawBlockFileObj.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if rawBlockInfo.Size() == 0 {
+		return nil, nil
+	}
+	ptrRawBlock := new(RawBlock)
+	err = ptrRawBlock.UnPack(rawBlockFileObj)
+	if err != nil {
+		return nil, err
+	}
+	return ptrRawBlock, nil
+}
+
+// fetchGenesisBlock gathers the genesis block from the upstream, which is initialized here if it's not yet
+func fetchGenesisBlock() (*RawBlock, error) {
+	if blockSource == nil {
+		err := initBlockSource()
+		if err != nil {
+			return nil, err
+		}
+		err = checkBlockSourceNetwork()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the p2p block source learns the block hashes by syncing the headers
+	_, err := blockSource.GetBlockCount()
+	if err != nil {
+		return nil, err
+	}
+	blockHash, err := blockSource.GetBlockHash(GenesisBlockHeight)
+	if err != nil {
+		return nil, err
+	}
+	rawBlockData, err := blockSource.GetRawBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	err = validateRawBlock(GenesisBlockHeight, blockHash, rawBlockData)
+	if err != nil {
+		return nil, err
+	}
+	compressedType, err := getCompressedType(config.DataConfig.CompressedType)
+	if err != nil {
+		return nil, err
+	}
+	genesisBlock := new(RawBlock)
+	genesisBlock.BlockHeight = GenesisBlockHeight
+	_ = genesisBlock.BlockHash.SetHex(blockHash)
+	genesisBlock.CompressedType = CompressedTypeNone
+	genesisBlock.RawBlockData.SetData(rawBlockData)
+	err = genesisBlock.Compress(compressedType)
+	if err != nil {
+		return nil, err
+	}
+	return genesisBlock, nil
+}
+
+// loadGenesisBlock returns the genesis block to store in front of the raw block files, and whether it is stored
+// already, nil if the raw block files are empty. It's fetched from the upstream only if the raw block files lack it
+func loadGenesisBlock() (*RawBlock, bool, error) {
+	firstRawBlock, err := loadFirstRawBlock()
+	if err != nil {
+		return nil, false, err
+	}
+	if firstRawBlock == nil {
+		return nil, false, nil
+	}
+	if firstRawBlock.BlockHeight == GenesisBlockHeight {
+		return firstRawBlock, true, nil
+	}
+	if firstRawBlock.BlockHeight != GenesisBlockHeight+1 {
+		return nil, false, errors.New("unexpected first block height " + strconv.Itoa(int(firstRawBlock.BlockHeight)) + " in " + getRawBlockFileName(0))
+	}
+	fmt.Println("fetch the genesis block to store in front of", getRawBlockFileName(0))
+	genesisBlock, err := fetchGenesisBlock()
+	if err != nil {
+		return nil, false, errors.New("fetch the genesis block failed: " + err.Error())
+	}
+	return genesisBlock, false, nil
+}
+
+// newGenesisBlockIndex returns the index record of the genesis block stored in front of the raw block files
+func newGenesisBlockIndex(genesisBlock *RawBlock) (*RawBlockIndex, error) {
+	rawBlockData := genesisBlock.RawBlockData.GetData()
+	if genesisBlock.CompressedType != CompressedTypeNone {
+		var err error
+		rawBlockData, err = decompressData(genesisBlock.CompressedType, rawBlockData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	genesisIndex := new(RawBlockIndex)
+	genesisIndex.BlockHeight = GenesisBlockHeight
+	genesisIndex.BlockHash = genesisBlock.BlockHash
+	genesisIndex.RawBlockSize = uint32(len(rawBlockData))
+	genesisIndex.RawBlockFileTag = 0
+	genesisIndex.BlockFileStartPos = 0
+	genesisIndex.BlockFileEndPos = genesisBlock.PackSize()
+	return genesisIndex, nil
+}
+
+// migrateGenesisBlock stores the genesis block in front of the raw block files collected without it
+func migrateGenesisBlock() error {
+	genesisBlock, stored, err := loadGenesisBlock()
+	if err != nil {
+		return err
+	}
+	if genesisBlock == nil || stored {
+		return nil
+	}
+	return prependRawBlock(genesisBlock)
+}
+
+// prependRawBlock rewrites the first raw block file with the raw block in front, and replaces it when it's complete
+func prependRawBlock(ptrRawBlock *RawBlock) error {
+	rawBlockFileName := getRawBlockFileName(0)
+	prependFileName := rawBlockFileName + ".genesis"
+	rawBlockFileObj, err := os.Open(rawBlockFileName)
+	if err != nil {
+		return err
+	}
+	defer rawBlockFileObj.Close()
+	prependFileObj, err := os.OpenFile(prependFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = ptrRawBlock.Pack(prependFileObj)
+	if err != nil {
+		_ = prependFileObj.Close()
+		return err
+	}
+	_, err = io.Copy(prependFileObj, rawBlockFileObj)
+	if err != nil {
+		_ = prependFileObj.Close()
+		return err
+	}
+	err = prependFileObj.Sync()
+	if err != nil {
+		_ = prependFileObj.Close()
+		return err
+	}
+	_ = prependFileObj.Close()
+	return os.Rename(prependFileName, rawBlockFileName)
+}
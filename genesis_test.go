@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testChainBlockSource serves the blocks of a chain from height 0, and counts the calls
+type testChainBlockSource struct {
+	blockHashes []string
+	rawBlocks   [][]byte
+	calls       int
+}
+
+func newTestChainBlockSource(rawBlocks ...[]byte) *testChainBlockSource {
+	s := new(testChainBlockSource)
+	for _, rawBlock := range rawBlocks {
+		s.blockHashes = append(s.blockHashes, calcBlockHash(rawBlock))
+	}
+	s.rawBlocks = rawBlocks
+	return s
+}
+
+func (s *testChainBlockSource) GetBlockCount() (uint32, error) {
+	s.calls++
+	return uint32(len(s.blockHashes)) - 1, nil
+}
+
+func (s *testChainBlockSource) GetBlockHash(blockHeight uint32) (string, error) {
+	s.calls++
+	if int(blockHeight) >= len(s.blockHashes) {
+		return "", errors.New("block height out of range")
+	}
+	return s.blockHashes[blockHeight], nil
+}
+
+func (s *testChainBlockSource) GetBlockHashes(blockHeights []uint32) ([]string, []error, error) {
+	hashes := make([]string, len(blockHeights))
+	errs := make([]error, len(blockHeights))
+	for i, blockHeight := range blockHeights {
+		hashes[i], errs[i] = s.GetBlockHash(blockHeight)
+	}
+	return hashes, errs, nil
+}
+
+func (s *testChainBlockSource) GetRawBlock(blockHash string) ([]byte, error) {
+	s.calls++
+	for i := range s.blockHashes {
+		if s.blockHashes[i] == blockHash {
+			return s.rawBlocks[i], nil
+		}
+	}
+	return nil, errors.New("block not found")
+}
+
+func (s *testChainBlockSource) GetRawBlocks(blockHashes []string) ([][]byte, []error, error) {
+	rawBlocks := make([][]byte, len(blockHashes))
+	errs := make([]error, len(blockHashes))
+	for i, blockHash := range blockHashes {
+		rawBlocks[i], errs[i] = s.GetRawBlock(blockHash)
+	}
+	return rawBlocks, errs, nil
+}
+
+// useTestBlockSourceOf sets the block source for the test, nil leaves it to be initialized from the config
+func useTestBlockSourceOf(t *testing.T, source BlockSource) {
+	savedBlockSource := blockSource
+	blockSource = source
+	t.Cleanup(func() {
+		blockSource = savedBlockSource
+	})
+}
+
+// packTestRawBlockIndexV1 writes the index record of version 1, which carries 32-bit positions
+func packTestRawBlockIndexV1(writer io.Writer, blockIndex *RawBlockIndex) error {
+	err := serialize.PackUint32(writer, blockIndex.BlockHeight)
+	if err != nil {
+		return err
+	}
+	err = blockIndex.BlockHash.Pack(writer)
+	if err != nil {
+		return err
+	}
+	for _, v := range []uint32{blockIndex.RawBlockSize, blockIndex.RawBlockFileTag, uint32(blockIndex.BlockFileStartPos), uint32(blockIndex.BlockFileEndPos)} {
+		err = serialize.PackUint32(writer, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTestLegacyData stores the raw blocks from height 1 without the genesis block, the last one in the raw block
+// file 1, and indexes them in the legacy version
+func writeTestLegacyData(t *testing.T, version uint32, rawBlocks [][]byte) {
+	fileTags := make([]uint32, len(rawBlocks))
+	fileTags[len(rawBlocks)-1] = 1
+	writeTestLegacyFiles(t, version, rawBlocks, fileTags)
+}
+
+// writeTestLegacyFiles stores the raw blocks from height 1 in the raw block files of the tags, and indexes them
+// in the legacy version, the raw block records of the versions before 3 carry no checksum
+func writeTestLegacyFiles(t *testing.T, version uint32, rawBlocks [][]byte, fileTags []uint32) {
+	rawBlockFiles := make([][]byte, fileTags[len(fileTags)-1]+1)
+	index := new(bytes.Buffer)
+	if version != 1 {
+		err := RawBlockIndexHeader{Magic: RawBlockIndexMagic, Version: version}.Pack(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, rawBlockData := range rawBlocks {
+		tag := fileTags[i]
+		// the raw block records carry checksums since the index of version 3
+		rawBlock := new(RawBlock)
+		rawBlock.BlockHeight = uint32(i + 1)
+		_ = rawBlock.BlockHash.SetHex(calcBlockHash(rawBlockData))
+		rawBlock.RawBlockData.SetData(rawBlockData)
+		rawBlock.NoChecksum = version < 3
+		buf := new(bytes.Buffer)
+		err := rawBlock.Pack(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := buf.Bytes()
+		blockIndex := new(RawBlockIndex)
+		blockIndex.BlockHeight = uint32(i + 1)
+		_ = blockIndex.BlockHash.SetHex(calcBlockHash(rawBlockData))
+		blockIndex.RawBlockSize = uint32(len(rawBlockData))
+		blockIndex.RawBlockFileTag = tag
+		blockIndex.BlockFileStartPos = uint64(len(rawBlockFiles[tag]))
+		blockIndex.BlockFileEndPos = uint64(len(rawBlockFiles[tag]) + len(record))
+		rawBlockFiles[tag] = append(rawBlockFiles[tag], record...)
+
+		if version == 1 {
+			err = packTestRawBlockIndexV1(index, blockIndex)
+		} else if version == 2 {
+			err = blockIndex.packBody(index)
+		} else {
+			err = blockIndex.Pack(index)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tag, data := range rawBlockFiles {
+		err := ioutil.WriteFile(getRawBlockFileName(uint32(tag)), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(config.DataConfig.DataDir+"/"+config.DataConfig.BlockIndexName, index.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkTestUpgradedData checks the index records from the genesis block locate the raw blocks
+func checkTestUpgradedData(t *testing.T, rawBlocks [][]byte) {
+	version, err := getBlockIndexVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != RawBlockIndexVersion {
+		t.Fatal("unexpected raw block index version", version)
+	}
+	blockIndexes := readTestBlockIndexes(t)
+	if len(blockIndexes) != len(rawBlocks) {
+		t.Fatal("unexpected raw block index count", len(blockIndexes))
+	}
+	for height, blockIndex := range blockIndexes {
+		if blockIndex.BlockHeight != uint32(height) || blockIndex.BlockHash.GetHex() != calcBlockHash(rawBlocks[height]) ||
+			blockIndex.RawBlockSize != uint32(len(rawBlocks[height])) {
+			t.Fatalf("unexpected index record of height %d", height)
+		}
+		rawBlockFileData, err := ioutil.ReadFile(getRawBlockFileName(blockIndex.RawBlockFileTag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptrRawBlock := new(RawBlock)
+		err = ptrRawBlock.UnPack(bytes.NewReader(rawBlockFileData[blockIndex.BlockFileStartPos:blockIndex.BlockFileEndPos]))
+		if err != nil {
+			t.Fatalf("unpack raw block of height %d: %v", height, err)
+		}
+		err = ptrRawBlock.Decompress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ptrRawBlock.BlockHeight != uint32(height) || !bytes.Equal(ptrRawBlock.RawBlockData.GetData(), rawBlocks[height]) {
+			t.Fatalf("unexpected raw block of height %d", height)
+		}
+	}
+}
+
+func TestUpgradeBlockIndex(t *testing.T) {
+	for _, version := range []uint32{1, 2, 3} {
+		for _, compressedType := range []string{"none", "zstd"} {
+			t.Run("v"+strconv.Itoa(int(version))+" "+compressedType, func(t *testing.T) {
+				useTestDataDir(t)
+				useTestNetwork(t, "bitcoin", "regtest")
+				config.DataConfig.CompressedType = compressedType
+				genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+				source := newTestChainBlockSource(genesisBlock)
+				useTestBlockSourceOf(t, source)
+				rawBlocks := buildTestRawBlocks(3)
+				writeTestLegacyData(t, version, rawBlocks)
+
+				err := upgradeBlockIndex()
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkTestUpgradedData(t, append([][]byte{genesisBlock}, rawBlocks...))
+				if source.calls == 0 {
+					t.Fatal("genesis block not fetched")
+				}
+				_, err = os.Stat(config.DataConfig.DataDir + "/" + config.DataConfig.BlockIndexName + ".upgrade")
+				if !os.IsNotExist(err) {
+					t.Fatal("upgraded index left aside", err)
+				}
+
+				// the upgraded index is not upgraded again
+				source.calls = 0
+				err = upgradeBlockIndex()
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkTestUpgradedData(t, append([][]byte{genesisBlock}, rawBlocks...))
+				if source.calls != 0 {
+					t.Fatal("genesis block fetched again")
+				}
+			})
+		}
+	}
+}
+
+func TestUpgradeBlockIndexInterrupted(t *testing.T) {
+	tests := []struct {
+		name string
+		// the state of the data directory left by the interrupted upgrade
+		interrupt func(t *testing.T, genesisBlock []byte)
+		fetched   bool
+	}{
+		// crashed while the upgraded index or the genesis block are written aside
+		{"before prepend", func(t *testing.T, genesisBlock []byte) {
+			err := ioutil.WriteFile(config.DataConfig.DataDir+"/"+config.DataConfig.BlockIndexName+".upgrade", []byte("partial"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(getRawBlockFileName(0)+".genesis", []byte("partial"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		// crashed after the genesis block is stored in front of the raw block file, before the index is replaced
+		{"after prepend", func(t *testing.T, genesisBlock []byte) {
+			err := migrateGenesisBlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			useTestBlockSourceOf(t, newTestChainBlockSource())
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestDataDir(t)
+			useTestNetwork(t, "bitcoin", "regtest")
+			genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+			useTestBlockSourceOf(t, newTestChainBlockSource(genesisBlock))
+			rawBlocks := buildTestRawBlocks(3)
+			writeTestLegacyData(t, 3, rawBlocks)
+			test.interrupt(t, genesisBlock)
+			source := blockSource.(*testChainBlockSource)
+
+			err := upgradeBlockIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTestUpgradedData(t, append([][]byte{genesisBlock}, rawBlocks...))
+			if (source.calls != 0) != test.fetched {
+				t.Fatal("unexpected calls to the block source", source.calls)
+			}
+		})
+	}
+}
+
+func TestRebuildIndexGenesisBlock(t *testing.T) {
+	useTestDataDir(t)
+	useTestNetwork(t, "bitcoin", "regtest")
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	rawBlocks := buildTestRawBlocks(3)
+	writeTestLegacyData(t, 3, rawBlocks)
+	// the block source is initialized from the config only when the genesis block is missing
+	useTestBlockSourceOf(t, nil)
+	config.RpcClientConfig.BlockSource = "unknown"
+
+	err := rebuildIndex()
+	if err == nil || !strings.Contains(err.Error(), "unknown block source") {
+		t.Fatal("unexpected error without the genesis block", err)
+	}
+
+	// the genesis block is stored, the reindex does not need the upstream
+	useTestBlockSourceOf(t, newTestChainBlockSource(genesisBlock))
+	err = migrateGenesisBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockSource = nil
+	err = rebuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestUpgradedData(t, append([][]byte{genesisBlock}, rawBlocks...))
+}
+
+func TestUpgradeLegacyFixture(t *testing.T) {
+	for _, version := range []uint32{1, 2} {
+		t.Run("v"+strconv.Itoa(int(version)), func(t *testing.T) {
+			useTestDataDir(t)
+			useTestNetwork(t, "bitcoin", "regtest")
+			useTestChain(t, nil)
+			savedLatestRawBlockMgr := latestRawBlockMgr
+			latestRawBlockMgr = new(RawBlockManager)
+			t.Cleanup(func() {
+				latestRawBlockMgr = savedLatestRawBlockMgr
+			})
+			genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+			useTestBlockSourceOf(t, newTestChainBlockSource(genesisBlock))
+			// a collected chain from height 1 over three raw block files, the first of which starts at height 1
+			_, rawBlocks := mineTestChain(t, calcBlockHash(genesisBlock), 1, 8, "legacy")
+			writeTestLegacyFiles(t, version, rawBlocks, []uint32{0, 0, 0, 1, 1, 1, 2, 2})
+
+			err := upgradeBlockIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			chainBlocks := append([][]byte{genesisBlock}, rawBlocks...)
+			checkTestUpgradedData(t, chainBlocks)
+			err = repairTail()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = verifyData()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// every record is read again through the index as the rpc server reads it
+			for height, rawBlockData := range chainBlocks {
+				ptrRawBlock, err := loadStoredRawBlock(uint32(height))
+				if err != nil {
+					t.Fatalf("load raw block of height %d: %v", height, err)
+				}
+				if ptrRawBlock.BlockHeight != uint32(height) || !bytes.Equal(ptrRawBlock.RawBlockData.GetData(), rawBlockData) {
+					t.Fatalf("unexpected raw block of height %d", height)
+				}
+			}
+			blockIndexes := readTestBlockIndexes(t)
+			if blockIndexes[len(blockIndexes)-1].RawBlockFileTag != 2 {
+				t.Fatal("unexpected raw block file of the tip", blockIndexes[len(blockIndexes)-1].RawBlockFileTag)
+			}
+		})
+	}
+}
@@ -3,10 +3,14 @@ module github.com/mutalisk999/btc_raw_block_collector
 go 1.14
 
 require (
+	github.com/go-zeromq/zmq4 v0.10.0
+	github.com/golang/snappy v0.0.2
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/rpc v1.2.0
+	github.com/klauspost/compress v1.11.4
 	github.com/mutalisk999/bitcoin-lib v0.0.0-20200608160650-d184f2ce1133
 	github.com/mutalisk999/go-lib v0.0.0-20200608161418-a271bd5ce979
 	github.com/onsi/gomega v1.10.2 // indirect
 	github.com/ybbus/jsonrpc v2.1.2+incompatible
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
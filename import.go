@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/block"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	BlkFileRecordHeaderSize   = 8
+	ImportSyncInterval        = 1000
+	ImportProgressInterval    = 10000
+	BlkFileObfuscationKeySize = 8
+)
+
+// BlkFile reads a blk*.dat file of bitcoin core, undoing the xor obfuscation of the newer versions
+type BlkFile struct {
+	FileObj *os.File
+	XorKey  []byte
+}
+
+func (f *BlkFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.FileObj.ReadAt(p, off)
+	if len(f.XorKey) != 0 {
+		for i := 0; i < n; i++ {
+			p[i] ^= f.XorKey[(off+int64(i))%int64(len(f.XorKey))]
+		}
+	}
+	return n, err
+}
+
+// BlkFileBlock is the location of a block found in the blk*.dat files, the block itself is read again when needed
+type BlkFileBlock struct {
+	FileNum int
+	Offset  int64
+	Size    uint32
+}
+
+func getBlkFileName(blocksDir string, fileNum int) string {
+	return filepath.Join(blocksDir, fmt.Sprintf("blk%05d.dat", fileNum))
+}
+
+// loadXorKey loads the obfuscation key of the blocks directory, nil if the files are not obfuscated
+func loadXorKey(blocksDir string) ([]byte, error) {
+	xorKey, err := ioutil.ReadFile(filepath.Join(blocksDir, "xor.dat"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(xorKey) != BlkFileObfuscationKeySize {
+		return nil, errors.New("invalid xor.dat size")
+	}
+	if bytes.Equal(xorKey, make([]byte, BlkFileObfuscationKeySize)) {
+		return nil, nil
+	}
+	return xorKey, nil
+}
+
+func openBlkFile(blocksDir string, fileNum int, xorKey []byte) (*BlkFile, error) {
+	fileObj, err := os.Open(getBlkFileName(blocksDir, fileNum))
+	if err != nil {
+		return nil, err
+	}
+	blkFile := new(BlkFile)
+	blkFile.FileObj = fileObj
+	blkFile.XorKey = xorKey
+	return blkFile, nil
+}
+
+// BlkFileReader reads the blocks at their locations, and keeps the blk files open
+type BlkFileReader struct {
+	BlocksDir string
+	XorKey    []byte
+	blkFiles  map[int]*BlkFile
+}
+
+func newBlkFileReader(blocksDir string, xorKey []byte) *BlkFileReader {
+	r := new(BlkFileReader)
+	r.BlocksDir = blocksDir
+	r.XorKey = xorKey
+	r.blkFiles = make(map[int]*BlkFile)
+	return r
+}
+
+func (r *BlkFileReader) readAt(blkFileBlock BlkFileBlock, size uint32) ([]byte, error) {
+	blkFile, ok := r.blkFiles[blkFileBlock.FileNum]
+	if !ok {
+		var err error
+		blkFile, err = openBlkFile(r.BlocksDir, blkFileBlock.FileNum, r.XorKey)
+		if err != nil {
+			return nil, err
+		}
+		r.blkFiles[blkFileBlock.FileNum] = blkFile
+	}
+	data := make([]byte, size)
+	_, err := blkFile.ReadAt(data, blkFileBlock.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (r *BlkFileReader) ReadBlockHeader(blkFileBlock BlkFileBlock) (*block.BlockHeader, error) {
+	headerBytes, err := r.readAt(blkFileBlock, BlockHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	blockHeader := new(block.BlockHeader)
+	err = blockHeader.UnPack(bytes.NewReader(headerBytes))
+	if err != nil {
+		return nil, err
+	}
+	return blockHeader, nil
+}
+
+func (r *BlkFileReader) ReadBlock(blkFileBlock BlkFileBlock) ([]byte, error) {
+	return r.readAt(blkFileBlock, blkFileBlock.Size)
+}
+
+func (r *BlkFileReader) Close() {
+	for _, blkFile := range r.blkFiles {
+		_ = blkFile.FileObj.Close()
+	}
+	r.blkFiles = make(map[int]*BlkFile)
+}
+
+// checkBlkFileNetwork checks the magic of the first record matches with the network
+func checkBlkFileNetwork(blocksDir string, xorKey []byte) error {
+	blkFile, err := openBlkFile(blocksDir, 0, xorKey)
+	if err != nil {
+		return err
+	}
+	defer blkFile.FileObj.Close()
+	var magic [4]byte
+	_, err = blkFile.ReadAt(magic[:], 0)
+	if err != nil {
+		return err
+	}
+	if magic != networkParams.DiskMagic {
+		return errors.New(getBlkFileName(blocksDir, 0) + " is not of " + networkParams.Chain + " " + networkParams.Name)
+	}
+	return nil
+}
+
+// scanBlkFile records the location of every block in the blk file, stops at the zero filled or partial tail
+func scanBlkFile(blkFile *BlkFile, fileNum int, magic [4]byte, blocks map[string]BlkFileBlock) error {
+	fileInfo, err := blkFile.FileObj.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := fileInfo.Size()
+	recordHeader := make([]byte, BlkFileRecordHeaderSize)
+	headerBytes := make([]byte, BlockHeaderSize)
+	var offSet int64 = 0
+	for offSet+BlkFileRecordHeaderSize <= fileSize {
+		_, err = blkFile.ReadAt(recordHeader, offSet)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(recordHeader[0:4], make([]byte, 4)) {
+			break
+		}
+		if !bytes.Equal(recordHeader[0:4], magic[:]) {
+			// skip the garbage till the next magic, as bitcoin core does on reindex
+			offSet++
+			continue
+		}
+		blockSize, _ := serialize.UnPackUint32(bytes.NewReader(recordHeader[4:8]))
+		if blockSize < BlockHeaderSize || blockSize > networkParams.MaxBlockSize || offSet+BlkFileRecordHeaderSize+int64(blockSize) > fileSize {
+			offSet++
+			continue
+		}
+		_, err = blkFile.ReadAt(headerBytes, offSet+BlkFileRecordHeaderSize)
+		if err != nil {
+			return err
+		}
+		blockHash := calcBlockHash(headerBytes)
+		if _, ok := blocks[blockHash]; !ok {
+			blocks[blockHash] = BlkFileBlock{fileNum, offSet + BlkFileRecordHeaderSize, blockSize}
+		}
+		offSet = offSet + BlkFileRecordHeaderSize + int64(blockSize)
+	}
+	return nil
+}
+
+// calcBlockWork returns 2^256 / (target + 1)
+func calcBlockWork(bits uint32) *big.Int {
+	target := compactToTarget(bits)
+	if target == nil {
+		return big.NewInt(0)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+// selectBestChain follows the headers from the genesis, and returns the hashes of the most work chain by height,
+// the headers are read back from the blk files
+func selectBestChain(genesisHash string, blocks map[string]BlkFileBlock, reader *BlkFileReader) ([]string, error) {
+	genesisBlock, ok := blocks[genesisHash]
+	if !ok {
+		return nil, errors.New("genesis block not found in the blk files")
+	}
+	genesisHeader, err := reader.ReadBlockHeader(genesisBlock)
+	if err != nil {
+		return nil, err
+	}
+	type childBlock struct {
+		blockHash string
+		bits      uint32
+	}
+	children := make(map[string][]childBlock)
+	for blockHash, blkFileBlock := range blocks {
+		if blockHash == genesisHash {
+			continue
+		}
+		blockHeader, err := reader.ReadBlockHeader(blkFileBlock)
+		if err != nil {
+			return nil, err
+		}
+		prevBlockHash := blockHeader.HashPrevBlock.GetHex()
+		children[prevBlockHash] = append(children[prevBlockHash], childBlock{blockHash, blockHeader.Bits})
+	}
+
+	type chainTip struct {
+		blockHash string
+		height    uint32
+		chainWork *big.Int
+	}
+	bestTip := chainTip{genesisHash, 0, calcBlockWork(genesisHeader.Bits)}
+	queue := []chainTip{bestTip}
+	for len(queue) != 0 {
+		tip := queue[0]
+		queue = queue[1:]
+		if tip.chainWork.Cmp(bestTip.chainWork) > 0 {
+			bestTip = tip
+		}
+		for _, child := range children[tip.blockHash] {
+			childWork := new(big.Int).Add(tip.chainWork, calcBlockWork(child.bits))
+			queue = append(queue, chainTip{child.blockHash, tip.height + 1, childWork})
+		}
+		delete(children, tip.blockHash)
+	}
+
+	chain := make([]string, bestTip.height+1)
+	blockHash := bestTip.blockHash
+	for height := int64(bestTip.height); height > 0; height-- {
+		chain[height] = blockHash
+		blockHeader, err := reader.ReadBlockHeader(blocks[blockHash])
+		if err != nil {
+			return nil, err
+		}
+		blockHash = blockHeader.HashPrevBlock.GetHex()
+	}
+	chain[0] = genesisHash
+	return chain, nil
+}
+
+// writeImportBlockIndexes syncs the raw block data, and then writes the index records which point to it
+func writeImportBlockIndexes(blockIndexes []*RawBlockIndex) error {
+	err := latestRawBlockMgr.Sync()
+	if err != nil {
+		return err
+	}
+	for _, blockIndex := range blockIndexes {
+		err = blockIndexMgr.AddNewBlockIndex(blockIndex)
+		if err != nil {
+			return err
+		}
+	}
+	return blockIndexMgr.Sync()
+}
+
+func importBlocks(blocksDir string) error {
+	var err error
+	xorKey, err := loadXorKey(blocksDir)
+	if err != nil {
+		return err
+	}
+	err = checkBlkFileNetwork(blocksDir, xorKey)
+	if err != nil {
+		return err
+	}
+
+	// locate the blocks in all blk files
+	fileCount := 0
+	for {
+		_, err = os.Stat(getBlkFileName(blocksDir, fileCount))
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
+		fileCount++
+	}
+	blocks := make(map[string]BlkFileBlock)
+	for fileNum := 0; fileNum < fileCount; fileNum++ {
+		blkFile, err := openBlkFile(blocksDir, fileNum, xorKey)
+		if err != nil {
+			return err
+		}
+		err = scanBlkFile(blkFile, fileNum, networkParams.DiskMagic, blocks)
+		_ = blkFile.FileObj.Close()
+		if err != nil {
+			return err
+		}
+		var completeRate float64 = float64(fileNum+1) * float64(100) / float64(fileCount)
+		fmt.Println("scan", filepath.Base(getBlkFileName(blocksDir, fileNum)), "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+	}
+
+	reader := newBlkFileReader(blocksDir, xorKey)
+	defer reader.Close()
+	chain, err := selectBestChain(networkParams.GenesisHash, blocks, reader)
+	if err != nil {
+		return err
+	}
+	bestHeight := uint32(len(chain) - 1)
+	fmt.Println("found", len(blocks), "blocks in", fileCount, "blk files, best chain height", bestHeight)
+
+	// continue from the stored tip, which must be on the imported chain
+	tipHeight, startHeight := getStoredTip()
+	tipHash, _ := getStoredBlockHash(tipHeight)
+	if startHeight > 0 && (tipHeight > bestHeight || tipHash != chain[tipHeight]) {
+		return errors.New("stored block at height " + strconv.Itoa(int(tipHeight)) + " is not on the chain of the blk files")
+	}
+
+	// the index records of a batch are written after the raw block data of the batch is synced
+	pendingBlockIndexes := make([]*RawBlockIndex, 0, ImportSyncInterval)
+	for height := startHeight; height <= bestHeight && !quitFlag; height++ {
+		blockHash := chain[height]
+		blkFileBlock := blocks[blockHash]
+		rawBlockData, err := reader.ReadBlock(blkFileBlock)
+		if err != nil {
+			return err
+		}
+
+		err = validateRawBlock(height, blockHash, rawBlockData)
+		if err != nil {
+			return errors.New("invalid block at height " + strconv.Itoa(int(height)) + " in " + getBlkFileName(blocksDir, blkFileBlock.FileNum) + ": " + err.Error())
+		}
+		rawBlockNew := new(RawBlock)
+		rawBlockNew.BlockHeight = height
+		_ = rawBlockNew.BlockHash.SetHex(blockHash)
+		rawBlockNew.CompressedType = CompressedTypeNone
+		rawBlockNew.RawBlockData.SetData(rawBlockData)
+		blockIndexNew, err := storeNewBlockData(rawBlockNew, blockHash, blkFileBlock.Size)
+		if err != nil {
+			return err
+		}
+		pendingBlockIndexes = append(pendingBlockIndexes, blockIndexNew)
+
+		if len(pendingBlockIndexes) == ImportSyncInterval {
+			err = writeImportBlockIndexes(pendingBlockIndexes)
+			if err != nil {
+				return err
+			}
+			pendingBlockIndexes = pendingBlockIndexes[:0]
+		}
+		if height%ImportProgressInterval == 0 || height == bestHeight {
+			var completeRate float64 = float64(height-startHeight+1) * float64(100) / float64(bestHeight-startHeight+1)
+			fmt.Println("import block height", height, "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+		}
+	}
+
+	err = writeImportBlockIndexes(pendingBlockIndexes)
+	if err != nil {
+		return err
+	}
+	err = blockHeaderMgr.Sync()
+	if err != nil {
+		return err
+	}
+	err = syncIndexes()
+	if err != nil {
+		return err
+	}
+	fmt.Println("import has been finished, block height", latestRawBlockMgr.BlockHeight)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestBlkFile writes the blocks as the records of a blk file, obfuscated with the xor key
+func writeTestBlkFile(t *testing.T, blocksDir string, fileNum int, xorKey []byte, garbage []byte, rawBlocks ...[]byte) {
+	buf := bytes.NewBuffer(append([]byte{}, garbage...))
+	for _, rawBlock := range rawBlocks {
+		buf.Write(networkParams.DiskMagic[:])
+		_ = serialize.PackUint32(buf, uint32(len(rawBlock)))
+		buf.Write(rawBlock)
+	}
+	// the preallocated tail of the file
+	buf.Write(make([]byte, 64))
+	data := buf.Bytes()
+	if len(xorKey) != 0 {
+		for i := range data {
+			data[i] ^= xorKey[i%len(xorKey)]
+		}
+	}
+	err := ioutil.WriteFile(getBlkFileName(blocksDir, fileNum), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportSelectBestChain(t *testing.T) {
+	useTestNetwork(t, "bitcoin", "regtest")
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	genesisHash := calcBlockHash(genesisBlock)
+	hash1, block1 := mineTestBlock(t, genesisHash, buildTestCoinbase(1, "main", []byte{0x51}))
+	hash2, block2 := mineTestBlock(t, hash1, buildTestCoinbase(2, "main", []byte{0x51}))
+	hash3, block3 := mineTestBlock(t, hash2, buildTestCoinbase(3, "main", []byte{0x51}))
+	forkHash1, forkBlock1 := mineTestBlock(t, genesisHash, buildTestCoinbase(1, "fork", []byte{0x51}))
+	_, forkBlock2 := mineTestBlock(t, forkHash1, buildTestCoinbase(2, "fork", []byte{0x51}))
+
+	tests := []struct {
+		name   string
+		xorKey []byte
+	}{
+		{"plain", nil},
+		{"obfuscated", []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocksDir, err := ioutil.TempDir("", "blocks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(blocksDir)
+			if test.xorKey != nil {
+				err = ioutil.WriteFile(filepath.Join(blocksDir, "xor.dat"), test.xorKey, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// out of height order, with a shorter fork and garbage between the records
+			writeTestBlkFile(t, blocksDir, 0, test.xorKey, nil, genesisBlock, block2, forkBlock1)
+			writeTestBlkFile(t, blocksDir, 1, test.xorKey, []byte{0xff, 0xfe}, block3, forkBlock2, block1)
+
+			xorKey, err := loadXorKey(blocksDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(xorKey, test.xorKey) {
+				t.Fatal("unexpected xor key", xorKey)
+			}
+			err = checkBlkFileNetwork(blocksDir, xorKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks := make(map[string]BlkFileBlock)
+			for fileNum := 0; fileNum < 2; fileNum++ {
+				blkFile, err := openBlkFile(blocksDir, fileNum, xorKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = scanBlkFile(blkFile, fileNum, networkParams.DiskMagic, blocks)
+				_ = blkFile.FileObj.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(blocks) != 6 {
+				t.Fatal("unexpected block count", len(blocks))
+			}
+
+			reader := newBlkFileReader(blocksDir, xorKey)
+			defer reader.Close()
+			chain, err := selectBestChain(genesisHash, blocks, reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedChain := []string{genesisHash, hash1, hash2, hash3}
+			if len(chain) != len(expectedChain) {
+				t.Fatal("unexpected best chain height", len(chain)-1)
+			}
+			rawBlocks := [][]byte{genesisBlock, block1, block2, block3}
+			for height, blockHash := range chain {
+				if blockHash != expectedChain[height] {
+					t.Fatalf("unexpected block hash at height %d", height)
+				}
+				rawBlock, err := reader.ReadBlock(blocks[blockHash])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(rawBlock, rawBlocks[height]) {
+					t.Fatalf("unexpected raw block at height %d", height)
+				}
+			}
+		})
+	}
+}
+
+func TestImportSelectBestChainWithoutGenesis(t *testing.T) {
+	useTestNetwork(t, "bitcoin", "regtest")
+	_, err := selectBestChain(networkParams.GenesisHash, map[string]BlkFileBlock{}, newBlkFileReader("", nil))
+	if err == nil {
+		t.Fatal("best chain selected without the genesis block")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+)
+
+// the optional indexes derived from the stored blocks, each is maintained along with the raw blocks if enabled
+
+// initIndexes opens the enabled indexes and indexes the stored blocks below blockCount which are not indexed yet
+func initIndexes(blockCount uint32) error {
+	var err error
+	if config.DataConfig.TxIndex {
+		txIndexMgr = new(TxIndexManager)
+		err = txIndexMgr.Init(config.DataConfig.DataDir, config.DataConfig.TxIndexName)
+		if err != nil {
+			return err
+		}
+		err = txIndexMgr.Catchup(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	if config.DataConfig.AddressIndex {
+		addressIndexMgr = new(AddressIndexManager)
+		err = addressIndexMgr.Init(config.DataConfig.DataDir, config.DataConfig.AddressIndexName)
+		if err != nil {
+			return err
+		}
+		err = addressIndexMgr.Catchup(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	if config.DataConfig.UtxoSet {
+		utxoSetMgr = new(UtxoSetManager)
+		err = utxoSetMgr.Init(config.DataConfig.DataDir, config.DataConfig.UtxoSetName)
+		if err != nil {
+			return err
+		}
+		err = utxoSetMgr.Catchup(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	if config.DataConfig.SpentIndex {
+		spentIndexMgr = new(SpentIndexManager)
+		err = spentIndexMgr.Init(config.DataConfig.DataDir, config.DataConfig.SpentIndexName)
+		if err != nil {
+			return err
+		}
+		err = spentIndexMgr.Catchup(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	// the block filter reads the outputs spent by a block from the utxo set, which is caught up to the stored blocks above
+	if config.DataConfig.BlockFilterIndex {
+		if utxoSetMgr == nil {
+			return errors.New("blockFilterIndex needs utxoSet enabled in config.json")
+		}
+		blockFilterMgr = new(BlockFilterManager)
+		err = blockFilterMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockFilterName)
+		if err != nil {
+			return err
+		}
+		err = blockFilterMgr.Catchup(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBlockToIndexes indexes the decompressed raw block data of the new stored block
+func addBlockToIndexes(blockHeight uint32, rawBlockData []byte) error {
+	var err error
+	if txIndexMgr != nil {
+		err = txIndexMgr.AddBlockTxIndex(blockHeight, rawBlockData)
+		if err != nil {
+			return err
+		}
+	}
+	if addressIndexMgr != nil {
+		err = addressIndexMgr.AddBlockAddressIndex(blockHeight, rawBlockData)
+		if err != nil {
+			return err
+		}
+	}
+	if utxoSetMgr != nil {
+		err = utxoSetMgr.AddBlockUtxoSet(blockHeight, rawBlockData)
+		if err != nil {
+			return err
+		}
+	}
+	if spentIndexMgr != nil {
+		err = spentIndexMgr.AddBlockSpentIndex(blockHeight, rawBlockData)
+		if err != nil {
+			return err
+		}
+	}
+	if blockFilterMgr != nil {
+		err = blockFilterMgr.AddBlockFilter(blockHeight, rawBlockData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateIndexes keeps the indexes of the first blockCount blocks, called when the blocks are rolled back
+func truncateIndexes(blockCount uint32) error {
+	var err error
+	if txIndexMgr != nil {
+		err = txIndexMgr.TruncateTxIndex(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	if addressIndexMgr != nil {
+		err = addressIndexMgr.TruncateAddressIndex(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	if utxoSetMgr != nil {
+		err = utxoSetMgr.TruncateUtxoSet(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	if spentIndexMgr != nil {
+		err = spentIndexMgr.TruncateSpentIndex(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	if blockFilterMgr != nil {
+		err = blockFilterMgr.TruncateBlockFilter(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncIndexes() error {
+	var err error
+	if txIndexMgr != nil {
+		err = txIndexMgr.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	if addressIndexMgr != nil {
+		err = addressIndexMgr.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	if utxoSetMgr != nil {
+		err = utxoSetMgr.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	if spentIndexMgr != nil {
+		err = spentIndexMgr.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	if blockFilterMgr != nil {
+		err = blockFilterMgr.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func closeIndexes() {
+	if txIndexMgr != nil {
+		_ = txIndexMgr.TxIndexFileObj.Close()
+	}
+	if addressIndexMgr != nil {
+		_ = addressIndexMgr.AddressIndexFileObj.Close()
+	}
+	if utxoSetMgr != nil {
+		_ = utxoSetMgr.UtxoSetFileObj.Close()
+	}
+	if spentIndexMgr != nil {
+		_ = spentIndexMgr.SpentIndexFileObj.Close()
+	}
+	if blockFilterMgr != nil {
+		_ = blockFilterMgr.BlockFilterFileObj.Close()
+	}
+}
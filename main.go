@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
 	"github.com/mutalisk999/go-lib/src/sched/goroutine_mgr"
 	"io"
 	"os"
@@ -15,6 +17,7 @@ import (
 var goroutineMgr *goroutine_mgr.GoroutineManager
 var blockIndexMgr *RawBlockIndexManager
 var latestRawBlockMgr *RawBlockManager
+var staleBlockMgr *StaleBlockManager
 
 var config Config
 
@@ -24,11 +27,154 @@ var quitChan chan byte
 var heightToHashMap = make(map[uint32]string)
 var hashToHeightMap = make(map[string]uint32)
 
+func getRawBlockFileName(tag uint32) string {
+	return config.DataConfig.DataDir + "/" + config.DataConfig.RawBlockFilePrefix + "." + strconv.Itoa(int(tag))
+}
+
+func loadBlockIndex(blockHeight uint32) (*RawBlockIndex, error) {
+	var err error
+	IndexMgr := new(RawBlockIndexManager)
+	err = IndexMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockIndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	defer IndexMgr.BlockIndexFileObj.Close()
+	_, err = IndexMgr.BlockIndexFileObj.Seek(getBlockIndexPos(blockHeight), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	ptrBlockIndex := new(RawBlockIndex)
+	err = ptrBlockIndex.UnPack(IndexMgr.BlockIndexFileObj)
+	if err != nil {
+		return nil, err
+	}
+	return ptrBlockIndex, nil
+}
+
+func loadRawBlock(ptrBlockIndex *RawBlockIndex) (*RawBlock, error) {
+	var err error
+	rawBlockMgr := new(RawBlockManager)
+	err = rawBlockMgr.Init(config.DataConfig.DataDir, config.DataConfig.RawBlockFilePrefix, ptrBlockIndex.RawBlockFileTag)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rawBlockMgr.RawBlockFileObj.Close()
+	_, err = rawBlockMgr.RawBlockFileObj.Seek(int64(ptrBlockIndex.BlockFileStartPos), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	ptrRawBlock := new(RawBlock)
+	err = ptrRawBlock.UnPack(rawBlockMgr.RawBlockFileObj)
+	if err != nil {
+		return nil, err
+	}
+	return ptrRawBlock, nil
+}
+
+// loadStoredRawBlock returns the decompressed raw block of the stored block height
+func loadStoredRawBlock(blockHeight uint32) (*RawBlock, error) {
+	ptrBlockIndex, err := loadBlockIndex(blockHeight)
+	if err != nil {
+		return nil, err
+	}
+	ptrRawBlock, err := loadRawBlock(ptrBlockIndex)
+	if err != nil {
+		return nil, err
+	}
+	err = ptrRawBlock.Decompress()
+	if err != nil {
+		return nil, err
+	}
+	return ptrRawBlock, nil
+}
+
+// loadBlockTxCount reads the transaction count after the header of the stored block, only the front of the
+// uncompressed raw block is read, the compressed one is decompressed as a whole
+func loadBlockTxCount(blockHeight uint32) (int, error) {
+	ptrBlockIndex, err := loadBlockIndex(blockHeight)
+	if err != nil {
+		return 0, err
+	}
+	rawBlockFileObj, err := os.Open(getRawBlockFileName(ptrBlockIndex.RawBlockFileTag))
+	if err != nil {
+		return 0, err
+	}
+	defer rawBlockFileObj.Close()
+	reader := bufio.NewReader(io.NewSectionReader(rawBlockFileObj, int64(ptrBlockIndex.BlockFileStartPos), int64(ptrBlockIndex.BlockFileEndPos-ptrBlockIndex.BlockFileStartPos)))
+
+	// skip the block height and the block hash of the record
+	_, err = reader.Discard(4 + 32)
+	if err != nil {
+		return 0, err
+	}
+	compressedType, err := serialize.UnPackByte(reader)
+	if err != nil {
+		return 0, err
+	}
+	compressedType = compressedType &^ RawBlockChecksumFlag
+	rawBlockDataSize, err := serialize.UnPackCompactSize(reader)
+	if err != nil {
+		return 0, err
+	}
+	var rawBlockReader io.Reader = io.LimitReader(reader, int64(rawBlockDataSize))
+	if compressedType != CompressedTypeNone {
+		compressedData := make([]byte, rawBlockDataSize)
+		_, err = io.ReadFull(reader, compressedData)
+		if err != nil {
+			return 0, err
+		}
+		rawBlockData, err := decompressData(compressedType, compressedData)
+		if err != nil {
+			return 0, err
+		}
+		rawBlockReader = bytes.NewReader(rawBlockData)
+	}
+	_, _, _, err = unpackChainHeader(rawBlockReader)
+	if err != nil {
+		return 0, err
+	}
+	txCount, err := serialize.UnPackCompactSize(rawBlockReader)
+	if err != nil {
+		return 0, err
+	}
+	return int(txCount), nil
+}
+
+func getFileBlockCount(fileTag uint32, tipHeight uint32) (uint32, error) {
+	var err error
+	IndexMgr := new(RawBlockIndexManager)
+	err = IndexMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockIndexName)
+	if err != nil {
+		return 0, err
+	}
+
+	defer IndexMgr.BlockIndexFileObj.Close()
+	var blockCount uint32 = 0
+	for height := int64(tipHeight); height >= 0; height-- {
+		_, err = IndexMgr.BlockIndexFileObj.Seek(getBlockIndexPos(uint32(height)), io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		ptrBlockIndex := new(RawBlockIndex)
+		err = ptrBlockIndex.UnPack(IndexMgr.BlockIndexFileObj)
+		if err != nil {
+			return 0, err
+		}
+		if ptrBlockIndex.RawBlockFileTag != fileTag {
+			break
+		}
+		blockCount++
+	}
+	return blockCount, nil
+}
+
 func getLatestRawBlockTag() (uint32, error) {
 	var tag uint32 = 0
 	for {
 		var tagNext = tag + 1
-		rawBlockFileNext := config.DataConfig.DataDir + "/" + config.DataConfig.RawBlockFilePrefix + "." + strconv.Itoa(int(tagNext))
+		rawBlockFileNext := getRawBlockFileName(tagNext)
 		_, err := os.Stat(rawBlockFileNext)
 		if err != nil {
 			break
@@ -47,6 +193,39 @@ func appInit() error {
 	goroutineMgr = new(goroutine_mgr.GoroutineManager)
 	goroutineMgr.Initialise("MainGoroutineManager")
 
+	// init the parameters of the network
+	err = initNetworkParams()
+	if err != nil {
+		return err
+	}
+	// the data directory must belong to the configured network before anything is written to it
+	_, err = checkDataDirMeta()
+	if err != nil {
+		return err
+	}
+
+	// init the upstream of the blocks
+	err = initBlockSource()
+	if err != nil {
+		return err
+	}
+	err = checkBlockSourceNetwork()
+	if err != nil {
+		return err
+	}
+
+	// upgrade raw block index from the legacy format
+	err = upgradeBlockIndex()
+	if err != nil {
+		return err
+	}
+
+	// repair the tail of raw block index and raw block files left by a crash
+	err = repairTail()
+	if err != nil {
+		return err
+	}
+
 	// init raw block index manager
 	blockIndexMgr = new(RawBlockIndexManager)
 	err = blockIndexMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockIndexName)
@@ -54,6 +233,17 @@ func appInit() error {
 		return err
 	}
 
+	// init stale block manager
+	staleBlockMgr = new(StaleBlockManager)
+	err = staleBlockMgr.Init(config.DataConfig.DataDir, config.DataConfig.StaleBlockName)
+	if err != nil {
+		return err
+	}
+
+	// init chain state manager
+	chainStateMgr = new(ChainStateManager)
+	chainStateMgr.Init()
+
 	// find latest raw block tag
 	tag, err := getLatestRawBlockTag()
 	if err != nil {
@@ -66,19 +256,29 @@ func appInit() error {
 	if err != nil {
 		return err
 	}
+	latestRawBlockMgr.CompressedType, err = getCompressedType(config.DataConfig.CompressedType)
+	if err != nil {
+		return err
+	}
+	latestRawBlockMgr.MaxFileSize = config.DataConfig.MaxFileSize
+	latestRawBlockMgr.MaxFileBlocks = config.DataConfig.MaxFileBlocks
+	latestRawBlockMgr.FileHeightAlign = config.DataConfig.FileHeightAlign
+	if latestRawBlockMgr.MaxFileSize == 0 && latestRawBlockMgr.MaxFileBlocks == 0 && latestRawBlockMgr.FileHeightAlign == 0 {
+		latestRawBlockMgr.MaxFileSize = DefaultMaxFileSize
+	}
 	indexInfo, err := os.Stat(config.DataConfig.DataDir + "/" + config.DataConfig.BlockIndexName)
 	if err != nil {
 		return err
 	}
-	latestRawBlockInfo, err := os.Stat(config.DataConfig.DataDir + "/" + config.DataConfig.RawBlockFilePrefix + "." + strconv.Itoa(int(tag)))
+	latestRawBlockInfo, err := os.Stat(getRawBlockFileName(tag))
 	if err != nil {
 		return err
 	}
 
 	// verify raw block and raw block index
-	if indexInfo.Size() != 0 {
+	if indexInfo.Size() > RawBlockIndexHeaderSize {
 		indexSize := indexInfo.Size()
-		if indexSize%RawBlockIndexSize != 0 {
+		if (indexSize-RawBlockIndexHeaderSize)%RawBlockIndexSize != 0 {
 			return errors.New("invalid raw block index size")
 		}
 		// the latest block index
@@ -98,21 +298,22 @@ func appInit() error {
 		}
 
 		latestRawBlockMgr.BlockHeight = ptrBlockIndex.BlockHeight
+		latestRawBlockMgr.BlockCount = ptrBlockIndex.BlockHeight + 1
 		latestRawBlockMgr.BlockFileEndPos = ptrBlockIndex.BlockFileEndPos
 		if ptrBlockIndex.RawBlockFileTag != latestRawBlockMgr.RawBlockFileTag {
 			return errors.New("ptrBlockIndex.RawBlockFileTag != latestRawBlockMgr.RawBlockFileTag")
 		}
-		if ptrBlockIndex.BlockFileEndPos != uint32(latestRawBlockInfo.Size()) {
+		if ptrBlockIndex.BlockFileEndPos != uint64(latestRawBlockInfo.Size()) {
 			fmt.Println(ptrBlockIndex.BlockFileEndPos, latestRawBlockInfo.Size())
-			return errors.New("ptrBlockIndex.BlockFileEndPos != uint32(latestRawBlockInfo.Size())")
+			return errors.New("ptrBlockIndex.BlockFileEndPos != uint64(latestRawBlockInfo.Size())")
 		}
 
 		// load raw_block_index to map
-		_, err = IndexMgr.BlockIndexFileObj.Seek(0, io.SeekStart)
+		_, err = IndexMgr.BlockIndexFileObj.Seek(RawBlockIndexHeaderSize, io.SeekStart)
 		if err != nil {
 			return err
 		}
-		for i := 1; i <= int(latestRawBlockMgr.BlockHeight); i++ {
+		for i := 0; i <= int(latestRawBlockMgr.BlockHeight); i++ {
 			ptrBlockIndex := new(RawBlockIndex)
 			err := ptrBlockIndex.UnPack(IndexMgr.BlockIndexFileObj)
 			if err != nil {
@@ -120,20 +321,48 @@ func appInit() error {
 			}
 			heightToHashMap[ptrBlockIndex.BlockHeight] = ptrBlockIndex.BlockHash.GetHex()
 			hashToHeightMap[ptrBlockIndex.BlockHash.GetHex()] = ptrBlockIndex.BlockHeight
+			if ptrBlockIndex.RawBlockFileTag == latestRawBlockMgr.RawBlockFileTag {
+				latestRawBlockMgr.FileBlockCount++
+			}
 		}
 	} else {
 		latestRawBlockMgr.BlockHeight = uint32(0)
-		latestRawBlockMgr.BlockFileEndPos = uint32(0)
+		latestRawBlockMgr.BlockCount = uint32(0)
+		latestRawBlockMgr.BlockFileEndPos = uint64(0)
 		if latestRawBlockMgr.RawBlockFileTag != 0 || latestRawBlockInfo.Size() != 0 {
 			return errors.New("index is not match from raw block, need to rebuild index")
 		}
 	}
+
+	// init block header manager, the headers follow the stored blocks
+	blockHeaderMgr = new(BlockHeaderManager)
+	err = blockHeaderMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockHeaderName)
+	if err != nil {
+		return err
+	}
+	err = blockHeaderMgr.Catchup(latestRawBlockMgr.BlockCount)
+	if err != nil {
+		return err
+	}
+
+	// init the enabled indexes, the stored blocks not indexed yet are indexed here
+	err = initIndexes(latestRawBlockMgr.BlockCount)
+	if err != nil {
+		return err
+	}
+
+	// stamp the data directory with the network on the first run
+	err = stampDataDir()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 func appRun() error {
 	startSignalHandler()
 	startRpcServer()
+	startZmqNotifier()
 	startGatherBlock()
 	return nil
 }
@@ -177,6 +406,9 @@ func appCmd() error {
 	// sync and close
 	_ = blockIndexMgr.BlockIndexFileObj.Close()
 	_ = latestRawBlockMgr.RawBlockFileObj.Close()
+	_ = staleBlockMgr.StaleBlockFileObj.Close()
+	_ = blockHeaderMgr.BlockHeaderFileObj.Close()
+	closeIndexes()
 
 	return nil
 }
@@ -192,6 +424,20 @@ func rebuildIndex() error {
 			return err
 		}
 	}
+	// the block headers are loaded again from the raw blocks on startup
+	_, err = os.Stat(config.DataConfig.DataDir + "/" + config.DataConfig.BlockHeaderName)
+	if err == nil {
+		err = os.Remove(config.DataConfig.DataDir + "/" + config.DataConfig.BlockHeaderName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// store the genesis block in front of the raw block files collected without it
+	err = migrateGenesisBlock()
+	if err != nil {
+		return err
+	}
 
 	// init raw block index manager
 	indexMgr := new(RawBlockIndexManager)
@@ -206,6 +452,7 @@ func rebuildIndex() error {
 		return err
 	}
 
+	var blockCount uint32 = 0
 	for i := 0; i <= int(tag); i++ {
 		// raw block manager
 		rawBlockMgr := new(RawBlockManager)
@@ -213,20 +460,27 @@ func rebuildIndex() error {
 		if err != nil {
 			return err
 		}
-		rawBlockInfo, err := os.Stat(config.DataConfig.DataDir + "/" + config.DataConfig.RawBlockFilePrefix + "." + strconv.Itoa(i))
+		rawBlockInfo, err := os.Stat(getRawBlockFileName(uint32(i)))
 		if err != nil {
 			return err
 		}
 
-		var offSetBefore uint32 = 0
-		var offSetAfter uint32 = 0
+		var offSetBefore uint64 = 0
+		var offSetAfter uint64 = 0
 		for {
 			ptrRawBlock := new(RawBlock)
 			err := ptrRawBlock.UnPack(rawBlockMgr.RawBlockFileObj)
 			if err != nil {
 				return err
 			}
+			if ptrRawBlock.BlockHeight != blockCount {
+				return errors.New("unexpected block height " + strconv.Itoa(int(ptrRawBlock.BlockHeight)) + " in " + getRawBlockFileName(uint32(i)) + ", expect " + strconv.Itoa(int(blockCount)))
+			}
 			offSetAfter = offSetBefore + ptrRawBlock.PackSize()
+			err = ptrRawBlock.Decompress()
+			if err != nil {
+				return err
+			}
 
 			// add new block index
 			blockIndexNew := new(RawBlockIndex)
@@ -240,8 +494,9 @@ func rebuildIndex() error {
 			if err != nil {
 				return err
 			}
+			blockCount++
 
-			if offSetAfter == uint32(rawBlockInfo.Size()) {
+			if offSetAfter == uint64(rawBlockInfo.Size()) {
 				// reach the end of the raw block file
 				break
 			}
@@ -255,6 +510,161 @@ func rebuildIndex() error {
 	return nil
 }
 
+func getBlockIndexVersion() (uint32, error) {
+	indexFile, err := os.Open(config.DataConfig.DataDir + "/" + config.DataConfig.BlockIndexName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return RawBlockIndexVersion, nil
+		}
+		return 0, err
+	}
+	defer indexFile.Close()
+
+	indexHeader := new(RawBlockIndexHeader)
+	err = indexHeader.UnPack(indexFile)
+	if err == io.EOF {
+		// empty index
+		return RawBlockIndexVersion, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if indexHeader.Magic != RawBlockIndexMagic {
+		// the headerless index of version 1
+		return 1, nil
+	}
+	return indexHeader.Version, nil
+}
+
+// upgradeBlockIndex rewrites the legacy raw block index in the current version, with the genesis block in front
+func upgradeBlockIndex() error {
+	version, err := getBlockIndexVersion()
+	if err != nil {
+		return err
+	}
+	if version == RawBlockIndexVersion {
+		return nil
+	}
+
+	var legacyHeaderSize int64
+	var legacyIndexSize int64
+	if version == 1 {
+		legacyHeaderSize = 0
+		legacyIndexSize = RawBlockIndexSizeV1
+	} else if version == 2 {
+		legacyHeaderSize = RawBlockIndexHeaderSize
+		legacyIndexSize = RawBlockIndexSizeV2
+	} else if version == 3 {
+		legacyHeaderSize = RawBlockIndexHeaderSize
+		legacyIndexSize = RawBlockIndexSize
+	} else {
+		return errors.New("not support raw block index version: " + strconv.Itoa(int(version)))
+	}
+
+	indexFileName := config.DataConfig.DataDir + "/" + config.DataConfig.BlockIndexName
+	legacyIndexInfo, err := os.Stat(indexFileName)
+	if err != nil {
+		return err
+	}
+	if (legacyIndexInfo.Size()-legacyHeaderSize)%legacyIndexSize != 0 {
+		return errors.New("invalid legacy raw block index size")
+	}
+	legacyIndexFile, err := os.Open(indexFileName)
+	if err != nil {
+		return err
+	}
+	defer legacyIndexFile.Close()
+	_, err = legacyIndexFile.Seek(legacyHeaderSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// the legacy versions are collected from height 1, the genesis block is stored in front of them
+	genesisBlock, genesisStored, err := loadGenesisBlock()
+	if err != nil {
+		return err
+	}
+	var genesisIndex *RawBlockIndex = nil
+	if genesisBlock != nil {
+		if genesisStored {
+			fmt.Println("the genesis block is already stored in front of", getRawBlockFileName(0)+", continue the interrupted upgrade")
+		}
+		genesisIndex, err = newGenesisBlockIndex(genesisBlock)
+		if err != nil {
+			return err
+		}
+	}
+
+	// write the upgraded index aside, and replace the legacy index when it's complete
+	upgradeIndexName := config.DataConfig.BlockIndexName + ".upgrade"
+	_ = os.Remove(config.DataConfig.DataDir + "/" + upgradeIndexName)
+	indexMgr := new(RawBlockIndexManager)
+	err = indexMgr.Init(config.DataConfig.DataDir, upgradeIndexName)
+	if err != nil {
+		return err
+	}
+	if genesisIndex != nil {
+		err = indexMgr.AddNewBlockIndex(genesisIndex)
+		if err != nil {
+			_ = indexMgr.BlockIndexFileObj.Close()
+			return err
+		}
+	}
+
+	fmt.Println("upgrade raw block index from version", version, "to version", RawBlockIndexVersion)
+	blockCount := (legacyIndexInfo.Size() - legacyHeaderSize) / legacyIndexSize
+	for i := int64(1); i <= blockCount; i++ {
+		ptrBlockIndex := new(RawBlockIndex)
+		if version == 1 {
+			legacyBlockIndex := new(RawBlockIndexV1)
+			err = legacyBlockIndex.UnPack(legacyIndexFile)
+			ptrBlockIndex = legacyBlockIndex.Upgrade()
+		} else if version == 2 {
+			err = ptrBlockIndex.UnPackV2(legacyIndexFile)
+		} else {
+			err = ptrBlockIndex.UnPack(legacyIndexFile)
+		}
+		if err != nil {
+			_ = indexMgr.BlockIndexFileObj.Close()
+			return err
+		}
+		if genesisIndex != nil && ptrBlockIndex.RawBlockFileTag == 0 {
+			ptrBlockIndex.BlockFileStartPos += genesisIndex.BlockFileEndPos
+			ptrBlockIndex.BlockFileEndPos += genesisIndex.BlockFileEndPos
+		}
+		err = indexMgr.AddNewBlockIndex(ptrBlockIndex)
+		if err != nil {
+			_ = indexMgr.BlockIndexFileObj.Close()
+			return err
+		}
+		if i%100000 == 0 || i == blockCount {
+			var completeRate float64 = float64(i) * float64(100) / float64(blockCount)
+			fmt.Println("upgrade", config.DataConfig.BlockIndexName, "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+		}
+	}
+	err = indexMgr.BlockIndexFileObj.Sync()
+	if err != nil {
+		_ = indexMgr.BlockIndexFileObj.Close()
+		return err
+	}
+	_ = indexMgr.BlockIndexFileObj.Close()
+
+	// the raw block file and the index are replaced one after the other, a crash in between leaves the genesis
+	// block in front of the legacy index, which the rerun finds in the raw block file and continues from
+	if genesisBlock != nil && !genesisStored {
+		err = prependRawBlock(genesisBlock)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(config.DataConfig.DataDir+"/"+upgradeIndexName, indexFileName)
+	if err != nil {
+		return err
+	}
+	fmt.Println("upgrade raw block index has been finished")
+	return nil
+}
+
 func lockDataDir() error {
 	lockFile, err := os.OpenFile(config.DataConfig.DataDir+"/.lock", os.O_CREATE|os.O_EXCL, os.ModePerm)
 	if err != nil {
@@ -275,6 +685,10 @@ func unLockDataDir() error {
 func main() {
 	var err error
 	reindex := flag.Bool("reindex", false, "rebuild index")
+	verify := flag.Bool("verify", false, "verify raw blocks and index")
+	importDir := flag.String("import", "", "import blocks from the blocks directory of bitcoin core")
+	reindexTx := flag.Bool("reindextx", false, "rebuild tx index from the stored blocks")
+	reindexSpent := flag.Bool("reindexspent", false, "rebuild spent index from the stored blocks")
 	flag.Parse()
 
 	// init config
@@ -284,6 +698,27 @@ func main() {
 		fmt.Println("Load config.json", err)
 		return
 	}
+	if config.DataConfig.StaleBlockName == "" {
+		config.DataConfig.StaleBlockName = DefaultStaleBlockName
+	}
+	if config.DataConfig.BlockHeaderName == "" {
+		config.DataConfig.BlockHeaderName = DefaultBlockHeaderName
+	}
+	if config.DataConfig.TxIndexName == "" {
+		config.DataConfig.TxIndexName = DefaultTxIndexName
+	}
+	if config.DataConfig.AddressIndexName == "" {
+		config.DataConfig.AddressIndexName = DefaultAddressIndexName
+	}
+	if config.DataConfig.UtxoSetName == "" {
+		config.DataConfig.UtxoSetName = DefaultUtxoSetName
+	}
+	if config.DataConfig.SpentIndexName == "" {
+		config.DataConfig.SpentIndexName = DefaultSpentIndexName
+	}
+	if config.DataConfig.BlockFilterName == "" {
+		config.DataConfig.BlockFilterName = DefaultBlockFilterName
+	}
 
 	err = lockDataDir()
 	if err != nil {
@@ -293,7 +728,14 @@ func main() {
 
 	// rebuild index
 	if *reindex {
-		err = rebuildIndex()
+		// the genesis block is gathered from the upstream only if the raw block files lack it
+		err = initNetworkParams()
+		if err == nil {
+			_, err = checkDataDirMeta()
+		}
+		if err == nil {
+			err = rebuildIndex()
+		}
 		if err != nil {
 			fmt.Println("rebuildIndex", err)
 		}
@@ -301,12 +743,87 @@ func main() {
 		return
 	}
 
+	// verify raw blocks and index
+	if *verify {
+		err = verifyData()
+		if err != nil {
+			fmt.Println("verifyData", err)
+			_ = unLockDataDir()
+			os.Exit(1)
+		}
+		_ = unLockDataDir()
+		return
+	}
+
+	// remove tx index, it is rebuilt when initialized
+	if *reindexTx {
+		if !config.DataConfig.TxIndex {
+			fmt.Println("rebuildTxIndex", "txIndex is not enabled in config.json")
+			_ = unLockDataDir()
+			return
+		}
+		err = os.Remove(config.DataConfig.DataDir + "/" + config.DataConfig.TxIndexName)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("rebuildTxIndex", err)
+			_ = unLockDataDir()
+			return
+		}
+	}
+
+	// remove spent index, it is rebuilt when initialized
+	if *reindexSpent {
+		if !config.DataConfig.SpentIndex {
+			fmt.Println("rebuildSpentIndex", "spentIndex is not enabled in config.json")
+			_ = unLockDataDir()
+			return
+		}
+		err = os.Remove(config.DataConfig.DataDir + "/" + config.DataConfig.SpentIndexName)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("rebuildSpentIndex", err)
+			_ = unLockDataDir()
+			return
+		}
+	}
+
 	err = appInit()
 	if err != nil {
 		fmt.Println("appInit", err)
 		_ = unLockDataDir()
 		return
 	}
+
+	if *reindexTx || *reindexSpent {
+		if *reindexTx {
+			fmt.Println("rebuild tx index has been finished, block height", latestRawBlockMgr.BlockHeight)
+		}
+		if *reindexSpent {
+			fmt.Println("rebuild spent index has been finished, block height", latestRawBlockMgr.BlockHeight)
+		}
+		_ = blockIndexMgr.BlockIndexFileObj.Close()
+		_ = latestRawBlockMgr.RawBlockFileObj.Close()
+		_ = staleBlockMgr.StaleBlockFileObj.Close()
+		_ = blockHeaderMgr.BlockHeaderFileObj.Close()
+		closeIndexes()
+		_ = unLockDataDir()
+		return
+	}
+
+	// import blocks from bitcoin core
+	if *importDir != "" {
+		startSignalHandler()
+		err = importBlocks(*importDir)
+		if err != nil {
+			fmt.Println("importBlocks", err)
+		}
+		_ = blockIndexMgr.BlockIndexFileObj.Close()
+		_ = latestRawBlockMgr.RawBlockFileObj.Close()
+		_ = staleBlockMgr.StaleBlockFileObj.Close()
+		_ = blockHeaderMgr.BlockHeaderFileObj.Close()
+		closeIndexes()
+		_ = unLockDataDir()
+		return
+	}
+
 	err = appRun()
 	if err != nil {
 		fmt.Println("appRun", err)
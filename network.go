@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	DefaultChain       = "bitcoin"
+	DefaultNetwork     = "mainnet"
+	DataDirMetaName    = "metadata.json"
+	DataDirMetaTemp    = "metadata.json.tmp"
+	GenesisBlockHeight = 0
+)
+
+const (
+	PowAlgoSha256d = iota
+	PowAlgoScrypt
+)
+
+// NetworkParams holds the parameters which differ between the chains and their networks
+type NetworkParams struct {
+	Chain string
+	Name  string
+	// the chain name reported by getblockchaininfo
+	ChainName string
+	Magic     [4]byte
+	// the magic of the blk files, differs from the p2p magic on bitcoin cash
+	DiskMagic   [4]byte
+	GenesisHash string
+	DefaultPort string
+	PowAlgo     int
+	// the chain id of a merge mined chain, 0 if the chain has no auxpow
+	AuxPowChainId int32
+	// whether the blocks with another chain id are refused
+	StrictChainId bool
+	SegWit        bool
+	// litecoin appends the mweb extension block after the transactions
+	ExtensionBlock bool
+	MaxBlockSize   uint32
+	// the version bytes of the base58 addresses
+	PubKeyHashPrefix byte
+	ScriptHashPrefix byte
+	// the human readable part of the segwit addresses, empty if the chain has no segwit
+	Bech32Hrp string
+	// the prefix of the cashaddr addresses, empty if the chain uses the base58 addresses
+	CashAddrPrefix string
+	// a block after the split from another chain with the same genesis block, 0 if none
+	CheckpointHeight uint32
+	CheckpointHash   string
+}
+
+var networkParamsMap = map[string]map[string]*NetworkParams{
+	"bitcoin": {
+		"mainnet": {Chain: "bitcoin", Name: "mainnet", ChainName: "main",
+			Magic: [4]byte{0xf9, 0xbe, 0xb4, 0xd9}, DiskMagic: [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+			GenesisHash: "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f", DefaultPort: "8333",
+			PubKeyHashPrefix: 0, ScriptHashPrefix: 5, Bech32Hrp: "bc",
+			PowAlgo: PowAlgoSha256d, SegWit: true, MaxBlockSize: 4000000,
+			CheckpointHeight: 478559, CheckpointHash: "00000000000000000019f112ec0a9982926f1258cdcc558dd7c3b7e5dc7fa148"},
+		"testnet3": {Chain: "bitcoin", Name: "testnet3", ChainName: "test",
+			Magic: [4]byte{0x0b, 0x11, 0x09, 0x07}, DiskMagic: [4]byte{0x0b, 0x11, 0x09, 0x07},
+			GenesisHash: "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943", DefaultPort: "18333",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 196, Bech32Hrp: "tb",
+			PowAlgo: PowAlgoSha256d, SegWit: true, MaxBlockSize: 4000000},
+		"testnet4": {Chain: "bitcoin", Name: "testnet4", ChainName: "testnet4",
+			Magic: [4]byte{0x1c, 0x16, 0x3f, 0x28}, DiskMagic: [4]byte{0x1c, 0x16, 0x3f, 0x28},
+			GenesisHash: "00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043", DefaultPort: "48333",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 196, Bech32Hrp: "tb",
+			PowAlgo: PowAlgoSha256d, SegWit: true, MaxBlockSize: 4000000},
+		"signet": {Chain: "bitcoin", Name: "signet", ChainName: "signet",
+			Magic: [4]byte{0x0a, 0x03, 0xcf, 0x40}, DiskMagic: [4]byte{0x0a, 0x03, 0xcf, 0x40},
+			GenesisHash: "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6", DefaultPort: "38333",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 196, Bech32Hrp: "tb",
+			PowAlgo: PowAlgoSha256d, SegWit: true, MaxBlockSize: 4000000},
+		"regtest": {Chain: "bitcoin", Name: "regtest", ChainName: "regtest",
+			Magic: [4]byte{0xfa, 0xbf, 0xb5, 0xda}, DiskMagic: [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+			GenesisHash: "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206", DefaultPort: "18444",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 196, Bech32Hrp: "bcrt",
+			PowAlgo: PowAlgoSha256d, SegWit: true, MaxBlockSize: 4000000},
+	},
+	"litecoin": {
+		"mainnet": {Chain: "litecoin", Name: "mainnet", ChainName: "main",
+			Magic: [4]byte{0xfb, 0xc0, 0xb6, 0xdb}, DiskMagic: [4]byte{0xfb, 0xc0, 0xb6, 0xdb},
+			GenesisHash: "12a765e31ffd4059bada1e25190f6e98c99d9714d334efa41a195a7e7e04bfe2", DefaultPort: "9333",
+			PubKeyHashPrefix: 48, ScriptHashPrefix: 50, Bech32Hrp: "ltc",
+			PowAlgo: PowAlgoScrypt, SegWit: true, ExtensionBlock: true, MaxBlockSize: 8000000},
+		"testnet4": {Chain: "litecoin", Name: "testnet4", ChainName: "test",
+			Magic: [4]byte{0xfd, 0xd2, 0xc8, 0xf1}, DiskMagic: [4]byte{0xfd, 0xd2, 0xc8, 0xf1},
+			GenesisHash: "4966625a4b2851d9fdee139e56211a0d88575f59ed816ff5e6a63deb4e3e29a0", DefaultPort: "19335",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 58, Bech32Hrp: "tltc",
+			PowAlgo: PowAlgoScrypt, SegWit: true, ExtensionBlock: true, MaxBlockSize: 8000000},
+		"regtest": {Chain: "litecoin", Name: "regtest", ChainName: "regtest",
+			Magic: [4]byte{0xfa, 0xbf, 0xb5, 0xda}, DiskMagic: [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+			GenesisHash: "530827f38f93b43ed12af0b3ad25a288dc02ed74d6d7857862df51fc56c416f9", DefaultPort: "19444",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 58, Bech32Hrp: "rltc",
+			PowAlgo: PowAlgoScrypt, SegWit: true, ExtensionBlock: true, MaxBlockSize: 8000000},
+	},
+	"dogecoin": {
+		"mainnet": {Chain: "dogecoin", Name: "mainnet", ChainName: "main",
+			Magic: [4]byte{0xc0, 0xc0, 0xc0, 0xc0}, DiskMagic: [4]byte{0xc0, 0xc0, 0xc0, 0xc0},
+			GenesisHash: "1a91e3dace36e2be3bf030a65679fe821aa1d6ef92e7c9902eb318182c355691", DefaultPort: "22556",
+			PubKeyHashPrefix: 30, ScriptHashPrefix: 22,
+			PowAlgo: PowAlgoScrypt, AuxPowChainId: 0x0062, StrictChainId: true, MaxBlockSize: 1000000},
+		"testnet3": {Chain: "dogecoin", Name: "testnet3", ChainName: "test",
+			Magic: [4]byte{0xfc, 0xc1, 0xb7, 0xdc}, DiskMagic: [4]byte{0xfc, 0xc1, 0xb7, 0xdc},
+			GenesisHash: "bb0a78264637406b6360aad926284d544d7049f45189db5664f3c4d07350559e", DefaultPort: "44556",
+			PubKeyHashPrefix: 113, ScriptHashPrefix: 196,
+			PowAlgo: PowAlgoScrypt, AuxPowChainId: 0x0062, StrictChainId: false, MaxBlockSize: 1000000},
+		"regtest": {Chain: "dogecoin", Name: "regtest", ChainName: "regtest",
+			Magic: [4]byte{0xfa, 0xbf, 0xb5, 0xda}, DiskMagic: [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+			GenesisHash: "3d2160a3b5dc4a9d62e7e66a295f70313ac808440ef7400d6c0772171ce973a5", DefaultPort: "18444",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 196,
+			PowAlgo: PowAlgoScrypt, AuxPowChainId: 0x0062, StrictChainId: true, MaxBlockSize: 1000000},
+	},
+	"bitcoincash": {
+		"mainnet": {Chain: "bitcoincash", Name: "mainnet", ChainName: "main",
+			Magic: [4]byte{0xe3, 0xe1, 0xf3, 0xe8}, DiskMagic: [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+			GenesisHash: "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f", DefaultPort: "8333",
+			PubKeyHashPrefix: 0, ScriptHashPrefix: 5, CashAddrPrefix: "bitcoincash",
+			PowAlgo: PowAlgoSha256d, MaxBlockSize: 32000000,
+			CheckpointHeight: 478559, CheckpointHash: "000000000000000000651ef99cb9fcbe0dadde1d424bd9f15ff20136191a5eec"},
+		"testnet3": {Chain: "bitcoincash", Name: "testnet3", ChainName: "test",
+			Magic: [4]byte{0xf4, 0xe5, 0xf3, 0xf4}, DiskMagic: [4]byte{0x0b, 0x11, 0x09, 0x07},
+			GenesisHash: "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943", DefaultPort: "18333",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 196, CashAddrPrefix: "bchtest",
+			PowAlgo: PowAlgoSha256d, MaxBlockSize: 32000000},
+		"regtest": {Chain: "bitcoincash", Name: "regtest", ChainName: "regtest",
+			Magic: [4]byte{0xda, 0xb5, 0xbf, 0xfa}, DiskMagic: [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+			GenesisHash: "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206", DefaultPort: "18444",
+			PubKeyHashPrefix: 111, ScriptHashPrefix: 196, CashAddrPrefix: "bchreg",
+			PowAlgo: PowAlgoSha256d, MaxBlockSize: 32000000},
+	},
+}
+
+var networkParams *NetworkParams = nil
+
+func initNetworkParams() error {
+	chainName := config.DataConfig.Chain
+	if chainName == "" {
+		chainName = DefaultChain
+	}
+	networkName := config.DataConfig.Network
+	if networkName == "" {
+		networkName = DefaultNetwork
+	}
+	chainNetworks, ok := networkParamsMap[chainName]
+	if !ok {
+		return errors.New("unknown chain: " + chainName)
+	}
+	params, ok := chainNetworks[networkName]
+	if !ok {
+		return errors.New("unknown network of " + chainName + ": " + networkName)
+	}
+	networkParams = params
+	return nil
+}
+
+// DataDirMeta records what the data directory belongs to
+type DataDirMeta struct {
+	Chain   string `json:"chain"`
+	Network string `json:"network"`
+}
+
+func getDataDirMetaName() string {
+	return config.DataConfig.DataDir + "/" + DataDirMetaName
+}
+
+// loadDataDirMeta returns nil if the data directory is not stamped yet
+func loadDataDirMeta() (*DataDirMeta, error) {
+	_, err := os.Stat(getDataDirMetaName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	dataDirMeta := new(DataDirMeta)
+	jsonParser := new(JsonStruct)
+	err = jsonParser.Load(getDataDirMetaName(), dataDirMeta)
+	if err != nil {
+		return nil, err
+	}
+	return dataDirMeta, nil
+}
+
+func saveDataDirMeta(dataDirMeta *DataDirMeta) error {
+	data, err := json.MarshalIndent(dataDirMeta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempName := config.DataConfig.DataDir + "/" + DataDirMetaTemp
+	err = ioutil.WriteFile(tempName, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempName, getDataDirMetaName())
+}
+
+// checkStoredGenesis checks the stored genesis block is the one of the network
+func checkStoredGenesis() error {
+	if _, blockCount := getStoredTip(); blockCount == 0 {
+		return nil
+	}
+	if genesisHash, _ := getStoredBlockHash(GenesisBlockHeight); genesisHash != networkParams.GenesisHash {
+		return errors.New("stored genesis block is not the one of " + networkParams.Chain + " " + networkParams.Name)
+	}
+	return nil
+}
+
+// checkDataDirMeta refuses a data directory stamped with another network, called before anything is written to it
+func checkDataDirMeta() (*DataDirMeta, error) {
+	dataDirMeta, err := loadDataDirMeta()
+	if err != nil {
+		return nil, err
+	}
+	if dataDirMeta != nil {
+		// the data directories stamped before the chains other than bitcoin were supported
+		storedChain := dataDirMeta.Chain
+		if storedChain == "" {
+			storedChain = DefaultChain
+		}
+		if storedChain != networkParams.Chain || dataDirMeta.Network != networkParams.Name {
+			return nil, fmt.Errorf("data directory %s belongs to %s %s, but %s %s is configured",
+				config.DataConfig.DataDir, storedChain, dataDirMeta.Network, networkParams.Chain, networkParams.Name)
+		}
+	}
+	return dataDirMeta, nil
+}
+
+// stampDataDir records the network in the data directory on the first run, once the stored blocks are loaded
+func stampDataDir() error {
+	dataDirMeta, err := checkDataDirMeta()
+	if err != nil {
+		return err
+	}
+	err = checkStoredGenesis()
+	if err != nil {
+		return err
+	}
+	if dataDirMeta == nil || dataDirMeta.Chain == "" {
+		dataDirMeta = new(DataDirMeta)
+		dataDirMeta.Chain = networkParams.Chain
+		dataDirMeta.Network = networkParams.Name
+		err = saveDataDirMeta(dataDirMeta)
+		if err != nil {
+			return err
+		}
+		fmt.Println("stamp data directory", config.DataConfig.DataDir, "with", networkParams.Chain, networkParams.Name)
+	}
+	return nil
+}
+
+// checkBlockSourceNetwork checks the upstreams are on the configured network before the blocks are gathered from them
+func checkBlockSourceNetwork() error {
+	upstreamBlockSource, ok := blockSource.(*UpstreamBlockSource)
+	if !ok {
+		// the p2p messages carry the magic of the network
+		return nil
+	}
+	return upstreamBlockSource.CheckNetwork()
+}
+
+// checkUpstreamNetwork checks the chain and the genesis block of the upstream match with the network
+func checkUpstreamNetwork(source *RpcBlockSource) error {
+	chainName, err := getBlockChainNameRpc(source.RpcClient)
+	if err != nil {
+		return err
+	}
+	if chainName != networkParams.ChainName {
+		return newClassRpcError(RpcErrorNetwork, "getblockchaininfo", fmt.Errorf("upstream chain %s, expect %s", chainName, networkParams.ChainName))
+	}
+	genesisHash, err := source.GetBlockHash(GenesisBlockHeight)
+	if err != nil {
+		return err
+	}
+	if genesisHash != networkParams.GenesisHash {
+		return newClassRpcError(RpcErrorNetwork, "getblockhash", fmt.Errorf("upstream genesis %s, expect %s", genesisHash, networkParams.GenesisHash))
+	}
+	if networkParams.CheckpointHeight == 0 {
+		return nil
+	}
+	// the chains split from each other share the genesis block, tell them apart after the split
+	blockCount, err := source.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	if blockCount < networkParams.CheckpointHeight {
+		return nil
+	}
+	checkpointHash, err := source.GetBlockHash(networkParams.CheckpointHeight)
+	if err != nil {
+		return err
+	}
+	if checkpointHash != networkParams.CheckpointHash {
+		return newClassRpcError(RpcErrorNetwork, "getblockhash", fmt.Errorf("upstream block %s at height %d, expect %s of %s",
+			checkpointHash, networkParams.CheckpointHeight, networkParams.CheckpointHash, networkParams.Chain))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// readTestDataDir returns the contents of the files in the data directory
+func readTestDataDir(t *testing.T) map[string][]byte {
+	fileInfos, err := ioutil.ReadDir(config.DataConfig.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, fileInfo := range fileInfos {
+		data, err := ioutil.ReadFile(config.DataConfig.DataDir + "/" + fileInfo.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[fileInfo.Name()] = data
+	}
+	return files
+}
+
+func TestAppInitRefusesOtherNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		meta DataDirMeta
+		err  string
+	}{
+		{"other network", DataDirMeta{Chain: "bitcoin", Network: "testnet3"}, "belongs to bitcoin testnet3"},
+		// the data directories stamped before the chains other than bitcoin were supported
+		{"legacy stamp", DataDirMeta{Network: "mainnet"}, "belongs to bitcoin mainnet"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestDataDir(t)
+			useTestNetwork(t, "bitcoin", "regtest")
+			savedQuitChan := quitChan
+			savedGoroutineMgr := goroutineMgr
+			t.Cleanup(func() {
+				quitChan = savedQuitChan
+				goroutineMgr = savedGoroutineMgr
+			})
+			config.DataConfig.Chain = "bitcoin"
+			config.DataConfig.Network = "regtest"
+			// a legacy index which the startup would upgrade and repair
+			writeTestLegacyData(t, 1, buildTestRawBlocks(3))
+			err := saveDataDirMeta(&test.meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := readTestDataDir(t)
+
+			err = appInit()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+			// nothing is written to the data directory of the other network
+			filesAfter := readTestDataDir(t)
+			if len(filesAfter) != len(files) {
+				t.Fatalf("data directory changed from %d to %d files", len(files), len(filesAfter))
+			}
+			for name, data := range files {
+				if !bytes.Equal(filesAfter[name], data) {
+					t.Fatal("data directory file changed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestStampDataDir(t *testing.T) {
+	useTestDataDir(t)
+	useTestNetwork(t, "bitcoin", "regtest")
+	useTestChain(t, nil)
+	savedLatestRawBlockMgr := latestRawBlockMgr
+	latestRawBlockMgr = new(RawBlockManager)
+	t.Cleanup(func() {
+		latestRawBlockMgr = savedLatestRawBlockMgr
+	})
+	dataDirMeta, err := checkDataDirMeta()
+	if err != nil || dataDirMeta != nil {
+		t.Fatal("unexpected meta of the unstamped data directory", dataDirMeta, err)
+	}
+	err = stampDataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDirMeta, err = checkDataDirMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataDirMeta == nil || dataDirMeta.Chain != "bitcoin" || dataDirMeta.Network != "regtest" {
+		t.Fatalf("unexpected stamp %+v", dataDirMeta)
+	}
+
+	useTestNetwork(t, "bitcoin", "testnet3")
+	_, err = checkDataDirMeta()
+	if err == nil || !strings.Contains(err.Error(), "belongs to bitcoin regtest") {
+		t.Fatal("stamp of the other network not refused", err)
+	}
+}
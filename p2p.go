@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	P2PProtocolVersion    = 70016
+	P2PMinPeerVersion     = 70013
+	P2PUserAgent          = "/btc_raw_block_collector:0.1/"
+	P2PMessageHeaderSize  = 24
+	P2PMaxMessageSize     = 32 * 1024 * 1024
+	P2PMaxHeadersResults  = 2000
+	P2PNodeWitness        = 1 << 3
+	P2PInvBlock           = 2
+	P2PInvWitnessBlock    = 0x40000002
+	P2PLocatorDenseBlocks = 10
+)
+
+var ErrP2PMagicMismatch = errors.New("p2p message magic not match with the network")
+
+type P2PMessage struct {
+	Command string
+	Payload []byte
+}
+
+func writeP2PMessage(writer io.Writer, magic [4]byte, command string, payload []byte) error {
+	var commandBytes [12]byte
+	copy(commandBytes[:], command)
+	buf := new(bytes.Buffer)
+	buf.Write(magic[:])
+	buf.Write(commandBytes[:])
+	_ = serialize.PackUint32(buf, uint32(len(payload)))
+	buf.Write(calcDoubleSha256(payload)[0:4])
+	buf.Write(payload)
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
+
+func readP2PMessage(reader io.Reader, magic [4]byte) (*P2PMessage, error) {
+	header := make([]byte, P2PMessageHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[0:4], magic[:]) {
+		return nil, ErrP2PMagicMismatch
+	}
+	payloadSize, _ := serialize.UnPackUint32(bytes.NewReader(header[16:20]))
+	if payloadSize > P2PMaxMessageSize {
+		return nil, errors.New("p2p message too large")
+	}
+	payload := make([]byte, payloadSize)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(calcDoubleSha256(payload)[0:4], header[20:24]) {
+		return nil, errors.New("p2p message checksum mismatch")
+	}
+	message := new(P2PMessage)
+	message.Command = string(bytes.TrimRight(header[4:16], "\x00"))
+	message.Payload = payload
+	return message, nil
+}
+
+// P2PBlockSource gathers the blocks from a peer over the bitcoin p2p protocol, the heights come from the header chain of the peer
+type P2PBlockSource struct {
+	PeerAddress string
+	Network     *NetworkParams
+	conn        net.Conn
+	reader      *bufio.Reader
+	// header chain of the peer, headerHashes[i] is the hash at baseHeight + i
+	baseHeight    uint32
+	headerHashes  []string
+	headerHeights map[string]uint32
+	mutex         *sync.Mutex
+}
+
+func newP2PBlockSource(peerAddress string, network *NetworkParams) (*P2PBlockSource, error) {
+	if peerAddress == "" {
+		return nil, errors.New("p2p peer is not configured")
+	}
+	if _, _, err := net.SplitHostPort(peerAddress); err != nil {
+		peerAddress = net.JoinHostPort(peerAddress, network.DefaultPort)
+	}
+	s := new(P2PBlockSource)
+	s.PeerAddress = peerAddress
+	s.Network = network
+	s.headerHeights = make(map[string]uint32)
+	s.mutex = new(sync.Mutex)
+	return s, nil
+}
+
+func newP2PError(command string, class RpcErrorClass, err error) *RpcCallError {
+	return newClassRpcError(class, "p2p "+command, err)
+}
+
+func getP2PTimeout() time.Duration {
+	if config.RpcClientConfig.RpcTimeout <= 0 {
+		return DefaultRpcTimeout * time.Second
+	}
+	return time.Duration(config.RpcClientConfig.RpcTimeout) * time.Second
+}
+
+func (s *P2PBlockSource) disconnect() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		s.reader = nil
+	}
+}
+
+func (s *P2PBlockSource) send(command string, payload []byte) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(getP2PTimeout()))
+	err := writeP2PMessage(s.conn, s.Network.Magic, command, payload)
+	if err != nil {
+		s.disconnect()
+		return newP2PError(command, RpcErrorTransport, err)
+	}
+	return nil
+}
+
+// receive reads the next message which is not handled by the connection itself
+func (s *P2PBlockSource) receive(command string) (*P2PMessage, error) {
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(getP2PTimeout()))
+		message, err := readP2PMessage(s.reader, s.Network.Magic)
+		if err == ErrP2PMagicMismatch {
+			s.disconnect()
+			return nil, newP2PError(command, RpcErrorNetwork, err)
+		}
+		if err != nil {
+			s.disconnect()
+			return nil, newP2PError(command, RpcErrorTransport, err)
+		}
+		if message.Command == "ping" {
+			err = s.send("pong", message.Payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return message, nil
+	}
+}
+
+func (s *P2PBlockSource) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", s.PeerAddress, getP2PTimeout())
+	if err != nil {
+		return newP2PError("version", RpcErrorTransport, err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	// version, the addresses are left empty as the peer does not need them
+	payload := new(bytes.Buffer)
+	_ = serialize.PackInt32(payload, P2PProtocolVersion)
+	_ = serialize.PackUint64(payload, 0)
+	_ = serialize.PackInt64(payload, time.Now().Unix())
+	payload.Write(make([]byte, 26))
+	payload.Write(make([]byte, 26))
+	_ = serialize.PackUint64(payload, rand.Uint64())
+	_ = serialize.PackCompactSize(payload, uint64(len(P2PUserAgent)))
+	payload.WriteString(P2PUserAgent)
+	_ = serialize.PackInt32(payload, 0)
+	_ = serialize.PackByte(payload, 0)
+	err = s.send("version", payload.Bytes())
+	if err != nil {
+		return err
+	}
+
+	gotVersion := false
+	gotVerack := false
+	for !gotVersion || !gotVerack {
+		message, err := s.receive("version")
+		if err != nil {
+			return err
+		}
+		switch message.Command {
+		case "version":
+			reader := bytes.NewReader(message.Payload)
+			peerVersion, err := serialize.UnPackInt32(reader)
+			if err != nil {
+				s.disconnect()
+				return newP2PError("version", RpcErrorMalformed, err)
+			}
+			peerServices, err := serialize.UnPackUint64(reader)
+			if err != nil {
+				s.disconnect()
+				return newP2PError("version", RpcErrorMalformed, err)
+			}
+			if peerVersion < P2PMinPeerVersion || (s.Network.SegWit && peerServices&P2PNodeWitness == 0) {
+				s.disconnect()
+				return newP2PError("version", RpcErrorCode, fmt.Errorf("peer version %d services %x can not serve witness blocks", peerVersion, peerServices))
+			}
+			gotVersion = true
+			err = s.send("verack", nil)
+			if err != nil {
+				return err
+			}
+		case "verack":
+			gotVerack = true
+		}
+	}
+	fmt.Println("p2p: connected to", s.PeerAddress)
+	return nil
+}
+
+func (s *P2PBlockSource) getHeaderTip() uint32 {
+	return s.baseHeight + uint32(len(s.headerHashes)) - 1
+}
+
+// lookupHash returns the hash at the height from the header chain, or from the stored blocks below it
+func (s *P2PBlockSource) lookupHash(height uint32) (string, bool) {
+	if len(s.headerHashes) != 0 && height >= s.baseHeight && height <= s.getHeaderTip() {
+		return s.headerHashes[height-s.baseHeight], true
+	}
+	if height == 0 {
+		return s.Network.GenesisHash, true
+	}
+	return getStoredBlockHash(height)
+}
+
+func (s *P2PBlockSource) lookupHeight(blockHash string) (uint32, bool) {
+	height, ok := s.headerHeights[blockHash]
+	if ok {
+		return height, true
+	}
+	if blockHash == s.Network.GenesisHash {
+		return 0, true
+	}
+	return getStoredBlockHeight(blockHash)
+}
+
+// buildLocator lists the hashes from the tip back to the genesis, dense near the tip and then exponentially sparse
+func (s *P2PBlockSource) buildLocator() []string {
+	tipHeight, _ := getStoredTip()
+	if len(s.headerHashes) != 0 {
+		tipHeight = s.getHeaderTip()
+	}
+	locator := make([]string, 0, 32)
+	step := uint32(1)
+	height := tipHeight
+	for height > 0 {
+		blockHash, ok := s.lookupHash(height)
+		if ok {
+			locator = append(locator, blockHash)
+		}
+		if len(locator) >= P2PLocatorDenseBlocks {
+			step *= 2
+		}
+		if height < step {
+			break
+		}
+		height -= step
+	}
+	return append(locator, s.Network.GenesisHash)
+}
+
+// resetHeaderChain restarts the header chain from the anchor block known by both sides
+func (s *P2PBlockSource) resetHeaderChain(anchorHeight uint32, anchorHash string) {
+	s.baseHeight = anchorHeight
+	s.headerHashes = []string{anchorHash}
+	s.headerHeights = map[string]uint32{anchorHash: anchorHeight}
+}
+
+// syncHeaders follows the header chain of the peer to its tip
+func (s *P2PBlockSource) syncHeaders() error {
+	for {
+		locator := s.buildLocator()
+		payload := new(bytes.Buffer)
+		_ = serialize.PackInt32(payload, P2PProtocolVersion)
+		_ = serialize.PackCompactSize(payload, uint64(len(locator)))
+		for _, blockHash := range locator {
+			var hash bigint.Uint256
+			_ = hash.SetHex(blockHash)
+			payload.Write(hash.GetData())
+		}
+		payload.Write(make([]byte, 32))
+		err := s.send("getheaders", payload.Bytes())
+		if err != nil {
+			return err
+		}
+
+		var message *P2PMessage
+		for {
+			message, err = s.receive("getheaders")
+			if err != nil {
+				return err
+			}
+			if message.Command == "headers" {
+				break
+			}
+		}
+		headerCount, err := s.connectHeaders(message.Payload)
+		if err != nil {
+			s.disconnect()
+			return newP2PError("getheaders", RpcErrorMalformed, err)
+		}
+		if headerCount < P2PMaxHeadersResults {
+			return nil
+		}
+	}
+}
+
+// connectHeaders appends the headers to the header chain, and rewinds the chain if they fork from it
+func (s *P2PBlockSource) connectHeaders(payload []byte) (int, error) {
+	reader := bytes.NewReader(payload)
+	headerCount, err := serialize.UnPackCompactSize(reader)
+	if err != nil {
+		return 0, err
+	}
+	if headerCount > P2PMaxHeadersResults {
+		return 0, errors.New("too many headers")
+	}
+	for i := uint64(0); i < headerCount; i++ {
+		blockHeader, headerBytes, auxPow, err := unpackChainHeader(reader)
+		if err != nil {
+			return 0, err
+		}
+		txCount, err := serialize.UnPackCompactSize(reader)
+		if err != nil {
+			return 0, err
+		}
+		if txCount != 0 {
+			return 0, errors.New("header with transactions")
+		}
+		blockHash := calcBlockHash(headerBytes)
+		err = checkChainProofOfWork(headerBytes, &blockHeader, auxPow)
+		if err != nil {
+			return 0, err
+		}
+
+		prevBlockHash := blockHeader.HashPrevBlock.GetHex()
+		prevHeight, ok := s.lookupHeight(prevBlockHash)
+		if !ok {
+			return 0, errors.New("header not connect to the known chain")
+		}
+		if len(s.headerHashes) == 0 || prevHeight < s.baseHeight || prevHeight > s.getHeaderTip() {
+			s.resetHeaderChain(prevHeight, prevBlockHash)
+		} else if prevHeight < s.getHeaderTip() {
+			for _, staleHash := range s.headerHashes[prevHeight-s.baseHeight+1:] {
+				delete(s.headerHeights, staleHash)
+			}
+			s.headerHashes = s.headerHashes[0 : prevHeight-s.baseHeight+1]
+		}
+		s.headerHashes = append(s.headerHashes, blockHash)
+		s.headerHeights[blockHash] = prevHeight + 1
+	}
+	return int(headerCount), nil
+}
+
+func (s *P2PBlockSource) GetBlockCount() (uint32, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+	err = s.syncHeaders()
+	if err != nil {
+		return 0, err
+	}
+	if len(s.headerHashes) == 0 {
+		// the peer has nothing after the stored tip, or after the genesis block on an empty data directory
+		tipHeight, _ := getStoredTip()
+		tipHash, _ := s.lookupHash(tipHeight)
+		s.resetHeaderChain(tipHeight, tipHash)
+	}
+	return s.getHeaderTip(), nil
+}
+
+func (s *P2PBlockSource) GetBlockHash(blockHeight uint32) (string, error) {
+	blockHashes, errs, err := s.GetBlockHashes([]uint32{blockHeight})
+	if err != nil {
+		return "", err
+	}
+	return blockHashes[0], errs[0]
+}
+
+// GetBlockHashes answers from the header chain synced by GetBlockCount
+func (s *P2PBlockSource) GetBlockHashes(blockHeights []uint32) ([]string, []error, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	blockHashes := make([]string, len(blockHeights))
+	errs := make([]error, len(blockHeights))
+	for i, blockHeight := range blockHeights {
+		if len(s.headerHashes) == 0 || blockHeight < s.baseHeight || blockHeight > s.getHeaderTip() {
+			errs[i] = newP2PError("getheaders", RpcErrorCode, errors.New("block height out of range"))
+			errs[i].(*RpcCallError).Code = RpcCodeInvalidParameter
+			continue
+		}
+		blockHashes[i] = s.headerHashes[blockHeight-s.baseHeight]
+	}
+	return blockHashes, errs, nil
+}
+
+func (s *P2PBlockSource) GetRawBlock(blockHash string) ([]byte, error) {
+	rawBlocks, errs, err := s.GetRawBlocks([]string{blockHash})
+	if err != nil {
+		return nil, err
+	}
+	return rawBlocks[0], errs[0]
+}
+
+// GetRawBlocks requests the witness blocks with one getdata, and waits for all of them or notfound
+func (s *P2PBlockSource) GetRawBlocks(blockHashes []string) ([][]byte, []error, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.connect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload := new(bytes.Buffer)
+	_ = serialize.PackCompactSize(payload, uint64(len(blockHashes)))
+	pending := make(map[string]int)
+	for i, blockHash := range blockHashes {
+		var hash bigint.Uint256
+		_ = hash.SetHex(blockHash)
+		if s.Network.SegWit {
+			_ = serialize.PackUint32(payload, P2PInvWitnessBlock)
+		} else {
+			_ = serialize.PackUint32(payload, P2PInvBlock)
+		}
+		payload.Write(hash.GetData())
+		pending[strings.ToLower(blockHash)] = i
+	}
+	err = s.send("getdata", payload.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawBlocks := make([][]byte, len(blockHashes))
+	errs := make([]error, len(blockHashes))
+	for len(pending) != 0 {
+		message, err := s.receive("getdata")
+		if err != nil {
+			return nil, nil, err
+		}
+		switch message.Command {
+		case "block":
+			if len(message.Payload) < BlockHeaderSize {
+				s.disconnect()
+				return nil, nil, newP2PError("getdata", RpcErrorMalformed, errors.New("invalid block message"))
+			}
+			i, ok := pending[calcBlockHash(message.Payload)]
+			if !ok {
+				continue
+			}
+			rawBlocks[i] = message.Payload
+			delete(pending, calcBlockHash(message.Payload))
+		case "notfound":
+			reader := bytes.NewReader(message.Payload)
+			invCount, err := serialize.UnPackCompactSize(reader)
+			if err != nil {
+				s.disconnect()
+				return nil, nil, newP2PError("getdata", RpcErrorMalformed, err)
+			}
+			for j := uint64(0); j < invCount; j++ {
+				_, err = serialize.UnPackUint32(reader)
+				if err != nil {
+					s.disconnect()
+					return nil, nil, newP2PError("getdata", RpcErrorMalformed, err)
+				}
+				var hash bigint.Uint256
+				err = hash.UnPack(reader)
+				if err != nil {
+					s.disconnect()
+					return nil, nil, newP2PError("getdata", RpcErrorMalformed, err)
+				}
+				i, ok := pending[hash.GetHex()]
+				if !ok {
+					continue
+				}
+				notFoundErr := newP2PError("getdata", RpcErrorCode, errors.New("Block not found"))
+				notFoundErr.Code = RpcCodeInvalidAddressOrKey
+				errs[i] = notFoundErr
+				delete(pending, hash.GetHex())
+			}
+		}
+	}
+	return rawBlocks, errs, nil
+}
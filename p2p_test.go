@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testP2PPeer is a fake bitcoin peer on a local port, it serves the headers and the blocks of its chain
+type testP2PPeer struct {
+	listener    net.Listener
+	magic       [4]byte
+	version     int32
+	services    uint64
+	blockHashes []string
+	rawBlocks   map[string][]byte
+	// how the peer answers getheaders: "" serves the headers, "bad magic" and "short" send a broken message
+	getHeadersMode string
+	mutex          sync.Mutex
+	gotPong        bool
+}
+
+func newTestP2PPeer(blockHashes []string, rawBlocks [][]byte) *testP2PPeer {
+	p := new(testP2PPeer)
+	p.magic = networkParams.Magic
+	p.version = P2PProtocolVersion
+	p.services = P2PNodeWitness
+	p.blockHashes = blockHashes
+	p.rawBlocks = make(map[string][]byte)
+	for i, blockHash := range blockHashes {
+		p.rawBlocks[blockHash] = rawBlocks[i]
+	}
+	return p
+}
+
+// start listens on a local port, the peer is not changed after it is started
+func (p *testP2PPeer) start(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return listener.Addr().String()
+}
+
+func (p *testP2PPeer) serve(conn net.Conn) {
+	defer conn.Close()
+	message, err := readP2PMessage(conn, p.magic)
+	if err != nil || message.Command != "version" {
+		return
+	}
+	payload := new(bytes.Buffer)
+	_ = serialize.PackInt32(payload, p.version)
+	_ = serialize.PackUint64(payload, p.services)
+	_ = serialize.PackInt64(payload, 0)
+	payload.Write(make([]byte, 26+26+8))
+	_ = serialize.PackCompactSize(payload, 0)
+	_ = serialize.PackInt32(payload, int32(len(p.blockHashes)-1))
+	_ = serialize.PackByte(payload, 0)
+	_ = writeP2PMessage(conn, p.magic, "version", payload.Bytes())
+	// the collector answers the ping while it waits for the handshake
+	_ = writeP2PMessage(conn, p.magic, "ping", []byte("12345678"))
+	_ = writeP2PMessage(conn, p.magic, "verack", nil)
+
+	for {
+		message, err = readP2PMessage(conn, p.magic)
+		if err != nil {
+			return
+		}
+		switch message.Command {
+		case "pong":
+			p.mutex.Lock()
+			p.gotPong = bytes.Equal(message.Payload, []byte("12345678"))
+			p.mutex.Unlock()
+		case "getheaders":
+			switch p.getHeadersMode {
+			case "bad magic":
+				_ = writeP2PMessage(conn, [4]byte{0xde, 0xad, 0xbe, 0xef}, "headers", []byte{0})
+				continue
+			case "short":
+				buf := new(bytes.Buffer)
+				_ = writeP2PMessage(buf, p.magic, "headers", []byte{0})
+				_, _ = conn.Write(buf.Bytes()[0 : P2PMessageHeaderSize/2])
+				return
+			}
+			_ = writeP2PMessage(conn, p.magic, "headers", p.getHeaders(message.Payload))
+		case "getdata":
+			reader := bytes.NewReader(message.Payload)
+			invCount, _ := serialize.UnPackCompactSize(reader)
+			notFound := new(bytes.Buffer)
+			notFoundCount := uint64(0)
+			for i := uint64(0); i < invCount; i++ {
+				invType, _ := serialize.UnPackUint32(reader)
+				var hash bigint.Uint256
+				_ = hash.UnPack(reader)
+				rawBlock, ok := p.rawBlocks[hash.GetHex()]
+				if ok && invType == P2PInvWitnessBlock {
+					_ = writeP2PMessage(conn, p.magic, "block", rawBlock)
+					continue
+				}
+				_ = serialize.PackUint32(notFound, invType)
+				notFound.Write(hash.GetData())
+				notFoundCount++
+			}
+			if notFoundCount != 0 {
+				payload := new(bytes.Buffer)
+				_ = serialize.PackCompactSize(payload, notFoundCount)
+				payload.Write(notFound.Bytes())
+				_ = writeP2PMessage(conn, p.magic, "notfound", payload.Bytes())
+			}
+		}
+	}
+}
+
+// getHeaders answers the headers after the first block of the locator found in the chain
+func (p *testP2PPeer) getHeaders(getHeadersPayload []byte) []byte {
+	reader := bytes.NewReader(getHeadersPayload)
+	_, _ = serialize.UnPackInt32(reader)
+	locatorCount, _ := serialize.UnPackCompactSize(reader)
+	startHeight := len(p.blockHashes)
+	for i := uint64(0); i < locatorCount && startHeight == len(p.blockHashes); i++ {
+		var hash bigint.Uint256
+		_ = hash.UnPack(reader)
+		for height, blockHash := range p.blockHashes {
+			if blockHash == hash.GetHex() {
+				startHeight = height + 1
+				break
+			}
+		}
+	}
+	payload := new(bytes.Buffer)
+	if startHeight > len(p.blockHashes) {
+		startHeight = len(p.blockHashes)
+	}
+	_ = serialize.PackCompactSize(payload, uint64(len(p.blockHashes)-startHeight))
+	for _, blockHash := range p.blockHashes[startHeight:] {
+		payload.Write(p.rawBlocks[blockHash][0:BlockHeaderSize])
+		_ = serialize.PackCompactSize(payload, 0)
+	}
+	return payload.Bytes()
+}
+
+func (p *testP2PPeer) hasPong() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.gotPong
+}
+
+// useTestP2PChain mines a regtest chain of the block count after the genesis block, with the empty stored chain
+func useTestP2PChain(t *testing.T, blockCount int) ([]string, [][]byte) {
+	useTestNetwork(t, "bitcoin", "regtest")
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	blockHashes := []string{calcBlockHash(genesisBlock)}
+	rawBlocks := [][]byte{genesisBlock}
+	for height := 1; height <= blockCount; height++ {
+		coinbase := buildTestCoinbase(uint32(height), "p2p", []byte{0x51})
+		blockHash, rawBlock := mineTestBlock(t, blockHashes[height-1], coinbase)
+		blockHashes = append(blockHashes, blockHash)
+		rawBlocks = append(rawBlocks, rawBlock)
+	}
+	useTestChain(t, blockHashes[0:1])
+
+	savedLatestRawBlockMgr := latestRawBlockMgr
+	latestRawBlockMgr = new(RawBlockManager)
+	t.Cleanup(func() {
+		latestRawBlockMgr = savedLatestRawBlockMgr
+	})
+	return blockHashes, rawBlocks
+}
+
+func TestP2PMessage(t *testing.T) {
+	magic := [4]byte{0xfa, 0xbf, 0xb5, 0xda}
+	buf := new(bytes.Buffer)
+	_ = writeP2PMessage(buf, magic, "block", []byte("payload"))
+	message := buf.Bytes()
+	badChecksum := append([]byte{}, message...)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+	tooLarge := append([]byte{}, message...)
+	copy(tooLarge[16:20], []byte{0xff, 0xff, 0xff, 0xff})
+
+	tests := []struct {
+		name    string
+		message []byte
+		err     string
+	}{
+		{"message", message, ""},
+		{"bad magic", append([]byte{0x0b, 0x11, 0x09, 0x07}, message[4:]...), "magic not match"},
+		{"short header", message[0 : P2PMessageHeaderSize-1], "unexpected EOF"},
+		{"short payload", message[0 : len(message)-1], "unexpected EOF"},
+		{"checksum", badChecksum, "checksum mismatch"},
+		{"too large", tooLarge, "too large"},
+	}
+	for _, test := range tests {
+		p2pMessage, err := readP2PMessage(bytes.NewReader(test.message), magic)
+		if test.err == "" {
+			if err != nil || p2pMessage.Command != "block" || string(p2pMessage.Payload) != "payload" {
+				t.Errorf("%s: unexpected message %v %v", test.name, p2pMessage, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestP2PBlockSource(t *testing.T) {
+	blockHashes, rawBlocks := useTestP2PChain(t, 3)
+	peer := newTestP2PPeer(blockHashes, rawBlocks)
+	s, err := newP2PBlockSource(peer.start(t), networkParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.disconnect()
+
+	// version/verack and getheaders/headers
+	blockCount, err := s.GetBlockCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockCount != 3 {
+		t.Fatal("unexpected block count", blockCount)
+	}
+	if !peer.hasPong() {
+		t.Fatal("ping not answered during the handshake")
+	}
+	hashes, errs, err := s.GetBlockHashes([]uint32{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := 1; height <= 3; height++ {
+		if errs[height-1] != nil || hashes[height-1] != blockHashes[height] {
+			t.Fatalf("unexpected block hash of height %d: %s %v", height, hashes[height-1], errs[height-1])
+		}
+	}
+	if rpcCallError, ok := errs[3].(*RpcCallError); !ok || rpcCallError.Code != RpcCodeInvalidParameter {
+		t.Fatal("unexpected error of the block height past the tip", errs[3])
+	}
+
+	// getdata/block and notfound
+	unknownHash := strings.Repeat("ab", 32)
+	blocks, errs, err := s.GetRawBlocks([]string{blockHashes[3], unknownHash, blockHashes[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || !bytes.Equal(blocks[0], rawBlocks[3]) || errs[2] != nil || !bytes.Equal(blocks[2], rawBlocks[1]) {
+		t.Fatal("unexpected raw blocks from the peer")
+	}
+	if rpcCallError, ok := errs[1].(*RpcCallError); !ok || rpcCallError.Code != RpcCodeInvalidAddressOrKey {
+		t.Fatal("unexpected error of the unknown block", errs[1])
+	}
+
+	// the next sync continues from the header tip
+	blockCount, err = s.GetBlockCount()
+	if err != nil || blockCount != 3 {
+		t.Fatal("unexpected block count of the second sync", blockCount, err)
+	}
+}
+
+func TestP2PBlockSourceBrokenPeer(t *testing.T) {
+	tests := []struct {
+		name           string
+		version        int32
+		services       uint64
+		getHeadersMode string
+		class          RpcErrorClass
+	}{
+		{"old version", P2PMinPeerVersion - 1, P2PNodeWitness, "", RpcErrorCode},
+		{"no witness", P2PProtocolVersion, 0, "", RpcErrorCode},
+		{"bad magic", P2PProtocolVersion, P2PNodeWitness, "bad magic", RpcErrorNetwork},
+		{"short message", P2PProtocolVersion, P2PNodeWitness, "short", RpcErrorTransport},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockHashes, rawBlocks := useTestP2PChain(t, 1)
+			peer := newTestP2PPeer(blockHashes, rawBlocks)
+			peer.version = test.version
+			peer.services = test.services
+			peer.getHeadersMode = test.getHeadersMode
+			s, err := newP2PBlockSource(peer.start(t), networkParams)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.disconnect()
+
+			_, err = s.GetBlockCount()
+			rpcCallError, ok := err.(*RpcCallError)
+			if !ok || rpcCallError.Class != test.class {
+				t.Fatalf("got error %v, expected class %d", err, test.class)
+			}
+			if s.conn != nil {
+				t.Fatal("connection kept after the error")
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"github.com/mutalisk999/bitcoin-lib/src/bigint"
 	"github.com/mutalisk999/bitcoin-lib/src/blob"
 	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"hash/crc32"
 	"io"
 	"os"
 	"strconv"
@@ -11,19 +13,67 @@ import (
 )
 
 const (
-	RawBlockIndexSize = 4 + 32 + 4 + 4 + 4 + 4
+	RawBlockIndexMagic      = 0x78696272 // "rbix"
+	RawBlockIndexVersion    = 4
+	RawBlockIndexHeaderSize = 4 + 4
+	RawBlockIndexSize       = 4 + 32 + 4 + 4 + 8 + 8 + 4
+	RawBlockIndexSizeV2     = 4 + 32 + 4 + 4 + 8 + 8
+	RawBlockIndexSizeV1     = 4 + 32 + 4 + 4 + 4 + 4
+	DefaultMaxFileSize      = 1 * 1024 * 1024 * 1024
+	// set in the compressed type byte of the raw block records which carry a checksum
+	RawBlockChecksumFlag = 0x80
 )
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// getBlockIndexPos locates the index record of the block height, the record of the genesis block comes first
+func getBlockIndexPos(blockHeight uint32) int64 {
+	return RawBlockIndexHeaderSize + int64(blockHeight)*RawBlockIndexSize
+}
+
+type RawBlockIndexHeader struct {
+	Magic   uint32
+	Version uint32
+}
+
+func (r RawBlockIndexHeader) Pack(writer io.Writer) error {
+	var err error
+	err = serialize.PackUint32(writer, r.Magic)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, r.Version)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *RawBlockIndexHeader) UnPack(reader io.Reader) error {
+	var err error
+	r.Magic, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	r.Version, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 type RawBlockIndex struct {
 	BlockHeight       uint32
 	BlockHash         bigint.Uint256
 	RawBlockSize      uint32
 	RawBlockFileTag   uint32
-	BlockFileStartPos uint32
-	BlockFileEndPos   uint32
+	BlockFileStartPos uint64
+	BlockFileEndPos   uint64
 }
 
-func (r RawBlockIndex) Pack(writer io.Writer) error {
+func (r RawBlockIndex) packBody(writer io.Writer) error {
 	var err error
 	err = serialize.PackUint32(writer, r.BlockHeight)
 	if err != nil {
@@ -41,11 +91,53 @@ func (r RawBlockIndex) Pack(writer io.Writer) error {
 	if err != nil {
 		return err
 	}
-	err = serialize.PackUint32(writer, r.BlockFileStartPos)
+	err = serialize.PackUint64(writer, r.BlockFileStartPos)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint64(writer, r.BlockFileEndPos)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *RawBlockIndex) unpackBody(reader io.Reader) error {
+	var err error
+	r.BlockHeight, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	err = r.BlockHash.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	r.RawBlockSize, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	r.RawBlockFileTag, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	r.BlockFileStartPos, err = serialize.UnPackUint64(reader)
+	if err != nil {
+		return err
+	}
+	r.BlockFileEndPos, err = serialize.UnPackUint64(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r RawBlockIndex) Pack(writer io.Writer) error {
+	checksum := crc32.New(crc32cTable)
+	err := r.packBody(io.MultiWriter(writer, checksum))
 	if err != nil {
 		return err
 	}
-	err = serialize.PackUint32(writer, r.BlockFileEndPos)
+	err = serialize.PackUint32(writer, checksum.Sum32())
 	if err != nil {
 		return err
 	}
@@ -53,6 +145,37 @@ func (r RawBlockIndex) Pack(writer io.Writer) error {
 }
 
 func (r *RawBlockIndex) UnPack(reader io.Reader) error {
+	checksum := crc32.New(crc32cTable)
+	err := r.unpackBody(io.TeeReader(reader, checksum))
+	if err != nil {
+		return err
+	}
+	checksumRead, err := serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	if checksumRead != checksum.Sum32() {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// UnPackV2 reads the index record of version 2 which carries no checksum, only kept for upgrading
+func (r *RawBlockIndex) UnPackV2(reader io.Reader) error {
+	return r.unpackBody(reader)
+}
+
+// RawBlockIndexV1 is the headerless index record with 32-bit offsets, only kept for upgrading
+type RawBlockIndexV1 struct {
+	BlockHeight       uint32
+	BlockHash         bigint.Uint256
+	RawBlockSize      uint32
+	RawBlockFileTag   uint32
+	BlockFileStartPos uint32
+	BlockFileEndPos   uint32
+}
+
+func (r *RawBlockIndexV1) UnPack(reader io.Reader) error {
 	var err error
 	r.BlockHeight, err = serialize.UnPackUint32(reader)
 	if err != nil {
@@ -81,10 +204,21 @@ func (r *RawBlockIndex) UnPack(reader io.Reader) error {
 	return nil
 }
 
+func (r RawBlockIndexV1) Upgrade() *RawBlockIndex {
+	blockIndex := new(RawBlockIndex)
+	blockIndex.BlockHeight = r.BlockHeight
+	blockIndex.BlockHash = r.BlockHash
+	blockIndex.RawBlockSize = r.RawBlockSize
+	blockIndex.RawBlockFileTag = r.RawBlockFileTag
+	blockIndex.BlockFileStartPos = uint64(r.BlockFileStartPos)
+	blockIndex.BlockFileEndPos = uint64(r.BlockFileEndPos)
+	return blockIndex
+}
+
 type RawBlockIndexManager struct {
 	BlockIndexFileName string
 	BlockIndexFileObj  *os.File
-	BlockFileIndexPos  uint32
+	BlockFileIndexPos  uint64
 	blockIndexMutex    *sync.RWMutex
 }
 
@@ -99,7 +233,32 @@ func (r *RawBlockIndexManager) Init(indexDir string, indexName string) error {
 		r.blockIndexMutex.Unlock()
 		return err
 	}
-	r.BlockFileIndexPos = 0
+	blockIndexInfo, err := r.BlockIndexFileObj.Stat()
+	if err != nil {
+		_ = r.BlockIndexFileObj.Close()
+		r.blockIndexMutex.Unlock()
+		return err
+	}
+	indexHeader := new(RawBlockIndexHeader)
+	if blockIndexInfo.Size() == 0 {
+		// new index file, write the header
+		indexHeader.Magic = RawBlockIndexMagic
+		indexHeader.Version = RawBlockIndexVersion
+		err = indexHeader.Pack(r.BlockIndexFileObj)
+	} else {
+		err = indexHeader.UnPack(io.NewSectionReader(r.BlockIndexFileObj, 0, RawBlockIndexHeaderSize))
+		if err == nil && indexHeader.Magic != RawBlockIndexMagic {
+			err = errors.New("invalid raw block index magic")
+		} else if err == nil && indexHeader.Version != RawBlockIndexVersion {
+			err = errors.New("not support raw block index version: " + strconv.Itoa(int(indexHeader.Version)))
+		}
+	}
+	if err != nil {
+		_ = r.BlockIndexFileObj.Close()
+		r.blockIndexMutex.Unlock()
+		return err
+	}
+	r.BlockFileIndexPos = RawBlockIndexHeaderSize
 	r.BlockIndexFileName = indexName
 	r.blockIndexMutex.Unlock()
 	return nil
@@ -117,14 +276,36 @@ func (r *RawBlockIndexManager) AddNewBlockIndex(newBlockIndex *RawBlockIndex) er
 	return nil
 }
 
+// TruncateBlockIndex keeps the index records of the first blockCount blocks
+func (r *RawBlockIndexManager) TruncateBlockIndex(blockCount uint32) error {
+	r.blockIndexMutex.Lock()
+	err := r.BlockIndexFileObj.Truncate(getBlockIndexPos(blockCount))
+	if err != nil {
+		r.blockIndexMutex.Unlock()
+		return err
+	}
+	r.BlockFileIndexPos = uint64(getBlockIndexPos(blockCount))
+	r.blockIndexMutex.Unlock()
+	return nil
+}
+
+func (r *RawBlockIndexManager) Sync() error {
+	r.blockIndexMutex.Lock()
+	err := r.BlockIndexFileObj.Sync()
+	r.blockIndexMutex.Unlock()
+	return err
+}
+
 type RawBlock struct {
 	BlockHeight    uint32
 	BlockHash      bigint.Uint256
 	CompressedType byte
 	RawBlockData   blob.Byteblob
+	// records written before checksums were introduced
+	NoChecksum bool
 }
 
-func (r RawBlock) Pack(writer io.Writer) error {
+func (r RawBlock) packBody(writer io.Writer) error {
 	var err error
 	err = serialize.PackUint32(writer, r.BlockHeight)
 	if err != nil {
@@ -134,7 +315,11 @@ func (r RawBlock) Pack(writer io.Writer) error {
 	if err != nil {
 		return err
 	}
-	err = serialize.PackByte(writer, r.CompressedType)
+	if r.NoChecksum {
+		err = serialize.PackByte(writer, r.CompressedType)
+	} else {
+		err = serialize.PackByte(writer, r.CompressedType|RawBlockChecksumFlag)
+	}
 	if err != nil {
 		return err
 	}
@@ -145,28 +330,92 @@ func (r RawBlock) Pack(writer io.Writer) error {
 	return nil
 }
 
-func (r RawBlock) PackSize() uint32 {
-	return 4 + 32 + 1 + serialize.CompactSizeLen(uint64(len(r.RawBlockData.GetData()))) + uint32(len(r.RawBlockData.GetData()))
+func (r RawBlock) Pack(writer io.Writer) error {
+	if r.NoChecksum {
+		return r.packBody(writer)
+	}
+	checksum := crc32.New(crc32cTable)
+	err := r.packBody(io.MultiWriter(writer, checksum))
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, checksum.Sum32())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r RawBlock) PackSize() uint64 {
+	packSize := 4 + 32 + 1 + uint64(serialize.CompactSizeLen(uint64(len(r.RawBlockData.GetData())))) + uint64(len(r.RawBlockData.GetData()))
+	if !r.NoChecksum {
+		packSize = packSize + 4
+	}
+	return packSize
+}
+
+func (r *RawBlock) Compress(compressedType byte) error {
+	if r.CompressedType == compressedType {
+		return nil
+	}
+	err := r.Decompress()
+	if err != nil {
+		return err
+	}
+	compressedData, err := compressData(compressedType, r.RawBlockData.GetData())
+	if err != nil {
+		return err
+	}
+	r.RawBlockData.SetData(compressedData)
+	r.CompressedType = compressedType
+	return nil
+}
+
+func (r *RawBlock) Decompress() error {
+	if r.CompressedType == CompressedTypeNone {
+		return nil
+	}
+	rawData, err := decompressData(r.CompressedType, r.RawBlockData.GetData())
+	if err != nil {
+		return err
+	}
+	r.RawBlockData.SetData(rawData)
+	r.CompressedType = CompressedTypeNone
+	return nil
 }
 
 func (r *RawBlock) UnPack(reader io.Reader) error {
 	var err error
-	r.BlockHeight, err = serialize.UnPackUint32(reader)
+	checksum := crc32.New(crc32cTable)
+	bodyReader := io.TeeReader(reader, checksum)
+	r.BlockHeight, err = serialize.UnPackUint32(bodyReader)
 	if err != nil {
 		return err
 	}
-	err = r.BlockHash.UnPack(reader)
+	err = r.BlockHash.UnPack(bodyReader)
+	if err != nil {
+		return err
+	}
+	r.CompressedType, err = serialize.UnPackByte(bodyReader)
 	if err != nil {
 		return err
 	}
-	r.CompressedType, err = serialize.UnPackByte(reader)
+	r.NoChecksum = r.CompressedType&RawBlockChecksumFlag == 0
+	r.CompressedType = r.CompressedType &^ RawBlockChecksumFlag
+	err = r.RawBlockData.UnPack(bodyReader)
 	if err != nil {
 		return err
 	}
-	err = r.RawBlockData.UnPack(reader)
+	if r.NoChecksum {
+		return nil
+	}
+	checksumRead, err := serialize.UnPackUint32(reader)
 	if err != nil {
 		return err
 	}
+	if checksumRead != checksum.Sum32() {
+		return ErrChecksumMismatch
+	}
 	return nil
 }
 
@@ -175,8 +424,18 @@ type RawBlockManager struct {
 	RawBlockFileTag  uint32
 	RawBlockFileObj  *os.File
 	BlockHeight      uint32
-	BlockFileEndPos  uint32
-	rawBlockMutex    *sync.RWMutex
+	// the number of the stored blocks, which is the height of the next block, 0 before the genesis block is stored
+	BlockCount      uint32
+	BlockFileEndPos uint64
+	CompressedType  byte
+	// rollover policy of the raw block files, 0 means no limit
+	MaxFileSize     uint64
+	MaxFileBlocks   uint32
+	FileHeightAlign uint32
+	FileBlockCount  uint32
+	dataDir         string
+	dataNamePrefix  string
+	rawBlockMutex   *sync.RWMutex
 }
 
 func (r *RawBlockManager) Init(dataDir string, dataNamePrefix string, fileTag uint32) error {
@@ -194,19 +453,98 @@ func (r *RawBlockManager) Init(dataDir string, dataNamePrefix string, fileTag ui
 	r.RawBlockFileName = rawBlockFileName
 	r.RawBlockFileTag = fileTag
 	r.BlockHeight = 0
+	r.BlockCount = 0
+	r.BlockFileEndPos = 0
+	r.CompressedType = CompressedTypeNone
+	r.FileBlockCount = 0
+	r.dataDir = dataDir
+	r.dataNamePrefix = dataNamePrefix
+	r.rawBlockMutex.Unlock()
+	return nil
+}
+
+// SwitchFile makes the file of the tag current, the data of the previous file is synced before it is closed
+func (r *RawBlockManager) SwitchFile(fileTag uint32) error {
+	r.rawBlockMutex.Lock()
+	err := r.RawBlockFileObj.Sync()
+	if err != nil {
+		r.rawBlockMutex.Unlock()
+		return err
+	}
+	rawBlockFileName := r.dataDir + "/" + r.dataNamePrefix + "." + strconv.Itoa(int(fileTag))
+	rawBlockFileObj, err := os.OpenFile(rawBlockFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend)
+	if err != nil {
+		r.rawBlockMutex.Unlock()
+		return err
+	}
+	_ = r.RawBlockFileObj.Close()
+	r.RawBlockFileObj = rawBlockFileObj
+	r.RawBlockFileName = rawBlockFileName
+	r.RawBlockFileTag = fileTag
 	r.BlockFileEndPos = 0
+	r.FileBlockCount = 0
 	r.rawBlockMutex.Unlock()
 	return nil
 }
 
+// NeedRollOver checks if the new block should be added to a new file, the file size is checked
+// with the new block appended so that a file never exceeds the max file size unless it holds a single block
+func (r *RawBlockManager) NeedRollOver(newBlockHeight uint32, newPackSize uint64) bool {
+	r.rawBlockMutex.RLock()
+	defer r.rawBlockMutex.RUnlock()
+	if r.FileBlockCount == 0 {
+		// never roll over an empty file
+		return false
+	}
+	if r.MaxFileSize != 0 && r.BlockFileEndPos+newPackSize > r.MaxFileSize {
+		return true
+	}
+	if r.MaxFileBlocks != 0 && r.FileBlockCount >= r.MaxFileBlocks {
+		return true
+	}
+	if r.FileHeightAlign != 0 && newBlockHeight%r.FileHeightAlign == 0 {
+		return true
+	}
+	return false
+}
+
+func (r *RawBlockManager) RollOver() error {
+	return r.SwitchFile(r.RawBlockFileTag + 1)
+}
+
 func (r *RawBlockManager) AddNewBlock(newBlock *RawBlock) error {
 	r.rawBlockMutex.Lock()
-	err := newBlock.Pack(r.RawBlockFileObj)
+	err := newBlock.Compress(r.CompressedType)
+	if err != nil {
+		r.rawBlockMutex.Unlock()
+		return err
+	}
+	err = newBlock.Pack(r.RawBlockFileObj)
 	if err != nil {
 		r.rawBlockMutex.Unlock()
 		return err
 	}
 	r.BlockFileEndPos = r.BlockFileEndPos + newBlock.PackSize()
+	r.FileBlockCount = r.FileBlockCount + 1
 	r.rawBlockMutex.Unlock()
 	return nil
 }
+
+func (r *RawBlockManager) TruncateBlock(blockFileEndPos uint64) error {
+	r.rawBlockMutex.Lock()
+	err := r.RawBlockFileObj.Truncate(int64(blockFileEndPos))
+	if err != nil {
+		r.rawBlockMutex.Unlock()
+		return err
+	}
+	r.BlockFileEndPos = blockFileEndPos
+	r.rawBlockMutex.Unlock()
+	return nil
+}
+
+func (r *RawBlockManager) Sync() error {
+	r.rawBlockMutex.Lock()
+	err := r.RawBlockFileObj.Sync()
+	r.rawBlockMutex.Unlock()
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func getRawBlockFileSize(tag uint32) (uint64, error) {
+	rawBlockInfo, err := os.Stat(getRawBlockFileName(tag))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return uint64(rawBlockInfo.Size()), nil
+}
+
+func loadLastBlockIndex(indexMgr *RawBlockIndexManager, blockCount uint32) (*RawBlockIndex, error) {
+	ptrBlockIndex := new(RawBlockIndex)
+	err := ptrBlockIndex.UnPack(io.NewSectionReader(indexMgr.BlockIndexFileObj, getBlockIndexPos(blockCount-1), RawBlockIndexSize))
+	if err != nil {
+		return nil, err
+	}
+	return ptrBlockIndex, nil
+}
+
+// repairTail drops the partial or corrupt records at the tail of the raw block index and the raw block files,
+// and re-indexes the complete raw block records written after the latest index record
+func repairTail() error {
+	var err error
+	indexMgr := new(RawBlockIndexManager)
+	err = indexMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockIndexName)
+	if err != nil {
+		return err
+	}
+	defer indexMgr.BlockIndexFileObj.Close()
+	indexInfo, err := indexMgr.BlockIndexFileObj.Stat()
+	if err != nil {
+		return err
+	}
+
+	// drop the partial record at the tail of the raw block index
+	blockCount := uint32((indexInfo.Size() - RawBlockIndexHeaderSize) / RawBlockIndexSize)
+	if (indexInfo.Size()-RawBlockIndexHeaderSize)%RawBlockIndexSize != 0 {
+		fmt.Println("repair: drop the partial raw block index record of block height", blockCount)
+		err = indexMgr.TruncateBlockIndex(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+
+	// drop the corrupt records at the tail of the raw block index
+	var lastBlockIndex *RawBlockIndex = nil
+	for blockCount > 0 {
+		ptrBlockIndex, err := loadLastBlockIndex(indexMgr, blockCount)
+		if err != nil && err != ErrChecksumMismatch {
+			return err
+		}
+		if err == nil && ptrBlockIndex.BlockHeight == blockCount-1 {
+			lastBlockIndex = ptrBlockIndex
+			break
+		}
+		fmt.Println("repair: drop the corrupt raw block index record of block height", blockCount-1)
+		blockCount--
+		err = indexMgr.TruncateBlockIndex(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+
+	// drop the raw block index records which point past the raw block data
+	for lastBlockIndex != nil {
+		rawBlockFileSize, err := getRawBlockFileSize(lastBlockIndex.RawBlockFileTag)
+		if err != nil {
+			return err
+		}
+		if lastBlockIndex.BlockFileEndPos <= rawBlockFileSize {
+			break
+		}
+		fmt.Println("repair: drop the raw block index record of block height", blockCount-1, "which points past the raw block data")
+		blockCount--
+		err = indexMgr.TruncateBlockIndex(blockCount)
+		if err != nil {
+			return err
+		}
+		lastBlockIndex = nil
+		if blockCount > 0 {
+			lastBlockIndex, err = loadLastBlockIndex(indexMgr, blockCount)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var indexedTag uint32 = 0
+	var indexedEndPos uint64 = 0
+	if lastBlockIndex != nil {
+		indexedTag = lastBlockIndex.RawBlockFileTag
+		indexedEndPos = lastBlockIndex.BlockFileEndPos
+	}
+
+	// re-index the complete raw block records after the latest index record, and truncate the rest
+	latestTag, err := getLatestRawBlockTag()
+	if err != nil {
+		return err
+	}
+	for tag := indexedTag; tag <= latestTag; tag++ {
+		rawBlockFileObj, err := os.OpenFile(getRawBlockFileName(tag), os.O_RDWR, os.ModeAppend)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
+		rawBlockInfo, err := rawBlockFileObj.Stat()
+		if err != nil {
+			_ = rawBlockFileObj.Close()
+			return err
+		}
+		rawBlockFileSize := uint64(rawBlockInfo.Size())
+
+		var offSet uint64 = 0
+		if tag == indexedTag {
+			offSet = indexedEndPos
+		}
+		for offSet < rawBlockFileSize {
+			ptrRawBlock := new(RawBlock)
+			err = ptrRawBlock.UnPack(io.NewSectionReader(rawBlockFileObj, int64(offSet), int64(rawBlockFileSize-offSet)))
+			if err != nil || ptrRawBlock.BlockHeight != blockCount {
+				break
+			}
+			packSize := ptrRawBlock.PackSize()
+			err = ptrRawBlock.Decompress()
+			if err != nil {
+				break
+			}
+
+			blockIndexNew := new(RawBlockIndex)
+			blockIndexNew.BlockHeight = ptrRawBlock.BlockHeight
+			blockIndexNew.BlockHash = ptrRawBlock.BlockHash
+			blockIndexNew.RawBlockSize = uint32(len(ptrRawBlock.RawBlockData.GetData()))
+			blockIndexNew.RawBlockFileTag = tag
+			blockIndexNew.BlockFileStartPos = offSet
+			blockIndexNew.BlockFileEndPos = offSet + packSize
+			err = indexMgr.AddNewBlockIndex(blockIndexNew)
+			if err != nil {
+				_ = rawBlockFileObj.Close()
+				return err
+			}
+			fmt.Println("repair: re-index block height", blockIndexNew.BlockHeight, "in", getRawBlockFileName(tag), "offset", offSet)
+			blockCount++
+			indexedTag = tag
+			offSet = offSet + packSize
+		}
+
+		if offSet < rawBlockFileSize {
+			fmt.Println("repair: truncate", getRawBlockFileName(tag), "from", rawBlockFileSize, "to", offSet)
+			err = rawBlockFileObj.Truncate(int64(offSet))
+			if err != nil {
+				_ = rawBlockFileObj.Close()
+				return err
+			}
+			_ = rawBlockFileObj.Close()
+			for staleTag := latestTag; staleTag > tag; staleTag-- {
+				fmt.Println("repair: remove", getRawBlockFileName(staleTag))
+				err = os.Remove(getRawBlockFileName(staleTag))
+				if err != nil {
+					return err
+				}
+			}
+			break
+		}
+		_ = rawBlockFileObj.Close()
+	}
+
+	// remove the empty raw block files after the latest indexed one
+	latestTag, err = getLatestRawBlockTag()
+	if err != nil {
+		return err
+	}
+	for tag := latestTag; tag > indexedTag; tag-- {
+		rawBlockFileSize, err := getRawBlockFileSize(tag)
+		if err != nil {
+			return err
+		}
+		if rawBlockFileSize != 0 {
+			break
+		}
+		fmt.Println("repair: remove the empty", getRawBlockFileName(tag))
+		err = os.Remove(getRawBlockFileName(tag))
+		if err != nil {
+			return err
+		}
+	}
+
+	return indexMgr.Sync()
+}
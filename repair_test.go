@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// useTestDataDir points the data config to a temporary directory for the test
+func useTestDataDir(t *testing.T) string {
+	savedConfig := config
+	dataDir, err := ioutil.TempDir("", "btc_raw_block_collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DataConfig = DataConfig{
+		DataDir:            dataDir,
+		BlockIndexName:     "raw_block_index",
+		RawBlockFilePrefix: "raw_block",
+		StaleBlockName:     "stale_block",
+		BlockHeaderName:    DefaultBlockHeaderName,
+	}
+	t.Cleanup(func() {
+		config = savedConfig
+		_ = os.RemoveAll(dataDir)
+	})
+	return dataDir
+}
+
+func buildTestRawBlocks(count int) [][]byte {
+	rawBlocks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		rawBlocks = append(rawBlocks, bytes.Repeat([]byte{byte(i + 1)}, 200+i))
+	}
+	return rawBlocks
+}
+
+// writeTestRawBlocks stores the raw blocks from height 0 in the raw block file 0 and indexes them
+func writeTestRawBlocks(t *testing.T, rawBlocks [][]byte, compressedType byte) []*RawBlockIndex {
+	indexMgr := new(RawBlockIndexManager)
+	err := indexMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockIndexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexMgr.BlockIndexFileObj.Close()
+	rawBlockMgr := new(RawBlockManager)
+	err = rawBlockMgr.Init(config.DataConfig.DataDir, config.DataConfig.RawBlockFilePrefix, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawBlockMgr.RawBlockFileObj.Close()
+	rawBlockMgr.CompressedType = compressedType
+
+	blockIndexes := make([]*RawBlockIndex, 0, len(rawBlocks))
+	for height, rawBlockData := range rawBlocks {
+		rawBlock := new(RawBlock)
+		rawBlock.BlockHeight = uint32(height)
+		_ = rawBlock.BlockHash.SetHex(calcBlockHash(rawBlockData))
+		rawBlock.RawBlockData.SetData(rawBlockData)
+		startPos := rawBlockMgr.BlockFileEndPos
+		err = rawBlockMgr.AddNewBlock(rawBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockIndex := new(RawBlockIndex)
+		blockIndex.BlockHeight = uint32(height)
+		blockIndex.BlockHash = rawBlock.BlockHash
+		blockIndex.RawBlockSize = uint32(len(rawBlockData))
+		blockIndex.BlockFileStartPos = startPos
+		blockIndex.BlockFileEndPos = rawBlockMgr.BlockFileEndPos
+		err = indexMgr.AddNewBlockIndex(blockIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockIndexes = append(blockIndexes, blockIndex)
+	}
+	return blockIndexes
+}
+
+func readTestBlockIndexes(t *testing.T) []*RawBlockIndex {
+	indexData, err := ioutil.ReadFile(config.DataConfig.DataDir + "/" + config.DataConfig.BlockIndexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(indexData)-RawBlockIndexHeaderSize)%RawBlockIndexSize != 0 {
+		t.Fatal("invalid raw block index size", len(indexData))
+	}
+	reader := bytes.NewReader(indexData[RawBlockIndexHeaderSize:])
+	blockIndexes := make([]*RawBlockIndex, 0)
+	for reader.Len() != 0 {
+		blockIndex := new(RawBlockIndex)
+		err = blockIndex.UnPack(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockIndexes = append(blockIndexes, blockIndex)
+	}
+	return blockIndexes
+}
+
+func appendTestFile(t *testing.T, fileName string, data []byte) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func packTestRawBlock(t *testing.T, height uint32, rawBlockData []byte) []byte {
+	rawBlock := new(RawBlock)
+	rawBlock.BlockHeight = height
+	_ = rawBlock.BlockHash.SetHex(calcBlockHash(rawBlockData))
+	rawBlock.RawBlockData.SetData(rawBlockData)
+	buf := new(bytes.Buffer)
+	err := rawBlock.Pack(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRepairTail(t *testing.T) {
+	rawBlocks := buildTestRawBlocks(4)
+	tests := []struct {
+		name string
+		// damages the data directory holding the first 3 blocks
+		damage func(t *testing.T, blockIndexes []*RawBlockIndex)
+		// the expected block count and raw block file size after the repair
+		blockCount int
+		fileSize   func(blockIndexes []*RawBlockIndex, record4 []byte) int64
+	}{
+		{"clean", func(t *testing.T, blockIndexes []*RawBlockIndex) {},
+			3, func(blockIndexes []*RawBlockIndex, record4 []byte) int64 {
+				return int64(blockIndexes[2].BlockFileEndPos)
+			}},
+		{"partial index record", func(t *testing.T, blockIndexes []*RawBlockIndex) {
+			appendTestFile(t, config.DataConfig.DataDir+"/"+config.DataConfig.BlockIndexName, make([]byte, RawBlockIndexSize/2))
+		}, 3, func(blockIndexes []*RawBlockIndex, record4 []byte) int64 {
+			return int64(blockIndexes[2].BlockFileEndPos)
+		}},
+		{"truncated raw block record", func(t *testing.T, blockIndexes []*RawBlockIndex) {
+			record4 := packTestRawBlock(t, 3, rawBlocks[3])
+			appendTestFile(t, getRawBlockFileName(0), record4[0:len(record4)/2])
+		}, 3, func(blockIndexes []*RawBlockIndex, record4 []byte) int64 {
+			return int64(blockIndexes[2].BlockFileEndPos)
+		}},
+		{"index record past raw block data", func(t *testing.T, blockIndexes []*RawBlockIndex) {
+			record4 := packTestRawBlock(t, 3, rawBlocks[3])
+			appendTestFile(t, getRawBlockFileName(0), record4[0:len(record4)-1])
+			blockIndex := *blockIndexes[2]
+			blockIndex.BlockHeight = 3
+			blockIndex.BlockFileStartPos = blockIndexes[2].BlockFileEndPos
+			blockIndex.BlockFileEndPos = blockIndexes[2].BlockFileEndPos + uint64(len(record4))
+			buf := new(bytes.Buffer)
+			_ = blockIndex.Pack(buf)
+			appendTestFile(t, config.DataConfig.DataDir+"/"+config.DataConfig.BlockIndexName, buf.Bytes())
+		}, 3, func(blockIndexes []*RawBlockIndex, record4 []byte) int64 {
+			return int64(blockIndexes[2].BlockFileEndPos)
+		}},
+		{"unindexed raw block record", func(t *testing.T, blockIndexes []*RawBlockIndex) {
+			appendTestFile(t, getRawBlockFileName(0), packTestRawBlock(t, 3, rawBlocks[3]))
+		}, 4, func(blockIndexes []*RawBlockIndex, record4 []byte) int64 {
+			return int64(blockIndexes[2].BlockFileEndPos) + int64(len(record4))
+		}},
+		{"corrupt index record", func(t *testing.T, blockIndexes []*RawBlockIndex) {
+			indexFile, err := os.OpenFile(config.DataConfig.DataDir+"/"+config.DataConfig.BlockIndexName, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer indexFile.Close()
+			_, err = indexFile.WriteAt([]byte{0xff}, getBlockIndexPos(2)+40)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, 3, func(blockIndexes []*RawBlockIndex, record4 []byte) int64 {
+			return int64(blockIndexes[2].BlockFileEndPos)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestDataDir(t)
+			blockIndexes := writeTestRawBlocks(t, rawBlocks[0:3], CompressedTypeZstd)
+			test.damage(t, blockIndexes)
+
+			err := repairTail()
+			if err != nil {
+				t.Fatal(err)
+			}
+			repairedIndexes := readTestBlockIndexes(t)
+			if len(repairedIndexes) != test.blockCount {
+				t.Fatalf("%d index records after repair, expected %d", len(repairedIndexes), test.blockCount)
+			}
+			for height, blockIndex := range repairedIndexes {
+				if blockIndex.BlockHeight != uint32(height) || blockIndex.BlockHash.GetHex() != calcBlockHash(rawBlocks[height]) {
+					t.Fatalf("unexpected index record of height %d", height)
+				}
+				if height < len(blockIndexes) && (blockIndex.RawBlockFileTag != blockIndexes[height].RawBlockFileTag ||
+					blockIndex.BlockFileStartPos != blockIndexes[height].BlockFileStartPos ||
+					blockIndex.BlockFileEndPos != blockIndexes[height].BlockFileEndPos) {
+					t.Fatalf("index record of height %d changed", height)
+				}
+			}
+			rawBlockInfo, err := os.Stat(getRawBlockFileName(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rawBlockInfo.Size() != test.fileSize(blockIndexes, packTestRawBlock(t, 3, rawBlocks[3])) {
+				t.Fatalf("raw block file size %d after repair", rawBlockInfo.Size())
+			}
+
+			// the repaired tail is readable
+			lastIndex := repairedIndexes[len(repairedIndexes)-1]
+			ptrRawBlock, err := loadRawBlock(lastIndex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ptrRawBlock.Decompress()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ptrRawBlock.RawBlockData.GetData(), rawBlocks[lastIndex.BlockHeight]) {
+				t.Fatal("unexpected raw block data at the tail")
+			}
+
+			// a second repair changes nothing
+			err = repairTail()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(readTestBlockIndexes(t)) != test.blockCount {
+				t.Fatal("second repair changed the raw block index")
+			}
+		})
+	}
+}
+
+func TestRepairTailRemovesEmptyRawBlockFiles(t *testing.T) {
+	useTestDataDir(t)
+	writeTestRawBlocks(t, buildTestRawBlocks(2), CompressedTypeNone)
+	emptyFile, err := os.Create(getRawBlockFileName(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = emptyFile.Close()
+
+	err = repairTail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(getRawBlockFileName(1))
+	if !os.IsNotExist(err) {
+		t.Fatal("empty raw block file is not removed")
+	}
+	if len(readTestBlockIndexes(t)) != 2 {
+		t.Fatal("unexpected raw block index after repair")
+	}
+}
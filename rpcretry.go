@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ybbus/jsonrpc"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type RpcErrorClass int
+
+const (
+	RpcErrorTransport RpcErrorClass = iota
+	RpcErrorAuth
+	RpcErrorCode
+	RpcErrorMalformed
+	RpcErrorQuorum
+	RpcErrorNetwork
+)
+
+const (
+	DefaultRetryInitialDelay = 500
+	DefaultRetryMaxDelay     = 60000
+	DefaultRpcTimeout        = 60
+)
+
+// bitcoind rpc error codes which may go away by themselves
+const (
+	RpcCodeInvalidAddressOrKey = -5
+	RpcCodeInvalidParameter    = -8
+	RpcCodeInWarmup            = -28
+)
+
+func (c RpcErrorClass) String() string {
+	switch c {
+	case RpcErrorTransport:
+		return "transport"
+	case RpcErrorAuth:
+		return "auth"
+	case RpcErrorCode:
+		return "rpc"
+	case RpcErrorMalformed:
+		return "malformed response"
+	case RpcErrorQuorum:
+		return "quorum"
+	case RpcErrorNetwork:
+		return "network"
+	}
+	return "unknown"
+}
+
+type RpcCallError struct {
+	Class  RpcErrorClass
+	Method string
+	Code   int
+	Err    error
+}
+
+// the transport errors of jsonrpc carry the url of the node with its credentials
+var urlCredentialsRegexp = regexp.MustCompile(`//[^/@\s]+@`)
+
+// redactError drops the credentials of the urls in the error message
+func redactError(err error) string {
+	return urlCredentialsRegexp.ReplaceAllString(err.Error(), "//")
+}
+
+func (e *RpcCallError) Error() string {
+	if e.Class == RpcErrorCode {
+		return fmt.Sprintf("%s error %d on %s: %s", e.Class, e.Code, e.Method, redactError(e.Err))
+	}
+	return fmt.Sprintf("%s error on %s: %s", e.Class, e.Method, redactError(e.Err))
+}
+
+// Transient reports whether the call may succeed if it is retried later
+func (e *RpcCallError) Transient() bool {
+	switch e.Class {
+	case RpcErrorTransport, RpcErrorMalformed, RpcErrorQuorum:
+		return true
+	case RpcErrorCode:
+		// block not found and height out of range happen when the chain of the node changes between calls
+		return e.Code == RpcCodeInWarmup || e.Code == RpcCodeInvalidAddressOrKey || e.Code == RpcCodeInvalidParameter
+	}
+	return false
+}
+
+func newRpcCallError(method string, err error) *RpcCallError {
+	rpcCallError := new(RpcCallError)
+	rpcCallError.Method = method
+	rpcCallError.Err = err
+	switch e := err.(type) {
+	case *jsonrpc.RPCError:
+		rpcCallError.Class = RpcErrorCode
+		rpcCallError.Code = e.Code
+	case *jsonrpc.HTTPError:
+		rpcCallError.Code = e.Code
+		if e.Code == 401 || e.Code == 403 {
+			rpcCallError.Class = RpcErrorAuth
+		} else if e.Code >= 500 {
+			rpcCallError.Class = RpcErrorTransport
+		} else {
+			rpcCallError.Class = RpcErrorMalformed
+		}
+	default:
+		// jsonrpc only gives formatted errors, the decode failures are told apart by their message
+		if strings.Contains(err.Error(), "could not decode body") || strings.Contains(err.Error(), "rpc response missing") {
+			rpcCallError.Class = RpcErrorMalformed
+		} else {
+			rpcCallError.Class = RpcErrorTransport
+		}
+	}
+	return rpcCallError
+}
+
+func newClassRpcError(class RpcErrorClass, method string, err error) *RpcCallError {
+	rpcCallError := new(RpcCallError)
+	rpcCallError.Class = class
+	rpcCallError.Method = method
+	rpcCallError.Err = err
+	return rpcCallError
+}
+
+func newMalformedRpcError(method string, err error) *RpcCallError {
+	return newClassRpcError(RpcErrorMalformed, method, err)
+}
+
+// newQuorumError is returned when the upstreams do not agree, which may settle once they sync to the same tip
+func newQuorumError(method string, err error) *RpcCallError {
+	return newClassRpcError(RpcErrorQuorum, method, err)
+}
+
+func isTransientRpcError(err error) bool {
+	rpcCallError, ok := err.(*RpcCallError)
+	return ok && rpcCallError.Transient()
+}
+
+// RetryBackoff computes the delays between the retries, doubling from the initial delay up to the max delay with jitter
+type RetryBackoff struct {
+	InitialDelay  time.Duration
+	MaxDelay      time.Duration
+	MaxAttempts   int
+	MaxDuration   time.Duration
+	Attempts      int
+	FirstFailTime time.Time
+	random        *rand.Rand
+}
+
+func newRetryBackoff() *RetryBackoff {
+	b := new(RetryBackoff)
+	b.InitialDelay = DefaultRetryInitialDelay * time.Millisecond
+	if config.RpcClientConfig.RetryInitialDelay > 0 {
+		b.InitialDelay = time.Duration(config.RpcClientConfig.RetryInitialDelay) * time.Millisecond
+	}
+	b.MaxDelay = DefaultRetryMaxDelay * time.Millisecond
+	if config.RpcClientConfig.RetryMaxDelay > 0 {
+		b.MaxDelay = time.Duration(config.RpcClientConfig.RetryMaxDelay) * time.Millisecond
+	}
+	if b.MaxDelay < b.InitialDelay {
+		b.MaxDelay = b.InitialDelay
+	}
+	b.MaxAttempts = config.RpcClientConfig.RetryMaxAttempts
+	b.MaxDuration = time.Duration(config.RpcClientConfig.RetryMaxDuration) * time.Second
+	b.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return b
+}
+
+// NextDelay returns the delay before the next attempt, or an error if the give up policy is reached
+func (b *RetryBackoff) NextDelay() (time.Duration, error) {
+	if b.Attempts == 0 {
+		b.FirstFailTime = time.Now()
+	}
+	b.Attempts++
+	if b.MaxAttempts > 0 && b.Attempts > b.MaxAttempts {
+		return 0, fmt.Errorf("give up after %d retries", b.MaxAttempts)
+	}
+	if b.MaxDuration > 0 && time.Since(b.FirstFailTime) > b.MaxDuration {
+		return 0, fmt.Errorf("give up after retrying for %v", b.MaxDuration)
+	}
+	delay := b.MaxDelay
+	if b.Attempts <= 30 && b.InitialDelay<<uint(b.Attempts-1) < b.MaxDelay {
+		delay = b.InitialDelay << uint(b.Attempts-1)
+	}
+	// pick a delay in [delay/2, delay] so several collectors do not hit the node at the same time
+	return delay/2 + time.Duration(b.random.Int63n(int64(delay/2)+1)), nil
+}
+
+func (b *RetryBackoff) Reset() {
+	b.Attempts = 0
+}
+
+// sleepUnlessQuit sleeps for the duration, and wakes up early when the collector is stopping
+func sleepUnlessQuit(d time.Duration) {
+	deadline := time.Now().Add(d)
+	for !quitFlag && time.Now().Before(deadline) {
+		step := time.Until(deadline)
+		if step > 100*time.Millisecond {
+			step = 100 * time.Millisecond
+		}
+		time.Sleep(step)
+	}
+}
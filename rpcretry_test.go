@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"github.com/ybbus/jsonrpc"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestRpcNode answers every json rpc call with the http status and the body
+func startTestRpcNode(t *testing.T, status int, body string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return strings.Replace(server.URL, "http://", "http://user:password@", 1)
+}
+
+func TestRpcErrorClass(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		class     RpcErrorClass
+		transient bool
+	}{
+		{"warmup", 500, `{"id":0,"error":{"code":-28,"message":"Loading block index..."}}`, RpcErrorCode, true},
+		{"block not found", 500, `{"id":0,"error":{"code":-5,"message":"Block not found"}}`, RpcErrorCode, true},
+		{"height out of range", 500, `{"id":0,"error":{"code":-8,"message":"Block height out of range"}}`, RpcErrorCode, true},
+		{"pruned", 500, `{"id":0,"error":{"code":-1,"message":"Block not available (pruned data)"}}`, RpcErrorCode, false},
+		{"unauthorized", 401, ``, RpcErrorAuth, false},
+		{"forbidden", 403, ``, RpcErrorAuth, false},
+		{"unavailable", 503, `<html>Service Unavailable</html>`, RpcErrorTransport, true},
+		{"not found", 404, `not found`, RpcErrorMalformed, true},
+		{"undecodable", 200, `{"id":0,"result":`, RpcErrorMalformed, true},
+		{"empty body", 200, ``, RpcErrorMalformed, true},
+	}
+	for _, test := range tests {
+		rpcClient := newJsonRpcClient(startTestRpcNode(t, test.status, test.body))
+		_, err := doHttpJsonRpcCall(rpcClient, "getblockcount")
+		rpcCallError, ok := err.(*RpcCallError)
+		if !ok {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if rpcCallError.Class != test.class || rpcCallError.Transient() != test.transient || isTransientRpcError(err) != test.transient {
+			t.Errorf("%s: got %s error transient %v, expected %s transient %v", test.name, rpcCallError.Class, rpcCallError.Transient(), test.class, test.transient)
+		}
+		if strings.Contains(rpcCallError.Error(), "password") {
+			t.Errorf("%s: credentials in the error %v", test.name, rpcCallError)
+		}
+	}
+
+	// the node is down
+	_, err := doHttpJsonRpcCall(newJsonRpcClient("http://127.0.0.1:1"), "getblockcount")
+	if rpcCallError, ok := err.(*RpcCallError); !ok || rpcCallError.Class != RpcErrorTransport || !rpcCallError.Transient() {
+		t.Error("unexpected error of the node down", err)
+	}
+	// the classes set by the callers
+	if !isTransientRpcError(newQuorumError("getblockhash", errors.New("upstreams disagree"))) {
+		t.Error("quorum error not retried")
+	}
+	if isTransientRpcError(newClassRpcError(RpcErrorNetwork, "getblockchaininfo", errors.New("wrong chain"))) {
+		t.Error("network error retried")
+	}
+	if isTransientRpcError(errors.New("not an rpc error")) {
+		t.Error("unclassified error retried")
+	}
+}
+
+func TestRetryBackoffDelay(t *testing.T) {
+	savedRpcClientConfig := config.RpcClientConfig
+	t.Cleanup(func() {
+		config.RpcClientConfig = savedRpcClientConfig
+	})
+	config.RpcClientConfig.RetryInitialDelay = 100
+	config.RpcClientConfig.RetryMaxDelay = 1000
+	config.RpcClientConfig.RetryMaxAttempts = 6
+	config.RpcClientConfig.RetryMaxDuration = 0
+	backoff := newRetryBackoff()
+
+	// the delay doubles up to the max delay, with the jitter in the lower half
+	for i, maxDelay := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		maxDelay = maxDelay * time.Millisecond
+		delay, err := backoff.NextDelay()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delay < maxDelay/2 || delay > maxDelay {
+			t.Fatalf("attempt %d: delay %v out of [%v, %v]", i+1, delay, maxDelay/2, maxDelay)
+		}
+	}
+	_, err := backoff.NextDelay()
+	if err == nil || !strings.Contains(err.Error(), "give up after 6 retries") {
+		t.Fatal("max attempts not reached", err)
+	}
+	backoff.Reset()
+	delay, err := backoff.NextDelay()
+	if err != nil || delay > 100*time.Millisecond {
+		t.Fatal("backoff not reset", delay, err)
+	}
+
+	// the give up by the duration since the first failure
+	backoff.Reset()
+	backoff.MaxAttempts = 0
+	backoff.MaxDuration = time.Second
+	_, _ = backoff.NextDelay()
+	backoff.FirstFailTime = time.Now().Add(-2 * time.Second)
+	_, err = backoff.NextDelay()
+	if err == nil || !strings.Contains(err.Error(), "give up after retrying") {
+		t.Fatal("max duration not reached", err)
+	}
+}
+
+func TestWaitForRpcRetry(t *testing.T) {
+	savedRpcClientConfig := config.RpcClientConfig
+	gatherStatusMutex.RLock()
+	savedGatherStatus := gatherStatus
+	gatherStatusMutex.RUnlock()
+	savedLatestRawBlockMgr := latestRawBlockMgr
+	latestRawBlockMgr = new(RawBlockManager)
+	t.Cleanup(func() {
+		config.RpcClientConfig = savedRpcClientConfig
+		gatherStatusMutex.Lock()
+		gatherStatus = savedGatherStatus
+		gatherStatusMutex.Unlock()
+		latestRawBlockMgr = savedLatestRawBlockMgr
+	})
+	config.RpcClientConfig.RetryInitialDelay = 1
+	config.RpcClientConfig.RetryMaxDelay = 2
+	config.RpcClientConfig.RetryMaxAttempts = 2
+	config.RpcClientConfig.RetryMaxDuration = 0
+
+	tests := []struct {
+		name    string
+		err     error
+		retries int
+	}{
+		{"transport", newRpcCallError("getblock", errors.New("dial tcp 127.0.0.1:8332: connect: connection refused")), 2},
+		{"warmup", newRpcCallError("getblockcount", &jsonrpc.RPCError{Code: -28, Message: "Loading block index..."}), 2},
+		{"malformed", newMalformedRpcError("getblockhash", errors.New("rpc response missing in batch")), 2},
+		{"quorum", newQuorumError("getblockhash", errors.New("upstreams disagree")), 2},
+		{"auth", newClassRpcError(RpcErrorAuth, "getblockcount", errors.New("401 Unauthorized")), 0},
+		{"pruned", newRpcCallError("getblock", &jsonrpc.RPCError{Code: -1, Message: "Block not available (pruned data)"}), 0},
+		{"network", newClassRpcError(RpcErrorNetwork, "getblockchaininfo", errors.New("wrong chain")), 0},
+	}
+	for _, test := range tests {
+		backoff := newRetryBackoff()
+		retries := 0
+		for waitForRpcRetry(backoff, 7, test.err) {
+			retries++
+		}
+		if retries != test.retries {
+			t.Errorf("%s: retried %d times, expected %d", test.name, retries, test.retries)
+		}
+		status := getGatherStatus()
+		if status.LastError != redactError(test.err) || status.LastErrorHeight != 7 {
+			t.Errorf("%s: unexpected gather status %+v", test.name, status)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/mutalisk999/bitcoin-lib/src/bech32"
+	"github.com/mutalisk999/bitcoin-lib/src/keyid"
+	"github.com/mutalisk999/bitcoin-lib/src/script"
+	"strconv"
+	"strings"
+)
+
+// the script types named as bitcoin core does
+const (
+	ScriptTypeNonStandard         = "nonstandard"
+	ScriptTypePubKey              = "pubkey"
+	ScriptTypePubKeyHash          = "pubkeyhash"
+	ScriptTypeScriptHash          = "scripthash"
+	ScriptTypeMultiSig            = "multisig"
+	ScriptTypeNullData            = "nulldata"
+	ScriptTypeWitnessV0KeyHash    = "witness_v0_keyhash"
+	ScriptTypeWitnessV0ScriptHash = "witness_v0_scripthash"
+	ScriptTypeWitnessV1Taproot    = "witness_v1_taproot"
+	ScriptTypeWitnessUnknown      = "witness_unknown"
+	ScriptTypeAnchor              = "anchor"
+)
+
+const (
+	MaxScriptSize          = 10000
+	CompressedPubKeySize   = 33
+	UncompressedPubKeySize = 65
+	Bech32mConst           = 0x2bc830a3
+	CashAddrTypePubKeyHash = 0
+	CashAddrTypeScriptHash = 1
+	SigHashAnyoneCanPay    = 0x80
+
+	descriptorInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descriptorChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// the pay to anchor output is the witness v1 program 0x4e73
+var anchorWitnessProgram = []byte{0x4e, 0x73}
+
+var opCodeNames = map[byte]string{
+	0x50: "OP_RESERVED", 0x61: "OP_NOP", 0x62: "OP_VER", 0x63: "OP_IF", 0x64: "OP_NOTIF", 0x65: "OP_VERIF",
+	0x66: "OP_VERNOTIF", 0x67: "OP_ELSE", 0x68: "OP_ENDIF", 0x69: "OP_VERIFY", 0x6a: "OP_RETURN",
+	0x6b: "OP_TOALTSTACK", 0x6c: "OP_FROMALTSTACK", 0x6d: "OP_2DROP", 0x6e: "OP_2DUP", 0x6f: "OP_3DUP",
+	0x70: "OP_2OVER", 0x71: "OP_2ROT", 0x72: "OP_2SWAP", 0x73: "OP_IFDUP", 0x74: "OP_DEPTH", 0x75: "OP_DROP",
+	0x76: "OP_DUP", 0x77: "OP_NIP", 0x78: "OP_OVER", 0x79: "OP_PICK", 0x7a: "OP_ROLL", 0x7b: "OP_ROT",
+	0x7c: "OP_SWAP", 0x7d: "OP_TUCK", 0x7e: "OP_CAT", 0x7f: "OP_SUBSTR", 0x80: "OP_LEFT", 0x81: "OP_RIGHT",
+	0x82: "OP_SIZE", 0x83: "OP_INVERT", 0x84: "OP_AND", 0x85: "OP_OR", 0x86: "OP_XOR", 0x87: "OP_EQUAL",
+	0x88: "OP_EQUALVERIFY", 0x89: "OP_RESERVED1", 0x8a: "OP_RESERVED2", 0x8b: "OP_1ADD", 0x8c: "OP_1SUB",
+	0x8d: "OP_2MUL", 0x8e: "OP_2DIV", 0x8f: "OP_NEGATE", 0x90: "OP_ABS", 0x91: "OP_NOT", 0x92: "OP_0NOTEQUAL",
+	0x93: "OP_ADD", 0x94: "OP_SUB", 0x95: "OP_MUL", 0x96: "OP_DIV", 0x97: "OP_MOD", 0x98: "OP_LSHIFT",
+	0x99: "OP_RSHIFT", 0x9a: "OP_BOOLAND", 0x9b: "OP_BOOLOR", 0x9c: "OP_NUMEQUAL", 0x9d: "OP_NUMEQUALVERIFY",
+	0x9e: "OP_NUMNOTEQUAL", 0x9f: "OP_LESSTHAN", 0xa0: "OP_GREATERTHAN", 0xa1: "OP_LESSTHANOREQUAL",
+	0xa2: "OP_GREATERTHANOREQUAL", 0xa3: "OP_MIN", 0xa4: "OP_MAX", 0xa5: "OP_WITHIN", 0xa6: "OP_RIPEMD160",
+	0xa7: "OP_SHA1", 0xa8: "OP_SHA256", 0xa9: "OP_HASH160", 0xaa: "OP_HASH256", 0xab: "OP_CODESEPARATOR",
+	0xac: "OP_CHECKSIG", 0xad: "OP_CHECKSIGVERIFY", 0xae: "OP_CHECKMULTISIG", 0xaf: "OP_CHECKMULTISIGVERIFY",
+	0xb0: "OP_NOP1", 0xb1: "OP_CHECKLOCKTIMEVERIFY", 0xb2: "OP_CHECKSEQUENCEVERIFY", 0xb3: "OP_NOP4", 0xb4: "OP_NOP5",
+	0xb5: "OP_NOP6", 0xb6: "OP_NOP7", 0xb7: "OP_NOP8", 0xb8: "OP_NOP9", 0xb9: "OP_NOP10", 0xba: "OP_CHECKSIGADD",
+}
+
+var sigHashTypeNames = map[byte]string{
+	1: "ALL", 1 | SigHashAnyoneCanPay: "ALL|ANYONECANPAY",
+	2: "NONE", 2 | SigHashAnyoneCanPay: "NONE|ANYONECANPAY",
+	3: "SINGLE", 3 | SigHashAnyoneCanPay: "SINGLE|ANYONECANPAY",
+}
+
+var errScriptParse = errors.New("script parse error")
+
+// getScriptOp reads the operation at the position, returns the opcode, the pushed data and the next position
+func getScriptOp(scriptBytes []byte, pos int) (byte, []byte, int, error) {
+	if pos >= len(scriptBytes) {
+		return 0, nil, pos, errScriptParse
+	}
+	opCode := scriptBytes[pos]
+	pos++
+	if opCode > script.OP_PUSHDATA4 {
+		return opCode, nil, pos, nil
+	}
+	dataSize := int(opCode)
+	switch opCode {
+	case script.OP_PUSHDATA1:
+		if pos+1 > len(scriptBytes) {
+			return 0, nil, pos, errScriptParse
+		}
+		dataSize = int(scriptBytes[pos])
+		pos += 1
+	case script.OP_PUSHDATA2:
+		if pos+2 > len(scriptBytes) {
+			return 0, nil, pos, errScriptParse
+		}
+		dataSize = int(binary.LittleEndian.Uint16(scriptBytes[pos:]))
+		pos += 2
+	case script.OP_PUSHDATA4:
+		if pos+4 > len(scriptBytes) {
+			return 0, nil, pos, errScriptParse
+		}
+		dataSize = int(binary.LittleEndian.Uint32(scriptBytes[pos:]))
+		pos += 4
+	}
+	if dataSize < 0 || dataSize > len(scriptBytes)-pos {
+		return 0, nil, pos, errScriptParse
+	}
+	return opCode, scriptBytes[pos : pos+dataSize], pos + dataSize, nil
+}
+
+func getOpName(opCode byte) string {
+	if opCode == script.OP_0 {
+		return "0"
+	}
+	if opCode == script.OP_1NEGATE {
+		return "-1"
+	}
+	if opCode >= script.OP_1 && opCode <= script.OP_16 {
+		return strconv.Itoa(int(opCode - script.OP_1 + 1))
+	}
+	opName, ok := opCodeNames[opCode]
+	if !ok {
+		return "OP_UNKNOWN"
+	}
+	return opName
+}
+
+// decodeScriptNum decodes the little endian number with the sign bit in the last byte
+func decodeScriptNum(data []byte) int64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var value int64 = 0
+	for i, b := range data {
+		value |= int64(b) << (8 * uint(i))
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		return -(value & ^(int64(0x80) << (8 * uint(len(data)-1))))
+	}
+	return value
+}
+
+// isValidSignatureEncoding checks the strict DER signature with the hash type appended (BIP66)
+func isValidSignatureEncoding(sig []byte) bool {
+	if len(sig) < 9 || len(sig) > 73 {
+		return false
+	}
+	if sig[0] != 0x30 || int(sig[1]) != len(sig)-3 {
+		return false
+	}
+	lenR := int(sig[3])
+	if 5+lenR >= len(sig) {
+		return false
+	}
+	lenS := int(sig[5+lenR])
+	if lenR+lenS+7 != len(sig) {
+		return false
+	}
+	if sig[2] != 0x02 || lenR == 0 || sig[4]&0x80 != 0 {
+		return false
+	}
+	if lenR > 1 && sig[4] == 0x00 && sig[5]&0x80 == 0 {
+		return false
+	}
+	if sig[lenR+4] != 0x02 || lenS == 0 || sig[lenR+6]&0x80 != 0 {
+		return false
+	}
+	if lenS > 1 && sig[lenR+6] == 0x00 && sig[lenR+7]&0x80 == 0 {
+		return false
+	}
+	return true
+}
+
+func isUnspendableScript(scriptBytes []byte) bool {
+	return (len(scriptBytes) > 0 && scriptBytes[0] == script.OP_RETURN) || len(scriptBytes) > MaxScriptSize
+}
+
+// scriptToAsm disassembles the script as bitcoin core does, the signatures in a scriptSig are shown with their hash type
+func scriptToAsm(scriptBytes []byte, attemptSighashDecode bool) string {
+	asmItems := make([]string, 0)
+	for pos := 0; pos < len(scriptBytes); {
+		opCode, data, nextPos, err := getScriptOp(scriptBytes, pos)
+		if err != nil {
+			asmItems = append(asmItems, "[error]")
+			break
+		}
+		pos = nextPos
+		if opCode > script.OP_PUSHDATA4 {
+			asmItems = append(asmItems, getOpName(opCode))
+			continue
+		}
+		if len(data) <= 4 {
+			asmItems = append(asmItems, strconv.FormatInt(decodeScriptNum(data), 10))
+			continue
+		}
+		sigHashDecode := ""
+		if attemptSighashDecode && !isUnspendableScript(scriptBytes) && isValidSignatureEncoding(data) {
+			sigHashTypeName, ok := sigHashTypeNames[data[len(data)-1]]
+			if ok {
+				sigHashDecode = "[" + sigHashTypeName + "]"
+				data = data[0 : len(data)-1]
+			}
+		}
+		asmItems = append(asmItems, hex.EncodeToString(data)+sigHashDecode)
+	}
+	return strings.Join(asmItems, " ")
+}
+
+func isValidPubKeySize(pubKey []byte) bool {
+	if len(pubKey) == 0 {
+		return false
+	}
+	switch pubKey[0] {
+	case 2, 3:
+		return len(pubKey) == CompressedPubKeySize
+	case 4, 6, 7:
+		return len(pubKey) == UncompressedPubKeySize
+	}
+	return false
+}
+
+func isPushOnlyScript(scriptBytes []byte) bool {
+	for pos := 0; pos < len(scriptBytes); {
+		opCode, _, nextPos, err := getScriptOp(scriptBytes, pos)
+		if err != nil || opCode > script.OP_16 {
+			return false
+		}
+		pos = nextPos
+	}
+	return true
+}
+
+// getWitnessProgram returns the witness version and program, the version is -1 if the script is not a witness program
+func getWitnessProgram(scriptBytes []byte) (int, []byte) {
+	if len(scriptBytes) < 4 || len(scriptBytes) > 42 {
+		return -1, nil
+	}
+	if scriptBytes[0] != script.OP_0 && (scriptBytes[0] < script.OP_1 || scriptBytes[0] > script.OP_16) {
+		return -1, nil
+	}
+	if int(scriptBytes[1])+2 != len(scriptBytes) {
+		return -1, nil
+	}
+	if scriptBytes[0] == script.OP_0 {
+		return 0, scriptBytes[2:]
+	}
+	return int(scriptBytes[0]-script.OP_1) + 1, scriptBytes[2:]
+}
+
+// matchMultiSig returns the required signatures and the pubkeys of a bare multisig script
+func matchMultiSig(scriptBytes []byte) (int, [][]byte, bool) {
+	if len(scriptBytes) < 1 || scriptBytes[len(scriptBytes)-1] != 0xae {
+		return 0, nil, false
+	}
+	opCode, _, pos, err := getScriptOp(scriptBytes, 0)
+	if err != nil || opCode < script.OP_1 || opCode > script.OP_16 {
+		return 0, nil, false
+	}
+	required := int(opCode-script.OP_1) + 1
+	pubKeys := make([][]byte, 0)
+	for {
+		var data []byte
+		opCode, data, pos, err = getScriptOp(scriptBytes, pos)
+		if err != nil {
+			return 0, nil, false
+		}
+		if !isValidPubKeySize(data) {
+			break
+		}
+		pubKeys = append(pubKeys, data)
+	}
+	if opCode < script.OP_1 || opCode > script.OP_16 {
+		return 0, nil, false
+	}
+	keyCount := int(opCode-script.OP_1) + 1
+	if len(pubKeys) != keyCount || keyCount < required || pos+1 != len(scriptBytes) {
+		return 0, nil, false
+	}
+	return required, pubKeys, true
+}
+
+// solveScript classifies the scriptPubKey as the solver of bitcoin core, and returns the solutions of the type
+func solveScript(scriptBytes []byte) (string, [][]byte) {
+	if len(scriptBytes) == 23 && scriptBytes[0] == 0xa9 && scriptBytes[1] == 0x14 && scriptBytes[22] == 0x87 {
+		return ScriptTypeScriptHash, [][]byte{scriptBytes[2:22]}
+	}
+	// the witness programs are only standard on the chains with segwit
+	witnessVersion, witnessProgram := getWitnessProgram(scriptBytes)
+	if witnessVersion >= 0 && networkParams.SegWit {
+		switch {
+		case witnessVersion == 0 && len(witnessProgram) == 20:
+			return ScriptTypeWitnessV0KeyHash, [][]byte{witnessProgram}
+		case witnessVersion == 0 && len(witnessProgram) == 32:
+			return ScriptTypeWitnessV0ScriptHash, [][]byte{witnessProgram}
+		case witnessVersion == 1 && len(witnessProgram) == 32:
+			return ScriptTypeWitnessV1Taproot, [][]byte{witnessProgram}
+		case witnessVersion == 1 && bytes.Equal(witnessProgram, anchorWitnessProgram):
+			return ScriptTypeAnchor, nil
+		case witnessVersion != 0:
+			return ScriptTypeWitnessUnknown, [][]byte{{byte(witnessVersion)}, witnessProgram}
+		}
+		return ScriptTypeNonStandard, nil
+	}
+	if len(scriptBytes) >= 1 && scriptBytes[0] == script.OP_RETURN && isPushOnlyScript(scriptBytes[1:]) {
+		return ScriptTypeNullData, nil
+	}
+	if (len(scriptBytes) == CompressedPubKeySize+2 && scriptBytes[0] == CompressedPubKeySize ||
+		len(scriptBytes) == UncompressedPubKeySize+2 && scriptBytes[0] == UncompressedPubKeySize) &&
+		scriptBytes[len(scriptBytes)-1] == 0xac && isValidPubKeySize(scriptBytes[1:len(scriptBytes)-1]) {
+		return ScriptTypePubKey, [][]byte{scriptBytes[1 : len(scriptBytes)-1]}
+	}
+	if len(scriptBytes) == 25 && scriptBytes[0] == 0x76 && scriptBytes[1] == 0xa9 && scriptBytes[2] == 0x14 &&
+		scriptBytes[23] == 0x88 && scriptBytes[24] == 0xac {
+		return ScriptTypePubKeyHash, [][]byte{scriptBytes[3:23]}
+	}
+	required, pubKeys, ok := matchMultiSig(scriptBytes)
+	if ok {
+		return ScriptTypeMultiSig, append([][]byte{{byte(required)}}, pubKeys...)
+	}
+	return ScriptTypeNonStandard, nil
+}
+
+// encodeSegWitAddress encodes the witness program in bech32 for version 0, and in bech32m for the later versions
+func encodeSegWitAddress(hrp string, witnessVersion int, witnessProgram []byte) string {
+	data := append([]byte{byte(witnessVersion)}, bech32.Bytes8to5(witnessProgram)...)
+	var checksumConst uint32 = 1
+	if witnessVersion != 0 {
+		checksumConst = Bech32mConst
+	}
+	values := append(bech32.HRPExpand(hrp), data...)
+	checksum := bech32.PolyMod(append(values, 0, 0, 0, 0, 0, 0)) ^ checksumConst
+	for i := 0; i < 6; i++ {
+		data = append(data, byte(checksum>>(5*uint(5-i)))&0x1f)
+	}
+	encoded, _ := bech32.SquashedBytesToString(data)
+	return hrp + "1" + encoded
+}
+
+func cashAddrPolyMod(values []byte) uint64 {
+	generators := []uint64{0x98f2bc8e61, 0x79b76d99e2, 0xf33e5fb3c4, 0xae2eabe2a8, 0x1e4f43e470}
+	var checksum uint64 = 1
+	for _, value := range values {
+		top := checksum >> 35
+		checksum = ((checksum & 0x07ffffffff) << 5) ^ uint64(value)
+		for i, generator := range generators {
+			if (top>>uint(i))&1 != 0 {
+				checksum ^= generator
+			}
+		}
+	}
+	return checksum ^ 1
+}
+
+// encodeCashAddr encodes the 160 bits hash in the cashaddr format of bitcoin cash
+func encodeCashAddr(prefix string, addrType byte, hash []byte) string {
+	payload := bech32.Bytes8to5(append([]byte{addrType << 3}, hash...))
+	values := make([]byte, 0, len(prefix)+1+len(payload)+8)
+	for i := 0; i < len(prefix); i++ {
+		values = append(values, prefix[i]&0x1f)
+	}
+	values = append(values, 0)
+	values = append(values, payload...)
+	checksum := cashAddrPolyMod(append(values, 0, 0, 0, 0, 0, 0, 0, 0))
+	for i := 0; i < 8; i++ {
+		payload = append(payload, byte(checksum>>(5*uint(7-i)))&0x1f)
+	}
+	encoded, _ := bech32.SquashedBytesToString(payload)
+	return prefix + ":" + encoded
+}
+
+func encodeBase58Address(version byte, hash []byte) string {
+	var keyId keyid.KeyID
+	err := keyId.SetKeyIDData(hash)
+	if err != nil {
+		return ""
+	}
+	address, err := keyId.ToBase58Address(version)
+	if err != nil {
+		return ""
+	}
+	return address
+}
+
+// getScriptAddress returns the address of the solved script on the network, empty if the type has no address
+func getScriptAddress(scriptType string, solutions [][]byte) string {
+	switch scriptType {
+	case ScriptTypePubKeyHash:
+		if networkParams.CashAddrPrefix != "" {
+			return encodeCashAddr(networkParams.CashAddrPrefix, CashAddrTypePubKeyHash, solutions[0])
+		}
+		return encodeBase58Address(networkParams.PubKeyHashPrefix, solutions[0])
+	case ScriptTypeScriptHash:
+		if networkParams.CashAddrPrefix != "" {
+			return encodeCashAddr(networkParams.CashAddrPrefix, CashAddrTypeScriptHash, solutions[0])
+		}
+		return encodeBase58Address(networkParams.ScriptHashPrefix, solutions[0])
+	}
+	if networkParams.Bech32Hrp == "" {
+		return ""
+	}
+	switch scriptType {
+	case ScriptTypeWitnessV0KeyHash, ScriptTypeWitnessV0ScriptHash:
+		return encodeSegWitAddress(networkParams.Bech32Hrp, 0, solutions[0])
+	case ScriptTypeWitnessV1Taproot:
+		return encodeSegWitAddress(networkParams.Bech32Hrp, 1, solutions[0])
+	case ScriptTypeAnchor:
+		return encodeSegWitAddress(networkParams.Bech32Hrp, 1, anchorWitnessProgram)
+	case ScriptTypeWitnessUnknown:
+		return encodeSegWitAddress(networkParams.Bech32Hrp, int(solutions[0][0]), solutions[1])
+	}
+	return ""
+}
+
+func descriptorPolyMod(symbols []uint64) uint64 {
+	generators := []uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd}
+	var checksum uint64 = 1
+	for _, symbol := range symbols {
+		top := checksum >> 35
+		checksum = ((checksum & 0x7ffffffff) << 5) ^ symbol
+		for i, generator := range generators {
+			if (top>>uint(i))&1 != 0 {
+				checksum ^= generator
+			}
+		}
+	}
+	return checksum
+}
+
+// addDescriptorChecksum appends the checksum of the output descriptor after '#'
+func addDescriptorChecksum(descriptor string) string {
+	symbols := make([]uint64, 0, len(descriptor)*2)
+	groups := make([]uint64, 0, 3)
+	for i := 0; i < len(descriptor); i++ {
+		position := strings.IndexByte(descriptorInputCharset, descriptor[i])
+		if position < 0 {
+			return descriptor
+		}
+		symbols = append(symbols, uint64(position&31))
+		groups = append(groups, uint64(position>>5))
+		if len(groups) == 3 {
+			symbols = append(symbols, groups[0]*9+groups[1]*3+groups[2])
+			groups = groups[0:0]
+		}
+	}
+	if len(groups) == 1 {
+		symbols = append(symbols, groups[0])
+	} else if len(groups) == 2 {
+		symbols = append(symbols, groups[0]*3+groups[1])
+	}
+	checksum := descriptorPolyMod(append(symbols, 0, 0, 0, 0, 0, 0, 0, 0)) ^ 1
+	checksumChars := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		checksumChars[i] = descriptorChecksumCharset[(checksum>>(5*uint(7-i)))&31]
+	}
+	return descriptor + "#" + string(checksumChars)
+}
+
+// inferDescriptor returns the output descriptor of the scriptPubKey as bitcoin core infers it without the wallet keys
+func inferDescriptor(scriptBytes []byte, scriptType string, solutions [][]byte, address string) string {
+	var descriptor string
+	switch {
+	case scriptType == ScriptTypePubKey:
+		descriptor = "pk(" + hex.EncodeToString(solutions[0]) + ")"
+	case scriptType == ScriptTypeMultiSig:
+		descriptor = "multi(" + strconv.Itoa(int(solutions[0][0]))
+		for _, pubKey := range solutions[1:] {
+			descriptor += "," + hex.EncodeToString(pubKey)
+		}
+		descriptor += ")"
+	case scriptType == ScriptTypeWitnessV1Taproot:
+		descriptor = "rawtr(" + hex.EncodeToString(solutions[0]) + ")"
+	case address != "":
+		descriptor = "addr(" + address + ")"
+	default:
+		descriptor = "raw(" + hex.EncodeToString(scriptBytes) + ")"
+	}
+	return addDescriptorChecksum(descriptor)
+}
@@ -1,25 +1,64 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/rpc"
 	"github.com/gorilla/rpc/json"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
 	"github.com/mutalisk999/go-lib/src/sched/goroutine_mgr"
-	"io"
 	"net/http"
+	"strconv"
 )
 
 type Service struct {
 }
 
+var ErrBlockNotFound = errors.New("block hash not found")
+
+// loadRawBlockByHash returns the decompressed raw block of the block hash, and whether it is a stale block
+func loadRawBlockByHash(blockHash string) (*RawBlock, bool, error) {
+	var ptrRawBlock *RawBlock
+	stale := false
+	blockHeight, ok := getStoredBlockHeight(blockHash)
+	if ok {
+		ptrBlockIndex, err := loadBlockIndex(blockHeight)
+		if err != nil {
+			return nil, false, err
+		}
+		ptrRawBlock, err = loadRawBlock(ptrBlockIndex)
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		// the block may have been orphaned by a chain reorganization
+		var err error
+		ptrRawBlock, err = staleBlockMgr.GetStaleBlock(blockHash)
+		if err != nil {
+			return nil, false, ErrBlockNotFound
+		}
+		stale = true
+	}
+	err := ptrRawBlock.Decompress()
+	if err != nil {
+		return nil, false, err
+	}
+	return ptrRawBlock, stale, nil
+}
+
 func (s *Service) GetBlockCount(r *http.Request, args *interface{}, reply *uint32) error {
-	*reply = latestRawBlockMgr.BlockHeight
+	*reply, _ = getStoredTip()
+	return nil
+}
+
+func (s *Service) GetStatus(r *http.Request, args *interface{}, reply *GatherStatus) error {
+	*reply = getGatherStatus()
 	return nil
 }
 
 func (s *Service) GetBlockHash(r *http.Request, args *uint32, reply *string) error {
-	blockHash, ok := heightToHashMap[*args]
+	blockHash, ok := getStoredBlockHash(*args)
 	if !ok {
 		return errors.New("block height not found")
 	}
@@ -28,7 +67,7 @@ func (s *Service) GetBlockHash(r *http.Request, args *uint32, reply *string) err
 }
 
 func (s *Service) GetBlockHeight(r *http.Request, args *string, reply *uint32) error {
-	blockHeight, ok := hashToHeightMap[*args]
+	blockHeight, ok := getStoredBlockHeight(*args)
 	if !ok {
 		return errors.New("block hash not found")
 	}
@@ -37,47 +76,437 @@ func (s *Service) GetBlockHeight(r *http.Request, args *string, reply *uint32) e
 }
 
 func (s *Service) GetRawBlock(r *http.Request, args *string, reply *string) error {
-	blockHeight, ok := hashToHeightMap[*args]
-	if !ok {
-		return errors.New("block hash not found")
+	ptrRawBlock, _, err := loadRawBlockByHash(*args)
+	if err != nil {
+		return err
+	}
+	*reply = ptrRawBlock.RawBlockData.GetHex()
+	return nil
+}
+
+// GetDecodedBlock returns the block in the json of getblock verbosity 2
+func (s *Service) GetDecodedBlock(r *http.Request, args *string, reply *BlockInfo) error {
+	ptrRawBlock, stale, err := loadRawBlockByHash(*args)
+	if err != nil {
+		return err
 	}
+	chainBlock, err := unpackChainBlock(ptrRawBlock.RawBlockData.GetData())
+	if err != nil {
+		return err
+	}
+	blockInfo, err := getBlockInfo(ptrRawBlock, chainBlock, stale, 2)
+	if err != nil {
+		return err
+	}
+	*reply = *blockInfo
+	return nil
+}
 
-	var err error
-	IndexMgr := new(RawBlockIndexManager)
-	err = IndexMgr.Init(config.DataConfig.DataDir, config.DataConfig.BlockIndexName)
+func (s *Service) GetBlockHeader(r *http.Request, args *uint32, reply *string) error {
+	headerData, err := blockHeaderMgr.GetBlockHeader(*args)
 	if err != nil {
 		return err
 	}
+	*reply = hex.EncodeToString(headerData)
+	return nil
+}
 
-	defer IndexMgr.BlockIndexFileObj.Close()
-	_, err = IndexMgr.BlockIndexFileObj.Seek(int64(blockHeight-1)*RawBlockIndexSize, io.SeekStart)
+func (s *Service) GetBlockHeaderByHash(r *http.Request, args *string, reply *string) error {
+	blockHeight, ok := getStoredBlockHeight(*args)
+	if ok {
+		return s.GetBlockHeader(r, &blockHeight, reply)
+	}
+	// the block may have been orphaned by a chain reorganization
+	ptrRawBlock, _, err := loadRawBlockByHash(*args)
 	if err != nil {
 		return err
 	}
-	ptrBlockIndex := new(RawBlockIndex)
-	err = ptrBlockIndex.UnPack(IndexMgr.BlockIndexFileObj)
+	headerData, err := getBlockHeaderData(ptrRawBlock.RawBlockData.GetData())
 	if err != nil {
 		return err
 	}
+	*reply = hex.EncodeToString(headerData)
+	return nil
+}
+
+type BlockHeadersArgs struct {
+	StartHeight uint32 `json:"startHeight"`
+	Count       uint32 `json:"count"`
+}
 
-	rawBlockMgr := new(RawBlockManager)
-	err = rawBlockMgr.Init(config.DataConfig.DataDir, config.DataConfig.RawBlockFilePrefix, ptrBlockIndex.RawBlockFileTag)
+// GetBlockHeaders returns the headers of the contiguous blocks from the start height, fewer if the chain ends
+func (s *Service) GetBlockHeaders(r *http.Request, args *BlockHeadersArgs, reply *[]string) error {
+	if args.Count == 0 || args.Count > MaxBlockHeadersCount {
+		return errors.New("count must be between 1 and " + strconv.Itoa(MaxBlockHeadersCount))
+	}
+	headersData, err := blockHeaderMgr.GetBlockHeaders(args.StartHeight, args.Count)
 	if err != nil {
 		return err
 	}
+	headers := make([]string, 0, len(headersData)/BlockHeaderSize)
+	for pos := 0; pos < len(headersData); pos += BlockHeaderSize {
+		headers = append(headers, hex.EncodeToString(headersData[pos:pos+BlockHeaderSize]))
+	}
+	*reply = headers
+	return nil
+}
+
+// serveBlockHeaders streams the 80 bytes headers of the chain from the height of the start query parameter
+func serveBlockHeaders(w http.ResponseWriter, r *http.Request) {
+	var startHeight uint64 = 0
+	start := r.URL.Query().Get("start")
+	if start != "" {
+		var err error
+		startHeight, err = strconv.ParseUint(start, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid start height", http.StatusBadRequest)
+			return
+		}
+	}
+	if uint32(startHeight) > blockHeaderMgr.HeaderCount {
+		http.Error(w, "block height not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_ = blockHeaderMgr.WriteBlockHeaders(w, uint32(startHeight))
+}
+
+type RawTransactionArgs struct {
+	TxId    string `json:"txid"`
+	Verbose bool   `json:"verbose"`
+}
 
-	defer rawBlockMgr.RawBlockFileObj.Close()
-	_, err = rawBlockMgr.RawBlockFileObj.Seek(int64(ptrBlockIndex.BlockFileStartPos), io.SeekStart)
+// GetRawTransaction returns the transaction of the txid from the tx index, decoded if verbose
+func (s *Service) GetRawTransaction(r *http.Request, args *RawTransactionArgs, reply *RawTransactionInfo) error {
+	if txIndexMgr == nil {
+		return errors.New("tx index is not enabled")
+	}
+	txIndex, txData, err := loadIndexedTransaction(args.TxId)
 	if err != nil {
 		return err
 	}
-	ptrRawBlock := new(RawBlock)
-	err = ptrRawBlock.UnPack(rawBlockMgr.RawBlockFileObj)
+	blockHeader, err := loadBlockHeader(txIndex.BlockHeight)
 	if err != nil {
 		return err
 	}
+	blockHash, _ := getStoredBlockHash(txIndex.BlockHeight)
+	txResult, err := getRawTransactionInfo(txData, blockHash, txIndex.BlockHeight, blockHeader.Time, false, args.Verbose)
+	if err != nil {
+		return err
+	}
+	*reply = *txResult
+	return nil
+}
 
-	*reply = ptrRawBlock.RawBlockData.GetHex()
+type ScriptHashHistoryArgs struct {
+	// the electrum scripthash, the sha256 of the scriptPubKey in reversed hex
+	ScriptHash  string `json:"scriptHash"`
+	StartHeight uint32 `json:"startHeight"`
+	// 0 for the latest block
+	EndHeight uint32 `json:"endHeight"`
+	Limit     int    `json:"limit"`
+}
+
+// ScriptHashHistoryItem is an output funding the scripthash with Vout set, or an input spending it with Vin set
+type ScriptHashHistoryItem struct {
+	Height   uint32        `json:"height"`
+	TxId     string        `json:"txid"`
+	Type     string        `json:"type"`
+	Vout     *uint32       `json:"vout,omitempty"`
+	Vin      *uint32       `json:"vin,omitempty"`
+	PrevTxId string        `json:"prevTxId,omitempty"`
+	PrevVout *uint32       `json:"prevVout,omitempty"`
+	Value    BitcoinAmount `json:"value"`
+}
+
+// ScriptHashHistory is a page of the history, NextHeight is the start height of the next page, 0 if it is the last page
+type ScriptHashHistory struct {
+	History    []ScriptHashHistoryItem `json:"history"`
+	NextHeight uint32                  `json:"nextHeight"`
+}
+
+// GetScriptHashHistory returns the funding and the spending records of the scripthash from the address index
+func (s *Service) GetScriptHashHistory(r *http.Request, args *ScriptHashHistoryArgs, reply *ScriptHashHistory) error {
+	if addressIndexMgr == nil {
+		return errors.New("address index is not enabled")
+	}
+	scriptHashBytes, err := hex.DecodeString(args.ScriptHash)
+	if err != nil || len(scriptHashBytes) != 32 {
+		return errors.New("invalid scripthash")
+	}
+	var scriptHash bigint.Uint256
+	_ = scriptHash.SetHex(args.ScriptHash)
+	endHeight := args.EndHeight
+	if endHeight == 0 {
+		endHeight, _ = getStoredTip()
+	}
+	limit := args.Limit
+	if limit == 0 {
+		limit = DefaultScriptHashHistorySize
+	}
+	if limit < 0 || limit > MaxScriptHashHistorySize {
+		return errors.New("limit must be between 1 and " + strconv.Itoa(MaxScriptHashHistorySize))
+	}
+
+	records, nextHeight, err := addressIndexMgr.GetScriptHashHistory(&scriptHash, args.StartHeight, endHeight, limit)
+	if err != nil {
+		return err
+	}
+	history := make([]ScriptHashHistoryItem, 0, len(records))
+	for _, record := range records {
+		n := record.N
+		item := ScriptHashHistoryItem{Height: record.BlockHeight, TxId: record.TxId.GetHex(), Value: BitcoinAmount(record.Value)}
+		if record.Spending {
+			prevN := record.PrevN
+			item.Type = "spending"
+			item.Vin = &n
+			item.PrevTxId = record.PrevTxId.GetHex()
+			item.PrevVout = &prevN
+		} else {
+			item.Type = "funding"
+			item.Vout = &n
+		}
+		history = append(history, item)
+	}
+	reply.History = history
+	reply.NextHeight = nextHeight
+	return nil
+}
+
+type TxOutArgs struct {
+	TxId string `json:"txid"`
+	Vout uint32 `json:"vout"`
+}
+
+// GetTxOut returns the output from the utxo set, an error if it is spent
+func (s *Service) GetTxOut(r *http.Request, args *TxOutArgs, reply *UtxoInfo) error {
+	if utxoSetMgr == nil {
+		return errors.New("utxo set is not enabled")
+	}
+	var txId bigint.Uint256
+	err := txId.SetHex(args.TxId)
+	if err != nil {
+		return errors.New("invalid txid")
+	}
+	utxoRecord, err := utxoSetMgr.GetUtxo(&txId, args.Vout)
+	if err != nil {
+		return err
+	}
+	*reply = *getUtxoInfo(utxoRecord)
+	return nil
+}
+
+// ScriptHashUtxo is an unspent output of the scripthash
+type ScriptHashUtxo struct {
+	TxId     string        `json:"txid"`
+	Vout     uint32        `json:"vout"`
+	Height   uint32        `json:"height"`
+	Value    BitcoinAmount `json:"value"`
+	CoinBase bool          `json:"coinbase"`
+}
+
+// GetUtxosByScriptHash returns the unspent outputs of the scripthash in ascending order,
+// the outputs of the scripthash are found by the address index
+func (s *Service) GetUtxosByScriptHash(r *http.Request, args *string, reply *[]ScriptHashUtxo) error {
+	if utxoSetMgr == nil {
+		return errors.New("utxo set is not enabled")
+	}
+	if addressIndexMgr == nil {
+		return errors.New("address index is not enabled")
+	}
+	scriptHashBytes, err := hex.DecodeString(*args)
+	if err != nil || len(scriptHashBytes) != 32 {
+		return errors.New("invalid scripthash")
+	}
+	var scriptHash bigint.Uint256
+	_ = scriptHash.SetHex(*args)
+
+	records, err := addressIndexMgr.GetScriptHashUnspent(&scriptHash)
+	if err != nil {
+		return err
+	}
+	utxos := make([]ScriptHashUtxo, 0, len(records))
+	for _, record := range records {
+		utxoRecord, err := utxoSetMgr.GetUtxo(&record.TxId, record.N)
+		if err == ErrUtxoNotFound {
+			// spent by a block not indexed yet
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		utxos = append(utxos, ScriptHashUtxo{TxId: record.TxId.GetHex(), Vout: record.N, Height: utxoRecord.BlockHeight, Value: BitcoinAmount(utxoRecord.Value), CoinBase: utxoRecord.CoinBase})
+	}
+	*reply = utxos
+	return nil
+}
+
+// GetUtxoSetInfo returns the summary of the utxo set, the hash type is "muhash" by default or "none"
+func (s *Service) GetUtxoSetInfo(r *http.Request, args *string, reply *UtxoSetInfo) error {
+	if utxoSetMgr == nil {
+		return errors.New("utxo set is not enabled")
+	}
+	if *args != "" && *args != "muhash" && *args != "none" {
+		return errors.New("invalid hash type " + *args)
+	}
+	utxoSetInfo, err := utxoSetMgr.GetUtxoSetInfo(*args != "none")
+	if err != nil {
+		return err
+	}
+	*reply = *utxoSetInfo
+	return nil
+}
+
+type SpendingTxArgs struct {
+	TxId string `json:"txid"`
+	Vout uint32 `json:"vout"`
+}
+
+// SpendingTxInfo is the input of the transaction spending the outpoint
+type SpendingTxInfo struct {
+	TxId      string `json:"txid"`
+	Vin       uint32 `json:"vin"`
+	Height    uint32 `json:"height"`
+	BlockHash string `json:"blockhash"`
+}
+
+// GetSpendingTx returns the transaction spending the outpoint from the spent index, an error if it is not spent
+func (s *Service) GetSpendingTx(r *http.Request, args *SpendingTxArgs, reply *SpendingTxInfo) error {
+	if spentIndexMgr == nil {
+		return errors.New("spent index is not enabled")
+	}
+	var txId bigint.Uint256
+	err := txId.SetHex(args.TxId)
+	if err != nil {
+		return errors.New("invalid txid")
+	}
+	spentIndex, err := spentIndexMgr.GetSpentIndex(&txId, args.Vout)
+	if err != nil {
+		return err
+	}
+	reply.TxId = spentIndex.TxId.GetHex()
+	reply.Vin = spentIndex.Vin
+	reply.Height = spentIndex.BlockHeight
+	reply.BlockHash, _ = getStoredBlockHash(spentIndex.BlockHeight)
+	return nil
+}
+
+type CFiltersArgs struct {
+	FilterType  uint8  `json:"filterType"`
+	StartHeight uint32 `json:"startHeight"`
+	StopHash    string `json:"stopHash"`
+}
+
+type CFCheckptArgs struct {
+	FilterType uint8  `json:"filterType"`
+	StopHash   string `json:"stopHash"`
+}
+
+type CFilter struct {
+	BlockHash string `json:"blockHash"`
+	Filter    string `json:"filter"`
+}
+
+// CFHeaders is the cfheaders message of bip157, the filter header of a block is
+// the hash of its filter hash and the previous filter header
+type CFHeaders struct {
+	FilterType           uint8    `json:"filterType"`
+	StopHash             string   `json:"stopHash"`
+	PreviousFilterHeader string   `json:"previousFilterHeader"`
+	FilterHashes         []string `json:"filterHashes"`
+}
+
+// CFCheckpt is the cfcheckpt message of bip157, the filter headers at every 1000 blocks up to the stop block
+type CFCheckpt struct {
+	FilterType    uint8    `json:"filterType"`
+	StopHash      string   `json:"stopHash"`
+	FilterHeaders []string `json:"filterHeaders"`
+}
+
+// getBlockFilterStopHeight checks the block filter request and returns the height of the stop hash,
+// which must be a block of the active chain
+func getBlockFilterStopHeight(filterType uint8, stopHash string) (uint32, error) {
+	if blockFilterMgr == nil {
+		return 0, errors.New("block filter index is not enabled")
+	}
+	if filterType != BasicFilterType {
+		return 0, errors.New("unknown filter type " + strconv.Itoa(int(filterType)))
+	}
+	stopHeight, ok := getStoredBlockHeight(stopHash)
+	if !ok {
+		return 0, ErrBlockNotFound
+	}
+	return stopHeight, nil
+}
+
+// GetCFilters returns the filters of the blocks from the start height to the stop hash, at most 1000 blocks
+func (s *Service) GetCFilters(r *http.Request, args *CFiltersArgs, reply *[]CFilter) error {
+	stopHeight, err := getBlockFilterStopHeight(args.FilterType, args.StopHash)
+	if err != nil {
+		return err
+	}
+	if args.StartHeight > stopHeight || stopHeight-args.StartHeight >= MaxCFiltersCount {
+		return errors.New("invalid start height")
+	}
+	blockFilters, err := blockFilterMgr.GetBlockFilters(args.StartHeight, stopHeight)
+	if err != nil {
+		return err
+	}
+	cFilters := make([]CFilter, 0, len(blockFilters))
+	for _, blockFilter := range blockFilters {
+		cFilters = append(cFilters, CFilter{BlockHash: blockFilter.BlockHash.GetHex(), Filter: hex.EncodeToString(blockFilter.Filter)})
+	}
+	*reply = cFilters
+	return nil
+}
+
+// GetCFHeaders returns the filter hashes of the blocks from the start height to the stop hash, at most 2000 blocks
+func (s *Service) GetCFHeaders(r *http.Request, args *CFiltersArgs, reply *CFHeaders) error {
+	stopHeight, err := getBlockFilterStopHeight(args.FilterType, args.StopHash)
+	if err != nil {
+		return err
+	}
+	if args.StartHeight > stopHeight || stopHeight-args.StartHeight >= MaxCFHeadersCount {
+		return errors.New("invalid start height")
+	}
+	startHeight := args.StartHeight
+	if startHeight > 0 {
+		startHeight--
+	}
+	blockFilters, err := blockFilterMgr.GetBlockFilters(startHeight, stopHeight)
+	if err != nil {
+		return err
+	}
+	reply.FilterType = args.FilterType
+	reply.StopHash = args.StopHash
+	reply.PreviousFilterHeader = hex.EncodeToString(make([]byte, 32))
+	if args.StartHeight > 0 {
+		reply.PreviousFilterHeader = blockFilters[0].FilterHeader.GetHex()
+		blockFilters = blockFilters[1:]
+	}
+	reply.FilterHashes = make([]string, 0, len(blockFilters))
+	for _, blockFilter := range blockFilters {
+		reply.FilterHashes = append(reply.FilterHashes, blockFilter.FilterHash.GetHex())
+	}
+	return nil
+}
+
+// GetCFCheckpt returns the filter headers of the block heights 1000, 2000 ... up to the stop hash
+func (s *Service) GetCFCheckpt(r *http.Request, args *CFCheckptArgs, reply *CFCheckpt) error {
+	stopHeight, err := getBlockFilterStopHeight(args.FilterType, args.StopHash)
+	if err != nil {
+		return err
+	}
+	reply.FilterType = args.FilterType
+	reply.StopHash = args.StopHash
+	reply.FilterHeaders = make([]string, 0, stopHeight/CFCheckptInterval)
+	for height := uint32(CFCheckptInterval); height <= stopHeight; height += CFCheckptInterval {
+		blockFilter, err := blockFilterMgr.GetBlockFilter(height)
+		if err != nil {
+			return err
+		}
+		reply.FilterHeaders = append(reply.FilterHeaders, blockFilter.FilterHeader.GetHex())
+	}
 	return nil
 }
 
@@ -91,7 +520,8 @@ func rpcServer(goroutine goroutine_mgr.Goroutine, args ...interface{}) {
 	_ = rpcServer.RegisterService(rpcService, "")
 
 	urlRouter := mux.NewRouter()
-	urlRouter.Handle("/", rpcServer)
+	urlRouter.HandleFunc("/headers", serveBlockHeaders).Methods(http.MethodGet)
+	urlRouter.Handle("/", &BitcoinRpcHandler{Next: rpcServer})
 	_ = http.ListenAndServe(config.RpcServerConfig.RpcListenEndPoint, urlRouter)
 }
 
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	DefaultSpentIndexName = "spent_index"
+	SpentIndexSize        = 32 + 4 + 4 + 32 + 4 + 4
+)
+
+var ErrOutPointNotSpent = errors.New("outpoint not spent")
+
+// SpentIndex records the input of a transaction spending the outpoint
+type SpentIndex struct {
+	PrevTxId    bigint.Uint256
+	PrevN       uint32
+	BlockHeight uint32
+	TxId        bigint.Uint256
+	Vin         uint32
+}
+
+func (s SpentIndex) packBody(writer io.Writer) error {
+	var err error
+	err = s.PrevTxId.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, s.PrevN)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, s.BlockHeight)
+	if err != nil {
+		return err
+	}
+	err = s.TxId.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, s.Vin)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SpentIndex) unpackBody(reader io.Reader) error {
+	var err error
+	err = s.PrevTxId.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	s.PrevN, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	s.BlockHeight, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	err = s.TxId.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	s.Vin, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s SpentIndex) Pack(writer io.Writer) error {
+	checksum := crc32.New(crc32cTable)
+	err := s.packBody(io.MultiWriter(writer, checksum))
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, checksum.Sum32())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SpentIndex) UnPack(reader io.Reader) error {
+	checksum := crc32.New(crc32cTable)
+	err := s.unpackBody(io.TeeReader(reader, checksum))
+	if err != nil {
+		return err
+	}
+	checksumRead, err := serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	if checksumRead != checksum.Sum32() {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// getBlockSpentIndexes returns the outpoints spent by the inputs of the block, the coinbase spends nothing
+func getBlockSpentIndexes(blockHeight uint32, rawBlockData []byte) ([]SpentIndex, error) {
+	chainBlock, err := unpackChainBlock(rawBlockData)
+	if err != nil {
+		return nil, err
+	}
+	spentIndexes := make([]SpentIndex, 0)
+	for i := range chainBlock.Vtx {
+		tx := &chainBlock.Vtx[i]
+		if isCoinBase(tx) {
+			continue
+		}
+		txId, err := tx.CalcTrxId()
+		if err != nil {
+			return nil, err
+		}
+		for n, txIn := range tx.Vin {
+			spentIndex := SpentIndex{PrevTxId: txIn.PrevOut.Hash, PrevN: txIn.PrevOut.N, BlockHeight: blockHeight, TxId: txId, Vin: uint32(n)}
+			spentIndexes = append(spentIndexes, spentIndex)
+		}
+	}
+	return spentIndexes, nil
+}
+
+// SpentIndexManager appends the spent outpoints of every stored block in block order,
+// the records are looked up by a map from the outpoint key to the record number kept in memory
+type SpentIndexManager struct {
+	SpentIndexFileName string
+	SpentIndexFileObj  *os.File
+	RecordCount        uint64
+	// the number of the blocks whose inputs are indexed
+	BlockCount          uint32
+	outPointKeyToPosMap map[uint64]uint64
+	// the records whose outpoint key collides with a different outpoint
+	outPointToPosMap map[string]uint64
+	spentIndexMutex  *sync.RWMutex
+}
+
+var spentIndexMgr *SpentIndexManager
+
+func (s *SpentIndexManager) Init(dataDir string, spentIndexName string) error {
+	if s.spentIndexMutex == nil {
+		s.spentIndexMutex = new(sync.RWMutex)
+	}
+	s.spentIndexMutex.Lock()
+	defer s.spentIndexMutex.Unlock()
+
+	var err error
+	spentIndexFileName := dataDir + "/" + spentIndexName
+	s.SpentIndexFileObj, err = os.OpenFile(spentIndexFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend)
+	if err != nil {
+		return err
+	}
+	spentIndexInfo, err := s.SpentIndexFileObj.Stat()
+	if err != nil {
+		return err
+	}
+	s.SpentIndexFileName = spentIndexFileName
+	s.RecordCount = 0
+	s.BlockCount = 0
+	s.outPointKeyToPosMap = make(map[uint64]uint64)
+	s.outPointToPosMap = make(map[string]uint64)
+
+	// drop the partial record left by a crash
+	recordCount := uint64(spentIndexInfo.Size() / SpentIndexSize)
+	if uint64(spentIndexInfo.Size()) != recordCount*SpentIndexSize {
+		err = s.SpentIndexFileObj.Truncate(int64(recordCount) * SpentIndexSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	// load the outpoint keys of all records
+	_, err = s.SpentIndexFileObj.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	spentIndexReader := bufio.NewReader(s.SpentIndexFileObj)
+	spentIndexData := make([]byte, SpentIndexSize)
+	for pos := uint64(0); pos < recordCount; pos++ {
+		_, err = io.ReadFull(spentIndexReader, spentIndexData)
+		if err != nil {
+			return err
+		}
+		spentIndex := new(SpentIndex)
+		err = spentIndex.UnPack(bytes.NewReader(spentIndexData))
+		if err == ErrChecksumMismatch {
+			return errors.New("corrupt spent index record " + strconv.FormatUint(pos, 10) + ", need to rebuild spent index")
+		}
+		if err != nil {
+			return err
+		}
+		err = s.addOutPointPos(&spentIndex.PrevTxId, spentIndex.PrevN, pos)
+		if err != nil {
+			return err
+		}
+		s.RecordCount = pos + 1
+		s.BlockCount = spentIndex.BlockHeight + 1
+	}
+	return nil
+}
+
+func (s *SpentIndexManager) readSpentIndex(pos uint64) (*SpentIndex, error) {
+	spentIndexData := make([]byte, SpentIndexSize)
+	_, err := s.SpentIndexFileObj.ReadAt(spentIndexData, int64(pos)*SpentIndexSize)
+	if err != nil {
+		return nil, err
+	}
+	spentIndex := new(SpentIndex)
+	err = spentIndex.UnPack(bytes.NewReader(spentIndexData))
+	if err != nil {
+		return nil, err
+	}
+	return spentIndex, nil
+}
+
+func (s *SpentIndexManager) addOutPointPos(txId *bigint.Uint256, n uint32, pos uint64) error {
+	outPointKey := getOutPointKey(txId, n)
+	keyPos, ok := s.outPointKeyToPosMap[outPointKey]
+	if ok {
+		keySpentIndex, err := s.readSpentIndex(keyPos)
+		if err != nil {
+			return err
+		}
+		if keySpentIndex.PrevN != n || !bigint.IsUint256Equal(&keySpentIndex.PrevTxId, txId) {
+			s.outPointToPosMap[getOutPointString(txId, n)] = pos
+			return nil
+		}
+	}
+	s.outPointKeyToPosMap[outPointKey] = pos
+	return nil
+}
+
+func (s *SpentIndexManager) removeOutPointPos(txId *bigint.Uint256, n uint32, pos uint64) {
+	outPoint := getOutPointString(txId, n)
+	collidedPos, ok := s.outPointToPosMap[outPoint]
+	if ok && collidedPos == pos {
+		delete(s.outPointToPosMap, outPoint)
+		return
+	}
+	outPointKey := getOutPointKey(txId, n)
+	keyPos, ok := s.outPointKeyToPosMap[outPointKey]
+	if ok && keyPos == pos {
+		delete(s.outPointKeyToPosMap, outPointKey)
+	}
+}
+
+// AddBlockSpentIndex appends the outpoints spent by the block at the next height
+func (s *SpentIndexManager) AddBlockSpentIndex(blockHeight uint32, rawBlockData []byte) error {
+	s.spentIndexMutex.Lock()
+	defer s.spentIndexMutex.Unlock()
+	if blockHeight != s.BlockCount {
+		return errors.New("unexpected block height " + strconv.Itoa(int(blockHeight)) + " for spent index, expect " + strconv.Itoa(int(s.BlockCount)))
+	}
+	spentIndexes, err := getBlockSpentIndexes(blockHeight, rawBlockData)
+	if err != nil {
+		return err
+	}
+	spentIndexBuf := bytes.NewBuffer(make([]byte, 0, len(spentIndexes)*SpentIndexSize))
+	for i := range spentIndexes {
+		err = spentIndexes[i].Pack(spentIndexBuf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.SpentIndexFileObj.Write(spentIndexBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	for i := range spentIndexes {
+		err = s.addOutPointPos(&spentIndexes[i].PrevTxId, spentIndexes[i].PrevN, s.RecordCount+uint64(i))
+		if err != nil {
+			return err
+		}
+	}
+	s.RecordCount = s.RecordCount + uint64(len(spentIndexes))
+	s.BlockCount = blockHeight + 1
+	return nil
+}
+
+// TruncateSpentIndex keeps the records of the inputs of the first blockCount blocks
+func (s *SpentIndexManager) TruncateSpentIndex(blockCount uint32) error {
+	s.spentIndexMutex.Lock()
+	defer s.spentIndexMutex.Unlock()
+	pos := s.RecordCount
+	for pos > 0 {
+		spentIndex, err := s.readSpentIndex(pos - 1)
+		if err != nil {
+			return err
+		}
+		if spentIndex.BlockHeight < blockCount {
+			break
+		}
+		s.removeOutPointPos(&spentIndex.PrevTxId, spentIndex.PrevN, pos-1)
+		pos--
+	}
+	err := s.SpentIndexFileObj.Truncate(int64(pos) * SpentIndexSize)
+	if err != nil {
+		return err
+	}
+	s.RecordCount = pos
+	if s.BlockCount > blockCount {
+		s.BlockCount = blockCount
+	}
+	return nil
+}
+
+// Catchup indexes the stored blocks below blockCount which are not indexed yet, the last indexed block
+// is indexed again since its records may be partial, and it must still be the stored block of its height
+func (s *SpentIndexManager) Catchup(blockCount uint32) error {
+	if s.BlockCount > blockCount {
+		err := s.TruncateSpentIndex(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	indexedCount := s.BlockCount
+	if s.BlockCount > 0 {
+		lastHeight := s.BlockCount - 1
+		lastSpentIndex, err := s.readSpentIndex(s.RecordCount - 1)
+		if err != nil {
+			return err
+		}
+		ptrRawBlock, err := loadStoredRawBlock(lastHeight)
+		if err != nil {
+			return err
+		}
+		txIndexes, err := getBlockTxIndexes(lastHeight, ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		found := false
+		for i := range txIndexes {
+			if bigint.IsUint256Equal(&lastSpentIndex.TxId, &txIndexes[i].TxId) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("spent index not match with the stored block at height " + strconv.Itoa(int(lastHeight)) + ", need to rebuild spent index")
+		}
+		err = s.TruncateSpentIndex(lastHeight)
+		if err != nil {
+			return err
+		}
+	}
+	for height := s.BlockCount; height < blockCount; height++ {
+		ptrRawBlock, err := loadStoredRawBlock(height)
+		if err != nil {
+			return err
+		}
+		err = s.AddBlockSpentIndex(height, ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		if height >= indexedCount && (height%10000 == 0 || height == blockCount-1) {
+			var completeRate float64 = float64(height-indexedCount+1) * float64(100) / float64(blockCount-indexedCount)
+			fmt.Println("index spent outputs of block height", height, "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+		}
+	}
+	return s.Sync()
+}
+
+// GetSpentIndex returns the input spending the outpoint, ErrOutPointNotSpent if it is not spent by the stored blocks
+func (s *SpentIndexManager) GetSpentIndex(txId *bigint.Uint256, n uint32) (*SpentIndex, error) {
+	s.spentIndexMutex.RLock()
+	defer s.spentIndexMutex.RUnlock()
+	pos, ok := s.outPointToPosMap[getOutPointString(txId, n)]
+	if !ok {
+		pos, ok = s.outPointKeyToPosMap[getOutPointKey(txId, n)]
+		if !ok {
+			return nil, ErrOutPointNotSpent
+		}
+	}
+	spentIndex, err := s.readSpentIndex(pos)
+	if err != nil {
+		return nil, err
+	}
+	if spentIndex.PrevN != n || !bigint.IsUint256Equal(&spentIndex.PrevTxId, txId) {
+		return nil, ErrOutPointNotSpent
+	}
+	return spentIndex, nil
+}
+
+func (s *SpentIndexManager) Sync() error {
+	s.spentIndexMutex.Lock()
+	err := s.SpentIndexFileObj.Sync()
+	s.spentIndexMutex.Unlock()
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"testing"
+)
+
+func TestSpentIndexRollback(t *testing.T) {
+	rawBlocks, txs := buildTestSpendingChain(t)
+	coinbase1, coinbase2, tx2 := txs[0], txs[1], txs[2]
+	savedSpentIndexMgr := spentIndexMgr
+	spentIndexMgr = new(SpentIndexManager)
+	t.Cleanup(func() {
+		_ = spentIndexMgr.SpentIndexFileObj.Close()
+		spentIndexMgr = savedSpentIndexMgr
+	})
+	err := spentIndexMgr.Init(config.DataConfig.DataDir, DefaultSpentIndexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height, rawBlock := range rawBlocks {
+		err = spentIndexMgr.AddBlockSpentIndex(uint32(height), rawBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		blockCount uint32
+		reopen     bool
+		spent      bool
+	}{
+		{"stored", 3, false, true},
+		{"rolled back", 2, false, false},
+		{"reopened", 2, true, false},
+		{"stored again", 3, false, true},
+	}
+	for _, test := range tests {
+		if test.reopen {
+			_ = spentIndexMgr.SpentIndexFileObj.Close()
+			spentIndexMgr = new(SpentIndexManager)
+			err = spentIndexMgr.Init(config.DataConfig.DataDir, DefaultSpentIndexName)
+			// the blocks after the last spending record are counted by the catch-up on startup
+			if err == nil {
+				err = spentIndexMgr.Catchup(test.blockCount)
+			}
+		} else if test.blockCount < spentIndexMgr.BlockCount {
+			err = spentIndexMgr.TruncateSpentIndex(test.blockCount)
+		} else {
+			for height := spentIndexMgr.BlockCount; height < test.blockCount; height++ {
+				err = spentIndexMgr.AddBlockSpentIndex(height, rawBlocks[height])
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spentIndexMgr.BlockCount != test.blockCount {
+			t.Fatalf("%s: unexpected block count %d", test.name, spentIndexMgr.BlockCount)
+		}
+
+		// the output 0 of coinbase1 is spent by the input 0 of tx2 in the block 2
+		var prevTxId bigint.Uint256
+		_ = prevTxId.SetData(calcTestTxId(coinbase1))
+		spentIndex, err := spentIndexMgr.GetSpentIndex(&prevTxId, 0)
+		if !test.spent {
+			if err != ErrOutPointNotSpent {
+				t.Fatalf("%s: outpoint spent by the rolled back block: %v", test.name, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if spentIndex.BlockHeight != 2 || spentIndex.TxId.GetHex() != getTestTxIdHex(tx2) || spentIndex.Vin != 0 {
+				t.Fatalf("%s: unexpected spent index %+v", test.name, spentIndex)
+			}
+		}
+		// the outputs never spent
+		for _, outPoint := range []struct {
+			tx []byte
+			n  uint32
+		}{{coinbase1, 1}, {coinbase2, 0}, {tx2, 0}} {
+			var txId bigint.Uint256
+			_ = txId.SetData(calcTestTxId(outPoint.tx))
+			_, err = spentIndexMgr.GetSpentIndex(&txId, outPoint.n)
+			if err != ErrOutPointNotSpent {
+				t.Fatalf("%s: unspent outpoint %s:%d found spent: %v", test.name, txId.GetHex(), outPoint.n, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	DefaultStaleBlockName = "stale_block"
+)
+
+type StaleBlockManager struct {
+	StaleBlockFileName   string
+	StaleBlockFileObj    *os.File
+	StaleBlockFileEndPos uint64
+	staleHashToPosMap    map[string]uint64
+	staleBlockMutex      *sync.RWMutex
+}
+
+func (s *StaleBlockManager) Init(dataDir string, staleBlockName string) error {
+	if s.staleBlockMutex == nil {
+		s.staleBlockMutex = new(sync.RWMutex)
+	}
+	s.staleBlockMutex.Lock()
+	defer s.staleBlockMutex.Unlock()
+
+	var err error
+	staleBlockFileName := dataDir + "/" + staleBlockName
+	s.StaleBlockFileObj, err = os.OpenFile(staleBlockFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend)
+	if err != nil {
+		return err
+	}
+	staleBlockInfo, err := s.StaleBlockFileObj.Stat()
+	if err != nil {
+		return err
+	}
+	s.StaleBlockFileName = staleBlockFileName
+	s.StaleBlockFileEndPos = 0
+	s.staleHashToPosMap = make(map[string]uint64)
+
+	// load the positions of all stale blocks
+	_, err = s.StaleBlockFileObj.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	for s.StaleBlockFileEndPos < uint64(staleBlockInfo.Size()) {
+		ptrRawBlock := new(RawBlock)
+		err = ptrRawBlock.UnPack(s.StaleBlockFileObj)
+		if err != nil {
+			return err
+		}
+		s.staleHashToPosMap[ptrRawBlock.BlockHash.GetHex()] = s.StaleBlockFileEndPos
+		s.StaleBlockFileEndPos = s.StaleBlockFileEndPos + ptrRawBlock.PackSize()
+	}
+	return nil
+}
+
+func (s *StaleBlockManager) AddStaleBlock(staleBlock *RawBlock) error {
+	s.staleBlockMutex.Lock()
+	defer s.staleBlockMutex.Unlock()
+
+	blockHash := staleBlock.BlockHash.GetHex()
+	_, ok := s.staleHashToPosMap[blockHash]
+	if ok {
+		// already kept
+		return nil
+	}
+	err := staleBlock.Pack(s.StaleBlockFileObj)
+	if err != nil {
+		return err
+	}
+	s.staleHashToPosMap[blockHash] = s.StaleBlockFileEndPos
+	s.StaleBlockFileEndPos = s.StaleBlockFileEndPos + staleBlock.PackSize()
+	return nil
+}
+
+func (s *StaleBlockManager) GetStaleBlock(blockHash string) (*RawBlock, error) {
+	s.staleBlockMutex.RLock()
+	defer s.staleBlockMutex.RUnlock()
+
+	pos, ok := s.staleHashToPosMap[blockHash]
+	if !ok {
+		return nil, errors.New("stale block hash not found")
+	}
+	ptrRawBlock := new(RawBlock)
+	err := ptrRawBlock.UnPack(io.NewSectionReader(s.StaleBlockFileObj, int64(pos), int64(s.StaleBlockFileEndPos-pos)))
+	if err != nil {
+		return nil, err
+	}
+	return ptrRawBlock, nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	DefaultTxIndexName = "tx_index"
+	TxIndexSize        = 32 + 4 + 4 + 4 + 4
+)
+
+var ErrTxNotFound = errors.New("transaction not found")
+
+// TxIndex locates a transaction by the byte offset and the size within the decompressed raw block data
+type TxIndex struct {
+	TxId        bigint.Uint256
+	BlockHeight uint32
+	TxOffset    uint32
+	TxSize      uint32
+}
+
+func (t TxIndex) packBody(writer io.Writer) error {
+	var err error
+	err = t.TxId.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, t.BlockHeight)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, t.TxOffset)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, t.TxSize)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *TxIndex) unpackBody(reader io.Reader) error {
+	var err error
+	err = t.TxId.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	t.BlockHeight, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	t.TxOffset, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	t.TxSize, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t TxIndex) Pack(writer io.Writer) error {
+	checksum := crc32.New(crc32cTable)
+	err := t.packBody(io.MultiWriter(writer, checksum))
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, checksum.Sum32())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *TxIndex) UnPack(reader io.Reader) error {
+	checksum := crc32.New(crc32cTable)
+	err := t.unpackBody(io.TeeReader(reader, checksum))
+	if err != nil {
+		return err
+	}
+	checksumRead, err := serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	if checksumRead != checksum.Sum32() {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// getBlockTxIndexes locates the transactions in the decompressed raw block data
+func getBlockTxIndexes(blockHeight uint32, rawBlockData []byte) ([]TxIndex, error) {
+	blockReader := bytes.NewReader(rawBlockData)
+	_, _, _, err := unpackChainHeader(blockReader)
+	if err != nil {
+		return nil, err
+	}
+	txCount, err := serialize.UnPackCompactSize(blockReader)
+	if err != nil {
+		return nil, err
+	}
+	if txCount > uint64(blockReader.Len()) {
+		return nil, errors.New("invalid transaction count")
+	}
+	txIndexes := make([]TxIndex, 0, txCount)
+	for i := uint64(0); i < txCount; i++ {
+		txOffset := len(rawBlockData) - blockReader.Len()
+		tx, err := unpackChainTransaction(blockReader)
+		if err != nil {
+			return nil, err
+		}
+		txId, err := tx.CalcTrxId()
+		if err != nil {
+			return nil, err
+		}
+		txIndex := TxIndex{TxId: txId, BlockHeight: blockHeight}
+		txIndex.TxOffset = uint32(txOffset)
+		txIndex.TxSize = uint32(len(rawBlockData) - blockReader.Len() - txOffset)
+		txIndexes = append(txIndexes, txIndex)
+	}
+	return txIndexes, nil
+}
+
+// getTxIdKey returns the first 8 bytes of the txid, the key of the in-memory lookup map
+func getTxIdKey(txId *bigint.Uint256) uint64 {
+	return binary.LittleEndian.Uint64(txId.GetData()[0:8])
+}
+
+// TxIndexManager appends the index records of the transactions of every stored block in block order,
+// the records are looked up by a map from the txid key to the record number kept in memory
+type TxIndexManager struct {
+	TxIndexFileName string
+	TxIndexFileObj  *os.File
+	RecordCount     uint64
+	// the number of the blocks whose transactions are indexed
+	BlockCount      uint32
+	txIdKeyToPosMap map[uint64]uint64
+	// the records whose txid key collides with a different txid
+	txIdToPosMap map[string]uint64
+	txIndexMutex *sync.RWMutex
+}
+
+var txIndexMgr *TxIndexManager
+
+func (t *TxIndexManager) Init(dataDir string, txIndexName string) error {
+	if t.txIndexMutex == nil {
+		t.txIndexMutex = new(sync.RWMutex)
+	}
+	t.txIndexMutex.Lock()
+	defer t.txIndexMutex.Unlock()
+
+	var err error
+	txIndexFileName := dataDir + "/" + txIndexName
+	t.TxIndexFileObj, err = os.OpenFile(txIndexFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend)
+	if err != nil {
+		return err
+	}
+	txIndexInfo, err := t.TxIndexFileObj.Stat()
+	if err != nil {
+		return err
+	}
+	t.TxIndexFileName = txIndexFileName
+	t.RecordCount = 0
+	t.BlockCount = 0
+	t.txIdKeyToPosMap = make(map[uint64]uint64)
+	t.txIdToPosMap = make(map[string]uint64)
+
+	// drop the partial record left by a crash
+	recordCount := uint64(txIndexInfo.Size() / TxIndexSize)
+	if uint64(txIndexInfo.Size()) != recordCount*TxIndexSize {
+		err = t.TxIndexFileObj.Truncate(int64(recordCount) * TxIndexSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	// load the txid keys of all records
+	_, err = t.TxIndexFileObj.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	// the records are read whole, the unpack of a field does not retry a short read at the buffer boundary
+	txIndexReader := bufio.NewReader(t.TxIndexFileObj)
+	txIndexData := make([]byte, TxIndexSize)
+	for pos := uint64(0); pos < recordCount; pos++ {
+		_, err = io.ReadFull(txIndexReader, txIndexData)
+		if err != nil {
+			return err
+		}
+		txIndex := new(TxIndex)
+		err = txIndex.UnPack(bytes.NewReader(txIndexData))
+		if err == ErrChecksumMismatch {
+			return errors.New("corrupt tx index record " + strconv.FormatUint(pos, 10) + ", need to rebuild tx index")
+		}
+		if err != nil {
+			return err
+		}
+		err = t.addTxIdPos(&txIndex.TxId, pos)
+		if err != nil {
+			return err
+		}
+		t.RecordCount = pos + 1
+		t.BlockCount = txIndex.BlockHeight + 1
+	}
+	return nil
+}
+
+func (t *TxIndexManager) readTxIndex(pos uint64) (*TxIndex, error) {
+	txIndexData := make([]byte, TxIndexSize)
+	_, err := t.TxIndexFileObj.ReadAt(txIndexData, int64(pos)*TxIndexSize)
+	if err != nil {
+		return nil, err
+	}
+	txIndex := new(TxIndex)
+	err = txIndex.UnPack(bytes.NewReader(txIndexData))
+	if err != nil {
+		return nil, err
+	}
+	return txIndex, nil
+}
+
+// addTxIdPos maps the txid to the record, the later record of a duplicated txid replaces the earlier one as bitcoin core does
+func (t *TxIndexManager) addTxIdPos(txId *bigint.Uint256, pos uint64) error {
+	txIdKey := getTxIdKey(txId)
+	keyPos, ok := t.txIdKeyToPosMap[txIdKey]
+	if ok {
+		keyTxIndex, err := t.readTxIndex(keyPos)
+		if err != nil {
+			return err
+		}
+		if !bigint.IsUint256Equal(&keyTxIndex.TxId, txId) {
+			t.txIdToPosMap[txId.GetHex()] = pos
+			return nil
+		}
+	}
+	t.txIdKeyToPosMap[txIdKey] = pos
+	return nil
+}
+
+func (t *TxIndexManager) removeTxIdPos(txId *bigint.Uint256, pos uint64) {
+	txIdHex := txId.GetHex()
+	collidedPos, ok := t.txIdToPosMap[txIdHex]
+	if ok && collidedPos == pos {
+		delete(t.txIdToPosMap, txIdHex)
+		return
+	}
+	txIdKey := getTxIdKey(txId)
+	keyPos, ok := t.txIdKeyToPosMap[txIdKey]
+	if ok && keyPos == pos {
+		delete(t.txIdKeyToPosMap, txIdKey)
+	}
+}
+
+// AddBlockTxIndex appends the index records of the transactions of the block at the next height
+func (t *TxIndexManager) AddBlockTxIndex(blockHeight uint32, rawBlockData []byte) error {
+	t.txIndexMutex.Lock()
+	defer t.txIndexMutex.Unlock()
+	if blockHeight != t.BlockCount {
+		return errors.New("unexpected block height " + strconv.Itoa(int(blockHeight)) + " for tx index, expect " + strconv.Itoa(int(t.BlockCount)))
+	}
+	txIndexes, err := getBlockTxIndexes(blockHeight, rawBlockData)
+	if err != nil {
+		return err
+	}
+	txIndexBuf := bytes.NewBuffer(make([]byte, 0, len(txIndexes)*TxIndexSize))
+	for i := range txIndexes {
+		err = txIndexes[i].Pack(txIndexBuf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = t.TxIndexFileObj.Write(txIndexBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	for i := range txIndexes {
+		err = t.addTxIdPos(&txIndexes[i].TxId, t.RecordCount+uint64(i))
+		if err != nil {
+			return err
+		}
+	}
+	t.RecordCount = t.RecordCount + uint64(len(txIndexes))
+	t.BlockCount = blockHeight + 1
+	return nil
+}
+
+// TruncateTxIndex keeps the index records of the transactions of the first blockCount blocks
+func (t *TxIndexManager) TruncateTxIndex(blockCount uint32) error {
+	t.txIndexMutex.Lock()
+	defer t.txIndexMutex.Unlock()
+	pos := t.RecordCount
+	for pos > 0 {
+		txIndex, err := t.readTxIndex(pos - 1)
+		if err != nil {
+			return err
+		}
+		if txIndex.BlockHeight < blockCount {
+			break
+		}
+		t.removeTxIdPos(&txIndex.TxId, pos-1)
+		pos--
+	}
+	err := t.TxIndexFileObj.Truncate(int64(pos) * TxIndexSize)
+	if err != nil {
+		return err
+	}
+	t.RecordCount = pos
+	if t.BlockCount > blockCount {
+		t.BlockCount = blockCount
+	}
+	return nil
+}
+
+// Catchup indexes the stored blocks below blockCount which are not indexed yet, the last indexed block
+// is indexed again since its records may be partial, and it must still be the stored block of its height
+func (t *TxIndexManager) Catchup(blockCount uint32) error {
+	if t.BlockCount > blockCount {
+		err := t.TruncateTxIndex(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	indexedCount := t.BlockCount
+	if t.BlockCount > 0 {
+		lastHeight := t.BlockCount - 1
+		lastTxIndex, err := t.readTxIndex(t.RecordCount - 1)
+		if err != nil {
+			return err
+		}
+		ptrRawBlock, err := loadStoredRawBlock(lastHeight)
+		if err != nil {
+			return err
+		}
+		txIndexes, err := getBlockTxIndexes(lastHeight, ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		found := false
+		for i := range txIndexes {
+			if bigint.IsUint256Equal(&lastTxIndex.TxId, &txIndexes[i].TxId) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("tx index not match with the stored block at height " + strconv.Itoa(int(lastHeight)) + ", need to rebuild tx index")
+		}
+		err = t.TruncateTxIndex(lastHeight)
+		if err != nil {
+			return err
+		}
+	}
+	for height := t.BlockCount; height < blockCount; height++ {
+		ptrRawBlock, err := loadStoredRawBlock(height)
+		if err != nil {
+			return err
+		}
+		err = t.AddBlockTxIndex(height, ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		if height >= indexedCount && (height%10000 == 0 || height == blockCount-1) {
+			var completeRate float64 = float64(height-indexedCount+1) * float64(100) / float64(blockCount-indexedCount)
+			fmt.Println("index transactions of block height", height, "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+		}
+	}
+	return t.Sync()
+}
+
+func (t *TxIndexManager) GetTxIndex(txId string) (*TxIndex, error) {
+	t.txIndexMutex.RLock()
+	defer t.txIndexMutex.RUnlock()
+	var txIdValue bigint.Uint256
+	err := txIdValue.SetHex(txId)
+	if err != nil {
+		return nil, ErrTxNotFound
+	}
+	pos, ok := t.txIdToPosMap[txIdValue.GetHex()]
+	if !ok {
+		pos, ok = t.txIdKeyToPosMap[getTxIdKey(&txIdValue)]
+		if !ok {
+			return nil, ErrTxNotFound
+		}
+	}
+	txIndex, err := t.readTxIndex(pos)
+	if err != nil {
+		return nil, err
+	}
+	if !bigint.IsUint256Equal(&txIndex.TxId, &txIdValue) {
+		return nil, ErrTxNotFound
+	}
+	return txIndex, nil
+}
+
+// loadIndexedTransaction returns the index record and the raw transaction data of the txid
+func loadIndexedTransaction(txId string) (*TxIndex, []byte, error) {
+	txIndex, err := txIndexMgr.GetTxIndex(txId)
+	if err != nil {
+		return nil, nil, err
+	}
+	ptrRawBlock, err := loadStoredRawBlock(txIndex.BlockHeight)
+	if err != nil {
+		return nil, nil, err
+	}
+	rawBlockData := ptrRawBlock.RawBlockData.GetData()
+	if uint64(txIndex.TxOffset)+uint64(txIndex.TxSize) > uint64(len(rawBlockData)) {
+		return nil, nil, errors.New("tx index not match with the stored block")
+	}
+	return txIndex, rawBlockData[txIndex.TxOffset : txIndex.TxOffset+txIndex.TxSize], nil
+}
+
+func (t *TxIndexManager) Sync() error {
+	t.txIndexMutex.Lock()
+	err := t.TxIndexFileObj.Sync()
+	t.txIndexMutex.Unlock()
+	return err
+}
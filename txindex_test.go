@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"testing"
+)
+
+// buildTestSpendingChain stores a regtest chain of 3 blocks, the block 2 spends the coinbase of the block 1,
+// and returns the blocks with the transactions coinbase1, coinbase2 and tx2
+func buildTestSpendingChain(t *testing.T) ([][]byte, [][]byte) {
+	useTestDataDir(t)
+	useTestNetwork(t, "bitcoin", "regtest")
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	genesisHash := calcBlockHash(genesisBlock)
+	coinbase1 := buildTestCoinbaseOuts(1, testTxOut{50 * 100000000, []byte{0x51}}, testTxOut{0, []byte{0x6a}})
+	hash1, block1 := mineTestBlock(t, genesisHash, coinbase1)
+	coinbase2 := buildTestCoinbaseOuts(2, testTxOut{50 * 100000000, []byte{0x52}})
+	tx2 := buildTestTx(calcTestTxId(coinbase1), 0, []byte{0x51}, testTxOut{10 * 100000000, []byte{0x53}}, testTxOut{39 * 100000000, []byte{0x54, 0x55}})
+	hash2, block2 := mineTestBlock(t, hash1, coinbase2, tx2)
+	rawBlocks := [][]byte{genesisBlock, block1, block2}
+	writeTestRawBlocks(t, rawBlocks, CompressedTypeNone)
+	useTestChain(t, []string{genesisHash, hash1, hash2})
+	return rawBlocks, [][]byte{coinbase1, coinbase2, tx2}
+}
+
+// getTestTxIdHex returns the txid of the transaction in the rpc byte order
+func getTestTxIdHex(tx []byte) string {
+	var txId bigint.Uint256
+	_ = txId.SetData(calcTestTxId(tx))
+	return txId.GetHex()
+}
+
+func TestTxIndexRollback(t *testing.T) {
+	rawBlocks, txs := buildTestSpendingChain(t)
+	savedTxIndexMgr := txIndexMgr
+	txIndexMgr = new(TxIndexManager)
+	t.Cleanup(func() {
+		_ = txIndexMgr.TxIndexFileObj.Close()
+		txIndexMgr = savedTxIndexMgr
+	})
+	err := txIndexMgr.Init(config.DataConfig.DataDir, DefaultTxIndexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height, rawBlock := range rawBlocks {
+		err = txIndexMgr.AddBlockTxIndex(uint32(height), rawBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	heights := []uint32{1, 2, 2}
+	tests := []struct {
+		name       string
+		blockCount uint32
+		reopen     bool
+	}{
+		{"stored", 3, false},
+		{"rolled back", 2, false},
+		{"reopened", 2, true},
+		{"stored again", 3, false},
+	}
+	for _, test := range tests {
+		if test.reopen {
+			_ = txIndexMgr.TxIndexFileObj.Close()
+			txIndexMgr = new(TxIndexManager)
+			err = txIndexMgr.Init(config.DataConfig.DataDir, DefaultTxIndexName)
+		} else if test.blockCount < txIndexMgr.BlockCount {
+			err = txIndexMgr.TruncateTxIndex(test.blockCount)
+		} else {
+			for height := txIndexMgr.BlockCount; height < test.blockCount; height++ {
+				err = txIndexMgr.AddBlockTxIndex(height, rawBlocks[height])
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if txIndexMgr.BlockCount != test.blockCount {
+			t.Fatalf("%s: unexpected block count %d", test.name, txIndexMgr.BlockCount)
+		}
+		for i, tx := range txs {
+			txIndex, txData, err := loadIndexedTransaction(getTestTxIdHex(tx))
+			if heights[i] >= test.blockCount {
+				if err != ErrTxNotFound {
+					t.Fatalf("%s: tx %d of the rolled back block found: %v", test.name, i, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: tx %d: %v", test.name, i, err)
+			}
+			if txIndex.BlockHeight != heights[i] || !bytes.Equal(txData, tx) {
+				t.Fatalf("%s: unexpected tx %d at height %d", test.name, i, txIndex.BlockHeight)
+			}
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	UpstreamDownTime    = 5 * time.Second
+	UpstreamMaxDownTime = 60 * time.Second
+)
+
+type UpstreamStatus struct {
+	RpcReqUrl  string `json:"rpcReqUrl"`
+	Priority   int    `json:"priority"`
+	BlockCount uint32 `json:"blockCount"`
+	Healthy    bool   `json:"healthy"`
+	Lagging    bool   `json:"lagging"`
+	LastError  string `json:"lastError"`
+}
+
+type Upstream struct {
+	Source     *RpcBlockSource
+	RpcReqUrl  string
+	Priority   int
+	BlockCount uint32
+	FailCount  int
+	DownUntil  time.Time
+	Lagging    bool
+	LastError  string
+	// the upstream is checked to be on the configured network before use, and excluded if it is not
+	Checked  bool
+	Excluded bool
+}
+
+// UpstreamBlockSource spreads the calls over several bitcoind, the upstream with the smallest priority value
+// which is healthy and not lagging is used, and in quorum mode the block hashes must agree across the upstreams
+type UpstreamBlockSource struct {
+	Upstreams []*Upstream
+	Quorum    int
+	MaxLag    uint32
+	current   *Upstream
+	// the error of the latest upstream excluded for being on another network
+	networkErr error
+	mutex      *sync.Mutex
+}
+
+// redactUrl drops the credentials from the url for printing
+func redactUrl(rpcReqUrl string) string {
+	parsedUrl, err := url.Parse(rpcReqUrl)
+	if err != nil {
+		return "invalid url"
+	}
+	parsedUrl.User = nil
+	return parsedUrl.String()
+}
+
+func newUpstreamBlockSource() (*UpstreamBlockSource, error) {
+	s := new(UpstreamBlockSource)
+	s.Quorum = config.RpcClientConfig.Quorum
+	s.MaxLag = config.RpcClientConfig.MaxLag
+	s.mutex = new(sync.Mutex)
+	upstreamConfigs := config.RpcClientConfig.Upstreams
+	if len(upstreamConfigs) == 0 {
+		upstreamConfigs = []UpstreamConfig{{RpcReqUrl: config.RpcClientConfig.RpcReqUrl}}
+	}
+	for _, upstreamConfig := range upstreamConfigs {
+		if upstreamConfig.RpcReqUrl == "" {
+			return nil, errors.New("upstream without rpcReqUrl")
+		}
+		upstream := new(Upstream)
+		upstream.Source = newRpcBlockSource(upstreamConfig.RpcReqUrl)
+		upstream.RpcReqUrl = upstreamConfig.RpcReqUrl
+		upstream.Priority = upstreamConfig.Priority
+		s.Upstreams = append(s.Upstreams, upstream)
+	}
+	sort.SliceStable(s.Upstreams, func(i, j int) bool {
+		return s.Upstreams[i].Priority < s.Upstreams[j].Priority
+	})
+	if s.Quorum > len(s.Upstreams) {
+		return nil, fmt.Errorf("quorum %d is larger than the number of upstreams %d", s.Quorum, len(s.Upstreams))
+	}
+	return s, nil
+}
+
+func (s *UpstreamBlockSource) isQuorumMode() bool {
+	return s.Quorum > 1
+}
+
+func (s *UpstreamBlockSource) markFailed(upstream *Upstream, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upstream.FailCount++
+	downTime := UpstreamMaxDownTime
+	if upstream.FailCount <= 4 {
+		downTime = UpstreamDownTime << uint(upstream.FailCount-1)
+	}
+	upstream.DownUntil = time.Now().Add(downTime)
+	upstream.LastError = redactError(err)
+	fmt.Println("upstream", redactUrl(upstream.RpcReqUrl), "is down for", downTime, ":", upstream.LastError)
+}
+
+func (s *UpstreamBlockSource) markOk(upstream *Upstream) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if upstream.FailCount != 0 {
+		fmt.Println("upstream", redactUrl(upstream.RpcReqUrl), "is back")
+	}
+	upstream.FailCount = 0
+}
+
+func (s *UpstreamBlockSource) markExcluded(upstream *Upstream, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	upstream.Excluded = true
+	upstream.LastError = redactError(err)
+	s.networkErr = err
+	fmt.Println("upstream", redactUrl(upstream.RpcReqUrl), "is excluded:", upstream.LastError)
+}
+
+// checkUpstream checks the upstream is on the configured network once, the upstream is not used before it is checked
+func (s *UpstreamBlockSource) checkUpstream(upstream *Upstream) error {
+	s.mutex.Lock()
+	checked := upstream.Checked
+	s.mutex.Unlock()
+	if checked {
+		return nil
+	}
+	err := checkUpstreamNetwork(upstream.Source)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	upstream.Checked = true
+	s.mutex.Unlock()
+	return nil
+}
+
+// CheckNetwork checks all upstreams on startup, and fails if any upstream is on another network,
+// the upstreams which are not reachable are checked again when they are polled
+func (s *UpstreamBlockSource) CheckNetwork() error {
+	errs := make([]error, len(s.Upstreams))
+	wg := new(sync.WaitGroup)
+	for i, upstream := range s.Upstreams {
+		wg.Add(1)
+		go func(i int, upstream *Upstream) {
+			defer wg.Done()
+			errs[i] = s.checkUpstream(upstream)
+		}(i, upstream)
+	}
+	wg.Wait()
+
+	for i, upstream := range s.Upstreams {
+		if errs[i] == nil {
+			continue
+		}
+		if rpcCallError, ok := errs[i].(*RpcCallError); ok && rpcCallError.Class == RpcErrorNetwork {
+			s.markExcluded(upstream, errs[i])
+			return errors.New("upstream " + redactUrl(upstream.RpcReqUrl) + " is not on " + networkParams.Chain + " " + networkParams.Name + ": " + redactError(errs[i]))
+		}
+		s.markFailed(upstream, errs[i])
+	}
+	return nil
+}
+
+func (s *UpstreamBlockSource) allExcluded() bool {
+	for _, upstream := range s.Upstreams {
+		if !upstream.Excluded {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates lists the healthy upstreams which are not lagging, by priority
+func (s *UpstreamBlockSource) candidates() []*Upstream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	upstreams := make([]*Upstream, 0, len(s.Upstreams))
+	for _, upstream := range s.Upstreams {
+		if upstream.Checked && !upstream.Excluded && upstream.FailCount == 0 && !upstream.Lagging && !now.Before(upstream.DownUntil) {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	return upstreams
+}
+
+func noUpstreamError(method string, lastErr error) error {
+	if lastErr != nil {
+		return lastErr
+	}
+	return newClassRpcError(RpcErrorTransport, method, errors.New("no healthy upstream"))
+}
+
+// GetBlockCount polls every upstream which is not down, then picks the upstream to use
+func (s *UpstreamBlockSource) GetBlockCount() (uint32, error) {
+	now := time.Now()
+	probes := make([]*Upstream, 0, len(s.Upstreams))
+	s.mutex.Lock()
+	for _, upstream := range s.Upstreams {
+		if !upstream.Excluded && !now.Before(upstream.DownUntil) {
+			probes = append(probes, upstream)
+		}
+	}
+	s.mutex.Unlock()
+
+	blockCounts := make([]uint32, len(probes))
+	errs := make([]error, len(probes))
+	wg := new(sync.WaitGroup)
+	for i, upstream := range probes {
+		wg.Add(1)
+		go func(i int, upstream *Upstream) {
+			defer wg.Done()
+			errs[i] = s.checkUpstream(upstream)
+			if errs[i] != nil {
+				return
+			}
+			blockCounts[i], errs[i] = upstream.Source.GetBlockCount()
+		}(i, upstream)
+	}
+	wg.Wait()
+
+	var lastErr error = nil
+	for i, upstream := range probes {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			if rpcCallError, ok := errs[i].(*RpcCallError); ok && rpcCallError.Class == RpcErrorNetwork {
+				s.markExcluded(upstream, errs[i])
+				continue
+			}
+			s.markFailed(upstream, errs[i])
+			continue
+		}
+		s.markOk(upstream)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var bestCount uint32 = 0
+	healthyCounts := make([]uint32, 0, len(probes))
+	for i, upstream := range probes {
+		if errs[i] == nil {
+			upstream.BlockCount = blockCounts[i]
+			healthyCounts = append(healthyCounts, blockCounts[i])
+			if blockCounts[i] > bestCount {
+				bestCount = blockCounts[i]
+			}
+		}
+	}
+	var current *Upstream = nil
+	for _, upstream := range s.Upstreams {
+		upstream.Lagging = upstream.BlockCount+s.MaxLag < bestCount
+		if current == nil && upstream.Checked && !upstream.Excluded && upstream.FailCount == 0 && !upstream.Lagging && !now.Before(upstream.DownUntil) {
+			current = upstream
+		}
+	}
+	if current == nil {
+		if s.networkErr != nil && s.allExcluded() {
+			return 0, s.networkErr
+		}
+		return 0, noUpstreamError("getblockcount", lastErr)
+	}
+	if current != s.current {
+		fmt.Println("upstream: use", redactUrl(current.RpcReqUrl))
+		s.current = current
+	}
+
+	if s.isQuorumMode() {
+		// the highest block count reached by a quorum of upstreams
+		if len(healthyCounts) < s.Quorum {
+			return 0, newQuorumError("getblockcount", fmt.Errorf("%d healthy upstreams, quorum %d", len(healthyCounts), s.Quorum))
+		}
+		sort.Slice(healthyCounts, func(i, j int) bool { return healthyCounts[i] > healthyCounts[j] })
+		return healthyCounts[s.Quorum-1], nil
+	}
+	return current.BlockCount, nil
+}
+
+func (s *UpstreamBlockSource) GetBlockHash(blockHeight uint32) (string, error) {
+	blockHashes, errs, err := s.GetBlockHashes([]uint32{blockHeight})
+	if err != nil {
+		return "", err
+	}
+	return blockHashes[0], errs[0]
+}
+
+// GetBlockHashes asks the upstreams by priority, in quorum mode the hash of each height must be agreed by a quorum
+func (s *UpstreamBlockSource) GetBlockHashes(blockHeights []uint32) ([]string, []error, error) {
+	required := 1
+	if s.isQuorumMode() {
+		required = s.Quorum
+	}
+	var lastErr error = nil
+	results := make([][]string, 0, required)
+	resultErrs := make([][]error, 0, required)
+	for _, upstream := range s.candidates() {
+		blockHashes, errs, err := upstream.Source.GetBlockHashes(blockHeights)
+		if err != nil {
+			lastErr = err
+			s.markFailed(upstream, err)
+			continue
+		}
+		results = append(results, blockHashes)
+		resultErrs = append(resultErrs, errs)
+		if len(results) == required {
+			break
+		}
+	}
+	if len(results) == 0 {
+		return nil, nil, noUpstreamError("getblockhash", lastErr)
+	}
+	if len(results) < required {
+		return nil, nil, newQuorumError("getblockhash", fmt.Errorf("%d upstreams answered, quorum %d", len(results), required))
+	}
+
+	blockHashes := results[0]
+	errs := resultErrs[0]
+	for i := range blockHeights {
+		for j := 1; j < len(results) && errs[i] == nil; j++ {
+			if resultErrs[j][i] != nil {
+				errs[i] = resultErrs[j][i]
+			} else if results[j][i] != blockHashes[i] {
+				errs[i] = newQuorumError("getblockhash", fmt.Errorf("upstreams disagree on the block hash at height %d", blockHeights[i]))
+			}
+		}
+	}
+	return blockHashes, errs, nil
+}
+
+func (s *UpstreamBlockSource) GetRawBlock(blockHash string) ([]byte, error) {
+	rawBlocks, errs, err := s.GetRawBlocks([]string{blockHash})
+	if err != nil {
+		return nil, err
+	}
+	return rawBlocks[0], errs[0]
+}
+
+// GetRawBlocks fails over by priority, the raw blocks are bound to the agreed hashes by the validation of the gatherer
+func (s *UpstreamBlockSource) GetRawBlocks(blockHashes []string) ([][]byte, []error, error) {
+	var lastErr error = nil
+	for _, upstream := range s.candidates() {
+		rawBlocks, errs, err := upstream.Source.GetRawBlocks(blockHashes)
+		if err != nil {
+			lastErr = err
+			s.markFailed(upstream, err)
+			continue
+		}
+		return rawBlocks, errs, nil
+	}
+	return nil, nil, noUpstreamError("getblock", lastErr)
+}
+
+func (s *UpstreamBlockSource) GetUpstreamStatus() []UpstreamStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	upstreamStatus := make([]UpstreamStatus, 0, len(s.Upstreams))
+	for _, upstream := range s.Upstreams {
+		status := UpstreamStatus{}
+		status.RpcReqUrl = redactUrl(upstream.RpcReqUrl)
+		status.Priority = upstream.Priority
+		status.BlockCount = upstream.BlockCount
+		status.Healthy = upstream.Checked && !upstream.Excluded && upstream.FailCount == 0 && !now.Before(upstream.DownUntil)
+		status.Lagging = upstream.Lagging
+		status.LastError = upstream.LastError
+		upstreamStatus = append(upstreamStatus, status)
+	}
+	return upstreamStatus
+}
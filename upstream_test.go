@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// startTestBitcoind answers the json rpc calls of the network check as a bitcoind of the chain
+func startTestBitcoind(t *testing.T, chainName string, genesisHash string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Id     int    `json:"id"`
+			Method string `json:"method"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response := map[string]interface{}{"jsonrpc": "2.0", "id": request.Id}
+		switch request.Method {
+		case "getblockchaininfo":
+			response["result"] = map[string]interface{}{"chain": chainName}
+		case "getblockhash":
+			response["result"] = genesisHash
+		case "getblockcount":
+			response["result"] = 0
+		default:
+			response["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return strings.Replace(server.URL, "http://", "http://user:password@", 1)
+}
+
+// testChainNode is a bitcoind with a chain of block hashes which the test reorgs, it answers the single and the batch calls
+type testChainNode struct {
+	blockHashes []string
+	down        bool
+	mutex       sync.Mutex
+}
+
+func startTestChainNode(t *testing.T, blockHashes []string) (*testChainNode, string) {
+	node := &testChainNode{blockHashes: blockHashes}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+		if node.down {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if body[0] != '[' {
+			_ = json.NewEncoder(w).Encode(node.answer(body))
+			return
+		}
+		var requests []json.RawMessage
+		err = json.Unmarshal(body, &requests)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		responses := make([]map[string]interface{}, 0, len(requests))
+		for _, request := range requests {
+			responses = append(responses, node.answer(request))
+		}
+		_ = json.NewEncoder(w).Encode(responses)
+	}))
+	t.Cleanup(server.Close)
+	return node, strings.Replace(server.URL, "http://", "http://user:password@", 1)
+}
+
+func (node *testChainNode) answer(body json.RawMessage) map[string]interface{} {
+	var request struct {
+		Id     int           `json:"id"`
+		Method string        `json:"method"`
+		Params []interface{} `json:"params"`
+	}
+	_ = json.Unmarshal(body, &request)
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": request.Id}
+	switch request.Method {
+	case "getblockchaininfo":
+		response["result"] = map[string]interface{}{"chain": "regtest"}
+	case "getblockhash":
+		blockHeight, ok := request.Params[0].(float64)
+		if !ok || int(blockHeight) >= len(node.blockHashes) {
+			response["error"] = map[string]interface{}{"code": RpcCodeInvalidParameter, "message": "Block height out of range"}
+		} else {
+			response["result"] = node.blockHashes[int(blockHeight)]
+		}
+	case "getblockcount":
+		response["result"] = len(node.blockHashes) - 1
+	default:
+		response["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	}
+	return response
+}
+
+func (node *testChainNode) setChain(blockHashes []string, down bool) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.blockHashes = blockHashes
+	node.down = down
+}
+
+// useTestUpstreams configures the upstreams for the test
+func useTestUpstreams(t *testing.T, rpcReqUrls ...string) *UpstreamBlockSource {
+	savedRpcClientConfig := config.RpcClientConfig
+	config.RpcClientConfig.RpcTimeout = 5
+	config.RpcClientConfig.Upstreams = nil
+	for i, rpcReqUrl := range rpcReqUrls {
+		config.RpcClientConfig.Upstreams = append(config.RpcClientConfig.Upstreams, UpstreamConfig{RpcReqUrl: rpcReqUrl, Priority: i})
+	}
+	t.Cleanup(func() {
+		config.RpcClientConfig = savedRpcClientConfig
+	})
+	s, err := newUpstreamBlockSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUpstreamCheckNetwork(t *testing.T) {
+	useTestNetwork(t, "bitcoin", "regtest")
+	regtestGenesisHash := networkParams.GenesisHash
+	mainnetGenesisHash := networkParamsMap["bitcoin"]["mainnet"].GenesisHash
+	goodUrl := startTestBitcoind(t, "regtest", regtestGenesisHash)
+	otherChainUrl := startTestBitcoind(t, "main", mainnetGenesisHash)
+	otherGenesisUrl := startTestBitcoind(t, "regtest", mainnetGenesisHash)
+	downServer := httptest.NewServer(http.NotFoundHandler())
+	downUrl := downServer.URL
+	downServer.Close()
+
+	tests := []struct {
+		name      string
+		rpcReqUrl []string
+		err       string
+		// the expected state of each upstream after the check
+		checked  []bool
+		excluded []bool
+	}{
+		{"network", []string{goodUrl}, "", []bool{true}, []bool{false}},
+		{"other chain", []string{goodUrl, otherChainUrl}, "upstream chain main", []bool{true, false}, []bool{false, true}},
+		{"other genesis", []string{otherGenesisUrl}, "upstream genesis", []bool{false}, []bool{true}},
+		// the upstream which is down does not fail the startup, it is checked when it is polled
+		{"down", []string{downUrl, goodUrl}, "", []bool{false, true}, []bool{false, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := useTestUpstreams(t, test.rpcReqUrl...)
+			err := s.CheckNetwork()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+			if err != nil && strings.Contains(err.Error(), "password") {
+				t.Fatal("credentials in the error", err)
+			}
+			for i, upstream := range s.Upstreams {
+				if upstream.Checked != test.checked[i] || upstream.Excluded != test.excluded[i] {
+					t.Fatalf("upstream %d checked %v excluded %v", i, upstream.Checked, upstream.Excluded)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamUncheckedNotUsed(t *testing.T) {
+	useTestNetwork(t, "bitcoin", "regtest")
+	otherGenesisUrl := startTestBitcoind(t, "regtest", networkParamsMap["bitcoin"]["mainnet"].GenesisHash)
+	s := useTestUpstreams(t, otherGenesisUrl)
+
+	// the upstream is checked on the first poll, and excluded
+	_, err := s.GetBlockCount()
+	rpcCallError, ok := err.(*RpcCallError)
+	if !ok || rpcCallError.Class != RpcErrorNetwork {
+		t.Fatal("unexpected error", err)
+	}
+	if len(s.candidates()) != 0 {
+		t.Fatal("upstream of another network is a candidate")
+	}
+}
+
+func TestUpstreamQuorumReorg(t *testing.T) {
+	useTestNetwork(t, "bitcoin", "regtest")
+	genesisHash := networkParams.GenesisHash
+	chainA := []string{genesisHash, "a1", "a2", "a3"}
+	chainB := []string{genesisHash, "a1", "b2", "b3", "b4"}
+	nodes := make([]*testChainNode, 3)
+	rpcReqUrls := make([]string, 3)
+	nodes[0], rpcReqUrls[0] = startTestChainNode(t, chainA)
+	nodes[1], rpcReqUrls[1] = startTestChainNode(t, chainA[:3])
+	nodes[2], rpcReqUrls[2] = startTestChainNode(t, chainB)
+	s := useTestUpstreams(t, rpcReqUrls...)
+	s.Quorum = 2
+	s.MaxLag = 10
+
+	tests := []struct {
+		name   string
+		chains [][]string
+		down   []bool
+		// the block count reached by the quorum or the error
+		blockCount uint32
+		countErr   string
+		// the hash of each height agreed by the quorum or the class of the item error
+		blockHashes []string
+		hashesErr   string
+	}{
+		{"stored", [][]string{chainA, chainA[:3], chainB}, []bool{false, false, false},
+			3, "", []string{genesisHash, "a1", "a2", "rpc"}, ""},
+		// the second upstream rolls back a2 and follows the other branch
+		{"one upstream reorged", [][]string{chainA, chainB[:4], chainB}, []bool{false, false, false},
+			3, "", []string{genesisHash, "a1", "quorum", "quorum"}, ""},
+		{"quorum reorged", [][]string{chainB, chainB[:4], chainB}, []bool{false, false, false},
+			4, "", []string{genesisHash, "a1", "b2", "b3"}, ""},
+		{"one upstream down", [][]string{chainB, chainB[:4], chainB}, []bool{false, false, true},
+			3, "", []string{genesisHash, "a1", "b2", "b3"}, ""},
+		{"quorum down", [][]string{chainB, chainB[:4], chainB}, []bool{false, true, true},
+			0, "1 healthy upstreams, quorum 2", nil, "1 upstreams answered, quorum 2"},
+	}
+	for _, test := range tests {
+		for i, node := range nodes {
+			node.setChain(test.chains[i], test.down[i])
+		}
+		blockCount, err := s.GetBlockCount()
+		if test.countErr != "" {
+			rpcCallError, ok := err.(*RpcCallError)
+			if !ok || rpcCallError.Class != RpcErrorQuorum || !strings.Contains(err.Error(), test.countErr) {
+				t.Fatalf("%s: got block count error %v, expected %q", test.name, err, test.countErr)
+			}
+		} else if err != nil || blockCount != test.blockCount {
+			t.Fatalf("%s: got block count %d %v, expected %d", test.name, blockCount, err, test.blockCount)
+		}
+
+		blockHashes, errs, err := s.GetBlockHashes([]uint32{0, 1, 2, 3})
+		if test.hashesErr != "" {
+			rpcCallError, ok := err.(*RpcCallError)
+			if !ok || rpcCallError.Class != RpcErrorQuorum || !strings.Contains(err.Error(), test.hashesErr) {
+				t.Fatalf("%s: got block hashes error %v, expected %q", test.name, err, test.hashesErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		for i, expected := range test.blockHashes {
+			if errs[i] == nil {
+				if blockHashes[i] != expected {
+					t.Fatalf("%s: got hash %s at height %d, expected %s", test.name, blockHashes[i], i, expected)
+				}
+				continue
+			}
+			rpcCallError, ok := errs[i].(*RpcCallError)
+			if !ok || rpcCallError.Class.String() != expected || !rpcCallError.Transient() {
+				t.Fatalf("%s: got error %v at height %d, expected %s", test.name, errs[i], i, expected)
+			}
+			if strings.Contains(errs[i].Error(), "password") {
+				t.Fatalf("%s: credentials in the error %v", test.name, errs[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"golang.org/x/crypto/chacha20"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	DefaultUtxoSetName = "utxo_set"
+	// the fixed part of a utxo record before the scriptPubKey
+	UtxoRecordHeaderSize = 4 + 1 + 32 + 4 + 1 + 8 + 8 + 4
+	MuHashNumSize        = 384
+)
+
+var ErrUtxoNotFound = errors.New("utxo not found")
+var ErrUtxoSetChanged = errors.New("utxo set changed by a chain reorganization during the scan")
+
+// the modulus of MuHash3072, 2^3072 - 1103717
+var muHashPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1103717))
+
+// UtxoRecord is an output added to the utxo set, or an input spending an output of the set,
+// the spending record keeps the position of the spent output record as the undo data of the block
+type UtxoRecord struct {
+	BlockHeight uint32
+	Spending    bool
+	// the outpoint of the output added or spent
+	TxId     bigint.Uint256
+	N        uint32
+	CoinBase bool
+	Value    int64
+	SpentPos uint64
+	// empty for the spending record
+	ScriptPubKey []byte
+}
+
+func packBool(writer io.Writer, value bool) error {
+	var data byte = 0
+	if value {
+		data = 1
+	}
+	return serialize.PackByte(writer, data)
+}
+
+func unpackBool(reader io.Reader) (bool, error) {
+	data, err := serialize.UnPackByte(reader)
+	if err != nil {
+		return false, err
+	}
+	return data != 0, nil
+}
+
+func (u UtxoRecord) packBody(writer io.Writer) error {
+	var err error
+	err = serialize.PackUint32(writer, u.BlockHeight)
+	if err != nil {
+		return err
+	}
+	err = packBool(writer, u.Spending)
+	if err != nil {
+		return err
+	}
+	err = u.TxId.Pack(writer)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, u.N)
+	if err != nil {
+		return err
+	}
+	err = packBool(writer, u.CoinBase)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackInt64(writer, u.Value)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint64(writer, u.SpentPos)
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, uint32(len(u.ScriptPubKey)))
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(u.ScriptPubKey)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *UtxoRecord) unpackBody(reader io.Reader) error {
+	var err error
+	u.BlockHeight, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	u.Spending, err = unpackBool(reader)
+	if err != nil {
+		return err
+	}
+	err = u.TxId.UnPack(reader)
+	if err != nil {
+		return err
+	}
+	u.N, err = serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	u.CoinBase, err = unpackBool(reader)
+	if err != nil {
+		return err
+	}
+	u.Value, err = serialize.UnPackInt64(reader)
+	if err != nil {
+		return err
+	}
+	u.SpentPos, err = serialize.UnPackUint64(reader)
+	if err != nil {
+		return err
+	}
+	scriptSize, err := serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	u.ScriptPubKey = make([]byte, scriptSize)
+	_, err = io.ReadFull(reader, u.ScriptPubKey)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u UtxoRecord) Pack(writer io.Writer) error {
+	checksum := crc32.New(crc32cTable)
+	err := u.packBody(io.MultiWriter(writer, checksum))
+	if err != nil {
+		return err
+	}
+	err = serialize.PackUint32(writer, checksum.Sum32())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *UtxoRecord) UnPack(reader io.Reader) error {
+	checksum := crc32.New(crc32cTable)
+	err := u.unpackBody(io.TeeReader(reader, checksum))
+	if err != nil {
+		return err
+	}
+	checksumRead, err := serialize.UnPackUint32(reader)
+	if err != nil {
+		return err
+	}
+	if checksumRead != checksum.Sum32() {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// readUtxoRecordData reads a whole record, the size of the record is known from its fixed part
+func readUtxoRecordData(reader io.Reader) ([]byte, error) {
+	headerData := make([]byte, UtxoRecordHeaderSize)
+	_, err := io.ReadFull(reader, headerData)
+	if err != nil {
+		return nil, err
+	}
+	scriptSize := binary.LittleEndian.Uint32(headerData[UtxoRecordHeaderSize-4:])
+	if scriptSize > MaxScriptSize {
+		return nil, ErrChecksumMismatch
+	}
+	recordData := make([]byte, UtxoRecordHeaderSize+int(scriptSize)+4)
+	copy(recordData, headerData)
+	_, err = io.ReadFull(reader, recordData[UtxoRecordHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	return recordData, nil
+}
+
+// getMuHashNum maps the data to a 3072 bits number as the MuHash3072 of bitcoin core does
+func getMuHashNum(data []byte) (*big.Int, error) {
+	dataHash := sha256.Sum256(data)
+	nonce := make([]byte, chacha20.NonceSize)
+	cipher, err := chacha20.NewUnauthenticatedCipher(dataHash[:], nonce)
+	if err != nil {
+		return nil, err
+	}
+	keyStream := make([]byte, MuHashNumSize)
+	cipher.XORKeyStream(keyStream, keyStream)
+	// the number is little endian
+	for i, j := 0, len(keyStream)-1; i < j; i, j = i+1, j-1 {
+		keyStream[i], keyStream[j] = keyStream[j], keyStream[i]
+	}
+	return new(big.Int).SetBytes(keyStream), nil
+}
+
+// getUtxoSerialized serializes the output as the utxo set hash of bitcoin core does
+func getUtxoSerialized(utxoRecord *UtxoRecord) ([]byte, error) {
+	var err error
+	buf := bytes.NewBuffer(make([]byte, 0, 32+4+4+8+9+len(utxoRecord.ScriptPubKey)))
+	err = utxoRecord.TxId.Pack(buf)
+	if err != nil {
+		return nil, err
+	}
+	err = serialize.PackUint32(buf, utxoRecord.N)
+	if err != nil {
+		return nil, err
+	}
+	heightCode := utxoRecord.BlockHeight << 1
+	if utxoRecord.CoinBase {
+		heightCode = heightCode + 1
+	}
+	err = serialize.PackUint32(buf, heightCode)
+	if err != nil {
+		return nil, err
+	}
+	err = serialize.PackInt64(buf, utxoRecord.Value)
+	if err != nil {
+		return nil, err
+	}
+	err = serialize.PackCompactSize(buf, uint64(len(utxoRecord.ScriptPubKey)))
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(utxoRecord.ScriptPubKey)
+	return buf.Bytes(), nil
+}
+
+// UtxoSetInfo is the gettxoutsetinfo json of bitcoin core
+type UtxoSetInfo struct {
+	Height       uint32        `json:"height"`
+	BestBlock    string        `json:"bestblock"`
+	TxOuts       uint64        `json:"txouts"`
+	Transactions uint64        `json:"transactions"`
+	BogoSize     uint64        `json:"bogosize"`
+	MuHash       string        `json:"muhash,omitempty"`
+	TotalAmount  BitcoinAmount `json:"total_amount"`
+}
+
+// UtxoSetManager keeps the utxo set of the stored blocks, the records are appended to the utxo set file block by block
+// and the unspent outputs are located by their record positions in memory
+type UtxoSetManager struct {
+	UtxoSetFileName string
+	UtxoSetFileObj  *os.File
+	FileSize        uint64
+	BlockCount      uint32
+	// the position of the first record of each block
+	blockStartPos      []uint64
+	unspentKeyToPosMap map[uint64]uint64
+	// the unspent outputs whose outpoint key collides with a different outpoint
+	unspentToPosMap map[string]uint64
+	// counts the truncations, the records read without the lock are checked against it
+	truncateCount uint64
+	utxoSetMutex  *sync.RWMutex
+}
+
+var utxoSetMgr *UtxoSetManager
+
+func (u *UtxoSetManager) Init(dataDir string, utxoSetName string) error {
+	if u.utxoSetMutex == nil {
+		u.utxoSetMutex = new(sync.RWMutex)
+	}
+	u.utxoSetMutex.Lock()
+	defer u.utxoSetMutex.Unlock()
+
+	var err error
+	utxoSetFileName := dataDir + "/" + utxoSetName
+	u.UtxoSetFileObj, err = os.OpenFile(utxoSetFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend)
+	if err != nil {
+		return err
+	}
+	utxoSetInfo, err := u.UtxoSetFileObj.Stat()
+	if err != nil {
+		return err
+	}
+	u.UtxoSetFileName = utxoSetFileName
+	u.FileSize = 0
+	u.BlockCount = 0
+	u.blockStartPos = make([]uint64, 0)
+	u.unspentKeyToPosMap = make(map[uint64]uint64)
+	u.unspentToPosMap = make(map[string]uint64)
+
+	// replay the records to the unspent outputs
+	_, err = u.UtxoSetFileObj.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	utxoSetReader := bufio.NewReader(u.UtxoSetFileObj)
+	for u.FileSize < uint64(utxoSetInfo.Size()) {
+		recordData, err := readUtxoRecordData(utxoSetReader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// drop the partial record left by a crash
+			err = u.UtxoSetFileObj.Truncate(int64(u.FileSize))
+			if err != nil {
+				return err
+			}
+			break
+		}
+		utxoRecord := new(UtxoRecord)
+		if err == nil {
+			err = utxoRecord.UnPack(bytes.NewReader(recordData))
+		}
+		if err == ErrChecksumMismatch {
+			return errors.New("corrupt utxo set record at offset " + strconv.FormatUint(u.FileSize, 10) + ", need to rebuild utxo set")
+		}
+		if err != nil {
+			return err
+		}
+		for u.BlockCount <= utxoRecord.BlockHeight {
+			u.blockStartPos = append(u.blockStartPos, u.FileSize)
+			u.BlockCount++
+		}
+		err = u.applyUtxoRecord(utxoRecord, u.FileSize, nil)
+		if err != nil {
+			return err
+		}
+		u.FileSize = u.FileSize + uint64(len(recordData))
+	}
+	return nil
+}
+
+// readUtxoRecord reads the record at the position, the records not written yet are in pending
+func (u *UtxoSetManager) readUtxoRecord(pos uint64, pending map[uint64]*UtxoRecord) (*UtxoRecord, error) {
+	if pos >= u.FileSize {
+		utxoRecord, ok := pending[pos]
+		if !ok {
+			return nil, errors.New("utxo set record not found")
+		}
+		return utxoRecord, nil
+	}
+	return readUtxoRecordAt(u.UtxoSetFileObj, pos, u.FileSize)
+}
+
+// readUtxoRecordAt reads the record at the position of the utxo set file of the file size
+func readUtxoRecordAt(utxoSetFileObj *os.File, pos uint64, fileSize uint64) (*UtxoRecord, error) {
+	recordData, err := readUtxoRecordData(io.NewSectionReader(utxoSetFileObj, int64(pos), int64(fileSize-pos)))
+	if err != nil {
+		return nil, err
+	}
+	utxoRecord := new(UtxoRecord)
+	err = utxoRecord.UnPack(bytes.NewReader(recordData))
+	if err != nil {
+		return nil, err
+	}
+	return utxoRecord, nil
+}
+
+// findUnspent returns the position of the unspent output record of the outpoint
+func (u *UtxoSetManager) findUnspent(txId *bigint.Uint256, n uint32, pending map[uint64]*UtxoRecord) (uint64, bool, error) {
+	pos, ok := u.unspentToPosMap[getOutPointString(txId, n)]
+	if ok {
+		return pos, true, nil
+	}
+	pos, ok = u.unspentKeyToPosMap[getOutPointKey(txId, n)]
+	if !ok {
+		return 0, false, nil
+	}
+	utxoRecord, err := u.readUtxoRecord(pos, pending)
+	if err != nil {
+		return 0, false, err
+	}
+	if utxoRecord.N != n || !bigint.IsUint256Equal(&utxoRecord.TxId, txId) {
+		return 0, false, nil
+	}
+	return pos, true, nil
+}
+
+// addUnspent maps the outpoint to the output record, an unspent output of the same outpoint is replaced as bitcoin core does
+func (u *UtxoSetManager) addUnspent(utxoRecord *UtxoRecord, pos uint64, pending map[uint64]*UtxoRecord) error {
+	outPointKey := getOutPointKey(&utxoRecord.TxId, utxoRecord.N)
+	keyPos, ok := u.unspentKeyToPosMap[outPointKey]
+	if ok {
+		keyRecord, err := u.readUtxoRecord(keyPos, pending)
+		if err != nil {
+			return err
+		}
+		if keyRecord.N != utxoRecord.N || !bigint.IsUint256Equal(&keyRecord.TxId, &utxoRecord.TxId) {
+			u.unspentToPosMap[getOutPointString(&utxoRecord.TxId, utxoRecord.N)] = pos
+			return nil
+		}
+	}
+	u.unspentKeyToPosMap[outPointKey] = pos
+	return nil
+}
+
+func (u *UtxoSetManager) removeUnspent(txId *bigint.Uint256, n uint32, pos uint64) {
+	outPoint := getOutPointString(txId, n)
+	collidedPos, ok := u.unspentToPosMap[outPoint]
+	if ok && collidedPos == pos {
+		delete(u.unspentToPosMap, outPoint)
+		return
+	}
+	outPointKey := getOutPointKey(txId, n)
+	keyPos, ok := u.unspentKeyToPosMap[outPointKey]
+	if ok && keyPos == pos {
+		delete(u.unspentKeyToPosMap, outPointKey)
+	}
+}
+
+func (u *UtxoSetManager) applyUtxoRecord(utxoRecord *UtxoRecord, pos uint64, pending map[uint64]*UtxoRecord) error {
+	if utxoRecord.Spending {
+		u.removeUnspent(&utxoRecord.TxId, utxoRecord.N, utxoRecord.SpentPos)
+		return nil
+	}
+	return u.addUnspent(utxoRecord, pos, pending)
+}
+
+// undoUtxoRecord reverts the record, the output spent by the spending record becomes unspent again
+func (u *UtxoSetManager) undoUtxoRecord(utxoRecord *UtxoRecord, pos uint64) error {
+	if !utxoRecord.Spending {
+		u.removeUnspent(&utxoRecord.TxId, utxoRecord.N, pos)
+		return nil
+	}
+	spentRecord, err := u.readUtxoRecord(utxoRecord.SpentPos, nil)
+	if err != nil {
+		return err
+	}
+	return u.addUnspent(spentRecord, utxoRecord.SpentPos, nil)
+}
+
+// AddBlockUtxoSet spends the outputs spent by the block at the next height and adds its outputs,
+// the outputs of the genesis block and the unspendable outputs are never in the utxo set
+func (u *UtxoSetManager) AddBlockUtxoSet(blockHeight uint32, rawBlockData []byte) error {
+	u.utxoSetMutex.Lock()
+	defer u.utxoSetMutex.Unlock()
+	if blockHeight != u.BlockCount {
+		return errors.New("unexpected block height " + strconv.Itoa(int(blockHeight)) + " for utxo set, expect " + strconv.Itoa(int(u.BlockCount)))
+	}
+	chainBlock, err := unpackChainBlock(rawBlockData)
+	if err != nil {
+		return err
+	}
+
+	pending := make(map[uint64]*UtxoRecord)
+	utxoSetBuf := new(bytes.Buffer)
+	addPending := func(utxoRecord *UtxoRecord) error {
+		pos := u.FileSize + uint64(utxoSetBuf.Len())
+		utxoRecord.BlockHeight = blockHeight
+		err := utxoRecord.Pack(utxoSetBuf)
+		if err != nil {
+			return err
+		}
+		pending[pos] = utxoRecord
+		return u.applyUtxoRecord(utxoRecord, pos, pending)
+	}
+	// the outputs of the genesis block can not be spent
+	if blockHeight == GenesisBlockHeight {
+		chainBlock.Vtx = nil
+	}
+	for i := range chainBlock.Vtx {
+		tx := &chainBlock.Vtx[i]
+		txId, err := tx.CalcTrxId()
+		if err != nil {
+			return err
+		}
+		coinBase := isCoinBase(tx)
+		if !coinBase {
+			for _, txIn := range tx.Vin {
+				// the outputs not in the utxo set, like the unspendable ones, are never spent
+				spentPos, found, err := u.findUnspent(&txIn.PrevOut.Hash, txIn.PrevOut.N, pending)
+				if err != nil {
+					return err
+				}
+				if !found {
+					continue
+				}
+				err = addPending(&UtxoRecord{Spending: true, TxId: txIn.PrevOut.Hash, N: txIn.PrevOut.N, SpentPos: spentPos})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for n, txOut := range tx.Vout {
+			scriptBytes := txOut.ScriptPubKey.GetScriptBytes()
+			if isUnspendableScript(scriptBytes) {
+				continue
+			}
+			err = addPending(&UtxoRecord{TxId: txId, N: uint32(n), CoinBase: coinBase, Value: txOut.Value, ScriptPubKey: scriptBytes})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = u.UtxoSetFileObj.Write(utxoSetBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	u.blockStartPos = append(u.blockStartPos, u.FileSize)
+	u.FileSize = u.FileSize + uint64(utxoSetBuf.Len())
+	u.BlockCount = blockHeight + 1
+	return nil
+}
+
+// readBlockUtxoRecords reads the records from the first record of the block height to the end of the file
+func (u *UtxoSetManager) readBlockUtxoRecords(blockHeight uint32) ([]*UtxoRecord, []uint64, error) {
+	utxoRecords := make([]*UtxoRecord, 0)
+	positions := make([]uint64, 0)
+	pos := u.blockStartPos[blockHeight]
+	utxoSetReader := bufio.NewReader(io.NewSectionReader(u.UtxoSetFileObj, int64(pos), int64(u.FileSize-pos)))
+	for pos < u.FileSize {
+		recordData, err := readUtxoRecordData(utxoSetReader)
+		if err != nil {
+			return nil, nil, err
+		}
+		utxoRecord := new(UtxoRecord)
+		err = utxoRecord.UnPack(bytes.NewReader(recordData))
+		if err != nil {
+			return nil, nil, err
+		}
+		utxoRecords = append(utxoRecords, utxoRecord)
+		positions = append(positions, pos)
+		pos = pos + uint64(len(recordData))
+	}
+	return utxoRecords, positions, nil
+}
+
+// TruncateUtxoSet keeps the utxo set of the first blockCount blocks, the records of the later blocks are undone from the latest
+func (u *UtxoSetManager) TruncateUtxoSet(blockCount uint32) error {
+	u.utxoSetMutex.Lock()
+	defer u.utxoSetMutex.Unlock()
+	if blockCount >= u.BlockCount {
+		return nil
+	}
+	utxoRecords, positions, err := u.readBlockUtxoRecords(blockCount)
+	if err != nil {
+		return err
+	}
+	for i := len(utxoRecords) - 1; i >= 0; i-- {
+		err = u.undoUtxoRecord(utxoRecords[i], positions[i])
+		if err != nil {
+			return err
+		}
+	}
+	err = u.UtxoSetFileObj.Truncate(int64(u.blockStartPos[blockCount]))
+	if err != nil {
+		return err
+	}
+	u.FileSize = u.blockStartPos[blockCount]
+	u.blockStartPos = u.blockStartPos[0:blockCount]
+	u.BlockCount = blockCount
+	u.truncateCount++
+	return nil
+}
+
+// isUtxoRecordInBlock checks that the output record is added by the block, or the spending record is spent by the block
+func isUtxoRecordInBlock(utxoRecord *UtxoRecord, chainBlock *ChainBlock) (bool, error) {
+	for i := range chainBlock.Vtx {
+		tx := &chainBlock.Vtx[i]
+		if utxoRecord.Spending {
+			for _, txIn := range tx.Vin {
+				if txIn.PrevOut.N == utxoRecord.N && bigint.IsUint256Equal(&txIn.PrevOut.Hash, &utxoRecord.TxId) {
+					return true, nil
+				}
+			}
+			continue
+		}
+		txId, err := tx.CalcTrxId()
+		if err != nil {
+			return false, err
+		}
+		if bigint.IsUint256Equal(&txId, &utxoRecord.TxId) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Catchup updates the utxo set with the stored blocks below blockCount which are not applied yet, the last applied block
+// is applied again since its records may be partial, and it must still be the stored block of its height
+func (u *UtxoSetManager) Catchup(blockCount uint32) error {
+	if u.BlockCount > blockCount {
+		err := u.TruncateUtxoSet(blockCount)
+		if err != nil {
+			return err
+		}
+	}
+	appliedCount := u.BlockCount
+	if u.BlockCount > 0 {
+		lastHeight := u.BlockCount - 1
+		utxoRecords, _, err := u.readBlockUtxoRecords(lastHeight)
+		if err != nil {
+			return err
+		}
+		if len(utxoRecords) != 0 {
+			ptrRawBlock, err := loadStoredRawBlock(lastHeight)
+			if err != nil {
+				return err
+			}
+			chainBlock, err := unpackChainBlock(ptrRawBlock.RawBlockData.GetData())
+			if err != nil {
+				return err
+			}
+			found, err := isUtxoRecordInBlock(utxoRecords[len(utxoRecords)-1], chainBlock)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return errors.New("utxo set not match with the stored block at height " + strconv.Itoa(int(lastHeight)) + ", need to rebuild utxo set")
+			}
+		}
+		err = u.TruncateUtxoSet(lastHeight)
+		if err != nil {
+			return err
+		}
+	}
+	for height := u.BlockCount; height < blockCount; height++ {
+		ptrRawBlock, err := loadStoredRawBlock(height)
+		if err != nil {
+			return err
+		}
+		err = u.AddBlockUtxoSet(height, ptrRawBlock.RawBlockData.GetData())
+		if err != nil {
+			return err
+		}
+		if height >= appliedCount && (height%10000 == 0 || height == blockCount-1) {
+			var completeRate float64 = float64(height-appliedCount+1) * float64(100) / float64(blockCount-appliedCount)
+			fmt.Println("update utxo set of block height", height, "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+		}
+	}
+	return u.Sync()
+}
+
+// GetUtxo returns the unspent output of the outpoint, ErrUtxoNotFound if it is spent or never exists
+func (u *UtxoSetManager) GetUtxo(txId *bigint.Uint256, n uint32) (*UtxoRecord, error) {
+	u.utxoSetMutex.RLock()
+	defer u.utxoSetMutex.RUnlock()
+	pos, found, err := u.findUnspent(txId, n, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrUtxoNotFound
+	}
+	return u.readUtxoRecord(pos, nil)
+}
+
+// GetBlockSpentScripts returns the scriptPubKeys of the outputs spent by the block applied to the utxo set
+func (u *UtxoSetManager) GetBlockSpentScripts(blockHeight uint32) ([][]byte, error) {
+	u.utxoSetMutex.RLock()
+	defer u.utxoSetMutex.RUnlock()
+	if blockHeight >= u.BlockCount {
+		return nil, errors.New("block height " + strconv.Itoa(int(blockHeight)) + " not applied to utxo set")
+	}
+	endPos := u.FileSize
+	if blockHeight+1 < u.BlockCount {
+		endPos = u.blockStartPos[blockHeight+1]
+	}
+	pos := u.blockStartPos[blockHeight]
+	utxoSetReader := bufio.NewReader(io.NewSectionReader(u.UtxoSetFileObj, int64(pos), int64(endPos-pos)))
+	spentScripts := make([][]byte, 0)
+	for pos < endPos {
+		recordData, err := readUtxoRecordData(utxoSetReader)
+		if err != nil {
+			return nil, err
+		}
+		utxoRecord := new(UtxoRecord)
+		err = utxoRecord.UnPack(bytes.NewReader(recordData))
+		if err != nil {
+			return nil, err
+		}
+		if utxoRecord.Spending {
+			spentRecord, err := u.readUtxoRecord(utxoRecord.SpentPos, nil)
+			if err != nil {
+				return nil, err
+			}
+			spentScripts = append(spentScripts, spentRecord.ScriptPubKey)
+		}
+		pos = pos + uint64(len(recordData))
+	}
+	return spentScripts, nil
+}
+
+// GetUtxoSetInfo walks the whole utxo set, the positions of the unspent outputs are taken under the lock and the
+// records are read without it, the new blocks only append records after them. The set hash is the MuHash3072
+// of the outputs which bitcoin core shows as muhash
+func (u *UtxoSetManager) GetUtxoSetInfo(withMuHash bool) (*UtxoSetInfo, error) {
+	u.utxoSetMutex.RLock()
+	if u.BlockCount == 0 {
+		u.utxoSetMutex.RUnlock()
+		return nil, errors.New("utxo set is empty")
+	}
+	// the outputs of a transaction are adjacent in the file
+	positions := make([]uint64, 0, len(u.unspentKeyToPosMap)+len(u.unspentToPosMap))
+	for _, pos := range u.unspentKeyToPosMap {
+		positions = append(positions, pos)
+	}
+	for _, pos := range u.unspentToPosMap {
+		positions = append(positions, pos)
+	}
+	blockCount := u.BlockCount
+	fileSize := u.FileSize
+	truncateCount := u.truncateCount
+	u.utxoSetMutex.RUnlock()
+	sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+
+	utxoSetInfo := new(UtxoSetInfo)
+	utxoSetInfo.Height = blockCount - 1
+	utxoSetInfo.BestBlock, _ = getStoredBlockHash(utxoSetInfo.Height)
+	muHash := big.NewInt(1)
+	var prevTxId bigint.Uint256
+	_ = prevTxId.SetData(make([]byte, 32))
+	var totalAmount int64 = 0
+	for i, pos := range positions {
+		utxoRecord, err := readUtxoRecordAt(u.UtxoSetFileObj, pos, fileSize)
+		if err != nil {
+			// the records may have been truncated by a chain reorganization
+			if u.isTruncatedSince(truncateCount) {
+				return nil, ErrUtxoSetChanged
+			}
+			return nil, err
+		}
+		if i == 0 || !bigint.IsUint256Equal(&prevTxId, &utxoRecord.TxId) {
+			utxoSetInfo.Transactions++
+		}
+		prevTxId = utxoRecord.TxId
+		utxoSetInfo.TxOuts++
+		utxoSetInfo.BogoSize = utxoSetInfo.BogoSize + 50 + uint64(len(utxoRecord.ScriptPubKey))
+		totalAmount = totalAmount + utxoRecord.Value
+		if withMuHash {
+			utxoData, err := getUtxoSerialized(utxoRecord)
+			if err != nil {
+				return nil, err
+			}
+			muHashNum, err := getMuHashNum(utxoData)
+			if err != nil {
+				return nil, err
+			}
+			muHash.Mul(muHash, muHashNum)
+			muHash.Mod(muHash, muHashPrime)
+		}
+	}
+	if u.isTruncatedSince(truncateCount) {
+		return nil, ErrUtxoSetChanged
+	}
+	utxoSetInfo.TotalAmount = BitcoinAmount(totalAmount)
+	if withMuHash {
+		utxoSetInfo.MuHash = getMuHashDigest(muHash)
+	}
+	return utxoSetInfo, nil
+}
+
+// getMuHashDigest hashes the 384 bytes little endian number of the MuHash3072, in the byte order of the block hash
+func getMuHashDigest(muHash *big.Int) string {
+	muHashData := make([]byte, MuHashNumSize)
+	muHashBytes := muHash.Bytes()
+	copy(muHashData[MuHashNumSize-len(muHashBytes):], muHashBytes)
+	for i, j := 0, len(muHashData)-1; i < j; i, j = i+1, j-1 {
+		muHashData[i], muHashData[j] = muHashData[j], muHashData[i]
+	}
+	muHashDigest := sha256.Sum256(muHashData)
+	var muHashValue bigint.Uint256
+	_ = muHashValue.SetData(muHashDigest[:])
+	return muHashValue.GetHex()
+}
+
+// isTruncatedSince checks whether the utxo set was truncated after the truncate count was taken
+func (u *UtxoSetManager) isTruncatedSince(truncateCount uint64) bool {
+	u.utxoSetMutex.RLock()
+	defer u.utxoSetMutex.RUnlock()
+	return u.truncateCount != truncateCount
+}
+
+func (u *UtxoSetManager) Sync() error {
+	u.utxoSetMutex.Lock()
+	err := u.UtxoSetFileObj.Sync()
+	u.utxoSetMutex.Unlock()
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"math/big"
+	"testing"
+)
+
+func TestMuHash(t *testing.T) {
+	// FromInt of the muhash test of bitcoin core, the 32 bytes data with the first byte i
+	fromInt := func(i byte) *big.Int {
+		data := make([]byte, 32)
+		data[0] = i
+		muHashNum, err := getMuHashNum(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return muHashNum
+	}
+	// FromInt(0) * FromInt(1) / FromInt(2)
+	muHash := new(big.Int).Mul(fromInt(0), fromInt(1))
+	muHash.Mul(muHash, new(big.Int).ModInverse(fromInt(2), muHashPrime))
+	muHash.Mod(muHash, muHashPrime)
+	if getMuHashDigest(muHash) != "10d312b100cbd32ada024a6646e40d3482fcff103668d2625f10002a607d5863" {
+		t.Fatal("unexpected muhash", getMuHashDigest(muHash))
+	}
+	// the set hash does not depend on the order
+	reordered := new(big.Int).Mul(fromInt(1), fromInt(0))
+	reordered.Mul(reordered, new(big.Int).ModInverse(fromInt(2), muHashPrime))
+	reordered.Mod(reordered, muHashPrime)
+	if getMuHashDigest(reordered) != getMuHashDigest(muHash) {
+		t.Fatal("muhash depends on the order")
+	}
+}
+
+// buildTestCoinbaseOuts pays the coinbase of the height to the outputs
+func buildTestCoinbaseOuts(height uint32, txOuts ...testTxOut) []byte {
+	scriptSig := new(bytes.Buffer)
+	_ = serialize.PackByte(scriptSig, 4)
+	_ = serialize.PackUint32(scriptSig, height)
+	return buildTestTx(make([]byte, 32), 0xffffffff, scriptSig.Bytes(), txOuts...)
+}
+
+// getTestMuHash returns the set hash of the outputs multiplied in the reverse order
+func getTestMuHash(t *testing.T, utxoRecords []*UtxoRecord) string {
+	muHash := big.NewInt(1)
+	for i := len(utxoRecords) - 1; i >= 0; i-- {
+		utxoData, err := getUtxoSerialized(utxoRecords[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		muHashNum, err := getMuHashNum(utxoData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		muHash.Mul(muHash, muHashNum)
+		muHash.Mod(muHash, muHashPrime)
+	}
+	return getMuHashDigest(muHash)
+}
+
+func newTestUtxoRecord(txId []byte, n uint32, blockHeight uint32, coinBase bool, txOut testTxOut) *UtxoRecord {
+	utxoRecord := &UtxoRecord{N: n, BlockHeight: blockHeight, CoinBase: coinBase, Value: txOut.Value, ScriptPubKey: txOut.ScriptPubKey}
+	_ = utxoRecord.TxId.SetData(txId)
+	return utxoRecord
+}
+
+func TestUtxoSetInfo(t *testing.T) {
+	useTestDataDir(t)
+	useTestNetwork(t, "bitcoin", "regtest")
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	genesisHash := calcBlockHash(genesisBlock)
+	// the unspendable output is never in the utxo set
+	coinbase1 := buildTestCoinbaseOuts(1, testTxOut{50 * 100000000, []byte{0x51}}, testTxOut{0, []byte{0x6a}})
+	hash1, block1 := mineTestBlock(t, genesisHash, coinbase1)
+	coinbase2 := buildTestCoinbaseOuts(2, testTxOut{50 * 100000000, []byte{0x52}})
+	tx2 := buildTestTx(calcTestTxId(coinbase1), 0, []byte{0x51}, testTxOut{10 * 100000000, []byte{0x53}}, testTxOut{39 * 100000000, []byte{0x54, 0x55}})
+	hash2, block2 := mineTestBlock(t, hash1, coinbase2, tx2)
+	useTestChain(t, []string{genesisHash, hash1, hash2})
+
+	savedUtxoSetMgr := utxoSetMgr
+	utxoSetMgr = new(UtxoSetManager)
+	t.Cleanup(func() {
+		_ = utxoSetMgr.UtxoSetFileObj.Close()
+		utxoSetMgr = savedUtxoSetMgr
+	})
+	err := utxoSetMgr.Init(config.DataConfig.DataDir, "utxo_set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height, rawBlock := range [][]byte{genesisBlock, block1, block2} {
+		err = utxoSetMgr.AddBlockUtxoSet(uint32(height), rawBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		blockCount uint32
+		bestBlock  string
+		utxos      []*UtxoRecord
+		txCount    uint64
+	}{
+		{"tip", 3, hash2, []*UtxoRecord{
+			newTestUtxoRecord(calcTestTxId(coinbase2), 0, 2, true, testTxOut{50 * 100000000, []byte{0x52}}),
+			newTestUtxoRecord(calcTestTxId(tx2), 0, 2, false, testTxOut{10 * 100000000, []byte{0x53}}),
+			newTestUtxoRecord(calcTestTxId(tx2), 1, 2, false, testTxOut{39 * 100000000, []byte{0x54, 0x55}}),
+		}, 2},
+		// the spent output is back after the truncation
+		{"truncated", 2, hash1, []*UtxoRecord{
+			newTestUtxoRecord(calcTestTxId(coinbase1), 0, 1, true, testTxOut{50 * 100000000, []byte{0x51}}),
+		}, 1},
+	}
+	for _, test := range tests {
+		err = utxoSetMgr.TruncateUtxoSet(test.blockCount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utxoSetInfo, err := utxoSetMgr.GetUtxoSetInfo(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var totalAmount int64 = 0
+		var bogoSize uint64 = 0
+		for _, utxoRecord := range test.utxos {
+			totalAmount += utxoRecord.Value
+			bogoSize += 50 + uint64(len(utxoRecord.ScriptPubKey))
+		}
+		if utxoSetInfo.Height != test.blockCount-1 || utxoSetInfo.BestBlock != test.bestBlock ||
+			utxoSetInfo.TxOuts != uint64(len(test.utxos)) || utxoSetInfo.Transactions != test.txCount ||
+			utxoSetInfo.BogoSize != bogoSize || int64(utxoSetInfo.TotalAmount) != totalAmount {
+			t.Fatalf("%s: unexpected utxo set info %+v", test.name, utxoSetInfo)
+		}
+		if utxoSetInfo.MuHash != getTestMuHash(t, test.utxos) {
+			t.Fatalf("%s: unexpected muhash %s", test.name, utxoSetInfo.MuHash)
+		}
+	}
+
+	// the records read without the lock are dropped if the utxo set is truncated meanwhile
+	truncateCount := utxoSetMgr.truncateCount
+	if utxoSetMgr.isTruncatedSince(truncateCount) {
+		t.Fatal("utxo set truncated without a truncation")
+	}
+	err = utxoSetMgr.TruncateUtxoSet(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utxoSetMgr.isTruncatedSince(truncateCount) {
+		t.Fatal("truncation not counted")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/blob"
+	"github.com/mutalisk999/bitcoin-lib/src/utility"
+	"math/big"
+)
+
+const (
+	BlockHeaderSize = 80
+)
+
+func calcDoubleSha256(data []byte) []byte {
+	return utility.Sha256(utility.Sha256(data))
+}
+
+func calcBlockHash(headerBytes []byte) string {
+	var blockHash bigint.Uint256
+	_ = blockHash.SetData(calcDoubleSha256(headerBytes[0:BlockHeaderSize]))
+	return blockHash.GetHex()
+}
+
+// compactToTarget decodes nBits, returns nil if the target is negative, zero or overflows
+func compactToTarget(bits uint32) *big.Int {
+	exponent := uint(bits >> 24)
+	mantissa := int64(bits & 0x007fffff)
+	if bits&0x00800000 != 0 || mantissa == 0 {
+		return nil
+	}
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if target.Sign() == 0 || target.BitLen() > 256 {
+		return nil
+	}
+	return target
+}
+
+func checkProofOfWork(headerHash []byte, bits uint32) error {
+	target := compactToTarget(bits)
+	if target == nil {
+		return errors.New("invalid nBits")
+	}
+	hashValue := new(big.Int).SetBytes(blob.DataReverse(headerHash))
+	if hashValue.Cmp(target) > 0 {
+		return errors.New("proof of work failed")
+	}
+	return nil
+}
+
+// calcMerkleRoot returns the merkle root and whether the tree is mutated by duplicated txids (CVE-2012-2459)
+func calcMerkleRoot(hashes [][]byte) ([]byte, bool) {
+	mutated := false
+	for len(hashes) > 1 {
+		for i := 0; i+1 < len(hashes); i += 2 {
+			if bytes.Equal(hashes[i], hashes[i+1]) {
+				mutated = true
+			}
+		}
+		if len(hashes)%2 != 0 {
+			hashes = append(hashes, hashes[len(hashes)-1])
+		}
+		nextHashes := make([][]byte, 0, len(hashes)/2)
+		for i := 0; i < len(hashes); i += 2 {
+			nextHashes = append(nextHashes, calcDoubleSha256(append(append([]byte{}, hashes[i]...), hashes[i+1]...)))
+		}
+		hashes = nextHashes
+	}
+	if len(hashes) == 0 {
+		return nil, mutated
+	}
+	return hashes[0], mutated
+}
+
+func validateRawBlock(blockHeight uint32, blockHash string, rawBlockData []byte) error {
+	if len(rawBlockData) < BlockHeaderSize {
+		return errors.New("invalid raw block size")
+	}
+
+	// block hash
+	if calcBlockHash(rawBlockData) != blockHash {
+		return errors.New("block hash not match with block header")
+	}
+	if blockHeight == GenesisBlockHeight && blockHash != networkParams.GenesisHash {
+		return errors.New("block hash not match with the genesis block of the network")
+	}
+
+	rawBlock, err := unpackChainBlock(rawBlockData)
+	if err != nil {
+		return err
+	}
+
+	// link to the previous stored block
+	prevBlockHash, ok := getStoredBlockHash(blockHeight - 1)
+	if ok && rawBlock.Header.HashPrevBlock.GetHex() != prevBlockHash {
+		return errors.New("previous block hash not match with the stored block")
+	}
+
+	// proof of work
+	err = checkChainProofOfWork(rawBlock.HeaderBytes, &rawBlock.Header, rawBlock.AuxPow)
+	if err != nil {
+		return err
+	}
+
+	// merkle root
+	if len(rawBlock.Vtx) == 0 {
+		return errors.New("block without transaction")
+	}
+	txHashes := make([][]byte, 0, len(rawBlock.Vtx))
+	for _, tx := range rawBlock.Vtx {
+		txId, err := tx.CalcTrxId()
+		if err != nil {
+			return err
+		}
+		txHashes = append(txHashes, txId.GetData())
+	}
+	merkleRoot, mutated := calcMerkleRoot(txHashes)
+	if mutated {
+		return errors.New("duplicated transaction in merkle tree")
+	}
+	if !bytes.Equal(merkleRoot, rawBlock.Header.HashMerkleRoot.GetData()) {
+		return errors.New("merkle root not match with transactions")
+	}
+	return nil
+}
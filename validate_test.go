@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"github.com/mutalisk999/bitcoin-lib/src/serialize"
+	"strings"
+	"testing"
+)
+
+// the genesis block of the bitcoin regtest
+const regtestGenesisBlockHex = "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4adae5494dffff7f20020000000101000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+
+const regtestBits = 0x207fffff
+
+type testTxOut struct {
+	Value        int64
+	ScriptPubKey []byte
+}
+
+// useTestNetwork sets the network parameters for the test, and restores them when the test finishes
+func useTestNetwork(t *testing.T, chain string, network string) *NetworkParams {
+	savedNetworkParams := networkParams
+	networkParams = networkParamsMap[chain][network]
+	t.Cleanup(func() {
+		networkParams = savedNetworkParams
+	})
+	return networkParams
+}
+
+// useTestChain sets the stored chain of the height maps for the test
+func useTestChain(t *testing.T, blockHashes []string) {
+	savedHeightToHashMap := heightToHashMap
+	savedHashToHeightMap := hashToHeightMap
+	heightToHashMap = make(map[uint32]string)
+	hashToHeightMap = make(map[string]uint32)
+	for height, blockHash := range blockHashes {
+		heightToHashMap[uint32(height)] = blockHash
+		hashToHeightMap[blockHash] = uint32(height)
+	}
+	t.Cleanup(func() {
+		heightToHashMap = savedHeightToHashMap
+		hashToHeightMap = savedHashToHeightMap
+	})
+}
+
+func mustDecodeHex(t *testing.T, hexString string) []byte {
+	data, err := hex.DecodeString(hexString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// buildTestTx serializes a legacy transaction with one input
+func buildTestTx(prevTxId []byte, prevN uint32, scriptSig []byte, txOuts ...testTxOut) []byte {
+	buf := new(bytes.Buffer)
+	_ = serialize.PackInt32(buf, 1)
+	_ = serialize.PackCompactSize(buf, 1)
+	buf.Write(prevTxId)
+	_ = serialize.PackUint32(buf, prevN)
+	_ = serialize.PackCompactSize(buf, uint64(len(scriptSig)))
+	buf.Write(scriptSig)
+	_ = serialize.PackUint32(buf, 0xffffffff)
+	_ = serialize.PackCompactSize(buf, uint64(len(txOuts)))
+	for _, txOut := range txOuts {
+		_ = serialize.PackInt64(buf, txOut.Value)
+		_ = serialize.PackCompactSize(buf, uint64(len(txOut.ScriptPubKey)))
+		buf.Write(txOut.ScriptPubKey)
+	}
+	_ = serialize.PackUint32(buf, 0)
+	return buf.Bytes()
+}
+
+// buildTestCoinbase pays to the script, the tag makes the coinbase of the forks differ
+func buildTestCoinbase(height uint32, tag string, scriptPubKey []byte) []byte {
+	scriptSig := new(bytes.Buffer)
+	_ = serialize.PackByte(scriptSig, 4)
+	_ = serialize.PackUint32(scriptSig, height)
+	scriptSig.WriteString(tag)
+	return buildTestTx(make([]byte, 32), 0xffffffff, scriptSig.Bytes(), testTxOut{50 * 100000000, scriptPubKey})
+}
+
+func calcTestTxId(tx []byte) []byte {
+	return calcDoubleSha256(tx)
+}
+
+func buildTestHeader(prevBlockHash string, merkleRoot []byte, blockTime uint32, bits uint32, nonce uint32) []byte {
+	var prevHash bigint.Uint256
+	_ = prevHash.SetHex(prevBlockHash)
+	header := new(bytes.Buffer)
+	_ = serialize.PackInt32(header, 0x20000000)
+	header.Write(prevHash.GetData())
+	header.Write(merkleRoot)
+	_ = serialize.PackUint32(header, blockTime)
+	_ = serialize.PackUint32(header, bits)
+	_ = serialize.PackUint32(header, nonce)
+	return header.Bytes()
+}
+
+// mineTestBlock mines a sha256d block of the regtest difficulty on top of the previous block
+func mineTestBlock(t *testing.T, prevBlockHash string, txs ...[]byte) (string, []byte) {
+	txIds := make([][]byte, 0, len(txs))
+	for _, tx := range txs {
+		txIds = append(txIds, calcTestTxId(tx))
+	}
+	merkleRoot, _ := calcMerkleRoot(txIds)
+	if merkleRoot == nil {
+		merkleRoot = make([]byte, 32)
+	}
+	var header []byte
+	for nonce := uint32(0); ; nonce++ {
+		header = buildTestHeader(prevBlockHash, merkleRoot, 1296688602, regtestBits, nonce)
+		if checkProofOfWork(calcDoubleSha256(header), regtestBits) == nil {
+			break
+		}
+		if nonce == 1000 {
+			t.Fatal("mine test block failed")
+		}
+	}
+	return calcBlockHash(header), buildTestBlock(header, txs...)
+}
+
+func buildTestBlock(header []byte, txs ...[]byte) []byte {
+	rawBlock := bytes.NewBuffer(append([]byte{}, header...))
+	_ = serialize.PackCompactSize(rawBlock, uint64(len(txs)))
+	for _, tx := range txs {
+		rawBlock.Write(tx)
+	}
+	return rawBlock.Bytes()
+}
+
+func TestCompactToTarget(t *testing.T) {
+	tests := []struct {
+		bits   uint32
+		target string
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{0x207fffff, "7fffff0000000000000000000000000000000000000000000000000000000000"},
+		{0x1e0ffff0, "ffff0000000000000000000000000000000000000000000000000000000"},
+		{0x03123456, "123456"},
+		{0x02123456, "1234"},
+		// negative, zero and overflow
+		{0x04923456, ""},
+		{0x1d000000, ""},
+		{0xff123456, ""},
+	}
+	for _, test := range tests {
+		target := compactToTarget(test.bits)
+		if test.target == "" {
+			if target != nil {
+				t.Errorf("compactToTarget(%x) = %x, expected invalid", test.bits, target)
+			}
+			continue
+		}
+		if target == nil || target.Text(16) != test.target {
+			t.Errorf("compactToTarget(%x) = %v, expected %s", test.bits, target, test.target)
+		}
+	}
+}
+
+func TestCalcMerkleRoot(t *testing.T) {
+	a := calcDoubleSha256([]byte("a"))
+	b := calcDoubleSha256([]byte("b"))
+	c := calcDoubleSha256([]byte("c"))
+	ab := calcDoubleSha256(append(append([]byte{}, a...), b...))
+	cc := calcDoubleSha256(append(append([]byte{}, c...), c...))
+	abcc := calcDoubleSha256(append(append([]byte{}, ab...), cc...))
+
+	tests := []struct {
+		name    string
+		hashes  [][]byte
+		root    []byte
+		mutated bool
+	}{
+		{"single", [][]byte{a}, a, false},
+		{"pair", [][]byte{a, b}, ab, false},
+		// the odd hash is paired with itself
+		{"odd", [][]byte{a, b, c}, abcc, false},
+		// CVE-2012-2459, the duplicated last txid gives the same root as the odd tree
+		{"mutated", [][]byte{a, b, c, c}, abcc, true},
+		{"mutated pair", [][]byte{a, a}, calcDoubleSha256(append(append([]byte{}, a...), a...)), true},
+	}
+	for _, test := range tests {
+		root, mutated := calcMerkleRoot(test.hashes)
+		if !bytes.Equal(root, test.root) || mutated != test.mutated {
+			t.Errorf("%s: root %x mutated %v, expected %x %v", test.name, root, mutated, test.root, test.mutated)
+		}
+	}
+}
+
+func TestValidateRawBlock(t *testing.T) {
+	useTestNetwork(t, "bitcoin", "regtest")
+	genesisBlock := mustDecodeHex(t, regtestGenesisBlockHex)
+	genesisHash := calcBlockHash(genesisBlock)
+	if genesisHash != networkParams.GenesisHash {
+		t.Fatal("unexpected regtest genesis block hash", genesisHash)
+	}
+	useTestChain(t, []string{genesisHash})
+
+	opTrue := []byte{0x51}
+	coinbase := buildTestCoinbase(1, "test", opTrue)
+	spendTx := buildTestTx(calcTestTxId(genesisBlock[81:]), 0, []byte{0x51}, testTxOut{100, opTrue})
+	otherTx := buildTestTx(calcTestTxId(genesisBlock[81:]), 0, []byte{0x52}, testTxOut{200, opTrue})
+	blockHash, rawBlock := mineTestBlock(t, genesisHash, coinbase, spendTx, otherTx)
+	header := rawBlock[0:BlockHeaderSize]
+
+	// the header of the unmutated block commits to the same merkle root
+	mutatedBlock := buildTestBlock(header, coinbase, spendTx, otherTx, otherTx)
+	forkHash, forkBlock := mineTestBlock(t, strings.Repeat("11", 32), coinbase)
+	_, emptyBlock := mineTestBlock(t, genesisHash)
+	wrongMerkleBlock := buildTestBlock(header, coinbase, otherTx, spendTx)
+	hardHeader := buildTestHeader(genesisHash, calcTestTxId(coinbase), 1296688602, 0x1d00ffff, 0)
+	hardBlock := buildTestBlock(hardHeader, coinbase)
+
+	tests := []struct {
+		name      string
+		height    uint32
+		blockHash string
+		rawBlock  []byte
+		err       string
+	}{
+		{"genesis", 0, genesisHash, genesisBlock, ""},
+		{"block", 1, blockHash, rawBlock, ""},
+		{"short", 1, blockHash, rawBlock[0:79], "invalid raw block size"},
+		{"wrong hash", 1, genesisHash, rawBlock, "block hash not match"},
+		{"not genesis", 0, blockHash, rawBlock, "genesis block of the network"},
+		{"not linked", 1, forkHash, forkBlock, "previous block hash not match"},
+		{"proof of work", 1, calcBlockHash(hardHeader), hardBlock, "proof of work failed"},
+		{"no transaction", 1, calcBlockHash(emptyBlock), emptyBlock, "block without transaction"},
+		{"merkle root", 1, blockHash, wrongMerkleBlock, "merkle root not match"},
+		{"CVE-2012-2459", 1, blockHash, mutatedBlock, "duplicated transaction"},
+		{"trailing data", 1, blockHash, append(append([]byte{}, rawBlock...), 0), "unexpected data"},
+	}
+	for _, test := range tests {
+		err := validateRawBlock(test.height, test.blockHash, test.rawBlock)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mutalisk999/bitcoin-lib/src/bigint"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+func verifyData() error {
+	var err error
+	var corruptCount = 0
+	var uncheckedCount = 0
+
+	// verify raw block index, it is opened read only and the legacy versions are read as they are
+	version, err := getBlockIndexVersion()
+	if err != nil {
+		return err
+	}
+	var indexHeaderSize int64 = RawBlockIndexHeaderSize
+	var indexSize int64 = RawBlockIndexSize
+	// the legacy versions are collected from height 1
+	var firstHeight uint32 = GenesisBlockHeight + 1
+	if version == 1 {
+		indexHeaderSize = 0
+		indexSize = RawBlockIndexSizeV1
+	} else if version == 2 {
+		indexSize = RawBlockIndexSizeV2
+	} else if version == RawBlockIndexVersion {
+		firstHeight = GenesisBlockHeight
+	} else if version != 3 {
+		return errors.New("not support raw block index version: " + strconv.Itoa(int(version)))
+	}
+	if version != RawBlockIndexVersion {
+		fmt.Println("raw block index of version", version, "carries no genesis block, it is upgraded on startup")
+	}
+
+	var blockCount uint32 = 0
+	// block indexes located by raw block file tag and start position
+	posToBlockIndexMap := make(map[uint32]map[uint64]*RawBlockIndex)
+	indexFile, err := os.Open(config.DataConfig.DataDir + "/" + config.DataConfig.BlockIndexName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil {
+		fmt.Println("raw block index", config.DataConfig.BlockIndexName, "not found")
+		corruptCount++
+	} else {
+		defer indexFile.Close()
+		indexInfo, err := indexFile.Stat()
+		if err != nil {
+			return err
+		}
+		if indexInfo.Size() < indexHeaderSize {
+			indexHeaderSize = indexInfo.Size()
+		}
+		if (indexInfo.Size()-indexHeaderSize)%indexSize != 0 {
+			fmt.Println("corrupt raw block index: invalid size", indexInfo.Size())
+			corruptCount++
+		}
+		blockCount = uint32((indexInfo.Size() - indexHeaderSize) / indexSize)
+		_, err = indexFile.Seek(indexHeaderSize, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	for i := uint32(0); i < blockCount; i++ {
+		height := firstHeight + i
+		offSet := indexHeaderSize + int64(i)*indexSize
+		ptrBlockIndex := new(RawBlockIndex)
+		if version == 1 {
+			legacyBlockIndex := new(RawBlockIndexV1)
+			err = legacyBlockIndex.UnPack(indexFile)
+			ptrBlockIndex = legacyBlockIndex.Upgrade()
+		} else if version == 2 {
+			err = ptrBlockIndex.UnPackV2(indexFile)
+		} else {
+			err = ptrBlockIndex.UnPack(indexFile)
+		}
+		if err == ErrChecksumMismatch {
+			fmt.Println("corrupt raw block index record: height", height, "offset", offSet, "checksum mismatch")
+			corruptCount++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ptrBlockIndex.BlockHeight != height {
+			fmt.Println("corrupt raw block index record: height", height, "offset", offSet, "unexpected block height", ptrBlockIndex.BlockHeight)
+			corruptCount++
+			continue
+		}
+		_, ok := posToBlockIndexMap[ptrBlockIndex.RawBlockFileTag]
+		if !ok {
+			posToBlockIndexMap[ptrBlockIndex.RawBlockFileTag] = make(map[uint64]*RawBlockIndex)
+		}
+		posToBlockIndexMap[ptrBlockIndex.RawBlockFileTag][ptrBlockIndex.BlockFileStartPos] = ptrBlockIndex
+	}
+	fmt.Println("verify", config.DataConfig.BlockIndexName, "ok...", blockCount, "records")
+
+	// the block header file is compared with the raw blocks, it is loaded again on startup if missing
+	var headerCount uint32 = 0
+	headerFile, err := os.Open(config.DataConfig.DataDir + "/" + config.DataConfig.BlockHeaderName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer headerFile.Close()
+		headerInfo, err := headerFile.Stat()
+		if err != nil {
+			return err
+		}
+		headerCount = uint32(headerInfo.Size() / BlockHeaderSize)
+		if headerCount > blockCount {
+			fmt.Println("corrupt block header file:", headerCount, "headers for", blockCount, "blocks")
+			corruptCount++
+		}
+	}
+
+	// verify raw block files
+	tag, err := getLatestRawBlockTag()
+	if err != nil {
+		return err
+	}
+	for i := 0; i <= int(tag); i++ {
+		rawBlockFile, err := os.Open(getRawBlockFileName(uint32(i)))
+		if err != nil {
+			return err
+		}
+		rawBlockInfo, err := rawBlockFile.Stat()
+		if err != nil {
+			_ = rawBlockFile.Close()
+			return err
+		}
+
+		var offSet uint64 = 0
+		for offSet < uint64(rawBlockInfo.Size()) {
+			ptrBlockIndex, indexed := posToBlockIndexMap[uint32(i)][offSet]
+			var height uint32 = 0
+			if indexed {
+				height = ptrBlockIndex.BlockHeight
+			}
+
+			// the index records left in the map have no raw block record at their position
+			delete(posToBlockIndexMap[uint32(i)], offSet)
+
+			ptrRawBlock := new(RawBlock)
+			err = ptrRawBlock.UnPack(rawBlockFile)
+			if err != nil && err != ErrChecksumMismatch {
+				// the record is unreadable, the rest of the file can not be located any more
+				fmt.Println("corrupt raw block record: height", height, "file", getRawBlockFileName(uint32(i)), "offset", offSet, err)
+				corruptCount++
+				break
+			}
+			if !indexed {
+				height = ptrRawBlock.BlockHeight
+			}
+			packSize := ptrRawBlock.PackSize()
+			if err == ErrChecksumMismatch {
+				fmt.Println("corrupt raw block record: height", height, "file", getRawBlockFileName(uint32(i)), "offset", offSet, "checksum mismatch")
+				corruptCount++
+			} else if !indexed {
+				fmt.Println("corrupt raw block record: height", height, "file", getRawBlockFileName(uint32(i)), "offset", offSet, "not found in raw block index")
+				corruptCount++
+			} else if ptrBlockIndex.BlockFileEndPos != offSet+packSize || !bigint.IsUint256Equal(&ptrBlockIndex.BlockHash, &ptrRawBlock.BlockHash) {
+				fmt.Println("corrupt raw block record: height", height, "file", getRawBlockFileName(uint32(i)), "offset", offSet, "not match with raw block index")
+				corruptCount++
+			} else {
+				if ptrRawBlock.NoChecksum {
+					uncheckedCount++
+				}
+				err = ptrRawBlock.Decompress()
+				if err != nil || uint32(len(ptrRawBlock.RawBlockData.GetData())) != ptrBlockIndex.RawBlockSize {
+					fmt.Println("corrupt raw block record: height", height, "file", getRawBlockFileName(uint32(i)), "offset", offSet, "invalid raw block data")
+					corruptCount++
+				} else if height < headerCount {
+					headerData := make([]byte, BlockHeaderSize)
+					_, err = headerFile.ReadAt(headerData, int64(height)*BlockHeaderSize)
+					if err != nil {
+						_ = rawBlockFile.Close()
+						return err
+					}
+					if !bytes.Equal(headerData, ptrRawBlock.RawBlockData.GetData()[0:BlockHeaderSize]) {
+						fmt.Println("corrupt block header: height", height, "not match with raw block")
+						corruptCount++
+					}
+				}
+			}
+			offSet = offSet + packSize
+		}
+		_ = rawBlockFile.Close()
+
+		var completeRate float64 = float64(i+1) * float64(100) / float64(tag+1)
+		fmt.Println("verify", config.DataConfig.RawBlockFilePrefix+"."+strconv.Itoa(i), "ok...", strconv.FormatFloat(completeRate, 'f', 2, 64)+"%")
+	}
+
+	// the index records pointing to no raw block record, reported in the order of the heights
+	orphanIndexes := make([]*RawBlockIndex, 0)
+	for _, blockIndexes := range posToBlockIndexMap {
+		for _, ptrBlockIndex := range blockIndexes {
+			orphanIndexes = append(orphanIndexes, ptrBlockIndex)
+		}
+	}
+	sort.Slice(orphanIndexes, func(i, j int) bool { return orphanIndexes[i].BlockHeight < orphanIndexes[j].BlockHeight })
+	for _, ptrBlockIndex := range orphanIndexes {
+		fmt.Println("corrupt raw block index record: height", ptrBlockIndex.BlockHeight, "file", getRawBlockFileName(ptrBlockIndex.RawBlockFileTag), "offset", ptrBlockIndex.BlockFileStartPos, "raw block record not found")
+		corruptCount++
+	}
+
+	if uncheckedCount != 0 {
+		fmt.Println(uncheckedCount, "raw block records carry no checksum")
+	}
+	fmt.Println("verify has been finished,", corruptCount, "corrupt records found")
+	if corruptCount != 0 {
+		return errors.New(strconv.Itoa(corruptCount) + " corrupt records found")
+	}
+	return nil
+}
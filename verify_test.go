@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerifyData(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, blockIndexes []*RawBlockIndex)
+		err     string
+	}{
+		{"intact", func(t *testing.T, blockIndexes []*RawBlockIndex) {}, ""},
+		{"corrupt record", func(t *testing.T, blockIndexes []*RawBlockIndex) {
+			rawBlockData, err := ioutil.ReadFile(getRawBlockFileName(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a byte of the block data in the middle of the record of height 1
+			blockIndex := blockIndexes[1]
+			rawBlockData[(blockIndex.BlockFileStartPos+blockIndex.BlockFileEndPos)/2] ^= 0xff
+			err = ioutil.WriteFile(getRawBlockFileName(0), rawBlockData, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, "1 corrupt records found"},
+		{"index past the raw blocks", func(t *testing.T, blockIndexes []*RawBlockIndex) {
+			// the raw block records of the last two heights are lost, their index records are left
+			err := os.Truncate(getRawBlockFileName(0), int64(blockIndexes[2].BlockFileEndPos))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, "2 corrupt records found"},
+		{"raw block not indexed", func(t *testing.T, blockIndexes []*RawBlockIndex) {
+			indexName := config.DataConfig.DataDir + "/" + config.DataConfig.BlockIndexName
+			err := os.Truncate(indexName, getBlockIndexPos(4))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, "1 corrupt records found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestDataDir(t)
+			blockIndexes := writeTestRawBlocks(t, buildTestRawBlocks(5), CompressedTypeNone)
+			test.corrupt(t, blockIndexes)
+			err := verifyData()
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
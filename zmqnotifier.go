@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-zeromq/zmq4"
+	"github.com/mutalisk999/go-lib/src/sched/goroutine_mgr"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultZmqTopic        = "hashblock"
+	DefaultZmqPollInterval = 60
+	PollInterval           = 5 * time.Second
+)
+
+// ZmqNotifier subscribes the block notifications of the node, and wakes the gatherer when a new block arrives,
+// it is healthy while the socket is connected, the poll interval bounds the wait for a notification
+type ZmqNotifier struct {
+	EndPoint     string
+	Topic        string
+	PollInterval time.Duration
+	notifyChan   chan struct{}
+	connected    bool
+	cancel       context.CancelFunc
+	stopped      bool
+	mutex        *sync.Mutex
+}
+
+var zmqNotifier *ZmqNotifier = nil
+
+func getZmqPollInterval() time.Duration {
+	if config.RpcClientConfig.ZmqPollInterval <= 0 {
+		return DefaultZmqPollInterval * time.Second
+	}
+	return time.Duration(config.RpcClientConfig.ZmqPollInterval) * time.Second
+}
+
+func newZmqNotifier(endPoint string, topic string, pollInterval time.Duration) *ZmqNotifier {
+	n := new(ZmqNotifier)
+	n.EndPoint = endPoint
+	n.Topic = topic
+	if n.Topic == "" {
+		n.Topic = DefaultZmqTopic
+	}
+	n.PollInterval = pollInterval
+	n.notifyChan = make(chan struct{}, 1)
+	n.mutex = new(sync.Mutex)
+	return n
+}
+
+func startZmqNotifier() {
+	if config.RpcClientConfig.ZmqEndPoint == "" {
+		return
+	}
+	zmqNotifier = newZmqNotifier(config.RpcClientConfig.ZmqEndPoint, config.RpcClientConfig.ZmqTopic, getZmqPollInterval())
+	goroutineMgr.GoroutineCreatePn("zmqsubscriber", doZmqSubscribe, zmqNotifier)
+}
+
+func doZmqSubscribe(goroutine goroutine_mgr.Goroutine, args ...interface{}) {
+	defer goroutine.OnQuit()
+	n := args[0].(*ZmqNotifier)
+	n.Subscribe()
+}
+
+// Subscribe receives the notifications until stopped, and reconnects when the socket fails
+func (n *ZmqNotifier) Subscribe() {
+	for !quitFlag && !n.IsStopped() {
+		ctx, cancel := context.WithCancel(context.Background())
+		socket := zmq4.NewSub(ctx)
+		err := socket.Dial(n.EndPoint)
+		if err == nil {
+			err = socket.SetOption(zmq4.OptionSubscribe, n.Topic)
+		}
+		if err != nil {
+			fmt.Println("zmq: subscribe", n.Topic, "on", n.EndPoint, "Failed: ", err)
+			_ = socket.Close()
+			cancel()
+			sleepUnlessQuit(PollInterval)
+			continue
+		}
+		if !n.setCancel(cancel) {
+			_ = socket.Close()
+			cancel()
+			return
+		}
+		fmt.Println("zmq: subscribed", n.Topic, "on", n.EndPoint)
+
+		for {
+			msg, err := socket.Recv()
+			if err != nil {
+				if !quitFlag && !n.IsStopped() {
+					fmt.Println("zmq: receive Failed, fall back to polling: ", err)
+				}
+				break
+			}
+			// topic, body and sequence number, the body is not needed as the gatherer fetches by height
+			if len(msg.Frames) == 0 || string(msg.Frames[0]) != n.Topic {
+				continue
+			}
+			select {
+			case n.notifyChan <- struct{}{}:
+			default:
+			}
+		}
+		stopped := !n.setCancel(nil)
+		_ = socket.Close()
+		cancel()
+		if stopped {
+			return
+		}
+		sleepUnlessQuit(time.Second)
+	}
+}
+
+// setCancel sets the cancel func of the connected socket, nil when the socket is closed, returns false if stopped
+func (n *ZmqNotifier) setCancel(cancel context.CancelFunc) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return false
+	}
+	n.cancel = cancel
+	n.connected = cancel != nil
+	return true
+}
+
+func (n *ZmqNotifier) IsStopped() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.stopped
+}
+
+func (n *ZmqNotifier) IsConnected() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.connected
+}
+
+// IsHealthy reports whether the gatherer can rely on the notifications, the socket is connected and not found
+// missing a block
+func (n *ZmqNotifier) IsHealthy() bool {
+	return n.IsConnected()
+}
+
+// MarkSilent falls back to polling and reconnects, it is called when a new block is found without notification
+func (n *ZmqNotifier) MarkSilent() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !n.connected {
+		return
+	}
+	fmt.Println("zmq: new block found without notification, fall back to polling and reconnect")
+	n.connected = false
+	if n.cancel != nil {
+		n.cancel()
+	}
+}
+
+func (n *ZmqNotifier) Stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.stopped = true
+	if n.cancel != nil {
+		n.cancel()
+	}
+}
+
+// WaitForNewBlock waits for the next block notification, up to the poll interval while the socket is connected
+// and up to 5 seconds while it is not, so a notification wakes the gatherer even after a long silence. Returns true
+// if the connected socket stayed silent for the whole poll interval, then a new block found by the following poll
+// means the notification is missed
+func (n *ZmqNotifier) WaitForNewBlock() bool {
+	connected := n.IsConnected()
+	timeout := PollInterval
+	if connected {
+		timeout = n.PollInterval
+	}
+	deadline := time.Now().Add(timeout)
+	for !quitFlag && time.Now().Before(deadline) {
+		step := time.Until(deadline)
+		if step > 100*time.Millisecond {
+			step = 100 * time.Millisecond
+		}
+		select {
+		case <-n.notifyChan:
+			return false
+		case <-time.After(step):
+		}
+		// poll at once when the socket is lost
+		if connected && !n.IsConnected() {
+			return false
+		}
+	}
+	return connected && !quitFlag
+}
+
+// waitForNewBlock waits for the next block notification, or polls the node every 5 seconds without zmq
+func waitForNewBlock() bool {
+	if zmqNotifier == nil {
+		sleepUnlessQuit(PollInterval)
+		return false
+	}
+	return zmqNotifier.WaitForNewBlock()
+}
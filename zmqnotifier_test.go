@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"github.com/go-zeromq/zmq4"
+	"testing"
+	"time"
+)
+
+// startZmqPublisher listens on a local port as a stand-in of the zmq publisher of the node
+func startZmqPublisher(t *testing.T) (zmq4.Socket, string) {
+	publisher := zmq4.NewPub(context.Background())
+	err := publisher.Listen("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = publisher.Close()
+	})
+	return publisher, "tcp://" + publisher.Addr().String()
+}
+
+func publishHashBlock(t *testing.T, publisher zmq4.Socket, topic string) {
+	blockHash := make([]byte, 32)
+	sequence := make([]byte, 4)
+	err := publisher.Send(zmq4.NewMsgFrom([]byte(topic), blockHash, sequence))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startZmqSubscriber subscribes the publisher, and publishes until the first notification arrives,
+// as the subscription reaches the publisher some time after the socket is connected
+func startZmqSubscriber(t *testing.T, publisher zmq4.Socket, endPoint string, pollInterval time.Duration) *ZmqNotifier {
+	n := newZmqNotifier(endPoint, DefaultZmqTopic, pollInterval)
+	go n.Subscribe()
+	t.Cleanup(n.Stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("no notification received from the publisher")
+		}
+		if n.IsConnected() {
+			publishHashBlock(t, publisher, DefaultZmqTopic)
+		}
+		select {
+		case <-n.notifyChan:
+		case <-time.After(50 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	// drain the notifications of the subscription
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-n.notifyChan:
+	default:
+	}
+	return n
+}
+
+func TestZmqNotifierWakesOnHashBlock(t *testing.T) {
+	publisher, endPoint := startZmqPublisher(t)
+	n := startZmqSubscriber(t, publisher, endPoint, time.Minute)
+
+	waitResult := make(chan bool, 1)
+	startTime := time.Now()
+	go func() {
+		waitResult <- n.WaitForNewBlock()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	publishHashBlock(t, publisher, DefaultZmqTopic)
+	select {
+	case timedOut := <-waitResult:
+		if timedOut {
+			t.Fatal("wait timed out although a notification arrived")
+		}
+		if time.Since(startTime) > PollInterval {
+			t.Fatal("the gatherer was not woken before the poll interval")
+		}
+	case <-time.After(PollInterval):
+		t.Fatal("the gatherer was not woken by the hashblock notification")
+	}
+}
+
+func TestZmqNotifierIgnoresOtherTopics(t *testing.T) {
+	publisher, endPoint := startZmqPublisher(t)
+	n := startZmqSubscriber(t, publisher, endPoint, time.Minute)
+
+	publishHashBlock(t, publisher, "hashtx")
+	select {
+	case <-n.notifyChan:
+		t.Fatal("woken by a notification of another topic")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestZmqNotifierSilentTimesOut(t *testing.T) {
+	publisher, endPoint := startZmqPublisher(t)
+	pollInterval := 500 * time.Millisecond
+	n := startZmqSubscriber(t, publisher, endPoint, pollInterval)
+
+	// the wait times out when the socket stays silent for the poll interval, the gatherer polls then
+	startTime := time.Now()
+	if !n.WaitForNewBlock() {
+		t.Fatal("silent wait was not reported as timed out")
+	}
+	if time.Since(startTime) > pollInterval+time.Second {
+		t.Fatal("silent wait lasted longer than the poll interval")
+	}
+	if !n.IsConnected() || !n.IsHealthy() {
+		t.Fatal("silent socket is not trusted any more")
+	}
+}
+
+func TestZmqNotifierWakesAfterSilence(t *testing.T) {
+	publisher, endPoint := startZmqPublisher(t)
+	pollInterval := 300 * time.Millisecond
+	n := startZmqSubscriber(t, publisher, endPoint, pollInterval)
+
+	// no notification for longer than the poll interval, as between the blocks of bitcoin
+	time.Sleep(3 * pollInterval)
+	if !n.WaitForNewBlock() {
+		t.Fatal("silent wait was not reported as timed out")
+	}
+
+	// the notification after the silence still wakes the wait at once
+	waitResult := make(chan bool, 1)
+	startTime := time.Now()
+	go func() {
+		waitResult <- n.WaitForNewBlock()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	publishHashBlock(t, publisher, DefaultZmqTopic)
+	select {
+	case timedOut := <-waitResult:
+		if timedOut {
+			t.Fatal("wait timed out although a notification arrived")
+		}
+		if elapsed := time.Since(startTime); elapsed >= pollInterval {
+			t.Fatal("the wait was not woken at once", elapsed)
+		}
+	case <-time.After(PollInterval):
+		t.Fatal("the wait was not woken by the notification after the silence")
+	}
+}
+
+func TestZmqNotifierMarkSilent(t *testing.T) {
+	publisher, endPoint := startZmqPublisher(t)
+	n := startZmqSubscriber(t, publisher, endPoint, time.Minute)
+
+	// a block found without notification drops the socket, the wait listens without trusting it until reconnected
+	n.MarkSilent()
+	if n.IsHealthy() {
+		t.Fatal("notifier is healthy after a missed notification")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !n.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("notifier is not reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}